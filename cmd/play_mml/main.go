@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/cbegin/mmlfm-go"
@@ -13,6 +14,12 @@ import (
 const defaultMML = "e g b d f a" // spaces prevent "b" from being parsed as flat accidental
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "mmlfmt" {
+		if err := runFormat(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	var (
 		sampleRate = flag.Int("sample-rate", 48000, "output sample rate")
 		engineName = flag.String("engine", "fm", "synth engine: fm|chiptune|nesapu|wavetable")
@@ -22,14 +29,37 @@ func main() {
 		mmlInline  = flag.String("mml", "", "inline MML string")
 		volume     = flag.Float64("volume", 1.0, "master volume scalar")
 		octave     = flag.Int("octave", 0, "master octave shift (-4..+4)")
+		preprocess = flag.Bool("preprocess", false, "print each track's preprocessed text with macro spans and exit")
+		resolve    = flag.Bool("resolve", false, "print the MML with variables and expressions replaced by values and exit")
+		dialect    = flag.String("dialect", "sion", "MML dialect: sion|mck|mdx (mck implies -engine nesapu)")
 	)
 	flag.Parse()
+	dialectName, err := parseDialect(*dialect)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if dialectName == "mck" && !flagSet("engine") {
+		*engineName = "nesapu"
+	}
 
 	mmlText, err := resolveMMLInput(*mmlPath, *mmlInline)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if *resolve {
+		out, err := mmlfm.ResolveExpressions(mmlText)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Print(out)
+		return
+	}
+	if *preprocess {
+		fmt.Print(mmlfm.Preprocess(mmlText))
+		return
+	}
+
 	mode, err := parseSynthMode(*engineName)
 	if err != nil {
 		log.Fatal(err)
@@ -41,7 +71,7 @@ func main() {
 	pl.SetMasterVolume(*volume)
 	pl.SetTranspose(*octave)
 	ch := pl.Watch()
-	if err := pl.PlayMML(mmlText); err != nil {
+	if err := play(pl, dialectName, mmlText, *mmlPath); err != nil {
 		log.Fatal(err)
 	}
 	loopCount := 0
@@ -78,6 +108,59 @@ func resolveMMLInput(path string, inline string) (string, error) {
 	return defaultMML, nil
 }
 
+func parseDialect(name string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "sion":
+		return "sion", nil
+	case "mck", "ppmck":
+		return "mck", nil
+	case "mdx", "mxdrv":
+		return "mdx", nil
+	default:
+		return "", fmt.Errorf("invalid -dialect %q (expected sion|mck|mdx)", name)
+	}
+}
+
+func play(pl *mmlfm.Player, dialect string, mmlText string, mmlPath string) error {
+	switch dialect {
+	case "mck":
+		score, err := mmlfm.CompileMCK(mmlText, includeLoader(mmlPath))
+		if err != nil {
+			return err
+		}
+		return pl.Play(score)
+	case "mdx":
+		score, _, err := mmlfm.CompileMDX(mmlText)
+		if err != nil {
+			return err
+		}
+		return pl.Play(score)
+	default:
+		return pl.PlayMML(mmlText)
+	}
+}
+
+// includeLoader resolves #INCLUDE and @DPCM paths relative to the MML file.
+func includeLoader(mmlPath string) func(string) ([]byte, error) {
+	dir := filepath.Dir(mmlPath)
+	return func(name string) ([]byte, error) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		return os.ReadFile(name)
+	}
+}
+
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 func parseSynthMode(name string) (mmlfm.SynthMode, error) {
 	switch strings.ToLower(strings.TrimSpace(name)) {
 	case "fm":
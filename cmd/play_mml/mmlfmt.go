@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cbegin/mmlfm-go"
+)
+
+// runFormat implements the mmlfmt mode: format each file to stdout, or in
+// place with -w. With no files it formats standard input.
+func runFormat(args []string) error {
+	fs := flag.NewFlagSet("mmlfmt", flag.ExitOnError)
+	write := fs.Bool("w", false, "write result to the source file instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: play_mml mmlfmt [-w] [file ...]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		if *write {
+			return fmt.Errorf("mmlfmt: -w needs at least one file")
+		}
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		out, err := mmlfm.Format(string(data))
+		if err != nil {
+			return fmt.Errorf("<stdin>: %w", err)
+		}
+		_, err = os.Stdout.WriteString(out)
+		return err
+	}
+	for _, path := range fs.Args() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		out, err := mmlfm.Format(string(data))
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if !*write {
+			if _, err := os.Stdout.WriteString(out); err != nil {
+				return err
+			}
+			continue
+		}
+		if out == string(data) {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(out), info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+// Package alloc chooses which voice a new note plays on once an engine's
+// voices are all sounding, and counts the voices it steals.
+package alloc
+
+import "sync/atomic"
+
+// Policy picks the voice a note steals.
+type Policy int
+
+const (
+	Default      Policy = iota // the engine's own choice
+	Oldest                     // the voice that started first
+	Quietest                   // the voice with the lowest level
+	SameTrack                  // the track's own oldest voice, else the oldest
+	ReleaseFirst               // the oldest voice in its release, else the oldest
+)
+
+// Owner is the track a note plays for. The zero value reserves nothing and
+// has the default priority.
+type Owner struct {
+	Track    int
+	Priority int // voices of lower priority tracks are stolen first
+	Reserve  int // how many of the track's voices other tracks cannot steal
+}
+
+// Voice describes a voice slot to Pick.
+type Voice struct {
+	Active   bool
+	Released bool
+	Start    int     // note-on order; lower started first
+	Level    float64 // current envelope level
+	Owner    Owner
+}
+
+// Stats counts steals since the engine was created.
+type Stats struct {
+	Steals        uint64 // sounding voices cut off by a new note
+	ReleaseSteals uint64 // voices cut off in their release
+	PeakVoices    int    // most voices sounding at once
+}
+
+// Allocator picks voices for an engine. Stats may be read from another
+// goroutine while the engine plays.
+type Allocator struct {
+	policy        Policy
+	owner         Owner // latched by the next Pick
+	steals        atomic.Uint64
+	releaseSteals atomic.Uint64
+	peak          atomic.Int64
+}
+
+// SetPolicy sets the steal policy.
+func (a *Allocator) SetPolicy(p Policy) { a.policy = p }
+
+// SetOwner sets the track the next note plays for.
+func (a *Allocator) SetOwner(o Owner) { a.owner = o }
+
+// Owner returns the track the next note plays for.
+func (a *Allocator) Owner() Owner { return a.owner }
+
+// Stats returns the steal counts.
+func (a *Allocator) Stats() Stats {
+	return Stats{Steals: a.steals.Load(), ReleaseSteals: a.releaseSteals.Load(), PeakVoices: int(a.peak.Load())}
+}
+
+// Pick returns the slot of n voices, described by at, that the next note
+// plays on: a free one if any, else the one the policy steals. Voices of
+// higher priority tracks and those within another track's reservation are
+// only stolen when every voice is. With the Default policy and no
+// priorities in the way, it steals the engine's own choice def.
+func (a *Allocator) Pick(n int, at func(i int) Voice, def func() int) int {
+	free, active := -1, 0
+	for i := 0; i < n; i++ {
+		if at(i).Active {
+			active++
+		} else if free < 0 {
+			free = i
+		}
+	}
+	if int64(min(active+1, n)) > a.peak.Load() {
+		a.peak.Store(int64(min(active+1, n)))
+	}
+	if free >= 0 {
+		return free
+	}
+	slot := a.steal(n, at, def)
+	if at(slot).Released {
+		a.releaseSteals.Add(1)
+	} else {
+		a.steals.Add(1)
+	}
+	return slot
+}
+
+func (a *Allocator) steal(n int, at func(i int) Voice, def func() int) int {
+	// Only the lowest priority voices that are not reserved are candidates.
+	protected := func(v Voice) bool {
+		if v.Owner.Track == a.owner.Track || v.Owner.Reserve <= 0 {
+			return false
+		}
+		held := 0
+		for i := 0; i < n; i++ {
+			if w := at(i); w.Active && w.Owner.Track == v.Owner.Track {
+				held++
+			}
+		}
+		return held <= v.Owner.Reserve
+	}
+	lowest, any := 0, false
+	for i := 0; i < n; i++ {
+		if v := at(i); !protected(v) && (!any || v.Owner.Priority < lowest) {
+			lowest, any = v.Owner.Priority, true
+		}
+	}
+	candidate := func(v Voice) bool {
+		return !any || (!protected(v) && v.Owner.Priority == lowest)
+	}
+	if a.policy == Default {
+		if slot := def(); candidate(at(slot)) {
+			return slot
+		}
+	}
+	best := -1
+	better := func(v, b Voice) bool {
+		switch a.policy {
+		case Quietest:
+			if v.Level != b.Level {
+				return v.Level < b.Level
+			}
+		case SameTrack:
+			if same, bSame := v.Owner.Track == a.owner.Track, b.Owner.Track == a.owner.Track; same != bSame {
+				return same
+			}
+		case ReleaseFirst:
+			if v.Released != b.Released {
+				return v.Released
+			}
+		}
+		return v.Start < b.Start
+	}
+	for i := 0; i < n; i++ {
+		if v := at(i); candidate(v) && (best < 0 || better(v, at(best))) {
+			best = i
+		}
+	}
+	return best
+}
@@ -0,0 +1,70 @@
+package alloc
+
+import "testing"
+
+// pick runs Pick over voices with the engine's own choice def.
+func pick(a *Allocator, voices []Voice, def int) int {
+	return a.Pick(len(voices), func(i int) Voice { return voices[i] }, func() int { return def })
+}
+
+func TestPickTakesAFreeVoiceFirst(t *testing.T) {
+	var a Allocator
+	voices := []Voice{{Active: true}, {}, {Active: true}}
+	if got := pick(&a, voices, 0); got != 1 {
+		t.Fatalf("expected the free voice, got %d", got)
+	}
+	if st := a.Stats(); st.Steals != 0 || st.PeakVoices != 3 {
+		t.Fatalf("expected no steals and a peak of 3, got %+v", st)
+	}
+}
+
+func TestPoliciesStealTheirVoice(t *testing.T) {
+	voices := []Voice{
+		{Active: true, Start: 3, Level: 0.2, Owner: Owner{Track: 1}},
+		{Active: true, Start: 1, Level: 0.9},
+		{Active: true, Start: 2, Level: 0.5, Released: true},
+		{Active: true, Start: 4, Level: 0.1, Owner: Owner{Track: 1}},
+	}
+	for _, tc := range []struct {
+		policy Policy
+		want   int
+	}{
+		{Default, 2},
+		{Oldest, 1},
+		{Quietest, 3},
+		{SameTrack, 0},
+		{ReleaseFirst, 2},
+	} {
+		var a Allocator
+		a.SetPolicy(tc.policy)
+		a.SetOwner(Owner{Track: 1})
+		if got := pick(&a, voices, 2); got != tc.want {
+			t.Fatalf("policy %d: expected voice %d, got %d", tc.policy, tc.want, got)
+		}
+	}
+}
+
+func TestReservationsAndPriorityProtectVoices(t *testing.T) {
+	voices := []Voice{
+		{Active: true, Start: 1, Owner: Owner{Track: 0, Reserve: 1}},
+		{Active: true, Start: 2, Owner: Owner{Track: 1, Priority: 2}},
+		{Active: true, Start: 3, Owner: Owner{Track: 2}},
+	}
+	var a Allocator
+	a.SetPolicy(Oldest)
+	a.SetOwner(Owner{Track: 1})
+	if got := pick(&a, voices, 0); got != 2 {
+		t.Fatalf("expected the reserved and higher priority voices to be passed over, got %d", got)
+	}
+	a.SetOwner(Owner{Track: 0})
+	if got := pick(&a, voices[:2], 0); got != 0 {
+		t.Fatalf("expected a track to steal its own reserved voice first, got %d", got)
+	}
+	a.SetOwner(Owner{Track: 2})
+	if got := pick(&a, voices[:1], 1); got != 0 {
+		t.Fatalf("expected to steal a reserved voice when every voice is, got %d", got)
+	}
+	if st := a.Stats(); st.Steals != 3 || st.ReleaseSteals != 0 {
+		t.Fatalf("expected three steals, got %+v", st)
+	}
+}
@@ -5,7 +5,10 @@ import (
 	"math/rand"
 	"sync/atomic"
 
+	"github.com/cbegin/mmlfm-go/internal/alloc"
+	"github.com/cbegin/mmlfm-go/internal/filter"
 	"github.com/cbegin/mmlfm-go/internal/lfo"
+	"github.com/cbegin/mmlfm-go/internal/pipe"
 )
 
 const twoPi = math.Pi * 2
@@ -70,20 +73,24 @@ type voice struct {
 	env              float64
 	envState         envState
 	pan              float64
+	panL, panR       float64 // equal-power gains for pan
 	noiseLFSR        uint16
 	portamentoTarget float64
 	portamentoFrames int
 	portamentoStep   float64
+	gain             float64      // table envelope level, 1 = unchanged
+	pitchMul         float64      // table envelope frequency ratio, 1 = unchanged
+	vcf              filter.Voice // @f envelope and resonant filter
+	pipes            pipe.Route   // @o/@r bus pipes
+	owner            alloc.Owner
+	releaseSec       float64      // 0 = ReleaseSec
+	sweep            float64      // semitones per second after key-off
+	swept            float64      // semitones swept so far
+	pitchMod         lfo.Mod
+	ampMod           lfo.Mod
+	filterMod        lfo.Mod
 }
 
-type filterType int
-
-const (
-	filterLP filterType = iota
-	filterHP
-	filterBP
-)
-
 type Engine struct {
 	sampleRate      float64
 	params          Params
@@ -96,17 +103,20 @@ type Engine struct {
 	dcPrevOutR      float64
 	lpfL            float64 // lowpass filter state
 	lpfR            float64
-	bpfL            float64 // bandpass stage
-	bpfR            float64
 	lpfAlpha        float64 // filter coefficient
-	baseLPFCutoff   float64
-	filterKind      filterType
+	mix             []float64 // RenderBlock voice sums, reused
+	allocator       alloc.Allocator
 	nextPhase       int
 	portamentoFrom  int
 	portamentoFrames int
-	pitchLFO        lfo.LFO
-	ampLFO          lfo.LFO
-	filterLFO       lfo.LFO
+	pitchLFO        lfo.Shape // latched by the next NoteOn
+	ampLFO          lfo.Shape
+	filterLFO       lfo.Shape
+	filterEnv       filter.Envelope // latched by the next NoteOn
+	pipes           pipe.Route      // latched by the next NoteOn
+	bus             *pipe.Bus
+	releaseSec      float64 // latched by the next NoteOn, 0 = ReleaseSec
+	sweep           float64
 }
 
 func New(sampleRate int, params Params) *Engine {
@@ -121,6 +131,7 @@ func New(sampleRate int, params Params) *Engine {
 		params:     params,
 		voices:     make([]voice, params.Voices),
 		masterGain: math.Float64bits(params.MasterGain),
+		filterEnv:  filter.Open,
 	}
 	for i := range e.voices {
 		e.voices[i].noiseLFSR = uint16(0xACE1 + i*97)
@@ -129,13 +140,12 @@ func New(sampleRate int, params Params) *Engine {
 		rc := 1.0 / (twoPi * params.LPFCutoff)
 		dt := 1.0 / float64(sampleRate)
 		e.lpfAlpha = dt / (rc + dt)
-		e.baseLPFCutoff = params.LPFCutoff
 	}
 	return e
 }
 
 func (e *Engine) NoteOn(note int, velocity int, pan int, encodedProgram int) int {
-	slot := e.stealVoice()
+	slot := e.allocator.Pick(len(e.voices), e.allocVoice, e.stealVoice)
 	id := e.nextID
 	e.nextID++
 	program, module, channel := decodeProgram(encodedProgram)
@@ -168,7 +178,16 @@ func (e *Engine) NoteOn(note int, velocity int, pan int, encodedProgram int) int
 	v.velocity = clamp(float64(velocity)/127.0, 0, 1)
 	v.env = 0
 	v.envState = envAttack
-	v.pan = clamp(float64(pan), -64, 64)
+	v.setPan(clamp(float64(pan), -64, 64))
+	v.gain = 1
+	v.pitchMul = 1
+	v.pitchMod.Start(e.pitchLFO)
+	v.ampMod.Start(e.ampLFO)
+	v.filterMod.Start(e.filterLFO)
+	v.vcf.Start(e.filterEnv)
+	v.pipes = e.pipes
+	v.owner = e.allocator.Owner()
+	v.releaseSec, v.sweep, v.swept = e.releaseSec, e.sweep, 0
 	if v.noiseLFSR == 0 {
 		v.noiseLFSR = 0xACE1
 	}
@@ -180,85 +199,181 @@ func (e *Engine) NoteOff(id int) {
 		v := &e.voices[i]
 		if v.active && v.id == id && v.envState != envRelease {
 			v.envState = envRelease
+			v.vcf.Release()
 		}
 	}
 }
 
-func (e *Engine) RenderFrame() (float32, float32) {
-	pitchMod := e.pitchLFO.Sample(e.sampleRate)
-	ampMod := e.ampLFO.Sample(e.sampleRate)
-	filterMod := e.filterLFO.Sample(e.sampleRate)
+// voiceByID returns the sounding voice with the given id, or nil.
+func (e *Engine) voiceByID(id int) *voice {
+	for i := range e.voices {
+		if v := &e.voices[i]; v.active && v.id == id {
+			return v
+		}
+	}
+	return nil
+}
 
-	freqMul := 1.0
-	if pitchMod != 0 {
-		freqMul = math.Pow(2, pitchMod/12.0)
+func (e *Engine) VoiceActive(id int) bool {
+	return e.voiceByID(id) != nil
+}
+
+// Legato moves the sounding voice id to note and velocity for a mono track,
+// gliding over frames, and gives it the latched release, sweep, pipes and
+// owner. With retrigger, or once the voice is released, its envelopes attack
+// again from their current level and its LFOs and filter restart from the
+// latched shapes. It reports false when the voice has finished.
+func (e *Engine) Legato(id, note, velocity, frames int, retrigger bool) bool {
+	v := e.voiceByID(id)
+	if v == nil {
+		return false
 	}
+	v.velocity = clamp(float64(velocity)/127.0, 0, 1)
+	v.glide(midiToFreq(note), frames)
+	v.pipes, v.owner = e.pipes, e.allocator.Owner()
+	v.releaseSec, v.sweep = e.releaseSec, e.sweep
+	if retrigger || v.envState == envRelease {
+		v.envState, v.swept = envAttack, 0
+		v.pitchMod.Start(e.pitchLFO)
+		v.ampMod.Start(e.ampLFO)
+		v.filterMod.Start(e.filterLFO)
+		v.vcf.Retrigger(e.filterEnv)
+	}
+	return true
+}
 
+func (e *Engine) SetVoicePitch(id int, semitones float64) {
+	if v := e.voiceByID(id); v != nil {
+		v.pitchMul = math.Pow(2, semitones/12.0)
+	}
+}
+
+func (e *Engine) SetVoiceGain(id int, gain float64) {
+	if v := e.voiceByID(id); v != nil {
+		v.gain = math.Max(gain, 0)
+	}
+}
+
+func (e *Engine) SetVoicePan(id int, pan int) {
+	if v := e.voiceByID(id); v != nil {
+		v.setPan(clamp(float64(pan), -64, 64))
+	}
+}
+
+func (e *Engine) SetVoiceFilter(id int, cutoff int) {
+	if v := e.voiceByID(id); v != nil {
+		v.vcf.Hold(float64(cutoff))
+	}
+}
+
+func (e *Engine) RenderFrame() (float32, float32) {
 	var l, r float64
+	gain := e.masterGainValue()
 	for i := range e.voices {
-		v := &e.voices[i]
-		if !v.active {
-			continue
+		if vl, vr, ok := e.stepVoice(&e.voices[i], gain); ok {
+			l += vl
+			r += vr
 		}
-		v.age++
-		if v.portamentoFrames > 0 {
-			v.portamentoFrames--
-			v.freq += v.portamentoStep
-			if v.portamentoFrames <= 0 {
-				v.freq = v.portamentoTarget
+	}
+	return e.output(l, r)
+}
+
+// RenderBlock renders len(dst)/2 frames into interleaved stereo dst, the
+// same as calling RenderFrame for each, one voice at a time over the block.
+func (e *Engine) RenderBlock(dst []float32) {
+	n := len(dst) / 2
+	if cap(e.mix) < n*2 {
+		e.mix = make([]float64, n*2)
+	}
+	mix := e.mix[:n*2]
+	clear(mix)
+	gain := e.masterGainValue()
+	for i := range e.voices {
+		v := &e.voices[i]
+		for f := 0; f < n && v.active; f++ {
+			if l, r, ok := e.stepVoice(v, gain); ok {
+				mix[f*2] += l
+				mix[f*2+1] += r
 			}
 		}
-		// Apply pitch LFO to effective frequency for rendering
-		origFreq := v.freq
-		v.freq *= freqMul
-		env := e.advanceEnv(v)
-		if !v.active {
-			v.freq = origFreq
-			continue
+	}
+	for f := 0; f < n; f++ {
+		dst[f*2], dst[f*2+1] = e.output(mix[f*2], mix[f*2+1])
+	}
+}
+
+// stepVoice renders one frame of v and advances it. Master gain applies to
+// what reaches the mix, not to pipe output. ok is false when the voice is
+// silent or its output went to a pipe.
+func (e *Engine) stepVoice(v *voice, gain float64) (l, r float64, ok bool) {
+	if !v.active {
+		return 0, 0, false
+	}
+	v.age++
+	if v.portamentoFrames > 0 {
+		v.portamentoFrames--
+		v.freq += v.portamentoStep
+		if v.portamentoFrames <= 0 {
+			v.freq = v.portamentoTarget
 		}
-		sample := e.renderWave(v)
+	}
+	// Apply pitch LFO to effective frequency for rendering
+	freqMul := v.pitchMul
+	if pitchMod := v.pitchMod.Sample(e.sampleRate); pitchMod != 0 {
+		freqMul *= math.Pow(2, pitchMod/12.0)
+	}
+	if v.envState == envRelease && v.sweep != 0 {
+		v.swept += v.sweep / e.sampleRate
+		freqMul *= math.Pow(2, v.swept/12.0)
+	}
+	origFreq := v.freq
+	v.freq *= freqMul
+	env := e.advanceEnv(v)
+	if !v.active {
 		v.freq = origFreq
-		level := quantize(env*(0.15+v.velocity*e.params.VelocityAmp), e.params.StepLevels)
-		sig := sample * level * (1.0 + ampMod)
-		angle := ((v.pan + 64.0) / 128.0) * (math.Pi / 2.0)
-		l += sig * math.Cos(angle) * e.masterGainValue()
-		r += sig * math.Sin(angle) * e.masterGainValue()
+		return 0, 0, false
 	}
+	sample := e.renderWave(v)
+	v.freq = origFreq
+	level := quantize(env*(0.15+v.velocity*e.params.VelocityAmp)*v.gain, e.params.StepLevels)
+	sig := v.vcf.Process(sample*level*(1.0+v.ampMod.Sample(e.sampleRate)), v.filterMod.Sample(e.sampleRate), e.sampleRate)
+	sig = v.pipes.Ring(e.bus, sig)
+	if v.pipes.Send(e.bus, sig) {
+		return 0, 0, false
+	}
+	return sig * v.panL * gain, sig * v.panR * gain, true
+}
+
+// output DC-blocks and filters a mixed frame and clamps it.
+func (e *Engine) output(l, r float64) (float32, float32) {
 	l = e.dcBlockL(l)
 	r = e.dcBlockR(r)
-	// Filter LFO
-	if e.baseLPFCutoff > 0 && filterMod != 0 {
-		cutoff := e.baseLPFCutoff + filterMod*100.0
-		if cutoff < 20 {
-			cutoff = 20
-		}
-		if cutoff > e.sampleRate/2 {
-			cutoff = e.sampleRate / 2
-		}
-		rc := 1.0 / (twoPi * cutoff)
-		dt := 1.0 / e.sampleRate
-		e.lpfAlpha = dt / (rc + dt)
-	}
 	if e.lpfAlpha > 0 {
 		e.lpfL += e.lpfAlpha * (l - e.lpfL)
 		e.lpfR += e.lpfAlpha * (r - e.lpfR)
-		switch e.filterKind {
-		case filterLP:
-			l = e.lpfL
-			r = e.lpfR
-		case filterHP:
-			l = l - e.lpfL
-			r = r - e.lpfR
-		case filterBP:
-			e.bpfL += e.lpfAlpha * (e.lpfL - e.bpfL)
-			e.bpfR += e.lpfAlpha * (e.lpfR - e.bpfR)
-			l = e.lpfL - e.bpfL
-			r = e.lpfR - e.bpfR
-		}
+		l = e.lpfL
+		r = e.lpfR
 	}
 	return float32(clamp(l, -1, 1)), float32(clamp(r, -1, 1))
 }
 
+// setPan sets the voice's pan and its equal-power channel gains.
+func (v *voice) setPan(pan float64) {
+	v.pan = pan
+	angle := ((pan + 64.0) / 128.0) * (math.Pi / 2.0)
+	v.panL, v.panR = math.Cos(angle), math.Sin(angle)
+}
+
+// glide moves the voice to freq over frames, at once when frames is 0.
+func (v *voice) glide(freq float64, frames int) {
+	if frames <= 0 {
+		v.freq, v.portamentoFrames = freq, 0
+		return
+	}
+	v.portamentoTarget, v.portamentoFrames = freq, frames
+	v.portamentoStep = (freq - v.freq) / float64(frames)
+}
+
 func (e *Engine) dcBlockL(x float64) float64 {
 	const r = 0.995
 	y := x - e.dcPrevInL + r*e.dcPrevOutL
@@ -354,6 +469,27 @@ func waveForProgram(program int, module int, channel int) waveType {
 	return wavePulseA
 }
 
+// allocVoice describes voice i to the allocator.
+func (e *Engine) allocVoice(i int) alloc.Voice {
+	v := &e.voices[i]
+	return alloc.Voice{Active: v.active, Released: v.envState == envRelease, Start: v.id, Level: v.env, Owner: v.owner}
+}
+
+// SetVoicePolicy sets which voice a note steals when all are sounding.
+func (e *Engine) SetVoicePolicy(p alloc.Policy) {
+	e.allocator.SetPolicy(p)
+}
+
+// SetVoiceOwner sets the track the next NoteOn plays for.
+func (e *Engine) SetVoiceOwner(o alloc.Owner) {
+	e.allocator.SetOwner(o)
+}
+
+// VoiceStats returns how many voices notes have stolen.
+func (e *Engine) VoiceStats() alloc.Stats {
+	return e.allocator.Stats()
+}
+
 func (e *Engine) stealVoice() int {
 	// Prefer an inactive slot.
 	for i := range e.voices {
@@ -407,7 +543,11 @@ func (e *Engine) advanceEnv(v *voice) float64 {
 		}
 	case envSustain:
 	case envRelease:
-		step := e.params.SustainLvl / (e.params.ReleaseSec * e.sampleRate)
+		release := v.releaseSec
+		if release <= 0 {
+			release = e.params.ReleaseSec
+		}
+		step := e.params.SustainLvl / (release * e.sampleRate)
 		if step <= 0 {
 			step = 1
 		}
@@ -467,15 +607,25 @@ func (e *Engine) masterGainValue() float64 {
 	return math.Float64frombits(atomic.LoadUint64(&e.masterGain))
 }
 
-func (e *Engine) SetFilterType(filterType int) {
-	switch filterType {
-	case 1:
-		e.filterKind = filterBP
-	case 2:
-		e.filterKind = filterHP
-	default:
-		e.filterKind = filterLP
-	}
+// SetFilter sets the @f envelope and %f mode for subsequent NoteOns.
+func (e *Engine) SetFilter(env filter.Envelope) {
+	e.filterEnv = env
+}
+
+// SetBus sets the bus the @o/@r pipes read and write.
+func (e *Engine) SetBus(b *pipe.Bus) {
+	e.bus = b
+}
+
+// SetPipes sets the bus pipe routing for subsequent NoteOns.
+func (e *Engine) SetPipes(r pipe.Route) {
+	e.pipes = r
+}
+
+// SetRelease sets the release time in seconds for subsequent NoteOns, 0 for
+// ReleaseSec, and the pitch sweep after key-off in semitones per second.
+func (e *Engine) SetRelease(seconds, sweep float64) {
+	e.releaseSec, e.sweep = seconds, sweep
 }
 
 func (e *Engine) SetNoteOnPhase(phase int) {
@@ -487,16 +637,16 @@ func (e *Engine) SetPortamento(fromNote int, frames int) {
 	e.portamentoFrames = frames
 }
 
-func (e *Engine) SetPitchLFO(depth float64, rateHz float64, waveform int) {
-	e.pitchLFO.Set(depth, rateHz, waveform)
+func (e *Engine) SetPitchLFO(shape lfo.Shape) {
+	e.pitchLFO = shape
 }
 
-func (e *Engine) SetAmpLFO(depth float64, rateHz float64, waveform int) {
-	e.ampLFO.Set(depth, rateHz, waveform)
+func (e *Engine) SetAmpLFO(shape lfo.Shape) {
+	e.ampLFO = shape
 }
 
-func (e *Engine) SetFilterLFO(depth float64, rateHz float64, waveform int) {
-	e.filterLFO.Set(depth, rateHz, waveform)
+func (e *Engine) SetFilterLFO(shape lfo.Shape) {
+	e.filterLFO = shape
 }
 
 func decodeProgram(encoded int) (program int, module int, channel int) {
@@ -0,0 +1,197 @@
+package filter
+
+import "math"
+
+// Filter modes, numbered like MML %f.
+const (
+	LowPass = iota
+	BandPass
+	HighPass
+)
+
+// CutoffHz maps an MML cutoff value (0-128) onto 20 Hz-20 kHz on an
+// exponential curve.
+func CutoffHz(cutoff float64) float64 {
+	if cutoff < 0 {
+		cutoff = 0
+	}
+	return 20 * math.Pow(1000, cutoff/128.0)
+}
+
+// SVF is a resonant state-variable filter. The zero value is open and passes
+// samples through unchanged.
+type SVF struct {
+	mode       int
+	k          float64 // damping, 2 = no resonance
+	a1, a2, a3 float64 // 0 = bypass
+	ic1, ic2   float64
+}
+
+// Set sets the mode, the cutoff from an MML value (0-128) and the resonance
+// from 0 (none) to 1 (close to self-oscillation). A lowpass at 128 or above
+// is fully open.
+func (f *SVF) Set(mode int, cutoff, resonance, sampleRate float64) {
+	f.mode = mode
+	if sampleRate <= 0 || (mode == LowPass && cutoff >= 128) {
+		f.a1 = 0
+		return
+	}
+	hz := math.Min(CutoffHz(cutoff), sampleRate*0.49)
+	f.k = 2 - 1.9*math.Max(0, math.Min(1, resonance))
+	g := math.Tan(math.Pi * hz / sampleRate)
+	f.a1 = 1 / (1 + g*(g+f.k))
+	f.a2 = g * f.a1
+	f.a3 = g * f.a2
+}
+
+// Process filters one sample.
+func (f *SVF) Process(x float64) float64 {
+	if f.a1 == 0 {
+		f.ic1, f.ic2 = 0, x
+		return x
+	}
+	v3 := x - f.ic2
+	v1 := f.a1*f.ic1 + f.a2*v3
+	v2 := f.ic2 + f.a2*f.ic1 + f.a3*v3
+	f.ic1 = 2*v1 - f.ic1
+	f.ic2 = 2*v2 - f.ic2
+	switch f.mode {
+	case BandPass:
+		return v1
+	case HighPass:
+		return x - f.k*v1 - v2
+	}
+	return v2
+}
+
+// Envelope is an @f filter setting. The cutoff starts at Cutoff, moves to
+// Peak over Attack, to Level over Decay and to End over Sustain, then holds;
+// after note-off it moves to ReleaseCutoff over Release. Cutoffs are MML
+// values (0-128) and times are in seconds; an infinite time holds the cutoff
+// the stage starts from.
+type Envelope struct {
+	Mode          int
+	Resonance     float64 // 0-1
+	Cutoff        float64
+	Peak          float64
+	Level         float64
+	End           float64
+	ReleaseCutoff float64
+	Attack        float64
+	Decay         float64
+	Sustain       float64
+	Release       float64
+}
+
+// Static returns an envelope that holds one cutoff for the whole note.
+func Static(mode int, cutoff, resonance float64) Envelope {
+	return Envelope{
+		Mode:          mode,
+		Resonance:     resonance,
+		Cutoff:        cutoff,
+		Peak:          cutoff,
+		Level:         cutoff,
+		End:           cutoff,
+		ReleaseCutoff: cutoff,
+	}
+}
+
+// Open is the unfiltered setting.
+var Open = Static(LowPass, 128, 0)
+
+const (
+	stageAttack = iota
+	stageDecay
+	stageSustain
+	stageRelease
+)
+
+// Voice runs an Envelope through an SVF for one note. The zero value is open.
+type Voice struct {
+	svf     SVF
+	env     Envelope
+	on      bool
+	held    bool
+	stage   int
+	t       float64 // seconds into the stage
+	from    float64 // release start cutoff
+	cutoff  float64 // envelope output
+	applied float64 // cutoff the SVF was last set to
+	fresh   bool    // svf needs setting
+}
+
+// Start restarts the envelope from key-on.
+func (v *Voice) Start(env Envelope) {
+	*v = Voice{env: env, on: true, cutoff: env.Cutoff, fresh: true}
+}
+
+// Retrigger restarts env from key-on, keeping the filter's state so a legato
+// note does not click. It replaces a held cutoff.
+func (v *Voice) Retrigger(env Envelope) {
+	v.env, v.on, v.held, v.fresh = env, true, false, true
+	v.stage, v.t, v.cutoff = stageAttack, 0, env.Cutoff
+}
+
+// Release moves the envelope to its release stage.
+func (v *Voice) Release() {
+	if !v.on || v.held || v.stage == stageRelease {
+		return
+	}
+	v.stage, v.t, v.from = stageRelease, 0, v.cutoff
+}
+
+// Hold fixes the cutoff, replacing the envelope.
+func (v *Voice) Hold(cutoff float64) {
+	if !v.on {
+		v.on, v.env = true, Open
+	}
+	v.held, v.cutoff, v.fresh = true, cutoff, true
+}
+
+// Process advances the envelope by one sample and filters x, with the cutoff
+// offset by mod.
+func (v *Voice) Process(x, mod, sampleRate float64) float64 {
+	if !v.on {
+		return x
+	}
+	if !v.held {
+		v.advance(1 / sampleRate)
+	}
+	if c := v.cutoff + mod; v.fresh || c != v.applied {
+		v.svf.Set(v.env.Mode, c, v.env.Resonance, sampleRate)
+		v.applied, v.fresh = c, false
+	}
+	return v.svf.Process(x)
+}
+
+func (v *Voice) advance(dt float64) {
+	e := &v.env
+	for {
+		var from, to, length float64
+		switch v.stage {
+		case stageAttack:
+			from, to, length = e.Cutoff, e.Peak, e.Attack
+		case stageDecay:
+			from, to, length = e.Peak, e.Level, e.Decay
+		case stageSustain:
+			from, to, length = e.Level, e.End, e.Sustain
+		default:
+			from, to, length = v.from, e.ReleaseCutoff, e.Release
+		}
+		if math.IsInf(length, 1) {
+			v.cutoff = from
+			return
+		}
+		if v.t < length {
+			v.cutoff = from + (to-from)*v.t/length
+			v.t += dt
+			return
+		}
+		v.cutoff = to
+		if v.stage >= stageSustain {
+			return
+		}
+		v.stage++
+		v.t = 0
+	}
+}
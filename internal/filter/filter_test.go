@@ -0,0 +1,93 @@
+package filter
+
+import (
+	"math"
+	"testing"
+)
+
+func TestZeroValueAndOpenFilterAreBypass(t *testing.T) {
+	var v Voice
+	for _, x := range []float64{0.5, -1, 0.25} {
+		if got := v.Process(x, 0, 48000); got != x {
+			t.Fatalf("zero-value filter changed %f to %f", x, got)
+		}
+	}
+	v.Start(Open)
+	if got := v.Process(0.75, 0, 48000); got != 0.75 {
+		t.Fatalf("open filter should bypass, got %f", got)
+	}
+}
+
+// sinePeak returns the peak output for a 5 kHz sine after the filter settles.
+func sinePeak(mode int, cutoff float64) float64 {
+	const sr = 48000.0
+	var f SVF
+	f.Set(mode, cutoff, 0, sr)
+	p := 0.0
+	for i := 0; i < 4800; i++ {
+		y := f.Process(math.Sin(2 * math.Pi * 5000 * float64(i) / sr))
+		if i > 2400 {
+			p = math.Max(p, math.Abs(y))
+		}
+	}
+	return p
+}
+
+func TestModesFilterAroundTheCutoff(t *testing.T) {
+	if open, closed := sinePeak(LowPass, 128), sinePeak(LowPass, 32); closed >= open*0.2 {
+		t.Fatalf("expected lowpass at 32 to attenuate 5 kHz, open peak %f closed peak %f", open, closed)
+	}
+	if high := sinePeak(HighPass, 120); high >= 0.2 {
+		t.Fatalf("expected highpass at 120 to attenuate 5 kHz, peak %f", high)
+	}
+	if high := sinePeak(HighPass, 32); high < 0.9 {
+		t.Fatalf("expected highpass at 32 to pass 5 kHz, peak %f", high)
+	}
+}
+
+func TestEnvelopeMovesThroughStagesAndRelease(t *testing.T) {
+	const sr = 1000.0
+	var v Voice
+	env := Envelope{Cutoff: 0, Peak: 100, Level: 50, End: 50, ReleaseCutoff: 10, Attack: 0.1, Decay: 0.1, Release: 0.1}
+	v.Start(env)
+	cutoffAfter := func(n int) float64 {
+		for i := 0; i < n; i++ {
+			v.Process(0, 0, sr)
+		}
+		return v.cutoff
+	}
+	if got := cutoffAfter(51); math.Abs(got-50) > 1.5 {
+		t.Fatalf("expected attack halfway near 50, got %f", got)
+	}
+	if got := cutoffAfter(100); math.Abs(got-75) > 1.5 {
+		t.Fatalf("expected decay halfway near 75, got %f", got)
+	}
+	if got := cutoffAfter(500); got != 50 {
+		t.Fatalf("expected sustain to hold 50, got %f", got)
+	}
+	v.Release()
+	if got := cutoffAfter(200); got != 10 {
+		t.Fatalf("expected release to reach 10, got %f", got)
+	}
+	v.Retrigger(env)
+	if got := cutoffAfter(51); math.Abs(got-50) > 1.5 {
+		t.Fatalf("expected a retrigger to attack again, got %f", got)
+	}
+	v.Retrigger(Static(LowPass, 20, 0))
+	if got := cutoffAfter(10); got != 20 {
+		t.Fatalf("expected a retrigger to take the new envelope, got %f", got)
+	}
+}
+
+func TestInfiniteStageHoldsItsStartingCutoff(t *testing.T) {
+	var v Voice
+	v.Start(Envelope{Cutoff: 40, Peak: 128, Level: 64, End: 32, ReleaseCutoff: 128, Attack: math.Inf(1), Release: math.Inf(1)})
+	for i := 0; i < 1000; i++ {
+		v.Process(0, 0, 1000)
+	}
+	v.Release()
+	v.Process(0, 0, 1000)
+	if v.cutoff != 40 {
+		t.Fatalf("expected cutoff to hold 40, got %f", v.cutoff)
+	}
+}
@@ -8,7 +8,10 @@ import (
 	"strings"
 	"sync/atomic"
 
+	"github.com/cbegin/mmlfm-go/internal/alloc"
+	"github.com/cbegin/mmlfm-go/internal/filter"
 	"github.com/cbegin/mmlfm-go/internal/lfo"
+	"github.com/cbegin/mmlfm-go/internal/pipe"
 )
 
 const twoPi = math.Pi * 2
@@ -45,14 +48,91 @@ func DefaultParams() Params {
 	}
 }
 
-type filterType int
+// Inline is the voice a track builds with @al, @fb and the operator
+// commands. Unset fields (-1) keep the program's #OPM@ patch or the engine
+// setting. Operators are indexed as i selects them: 0 is the first modulator
+// and the last the carrier.
+type Inline struct {
+	Ops       int // 1-4
+	Algorithm int // 0-7
+	Feedback  int // 0-7
+	Operators [4]Operator
+}
+
+// Operator holds the operator commands selected by i. TL, RR and ML are
+// unset at -1; DT and FX are off at 0.
+type Operator struct {
+	TL     int // @tl total level, 0-127 (0 = loudest)
+	RR     int // @rr release rate, 0-63 (0 holds until the voice is reused)
+	ML     int // @ml multiple, 0-15 (0 = x0.5)
+	MLFine int // @ml second argument, added to the multiple in 1/128s
+	DT     int // @dt detune, 64 per semitone
+	FX     int // @fx fixed note; 60 is o5c
+	SE     int // @se SSG-EG mode 8-15, or 16/17 as 8/12; others are off
+}
+
+// NoOperator leaves an operator to the patch or the engine.
+var NoOperator = Operator{TL: -1, RR: -1, ML: -1}
+
+// NoInline leaves every voice setting to the patch or the engine.
+var NoInline = Inline{
+	Ops:       -1,
+	Algorithm: -1,
+	Feedback:  -1,
+	Operators: [4]Operator{NoOperator, NoOperator, NoOperator, NoOperator},
+}
+
+// apply overrides an operator's patch or default settings.
+func (o Operator) apply(op *operator) {
+	if o.TL >= 0 {
+		op.tl = float64(127-clampInt(o.TL, 0, 127)) / 127.0
+	}
+	op.rr = o.release(op.rr)
+	if o.ML >= 0 {
+		op.mul = float64(clampInt(o.ML, 0, 15))
+		if op.mul == 0 {
+			op.mul = 0.5
+		}
+		op.mul += float64(o.MLFine) / 128.0
+	}
+	if o.DT != 0 {
+		op.mul *= math.Pow(2, float64(o.DT)/64.0/12.0)
+	}
+	if o.FX > 0 {
+		op.fixed = midiToFreq(clampInt(o.FX, 0, 127))
+	}
+	switch {
+	case o.SE >= 8 && o.SE <= 15:
+		op.ssg = o.SE
+	case o.SE == 16:
+		op.ssg = 8
+	case o.SE == 17:
+		op.ssg = 12
+	}
+}
+
+// release returns the release time rr with @rr applied.
+func (o Operator) release(rr float64) float64 {
+	switch {
+	case o.RR == 0:
+		return holdReleaseSec
+	case o.RR > 0:
+		return 0.01 + float64(63-clampInt(o.RR, 0, 63))/63.0*0.3
+	}
+	return rr
+}
 
+// SSG-EG mode bits, as in the OPN SSG-EG register.
 const (
-	filterLP filterType = iota
-	filterHP
-	filterBP
+	ssgHold      = 1
+	ssgAlternate = 2
+	ssgAttack    = 4
 )
 
+// holdReleaseSec is long enough that a released operator keeps sounding
+// until its voice is reused.
+const holdReleaseSec = 1e6
+
 // opmPatch holds OPM-format operator parameters for one program.
 type opmPatch struct {
 	alg  int
@@ -80,18 +160,24 @@ type Engine struct {
 	portamentoFrames int
 	lpfL             float64
 	lpfR             float64
-	bpfL             float64
-	bpfR             float64
 	lpfAlpha         float64
-	baseLPFCutoff    float64
-	filterKind       filterType
+	mix              []float64 // RenderBlock voice sums, reused
+	noise            uint32    // noise waveform LFSR, shared by the engine's voices
+	allocator        alloc.Allocator
 	algorithm        int
 	feedback         float64
 	opCount          int
 	patches          map[int]*opmPatch
-	pitchLFO         lfo.LFO
-	ampLFO           lfo.LFO
-	filterLFO        lfo.LFO
+	inline           Inline    // latched by the next NoteOn
+	envFrom          int       // voice whose levels the next NoteOn attacks from, -1 = none
+	pitchLFO         lfo.Shape // latched by the next NoteOn
+	ampLFO           lfo.Shape
+	filterLFO        lfo.Shape
+	filterEnv        filter.Envelope // latched by the next NoteOn
+	pipes            pipe.Route      // latched by the next NoteOn
+	bus              *pipe.Bus
+	releaseSec       float64 // latched by the next NoteOn, 0 = per operator
+	sweep            float64
 }
 
 type envState int
@@ -114,6 +200,9 @@ type operator struct {
 	dr       float64
 	sl       float64
 	rr       float64
+	fixed    float64 // Hz, 0 follows the note
+	ssg      int     // SSG-EG mode 8-15, 0 = off
+	ssgUp    bool    // SSG-EG cycle is rising
 	prevOut  float64
 }
 
@@ -128,6 +217,7 @@ type voice struct {
 	fb               float64
 	fbPrev           float64
 	pan              float64
+	panL, panR       float64 // equal-power gains for pan
 	module           int
 	channel          int
 	program          int
@@ -135,6 +225,17 @@ type voice struct {
 	portamentoTarget float64
 	portamentoFrames int
 	portamentoStep   float64
+	gain             float64      // table envelope level, 1 = unchanged
+	pitchMul         float64      // table envelope frequency ratio, 1 = unchanged
+	vcf              filter.Voice // @f envelope and resonant filter
+	pipes            pipe.Route   // @o/@i/@r bus pipes
+	released         bool
+	owner            alloc.Owner
+	sweep            float64 // semitones per second after key-off
+	swept            float64 // semitones swept so far
+	pitchMod         lfo.Mod
+	ampMod           lfo.Mod
+	filterMod        lfo.Mod
 }
 
 func New(sampleRate int, params Params) *Engine {
@@ -148,17 +249,21 @@ func New(sampleRate int, params Params) *Engine {
 		masterGain: math.Float64bits(params.MasterGain),
 		opCount:    2,
 		patches:    make(map[int]*opmPatch),
+		inline:     NoInline,
+		envFrom:    -1,
+		noise:      0x7FFF,
+		filterEnv:  filter.Open,
 	}
 	if params.LPFCutoff > 0 && params.LPFCutoff < float64(sampleRate)/2 {
 		rc := 1.0 / (twoPi * params.LPFCutoff)
 		dt := 1.0 / float64(sampleRate)
 		e.lpfAlpha = dt / (rc + dt)
-		e.baseLPFCutoff = params.LPFCutoff
 	}
 	return e
 }
 
-// SetAlgorithm sets the operator connection topology (0-7).
+// SetAlgorithm sets the operator connection topology (0-7) of voices without
+// a patch or inline algorithm.
 func (e *Engine) SetAlgorithm(alg int) {
 	if alg < 0 {
 		alg = 0
@@ -169,12 +274,14 @@ func (e *Engine) SetAlgorithm(alg int) {
 	e.algorithm = alg
 }
 
-// SetFeedback sets self-feedback for operator 1 (0.0-1.0).
+// SetFeedback sets self-feedback for operator 1 (0.0-1.0) of voices without a
+// patch or inline feedback.
 func (e *Engine) SetFeedback(fb float64) {
 	e.feedback = clamp(fb, 0, 1)
 }
 
-// SetOperatorCount sets the number of active operators (1-4).
+// SetOperatorCount sets the number of active operators (1-4) of voices
+// without a patch or inline count.
 func (e *Engine) SetOperatorCount(count int) {
 	if count < 1 {
 		count = 1
@@ -185,6 +292,18 @@ func (e *Engine) SetOperatorCount(count int) {
 	e.opCount = count
 }
 
+// SetInline sets the inline voice for subsequent NoteOns. Its set fields
+// override the program's patch.
+func (e *Engine) SetInline(v Inline) {
+	e.inline = v
+}
+
+// ContinueEnvelope makes the next NoteOn's operators attack from the levels
+// voice id has reached instead of from silence, as @er0 does. -1 resets.
+func (e *Engine) ContinueEnvelope(id int) {
+	e.envFrom = id
+}
+
 // LoadOPMPatch parses OPM-format patch data and stores it for the given program number.
 // OPM format: alg, fb, then 4 operators with AR,D1R,D2R,RR,D1L,TL,KS,MUL,DT1,DT2,AMS each.
 func (e *Engine) LoadOPMPatch(program int, data []int) {
@@ -252,7 +371,7 @@ func (e *Engine) LoadOPMPatchFromDefs(defs map[string]string) {
 }
 
 func (e *Engine) NoteOn(note int, velocity int, pan int, encodedProgram int) int {
-	slot := e.stealVoice()
+	slot := e.allocator.Pick(len(e.voices), e.allocVoice, e.stealVoice)
 	id := e.nextID
 	e.nextID++
 	program, module, channel := decodeProgram(encodedProgram)
@@ -285,6 +404,13 @@ func (e *Engine) NoteOn(note int, velocity int, pan int, encodedProgram int) int
 	if numOps <= 0 {
 		numOps = 2
 	}
+	var fromEnv [4]float64
+	if from := e.voiceByID(e.envFrom); from != nil {
+		for oi := range from.ops {
+			fromEnv[oi] = from.ops[oi].env
+		}
+	}
+	e.envFrom = -1
 	alg := e.algorithm
 	fb := e.feedback
 	if pat := e.patches[program]; pat != nil {
@@ -292,6 +418,15 @@ func (e *Engine) NoteOn(note int, velocity int, pan int, encodedProgram int) int
 		fb = pat.fb
 		numOps = 4
 	}
+	if e.inline.Ops >= 0 {
+		numOps = clampInt(e.inline.Ops, 1, 4)
+	}
+	if e.inline.Algorithm >= 0 {
+		alg = clampInt(e.inline.Algorithm, 0, 7)
+	}
+	if e.inline.Feedback >= 0 {
+		fb = float64(clampInt(e.inline.Feedback, 0, 7)) / 7.0
+	}
 	*v = voice{
 		active:           true,
 		id:               id,
@@ -300,7 +435,6 @@ func (e *Engine) NoteOn(note int, velocity int, pan int, encodedProgram int) int
 		numOps:           numOps,
 		alg:              alg,
 		fb:               fb,
-		pan:              p,
 		module:           module,
 		channel:          channel,
 		program:          program,
@@ -308,7 +442,17 @@ func (e *Engine) NoteOn(note int, velocity int, pan int, encodedProgram int) int
 		portamentoTarget: portTgt,
 		portamentoFrames: portFrames,
 		portamentoStep:   portStep,
+		gain:             1,
+		pitchMul:         1,
+		pipes:            e.pipes,
+		sweep:            e.sweep,
+		owner:            e.allocator.Owner(),
 	}
+	v.setPan(p)
+	v.pitchMod.Start(e.pitchLFO)
+	v.ampMod.Start(e.ampLFO)
+	v.filterMod.Start(e.filterLFO)
+	v.vcf.Start(e.filterEnv)
 	// Initialize operators from patch or defaults
 	pat := e.patches[program]
 	for oi := 0; oi < numOps; oi++ {
@@ -343,110 +487,264 @@ func (e *Engine) NoteOn(note int, velocity int, pan int, encodedProgram int) int
 			v.ops[oi].tl = e.params.ModIndex / 8.0
 		}
 	}
+	for oi := 0; oi < numOps; oi++ {
+		v.ops[oi].rr = e.opRelease(program, oi)
+		v.ops[oi].env = fromEnv[oi]
+	}
+	for i, o := range e.inline.Operators {
+		o.apply(&v.ops[operatorSlot(numOps, i)])
+	}
 	return id
 }
 
+// operatorSlot maps MML operator index i, where 0 is the first modulator and
+// the last index the carrier, to a voice's ops, where the carrier is 0. As in
+// SiON, an index past the last operator selects it.
+func operatorSlot(numOps, i int) int {
+	return max(numOps-1-i, 0)
+}
+
+// opRelease returns operator oi's release time from the program's patch or
+// the engine defaults, overridden by s.
+func (e *Engine) opRelease(program, oi int) float64 {
+	switch {
+	case e.releaseSec > 0:
+		return e.releaseSec
+	case e.patches[program] != nil:
+		return e.patches[program].op[oi].rr
+	}
+	return e.params.ReleaseSec
+}
+
 func (e *Engine) NoteOff(id int) {
 	for i := range e.voices {
 		v := &e.voices[i]
 		if v.active && v.id == id {
+			v.released = true
 			for oi := 0; oi < v.numOps; oi++ {
 				if v.ops[oi].envState != envRelease {
 					v.ops[oi].envState = envRelease
 				}
 			}
+			v.vcf.Release()
 		}
 	}
 }
 
-func (e *Engine) RenderFrame() (float32, float32) {
-	// Sample LFOs once per frame (global, not per-voice)
-	pitchMod := e.pitchLFO.Sample(e.sampleRate)  // in semitones
-	ampMod := e.ampLFO.Sample(e.sampleRate)       // gain factor offset
-	filterMod := e.filterLFO.Sample(e.sampleRate) // cutoff offset
+// voiceByID returns the sounding voice with the given id, or nil.
+func (e *Engine) voiceByID(id int) *voice {
+	for i := range e.voices {
+		if v := &e.voices[i]; v.active && v.id == id {
+			return v
+		}
+	}
+	return nil
+}
+
+func (e *Engine) VoiceActive(id int) bool {
+	return e.voiceByID(id) != nil
+}
 
+// Legato moves the sounding voice id to note and velocity for a mono track,
+// gliding over frames, and gives it the latched release, sweep, pipes and
+// owner. With retrigger, or once the voice is released, its envelopes attack
+// again from their current level and its LFOs and filter restart from the
+// latched shapes. It reports false when the voice has finished.
+func (e *Engine) Legato(id, note, velocity, frames int, retrigger bool) bool {
+	v := e.voiceByID(id)
+	if v == nil {
+		return false
+	}
+	v.velocity = clamp(float64(velocity)/127.0, 0, 1)
+	v.glide(midiToFreq(note), frames)
+	v.pipes, v.owner, v.sweep = e.pipes, e.allocator.Owner(), e.sweep
+	for oi := 0; oi < v.numOps; oi++ {
+		v.ops[oi].rr = e.opRelease(v.program, oi)
+	}
+	for i, o := range e.inline.Operators {
+		op := &v.ops[operatorSlot(v.numOps, i)]
+		op.rr = o.release(op.rr)
+	}
+	if retrigger || v.released {
+		v.released, v.swept = false, 0
+		for oi := 0; oi < v.numOps; oi++ {
+			v.ops[oi].envState = envAttack
+		}
+		v.pitchMod.Start(e.pitchLFO)
+		v.ampMod.Start(e.ampLFO)
+		v.filterMod.Start(e.filterLFO)
+		v.vcf.Retrigger(e.filterEnv)
+	}
+	return true
+}
+
+func (e *Engine) SetVoicePitch(id int, semitones float64) {
+	if v := e.voiceByID(id); v != nil {
+		v.pitchMul = math.Pow(2, semitones/12.0)
+	}
+}
+
+func (e *Engine) SetVoiceGain(id int, gain float64) {
+	if v := e.voiceByID(id); v != nil {
+		v.gain = math.Max(gain, 0)
+	}
+}
+
+func (e *Engine) SetVoicePan(id int, pan int) {
+	if v := e.voiceByID(id); v != nil {
+		v.setPan(clamp(float64(pan), -64, 64))
+	}
+}
+
+func (e *Engine) SetVoiceFilter(id int, cutoff int) {
+	if v := e.voiceByID(id); v != nil {
+		v.vcf.Hold(float64(cutoff))
+	}
+}
+
+func (e *Engine) RenderFrame() (float32, float32) {
 	var l, r float64
+	gain := e.masterGainValue()
 	for i := range e.voices {
-		v := &e.voices[i]
-		if !v.active {
-			continue
+		if vl, vr, ok := e.stepVoice(&e.voices[i], gain); ok {
+			l += vl
+			r += vr
 		}
-		// Advance all operator envelopes
-		allOff := true
-		for oi := 0; oi < v.numOps; oi++ {
-			advanceOpEnv(&v.ops[oi], e.sampleRate)
-			if v.ops[oi].envState != envOff {
-				allOff = false
-			}
+	}
+	return e.output(l, r)
+}
+
+// RenderBlock renders len(dst)/2 frames into interleaved stereo dst, the
+// same as calling RenderFrame for each. Voices are rendered one at a time
+// over the whole block, except when more than one plays noise, as they share
+// its generator and would draw from it in a different order.
+func (e *Engine) RenderBlock(dst []float32) {
+	n := len(dst) / 2
+	noise := 0
+	for i := range e.voices {
+		if e.voices[i].active && e.voices[i].waveform == 7 {
+			noise++
 		}
-		if allOff {
-			v.active = false
-			continue
+	}
+	if noise > 1 {
+		for f := 0; f < n; f++ {
+			dst[f*2], dst[f*2+1] = e.RenderFrame()
 		}
-		// Compute operator outputs based on algorithm
-		sig := e.renderVoice(v)
-		sig *= e.masterGainValue() * (0.2 + v.velocity*e.params.VelocityAmp)
-		// Apply amp LFO
-		sig *= (1.0 + ampMod)
-		// Pan
-		angle := ((v.pan + 64.0) / 128.0) * (math.Pi / 2.0)
-		l += sig * math.Cos(angle)
-		r += sig * math.Sin(angle)
-		// Portamento
-		if v.portamentoFrames > 0 {
-			v.portamentoFrames--
-			v.freq += v.portamentoStep
-			if v.portamentoFrames <= 0 {
-				v.freq = v.portamentoTarget
+		return
+	}
+	if cap(e.mix) < n*2 {
+		e.mix = make([]float64, n*2)
+	}
+	mix := e.mix[:n*2]
+	clear(mix)
+	gain := e.masterGainValue()
+	for i := range e.voices {
+		v := &e.voices[i]
+		for f := 0; f < n && v.active; f++ {
+			if l, r, ok := e.stepVoice(v, gain); ok {
+				mix[f*2] += l
+				mix[f*2+1] += r
 			}
 		}
-		// Advance phases with pitch LFO modulation
-		freqMul := 1.0
-		if pitchMod != 0 {
-			freqMul = math.Pow(2, pitchMod/12.0)
+	}
+	for f := 0; f < n; f++ {
+		dst[f*2], dst[f*2+1] = e.output(mix[f*2], mix[f*2+1])
+	}
+}
+
+// stepVoice renders one frame of v and advances it. Master gain applies to
+// what reaches the mix, not to pipe output. ok is false when the voice is
+// silent or its output went to a pipe.
+func (e *Engine) stepVoice(v *voice, gain float64) (l, r float64, ok bool) {
+	if !v.active {
+		return 0, 0, false
+	}
+	// Advance all operator envelopes
+	allOff := true
+	for oi := 0; oi < v.numOps; oi++ {
+		advanceOpEnv(&v.ops[oi], e.sampleRate)
+		if v.ops[oi].envState != envOff {
+			allOff = false
 		}
-		for oi := 0; oi < v.numOps; oi++ {
-			op := &v.ops[oi]
-			op.phase += twoPi * (v.freq * freqMul * op.mul) / e.sampleRate
-			if op.phase > twoPi {
-				op.phase -= twoPi
-			}
+	}
+	if allOff {
+		v.active = false
+		return 0, 0, false
+	}
+	// Compute operator outputs based on algorithm, with the input pipe
+	// modulating the carrier
+	pm := v.pipes.Modulation(e.bus)
+	v.ops[0].phase += pm
+	sig := e.renderVoice(v)
+	v.ops[0].phase -= pm
+	sig *= 0.2 + v.velocity*e.params.VelocityAmp
+	// Apply amp LFO
+	sig *= (1.0 + v.ampMod.Sample(e.sampleRate))
+	sig = v.vcf.Process(sig*v.gain, v.filterMod.Sample(e.sampleRate), e.sampleRate)
+	sig = v.pipes.Ring(e.bus, sig)
+	// Pan, unless the output goes to a pipe
+	if !v.pipes.Send(e.bus, sig) {
+		l, r, ok = sig*gain*v.panL, sig*gain*v.panR, true
+	}
+	// Portamento
+	if v.portamentoFrames > 0 {
+		v.portamentoFrames--
+		v.freq += v.portamentoStep
+		if v.portamentoFrames <= 0 {
+			v.freq = v.portamentoTarget
 		}
 	}
-	// Filter LFO: recalculate lpfAlpha if filter LFO is active
-	if e.baseLPFCutoff > 0 && filterMod != 0 {
-		cutoff := e.baseLPFCutoff + filterMod*100.0 // scale to Hz
-		if cutoff < 20 {
-			cutoff = 20
+	// Advance phases with pitch LFO modulation
+	freqMul := v.pitchMul
+	if pitchMod := v.pitchMod.Sample(e.sampleRate); pitchMod != 0 {
+		freqMul *= math.Pow(2, pitchMod/12.0)
+	}
+	if v.released && v.sweep != 0 {
+		v.swept += v.sweep / e.sampleRate
+		freqMul *= math.Pow(2, v.swept/12.0)
+	}
+	for oi := 0; oi < v.numOps; oi++ {
+		op := &v.ops[oi]
+		freq := v.freq * freqMul * op.mul
+		if op.fixed > 0 {
+			freq = op.fixed * op.mul
 		}
-		if cutoff > e.sampleRate/2 {
-			cutoff = e.sampleRate / 2
+		op.phase += twoPi * freq / e.sampleRate
+		if op.phase > twoPi {
+			op.phase -= twoPi
 		}
-		rc := 1.0 / (twoPi * cutoff)
-		dt := 1.0 / e.sampleRate
-		e.lpfAlpha = dt / (rc + dt)
 	}
-	// Output filter
+	return l, r, ok
+}
+
+// output applies the output filter to a mixed frame and clamps it.
+func (e *Engine) output(l, r float64) (float32, float32) {
 	if e.lpfAlpha > 0 {
 		e.lpfL += e.lpfAlpha * (l - e.lpfL)
 		e.lpfR += e.lpfAlpha * (r - e.lpfR)
-		switch e.filterKind {
-		case filterLP:
-			l = e.lpfL
-			r = e.lpfR
-		case filterHP:
-			l = l - e.lpfL
-			r = r - e.lpfR
-		case filterBP:
-			e.bpfL += e.lpfAlpha * (e.lpfL - e.bpfL)
-			e.bpfR += e.lpfAlpha * (e.lpfR - e.bpfR)
-			l = e.lpfL - e.bpfL
-			r = e.lpfR - e.bpfR
-		}
+		l = e.lpfL
+		r = e.lpfR
 	}
 	return float32(clamp(l, -1, 1)), float32(clamp(r, -1, 1))
 }
 
+// setPan sets the voice's pan and its equal-power channel gains.
+func (v *voice) setPan(pan float64) {
+	v.pan = pan
+	angle := ((pan + 64.0) / 128.0) * (math.Pi / 2.0)
+	v.panL, v.panR = math.Cos(angle), math.Sin(angle)
+}
+
+// glide moves the voice to freq over frames, at once when frames is 0.
+func (v *voice) glide(freq float64, frames int) {
+	if frames <= 0 {
+		v.freq, v.portamentoFrames = freq, 0
+		return
+	}
+	v.portamentoTarget, v.portamentoFrames = freq, frames
+	v.portamentoStep = (freq - v.freq) / float64(frames)
+}
+
 // renderVoice computes the FM synthesis output for a voice based on its algorithm.
 // Algorithms define how operators connect (serial modulation vs parallel carriers).
 func (e *Engine) renderVoice(v *voice) float64 {
@@ -461,20 +759,20 @@ func (e *Engine) renderVoice(v *voice) float64 {
 	case n == 1:
 		// Single operator: carrier only
 		fb := ops[0].prevOut * v.fb * math.Pi
-		s := waveformSample(ops[0].phase+fb, v.waveform) * out[0]
+		s := e.waveformSample(ops[0].phase+fb, v.waveform) * out[0]
 		ops[0].prevOut = s
 		return s
 	case n == 2:
 		switch v.alg {
 		case 1: // parallel: op0 + op1 both carriers
-			s0 := waveformSample(ops[0].phase, v.waveform) * out[0]
-			s1 := waveformSample(ops[1].phase, v.waveform) * out[1]
+			s0 := e.waveformSample(ops[0].phase, v.waveform) * out[0]
+			s1 := e.waveformSample(ops[1].phase, v.waveform) * out[1]
 			return (s0 + s1) * (1.0 / math.Sqrt2) // RMS-aware scaling
 		default: // alg 0: serial: op1 → op0
 			fb := ops[1].prevOut * v.fb * math.Pi
 			mod := math.Sin(ops[1].phase+fb) * out[1] * e.params.ModIndex
 			ops[1].prevOut = math.Sin(ops[1].phase+fb) * out[1]
-			return waveformSample(ops[0].phase+mod, v.waveform) * out[0]
+			return e.waveformSample(ops[0].phase+mod, v.waveform) * out[0]
 		}
 	case n == 3:
 		switch v.alg {
@@ -483,20 +781,20 @@ func (e *Engine) renderVoice(v *voice) float64 {
 			s2 := math.Sin(ops[2].phase+fb) * out[2] * e.params.ModIndex
 			ops[2].prevOut = math.Sin(ops[2].phase+fb) * out[2]
 			s1 := math.Sin(ops[1].phase+s2) * out[1] * e.params.ModIndex
-			return waveformSample(ops[0].phase+s1, v.waveform) * out[0]
+			return e.waveformSample(ops[0].phase+s1, v.waveform) * out[0]
 		case 2: // (op1+op2)→op0
 			s1 := math.Sin(ops[1].phase) * out[1] * e.params.ModIndex
 			s2 := math.Sin(ops[2].phase) * out[2] * e.params.ModIndex
-			return waveformSample(ops[0].phase+s1+s2, v.waveform) * out[0]
+			return e.waveformSample(ops[0].phase+s1+s2, v.waveform) * out[0]
 		case 3: // all parallel
-			s0 := waveformSample(ops[0].phase, v.waveform) * out[0]
-			s1 := waveformSample(ops[1].phase, v.waveform) * out[1]
-			s2 := waveformSample(ops[2].phase, v.waveform) * out[2]
+			s0 := e.waveformSample(ops[0].phase, v.waveform) * out[0]
+			s1 := e.waveformSample(ops[1].phase, v.waveform) * out[1]
+			s2 := e.waveformSample(ops[2].phase, v.waveform) * out[2]
 			return (s0 + s1 + s2) * (1.0 / math.Sqrt(3)) // RMS-aware scaling
 		default: // alg 0: op2→op1, op1→op0
 			s2 := math.Sin(ops[2].phase) * out[2] * e.params.ModIndex
 			s1 := math.Sin(ops[1].phase+s2) * out[1] * e.params.ModIndex
-			return waveformSample(ops[0].phase+s1, v.waveform) * out[0]
+			return e.waveformSample(ops[0].phase+s1, v.waveform) * out[0]
 		}
 	default: // n == 4
 		switch v.alg {
@@ -504,28 +802,28 @@ func (e *Engine) renderVoice(v *voice) float64 {
 			s3 := math.Sin(ops[3].phase) * out[3] * e.params.ModIndex
 			s2 := math.Sin(ops[2].phase+s3) * out[2] * e.params.ModIndex
 			s1 := math.Sin(ops[1].phase+s2) * out[1] * e.params.ModIndex
-			return waveformSample(ops[0].phase+s1, v.waveform) * out[0]
+			return e.waveformSample(ops[0].phase+s1, v.waveform) * out[0]
 		case 2: // (op2+op3)→op1→op0
 			s2 := math.Sin(ops[2].phase) * out[2] * e.params.ModIndex
 			s3 := math.Sin(ops[3].phase) * out[3] * e.params.ModIndex
 			s1 := math.Sin(ops[1].phase+s2+s3) * out[1] * e.params.ModIndex
-			return waveformSample(ops[0].phase+s1, v.waveform) * out[0]
+			return e.waveformSample(ops[0].phase+s1, v.waveform) * out[0]
 		case 3: // op2→op1, op3→op0 (two pairs)
 			s2 := math.Sin(ops[2].phase) * out[2] * e.params.ModIndex
 			s3 := math.Sin(ops[3].phase) * out[3] * e.params.ModIndex
-			c0 := waveformSample(ops[0].phase+s3, v.waveform) * out[0]
-			c1 := waveformSample(ops[1].phase+s2, v.waveform) * out[1]
+			c0 := e.waveformSample(ops[0].phase+s3, v.waveform) * out[0]
+			c1 := e.waveformSample(ops[1].phase+s2, v.waveform) * out[1]
 			return (c0 + c1) * (1.0 / math.Sqrt2) // RMS-aware scaling
 		case 4: // op3→op2→op1, op0 carrier
 			s3 := math.Sin(ops[3].phase) * out[3] * e.params.ModIndex
 			s2 := math.Sin(ops[2].phase+s3) * out[2] * e.params.ModIndex
 			s1 := math.Sin(ops[1].phase+s2) * out[1]
-			s0 := waveformSample(ops[0].phase, v.waveform) * out[0]
+			s0 := e.waveformSample(ops[0].phase, v.waveform) * out[0]
 			return (s0 + s1) * (1.0 / math.Sqrt2) // RMS-aware scaling
 		case 5: // all parallel
 			s := 0.0
 			for oi := 0; oi < 4; oi++ {
-				s += waveformSample(ops[oi].phase, v.waveform) * out[oi]
+				s += e.waveformSample(ops[oi].phase, v.waveform) * out[oi]
 			}
 			return s * 0.5 // 1/sqrt(4), RMS-aware scaling
 		default: // alg 0: op3→op2, op2→op1, op1→op0 (cascade)
@@ -534,11 +832,32 @@ func (e *Engine) renderVoice(v *voice) float64 {
 			ops[3].prevOut = math.Sin(ops[3].phase+fb) * out[3]
 			s2 := math.Sin(ops[2].phase+s3) * out[2] * e.params.ModIndex
 			s1 := math.Sin(ops[1].phase+s2) * out[1] * e.params.ModIndex
-			return waveformSample(ops[0].phase+s1, v.waveform) * out[0]
+			return e.waveformSample(ops[0].phase+s1, v.waveform) * out[0]
 		}
 	}
 }
 
+// allocVoice describes voice i to the allocator.
+func (e *Engine) allocVoice(i int) alloc.Voice {
+	v := &e.voices[i]
+	return alloc.Voice{Active: v.active, Released: v.released, Start: v.id, Level: v.ops[0].env, Owner: v.owner}
+}
+
+// SetVoicePolicy sets which voice a note steals when all are sounding.
+func (e *Engine) SetVoicePolicy(p alloc.Policy) {
+	e.allocator.SetPolicy(p)
+}
+
+// SetVoiceOwner sets the track the next NoteOn plays for.
+func (e *Engine) SetVoiceOwner(o alloc.Owner) {
+	e.allocator.SetOwner(o)
+}
+
+// VoiceStats returns how many voices notes have stolen.
+func (e *Engine) VoiceStats() alloc.Stats {
+	return e.allocator.Stats()
+}
+
 func (e *Engine) stealVoice() int {
 	for i := range e.voices {
 		if !e.voices[i].active {
@@ -568,8 +887,15 @@ func advanceOpEnv(op *operator, sampleRate float64) {
 		if op.env >= 1 {
 			op.env = 1
 			op.envState = envDecay
+			if op.ssg&ssgAttack != 0 {
+				op.env, op.ssgUp = 0, true
+			}
 		}
 	case envDecay:
+		if op.ssg != 0 {
+			advanceSSG(op, sampleRate)
+			return
+		}
 		step := (1 - op.sl) / (op.dr * sampleRate)
 		if step <= 0 {
 			step = 1
@@ -595,9 +921,42 @@ func advanceOpEnv(op *operator, sampleRate float64) {
 	}
 }
 
-var noiseLFSR uint32 = 0x7FFF
+// advanceSSG runs one sample of an SSG-EG cycle: the level sweeps between
+// full and silent at the decay rate, then repeats, reverses or holds as the
+// mode bits say.
+func advanceSSG(op *operator, sampleRate float64) {
+	step := 1.0 / (op.dr * sampleRate)
+	if step <= 0 {
+		step = 1
+	}
+	if op.ssgUp {
+		op.env += step
+	} else {
+		op.env -= step
+	}
+	if op.env > 0 && op.env < 1 {
+		return
+	}
+	end := 0.0
+	if op.ssgUp {
+		end = 1
+	}
+	switch {
+	case op.ssg&ssgHold != 0:
+		if op.ssg&ssgAlternate != 0 {
+			end = 1 - end
+		}
+		op.env = end
+		op.envState = envSustain
+	case op.ssg&ssgAlternate != 0:
+		op.env = end
+		op.ssgUp = !op.ssgUp
+	default:
+		op.env = 1 - end
+	}
+}
 
-func waveformSample(phase float64, waveform int) float64 {
+func (e *Engine) waveformSample(phase float64, waveform int) float64 {
 	switch waveform {
 	case 1: // saw
 		return 1.0 - 2.0*math.Mod(phase, twoPi)/twoPi
@@ -625,8 +984,8 @@ func waveformSample(phase float64, waveform int) float64 {
 		}
 		return 0
 	case 7: // noise
-		noiseLFSR = (noiseLFSR >> 1) ^ (-(noiseLFSR & 1) & 0xB400)
-		return float64(noiseLFSR)/float64(0x7FFF)*2.0 - 1.0
+		e.noise = (e.noise >> 1) ^ (-(e.noise & 1) & 0xB400)
+		return float64(e.noise)/float64(0x7FFF)*2.0 - 1.0
 	default: // 0 = sine
 		return math.Sin(phase)
 	}
@@ -677,15 +1036,25 @@ func (e *Engine) masterGainValue() float64 {
 	return math.Float64frombits(atomic.LoadUint64(&e.masterGain))
 }
 
-func (e *Engine) SetFilterType(ft int) {
-	switch ft {
-	case 1:
-		e.filterKind = filterBP
-	case 2:
-		e.filterKind = filterHP
-	default:
-		e.filterKind = filterLP
-	}
+// SetFilter sets the @f envelope and %f mode for subsequent NoteOns.
+func (e *Engine) SetFilter(env filter.Envelope) {
+	e.filterEnv = env
+}
+
+// SetBus sets the bus the @o/@i/@r pipes read and write.
+func (e *Engine) SetBus(b *pipe.Bus) {
+	e.bus = b
+}
+
+// SetPipes sets the bus pipe routing for subsequent NoteOns.
+func (e *Engine) SetPipes(r pipe.Route) {
+	e.pipes = r
+}
+
+// SetRelease sets the release time in seconds for subsequent NoteOns, 0 for
+// each operator's own, and the pitch sweep after key-off in semitones per second.
+func (e *Engine) SetRelease(seconds, sweep float64) {
+	e.releaseSec, e.sweep = seconds, sweep
 }
 
 func (e *Engine) SetNoteOnPhase(phase int) {
@@ -697,16 +1066,16 @@ func (e *Engine) SetPortamento(fromNote int, frames int) {
 	e.portamentoFrames = frames
 }
 
-func (e *Engine) SetPitchLFO(depth float64, rateHz float64, waveform int) {
-	e.pitchLFO.Set(depth, rateHz, waveform)
+func (e *Engine) SetPitchLFO(shape lfo.Shape) {
+	e.pitchLFO = shape
 }
 
-func (e *Engine) SetAmpLFO(depth float64, rateHz float64, waveform int) {
-	e.ampLFO.Set(depth, rateHz, waveform)
+func (e *Engine) SetAmpLFO(shape lfo.Shape) {
+	e.ampLFO = shape
 }
 
-func (e *Engine) SetFilterLFO(depth float64, rateHz float64, waveform int) {
-	e.filterLFO.Set(depth, rateHz, waveform)
+func (e *Engine) SetFilterLFO(shape lfo.Shape) {
+	e.filterLFO = shape
 }
 
 func decodeProgram(encoded int) (program int, module int, channel int) {
@@ -3,6 +3,9 @@ package fm
 import (
 	"math"
 	"testing"
+
+	"github.com/cbegin/mmlfm-go/internal/filter"
+	"github.com/cbegin/mmlfm-go/internal/pipe"
 )
 
 func TestEngineGeneratesSignal(t *testing.T) {
@@ -107,7 +110,7 @@ func TestWaveformTypes(t *testing.T) {
 func TestFilterTypes(t *testing.T) {
 	for _, ft := range []int{0, 1, 2} {
 		e := New(48000, DefaultParams())
-		e.SetFilterType(ft)
+		e.SetFilter(filter.Static(ft, 64, 0))
 		e.NoteOn(60, 100, 0, 0)
 		var maxAbs float64
 		for i := 0; i < 2000; i++ {
@@ -147,3 +150,203 @@ func TestFeedbackProducesDifferentOutput(t *testing.T) {
 		t.Error("feedback should change the output")
 	}
 }
+
+func TestVoiceGainSilencesAndVoiceEnds(t *testing.T) {
+	e := New(48000, DefaultParams())
+	id := e.NoteOn(60, 127, 0, 0)
+	e.SetVoiceGain(id, 0)
+	for i := 0; i < 2048; i++ {
+		if l, r := e.RenderFrame(); l != 0 || r != 0 {
+			t.Fatalf("expected silence at gain 0, got %f,%f at frame %d", l, r, i)
+		}
+	}
+	if !e.VoiceActive(id) {
+		t.Fatalf("expected voice to be active while held")
+	}
+	e.NoteOff(id)
+	for i := 0; i < 48000*4 && e.VoiceActive(id); i++ {
+		e.RenderFrame()
+	}
+	if e.VoiceActive(id) {
+		t.Fatalf("expected voice to end after release")
+	}
+}
+
+func TestInlineVoiceOverridesPatchAndIsLatchedAtNoteOn(t *testing.T) {
+	patch := make([]int, 2+4*11)
+	patch[0], patch[1] = 4, 0
+	e := New(48000, DefaultParams())
+	e.LoadOPMPatch(1, patch)
+	v := NoInline
+	v.Algorithm, v.Feedback = 7, 7
+	e.SetInline(v)
+	inline := e.NoteOn(60, 100, 0, 1)
+	e.SetInline(NoInline)
+	plain := e.NoteOn(64, 100, 0, 1)
+	for _, tc := range []struct {
+		name   string
+		id     int
+		alg    int
+		fb     float64
+		numOps int
+	}{
+		{"inline", inline, 7, 1, 4},
+		{"patch", plain, 4, 0, 4},
+	} {
+		v := e.voiceByID(tc.id)
+		if v == nil {
+			t.Fatalf("%s voice is not sounding", tc.name)
+		}
+		if v.alg != tc.alg || v.fb != tc.fb || v.numOps != tc.numOps {
+			t.Fatalf("%s voice: expected alg %d fb %v ops %d, got alg %d fb %v ops %d", tc.name, tc.alg, tc.fb, tc.numOps, v.alg, v.fb, v.numOps)
+		}
+	}
+}
+
+func TestFixedNoteOperatorsIgnoreTheNotePlayed(t *testing.T) {
+	render := func(note int) []float32 {
+		e := New(48000, DefaultParams())
+		v := NoInline
+		for oi := range v.Operators {
+			v.Operators[oi].FX = 69
+		}
+		e.SetInline(v)
+		e.NoteOn(note, 100, 0, 0)
+		out := make([]float32, 2000)
+		for i := range out {
+			out[i], _ = e.RenderFrame()
+		}
+		return out
+	}
+	low, high := render(48), render(72)
+	for i := range low {
+		if low[i] != high[i] {
+			t.Fatalf("fixed operators should sound the same for any note; sample %d differs", i)
+		}
+	}
+}
+
+func TestInlineOperatorsCountFromTheFirstModulator(t *testing.T) {
+	e := New(48000, DefaultParams())
+	v := NoInline
+	v.Ops = 3
+	v.Operators[0].TL = 127
+	v.Operators[3].TL = 64
+	e.SetInline(v)
+	voice := e.voiceByID(e.NoteOn(60, 100, 0, 0))
+	if voice.ops[2].tl != 0 {
+		t.Fatalf("expected i0 to silence the first modulator, got tl %f", voice.ops[2].tl)
+	}
+	if want := 63.0 / 127.0; voice.ops[0].tl != want {
+		t.Fatalf("expected an index past the last operator to set the carrier to %f, got %f", want, voice.ops[0].tl)
+	}
+	if voice.ops[1].tl == 0 {
+		t.Fatal("expected the second modulator to keep its level")
+	}
+}
+
+func TestSSGModesRepeatAlternateAndHold(t *testing.T) {
+	// levels returns the first operator's level every 1000 frames over
+	// several decay sweeps.
+	levels := func(mode int) []float64 {
+		e := New(48000, DefaultParams())
+		v := NoInline
+		v.Operators[1].SE = mode // the carrier of the default two operators
+		e.SetInline(v)
+		voice := e.voiceByID(e.NoteOn(60, 100, 0, 0))
+		var out []float64
+		for i := 1; i <= 30000; i++ {
+			e.RenderFrame()
+			if i%1000 == 0 {
+				out = append(out, voice.ops[0].env)
+			}
+		}
+		return out
+	}
+	rises := func(env []float64) int {
+		n := 0
+		for i := 1; i < len(env); i++ {
+			if env[i] > env[i-1] {
+				n++
+			}
+		}
+		return n
+	}
+	if repeat := levels(8); rises(repeat) == 0 || repeat[len(repeat)-1] == 0 {
+		t.Fatalf("mode 8 should restart each sweep, got %v", repeat)
+	}
+	if alt := levels(10); rises(alt) < 4 {
+		t.Fatalf("mode 10 should rise back up between sweeps, got %v", alt)
+	}
+	if hold := levels(9); hold[len(hold)-1] != 0 {
+		t.Fatalf("mode 9 should hold silent, got %v", hold)
+	}
+	if hold := levels(11); hold[len(hold)-1] != 1 {
+		t.Fatalf("mode 11 should hold full, got %v", hold)
+	}
+	if plain := levels(0); rises(plain) != 0 {
+		t.Fatalf("without SSG-EG the level should only fall, got %v", plain)
+	}
+}
+
+func TestContinueEnvelopeAttacksFromThePreviousLevel(t *testing.T) {
+	e := New(48000, DefaultParams())
+	first := e.NoteOn(60, 100, 0, 0)
+	for i := 0; i < 48000; i++ {
+		e.RenderFrame()
+	}
+	level := e.voiceByID(first).ops[0].env
+	e.NoteOff(first)
+	e.ContinueEnvelope(first)
+	cont := e.voiceByID(e.NoteOn(62, 100, 0, 0))
+	if cont.ops[0].env != level {
+		t.Fatalf("expected the next note to start from %f, got %f", level, cont.ops[0].env)
+	}
+	reset := e.voiceByID(e.NoteOn(64, 100, 0, 0))
+	if reset.ops[0].env != 0 {
+		t.Fatalf("continuation should only apply to one note, got %f", reset.ops[0].env)
+	}
+}
+
+func TestPipesCarryOneVoiceIntoAnother(t *testing.T) {
+	render := func(modulate bool) (mix []float32, bus *pipe.Bus) {
+		e := New(48000, DefaultParams())
+		bus = pipe.NewBus(1)
+		e.SetBus(bus)
+		e.SetPipes(pipe.Route{Output: pipe.Overwrite, OutPipe: 1})
+		e.NoteOn(48, 100, 0, 0)
+		if modulate {
+			e.SetPipes(pipe.Route{InputLevel: 7, InPipe: 1})
+		} else {
+			e.SetPipes(pipe.Route{})
+		}
+		e.NoteOn(60, 100, 0, 0)
+		mix = make([]float32, 2000)
+		for i := range mix {
+			mix[i], _ = e.RenderFrame()
+			bus.Advance()
+		}
+		return mix, bus
+	}
+	plain, bus := render(false)
+	if bus.Read(1) == 0 {
+		t.Fatalf("expected the first voice to write its pipe")
+	}
+	modulated, _ := render(true)
+	same := true
+	for i := range plain {
+		same = same && plain[i] == modulated[i]
+	}
+	if same {
+		t.Fatalf("expected the pipe input to modulate the second voice")
+	}
+	e := New(48000, DefaultParams())
+	e.SetBus(pipe.NewBus(1))
+	e.SetPipes(pipe.Route{Output: pipe.Add})
+	e.NoteOn(60, 100, 0, 0)
+	for i := 0; i < 500; i++ {
+		if l, r := e.RenderFrame(); l != 0 || r != 0 {
+			t.Fatalf("a voice playing into a pipe should be out of the mix")
+		}
+	}
+}
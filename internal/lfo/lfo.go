@@ -11,7 +11,7 @@ const (
 )
 
 // LFO is a low-frequency oscillator that produces per-sample modulation.
-// It is designed to be shared across all voices in an engine (global LFO).
+// It is the oscillator inside a Mod, which each voice owns.
 type LFO struct {
 	depth    float64 // modulation depth (units depend on context: semitones, gain factor, cutoff)
 	rateHz   float64 // oscillation rate in Hz
@@ -86,3 +86,60 @@ func (l *LFO) Reset() {
 	l.phase = 0
 	l.randVal = 0
 }
+
+// Shape describes an MML mp/ma/mf modulation: the LFO swings by Depth from
+// key-on, holds it for Delay seconds, then moves to EndDepth over Change
+// seconds.
+type Shape struct {
+	Depth    float64
+	EndDepth float64
+	RateHz   float64
+	Waveform int
+	Delay    float64 // seconds
+	Change   float64 // seconds
+}
+
+// Active reports whether the shape modulates at all.
+func (s Shape) Active() bool {
+	return s.RateHz != 0 && (s.Depth != 0 || s.EndDepth != 0)
+}
+
+// depthAt returns the depth t seconds after key-on.
+func (s Shape) depthAt(t float64) float64 {
+	switch {
+	case t < s.Delay:
+		return s.Depth
+	case t < s.Delay+s.Change:
+		return s.Depth + (s.EndDepth-s.Depth)*(t-s.Delay)/s.Change
+	}
+	return s.EndDepth
+}
+
+// Mod runs a Shape for one note. Each voice owns its own Mod, so notes keep
+// the modulation they started with and their own phase.
+type Mod struct {
+	osc     LFO
+	shape   Shape
+	samples int // since key-on
+}
+
+// Start restarts the modulation from key-on with the given shape.
+func (m *Mod) Start(shape Shape) {
+	*m = Mod{shape: shape}
+	m.osc.Set(1, shape.RateHz, shape.Waveform)
+}
+
+// Active reports whether the note is modulated.
+func (m *Mod) Active() bool {
+	return m.shape.Active()
+}
+
+// Sample advances the modulation by one sample and returns its value.
+func (m *Mod) Sample(sampleRate float64) float64 {
+	if !m.shape.Active() || sampleRate == 0 {
+		return 0
+	}
+	depth := m.shape.depthAt(float64(m.samples) / sampleRate)
+	m.samples++
+	return m.osc.Sample(sampleRate) * depth
+}
@@ -118,3 +118,41 @@ func TestLFORandomProducesValues(t *testing.T) {
 		t.Log("warning: all random samples were zero (possible but unlikely)")
 	}
 }
+
+func TestModHoldsDelayThenChangesDepth(t *testing.T) {
+	// Square wave at 1 Hz: +depth for the first half of each cycle.
+	var m Mod
+	m.Start(Shape{Depth: 1, EndDepth: 3, RateHz: 1, Waveform: WaveSquare, Delay: 0.1, Change: 0.2})
+	sr := 100.0
+	got := make([]float64, 40)
+	for i := range got {
+		got[i] = m.Sample(sr)
+	}
+	if got[0] != 1 || got[9] != 1 {
+		t.Errorf("expected depth 1 during the delay, got %f and %f", got[0], got[9])
+	}
+	if math.Abs(got[20]-2) > 1e-9 {
+		t.Errorf("expected depth 2 halfway through the change, got %f", got[20])
+	}
+	if got[30] != 3 || got[39] != 3 {
+		t.Errorf("expected end depth 3 after the change, got %f and %f", got[30], got[39])
+	}
+}
+
+func TestModRestartsAtKeyOn(t *testing.T) {
+	var m Mod
+	shape := Shape{Depth: 1, RateHz: 5, Waveform: WaveTriangle}
+	m.Start(shape)
+	first := m.Sample(1000)
+	for i := 0; i < 77; i++ {
+		m.Sample(1000)
+	}
+	m.Start(shape)
+	if got := m.Sample(1000); got != first {
+		t.Errorf("expected restarted phase to match key-on value %f, got %f", first, got)
+	}
+	m.Start(Shape{})
+	if m.Active() || m.Sample(1000) != 0 {
+		t.Error("zero shape should not modulate")
+	}
+}
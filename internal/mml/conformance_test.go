@@ -79,6 +79,23 @@ o5 l8 c&d&&e po12 *3 na1 np2 nt3 nf4 @@5;`)
 	}
 }
 
+func TestConformance_OperatorSelectIsAControlEvent(t *testing.T) {
+	p := NewParser(DefaultParserConfig())
+	score, err := p.Parse("%6 @al4 i2 @tl20 i c")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	var selects []int
+	for _, ev := range score.Tracks[0].Events {
+		if ev.Type == EventControl && ev.Command == "i" {
+			selects = append(selects, ev.Value)
+		}
+	}
+	if len(selects) != 2 || selects[0] != 2 || selects[1] != 0 {
+		t.Fatalf("expected operator selects [2 0], got %v", selects)
+	}
+}
+
 func TestConformance_PercentVScaleMax256Shift(t *testing.T) {
 	p := NewParser(DefaultParserConfig())
 	score, err := p.Parse("%v0,4 o5 c")
@@ -0,0 +1,166 @@
+package mml
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Helpers shared by the front-ends that translate other MML dialects (ppmck,
+// mxdrv) into SiON-style text for Parser.Parse.
+
+// ignoredWordAt reports which of words, if any, starts at body[at:].
+func ignoredWordAt(words []string, body string, at int) (string, bool) {
+	for _, word := range words {
+		if strings.HasPrefix(body[at:], word) {
+			return word, true
+		}
+	}
+	return "", false
+}
+
+func skipDialectArgs(body string, at int) int {
+	for at < len(body) && (isDigit(body[at]) || body[at] == ',' || body[at] == '-' || body[at] == '+' || body[at] == ' ' || body[at] == '\t') {
+		at++
+	}
+	return at
+}
+
+func copyDialectLength(out *strings.Builder, body string, at int) int {
+	start := at
+	for at < len(body) && (isDigit(body[at]) || body[at] == '.') {
+		at++
+	}
+	out.WriteString(body[start:at])
+	return at
+}
+
+func dialectNumber(body string, at int) (string, int) {
+	for at < len(body) && isSpace(body[at]) {
+		at++
+	}
+	start := at
+	for at < len(body) && isDigit(body[at]) {
+		at++
+	}
+	return body[start:at], at
+}
+
+func dialectSignedNumber(body string, at int) (string, int) {
+	for at < len(body) && isSpace(body[at]) {
+		at++
+	}
+	if at < len(body) && (body[at] == '-' || body[at] == '+') {
+		n, next := dialectNumber(body, at+1)
+		return body[at:at+1] + n, next
+	}
+	return dialectNumber(body, at)
+}
+
+// stripDialectComments removes /* */ block comments, and line comments
+// starting with lineComment when it is not empty, while keeping newlines so
+// line numbers stay valid.
+func stripDialectComments(src string, lineComment string) string {
+	var out strings.Builder
+	out.Grow(len(src))
+	inQuote := false
+	for i := 0; i < len(src); i++ {
+		ch := src[i]
+		switch {
+		case ch == '"':
+			inQuote = !inQuote
+		case ch == '\n':
+			inQuote = false
+		case inQuote:
+		case lineComment != "" && strings.HasPrefix(src[i:], lineComment):
+			i = lineEnd(src, i) - 1
+			continue
+		case ch == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				end = len(src) - i - 2
+			}
+			out.WriteString(strings.Repeat("\n", strings.Count(src[i:i+2+end], "\n")))
+			i += end + 3
+			continue
+		}
+		out.WriteByte(ch)
+	}
+	return out.String()
+}
+
+func lineEnd(src string, at int) int {
+	if end := strings.IndexByte(src[at:], '\n'); end >= 0 {
+		return at + end
+	}
+	return len(src)
+}
+
+func dialectError(file string, line int, format string, args ...any) error {
+	if file == "" {
+		return fmt.Errorf("line %d: "+format, append([]any{line}, args...)...)
+	}
+	return fmt.Errorf("%s:%d: "+format, append([]any{file, line}, args...)...)
+}
+
+// dialectLoops rewrites [pre|post]n loops, which in ppmck and mxdrv leave the
+// last pass at the break, into [pre post]n-1 pre, since Parser.Parse plays
+// the part after a break only once.
+func dialectLoops(src string) string {
+	var out strings.Builder
+	for at := 0; at < len(src); {
+		if src[at] == '[' {
+			loop, next := dialectLoop(src, at+1)
+			out.WriteString(loop)
+			at = next
+			continue
+		}
+		out.WriteByte(src[at])
+		at++
+	}
+	return out.String()
+}
+
+// dialectLoop rewrites the loop whose body starts at at, returning the
+// replacement text and the offset after its repeat count.
+func dialectLoop(src string, at int) (string, int) {
+	var pre, post strings.Builder
+	cur := &pre
+	breakHit := false
+	for at < len(src) {
+		ch := src[at]
+		switch {
+		case ch == '[':
+			loop, next := dialectLoop(src, at+1)
+			cur.WriteString(loop)
+			at = next
+			continue
+		case ch == '|' && !breakHit:
+			breakHit = true
+			cur = &post
+			at++
+			continue
+		case ch == ']':
+			n, next := dialectNumber(src, at+1)
+			repeat, err := strconv.Atoi(n)
+			if err != nil {
+				repeat = 2
+			}
+			if !breakHit {
+				return "[" + pre.String() + "]" + n, next
+			}
+			if repeat <= 1 {
+				return pre.String(), next
+			}
+			return "[" + pre.String() + " " + post.String() + "]" + strconv.Itoa(repeat-1) + " " + pre.String(), next
+		}
+		cur.WriteByte(ch)
+		at++
+	}
+	// Unclosed: leave it for the parser to report.
+	text := "[" + pre.String()
+	if breakHit {
+		text += "|" + post.String()
+	}
+	return text, at
+}
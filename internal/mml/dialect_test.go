@@ -0,0 +1,19 @@
+package mml
+
+import "testing"
+
+func TestDialectLoopsLeaveLastPassAtBreak(t *testing.T) {
+	cases := map[string]string{
+		"[c|d]3 e":     "[c d]2 c e",
+		"[c|d]1":       "c",
+		"[cd]4":        "[cd]4",
+		"[c[e|f]2|d]2": "[c[e f]1 e d]1 c[e f]1 e",
+		"[c|d":         "[c|d",
+		"o4 l8 [a]":    "o4 l8 [a]",
+	}
+	for src, want := range cases {
+		if got := dialectLoops(src); got != want {
+			t.Fatalf("%q: expected %q, got %q", src, want, got)
+		}
+	}
+}
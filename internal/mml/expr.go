@@ -0,0 +1,346 @@
+package mml
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ExprError reports a #VAR or {expression} that could not be evaluated.
+type ExprError struct {
+	Offset       int // input offset of the offending part of the expression
+	Line, Column int // 1-based position of Offset
+	Expr         string
+	Msg          string
+}
+
+func (e *ExprError) Error() string {
+	return fmt.Sprintf("line %d, column %d: {%s}: %s", e.Line, e.Column, e.Expr, e.Msg)
+}
+
+// ResolveExpressions returns input with the #VAR directives removed and every
+// {expression} replaced by its value, which is plain MML for players that do
+// not support variables. Comments and everything else are kept as written.
+func ResolveExpressions(input string) (string, error) {
+	out, _, err := resolveExpressions(input)
+	return out, err
+}
+
+// stripSource resolves expressions and removes comments from input, returning
+// the text the preprocessor reads and the input offset of each of its bytes.
+func stripSource(input string) (string, []int, error) {
+	resolved, resolvedAt, err := resolveExpressions(input)
+	if err != nil {
+		return "", nil, err
+	}
+	var kept []int
+	text := stripCommentsTracked(resolved, &kept)
+	for i, pos := range kept {
+		kept[i] = resolvedAt[pos]
+	}
+	return text, kept, nil
+}
+
+// resolveExpressions evaluates variables in source order: a #VAR NAME=expr;
+// directive sets NAME for the text after it, and {expr} in track text or in a
+// macro definition is replaced by its decimal value. Other directives and
+// everything after #END are copied unchanged. origins holds the input offset
+// of each output byte; a value maps to its opening brace.
+func resolveExpressions(input string) (string, []int, error) {
+	r := exprResolver{input: input, vars: make(map[string]int)}
+	r.out.Grow(len(input))
+	r.origins = make([]int, 0, len(input))
+	for i := 0; i < len(input); {
+		if end, ok := commentEnd(input, i); ok {
+			r.copy(i, end)
+			i = end
+			continue
+		}
+		switch input[i] {
+		case '#':
+			end := directiveEnd(input, i)
+			body := strings.TrimSpace(stripComments(strings.TrimSuffix(input[i+1:end], ";")))
+			switch {
+			case isVarDirective(body):
+				if err := r.assign(i, end); err != nil {
+					return "", nil, err
+				}
+			case strings.EqualFold(body, "END"):
+				r.copy(i, len(input))
+				return r.out.String(), r.origins, nil
+			case isMacroDefinition(body) && !strings.Contains(body[:strings.IndexByte(body, '=')], "{"):
+				if err := r.substitute(i, end); err != nil {
+					return "", nil, err
+				}
+			default:
+				r.copy(i, end)
+			}
+			i = end
+		case '{':
+			next, err := r.value(i)
+			if err != nil {
+				return "", nil, err
+			}
+			i = next
+		default:
+			r.copy(i, i+1)
+			i++
+		}
+	}
+	return r.out.String(), r.origins, nil
+}
+
+type exprResolver struct {
+	input   string
+	vars    map[string]int
+	out     strings.Builder
+	origins []int
+}
+
+func (r *exprResolver) copy(from, to int) {
+	r.out.WriteString(r.input[from:to])
+	for i := from; i < to; i++ {
+		r.origins = append(r.origins, i)
+	}
+}
+
+// substitute copies input[from:to], replacing the expressions outside
+// comments.
+func (r *exprResolver) substitute(from, to int) error {
+	for i := from; i < to; {
+		if end, ok := commentEnd(r.input, i); ok {
+			r.copy(i, min(end, to))
+			i = end
+			continue
+		}
+		if r.input[i] == '{' {
+			next, err := r.value(i)
+			if err != nil {
+				return err
+			}
+			i = next
+			continue
+		}
+		r.copy(i, i+1)
+		i++
+	}
+	return nil
+}
+
+// value writes the value of the {expression} at input[at] and returns the
+// offset after its closing brace.
+func (r *exprResolver) value(at int) (int, error) {
+	end := at + 1
+	for end < len(r.input) && r.input[end] != '}' && r.input[end] != ';' && r.input[end] != '\n' {
+		end++
+	}
+	if end >= len(r.input) || r.input[end] != '}' {
+		return 0, r.fail(at, r.input[at+1:end], "unclosed '{'")
+	}
+	v, err := r.eval(at+1, end)
+	if err != nil {
+		return 0, err
+	}
+	text := strconv.Itoa(v)
+	r.out.WriteString(text)
+	for range text {
+		r.origins = append(r.origins, at)
+	}
+	return end + 1, nil
+}
+
+// assign applies the #VAR directive in input[from:to].
+func (r *exprResolver) assign(from, to int) error {
+	i := from + 1
+	for isSpace(r.input[i]) {
+		i++
+	}
+	i += len("VAR")
+	for i < to && isSpace(r.input[i]) {
+		i++
+	}
+	nameStart := i
+	for i < to && isExprNameByte(r.input[i], i == nameStart) {
+		i++
+	}
+	name := r.input[nameStart:i]
+	for i < to && isSpace(r.input[i]) {
+		i++
+	}
+	stmtEnd := to
+	if r.input[to-1] == ';' {
+		stmtEnd--
+	}
+	if name == "" || i >= stmtEnd || r.input[i] != '=' {
+		return r.fail(nameStart, strings.TrimSpace(r.input[from+1:stmtEnd]), "#VAR expects NAME=value")
+	}
+	v, err := r.eval(i+1, stmtEnd)
+	if err != nil {
+		return err
+	}
+	r.vars[name] = v
+	return nil
+}
+
+// eval evaluates input[from:to].
+func (r *exprResolver) eval(from, to int) (int, error) {
+	p := exprParser{src: r.input[:to], pos: from, vars: r.vars}
+	v, err := p.expr()
+	if err == nil {
+		p.skipSpace()
+		if p.pos < to {
+			err = p.errorf("unexpected %q", r.input[p.pos:p.pos+1])
+		}
+	}
+	if err != nil {
+		e := err.(exprFault)
+		return 0, r.fail(e.at, strings.TrimSpace(r.input[from:to]), e.msg)
+	}
+	return v, nil
+}
+
+func (r *exprResolver) fail(at int, expr, msg string) *ExprError {
+	line := strings.Count(r.input[:at], "\n") + 1
+	col := at - strings.LastIndexByte(r.input[:at], '\n')
+	return &ExprError{Offset: at, Line: line, Column: col, Expr: expr, Msg: msg}
+}
+
+func isVarDirective(body string) bool {
+	return len(body) > 3 && strings.EqualFold(body[:3], "VAR") && isSpace(body[3])
+}
+
+func isExprNameByte(b byte, first bool) bool {
+	return isAlpha(b) || b == '_' || (!first && isDigit(b))
+}
+
+// exprParser evaluates integer arithmetic with + - * / %, unary signs,
+// parentheses, decimal numbers and variable names.
+type exprParser struct {
+	src  string
+	pos  int
+	vars map[string]int
+}
+
+// exprFault is an evaluation error at an input offset.
+type exprFault struct {
+	at  int
+	msg string
+}
+
+func (e exprFault) Error() string { return e.msg }
+
+func (p *exprParser) errorf(format string, args ...any) error {
+	return exprFault{at: p.pos, msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && isSpace(p.src[p.pos]) {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+func (p *exprParser) expr() (int, error) {
+	v, err := p.term()
+	for err == nil {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			break
+		}
+		p.pos++
+		var rhs int
+		if rhs, err = p.term(); op == '+' {
+			v += rhs
+		} else {
+			v -= rhs
+		}
+	}
+	return v, err
+}
+
+func (p *exprParser) term() (int, error) {
+	v, err := p.unary()
+	for err == nil {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			break
+		}
+		at := p.pos
+		p.pos++
+		var rhs int
+		if rhs, err = p.unary(); err != nil {
+			break
+		}
+		switch {
+		case op == '*':
+			v *= rhs
+		case rhs == 0:
+			return 0, exprFault{at: at, msg: "division by zero"}
+		case op == '/':
+			v /= rhs
+		default:
+			v %= rhs
+		}
+	}
+	return v, err
+}
+
+func (p *exprParser) unary() (int, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		v, err := p.unary()
+		return -v, err
+	case '+':
+		p.pos++
+		return p.unary()
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (int, error) {
+	ch := p.peek()
+	start := p.pos
+	switch {
+	case ch == '(':
+		p.pos++
+		v, err := p.expr()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, p.errorf("missing ')'")
+		}
+		p.pos++
+		return v, nil
+	case isDigit(ch):
+		for p.pos < len(p.src) && isDigit(p.src[p.pos]) {
+			p.pos++
+		}
+		v, err := strconv.Atoi(p.src[start:p.pos])
+		if err != nil {
+			return 0, exprFault{at: start, msg: "number out of range"}
+		}
+		return v, nil
+	case isExprNameByte(ch, true):
+		for p.pos < len(p.src) && isExprNameByte(p.src[p.pos], false) {
+			p.pos++
+		}
+		name := p.src[start:p.pos]
+		v, ok := p.vars[name]
+		if !ok {
+			return 0, exprFault{at: start, msg: "undefined variable " + name}
+		}
+		return v, nil
+	case ch == 0:
+		return 0, p.errorf("missing value")
+	}
+	return 0, p.errorf("unexpected %q", p.src[p.pos:p.pos+1])
+}
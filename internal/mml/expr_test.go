@@ -0,0 +1,78 @@
+package mml
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseVariablesAndExpressions(t *testing.T) {
+	src := `#VAR BASSVOL=12;
+#VAR PAN=40;
+#VAR PAN=PAN+2*(3-1);
+#A=v{BASSVOL-2}c;
+v{BASSVOL} @p{PAN-10} c A l{16/2} d e`
+	score, err := NewParser(DefaultParserConfig()).Parse(src)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	var vols, pans []int
+	var noteTicks []int
+	for _, ev := range score.Tracks[0].Events {
+		switch ev.Type {
+		case EventVolume:
+			vols = append(vols, ev.Value)
+		case EventPan:
+			pans = append(pans, ev.Value)
+		case EventNote:
+			noteTicks = append(noteTicks, ev.Tick)
+		}
+	}
+	if len(vols) != 2 || vols[0] != 12 || vols[1] != 10 {
+		t.Fatalf("expected volumes 12 then 10 from the macro, got %v", vols)
+	}
+	if len(pans) != 1 || pans[0] != 34 {
+		t.Fatalf("expected pan 34, got %v", pans)
+	}
+	if n := len(noteTicks); noteTicks[n-1]-noteTicks[n-2] != DefaultParserConfig().Resolution/8 {
+		t.Fatalf("expected l{16/2} to set eighth notes, got note ticks %v", noteTicks)
+	}
+}
+
+func TestExpressionErrorsPointAtExpression(t *testing.T) {
+	cases := []struct {
+		src          string
+		line, column int
+		want         string
+	}{
+		{"c d\no5 v{VOL+1} c", 2, 6, "line 2, column 6: {VOL+1}: undefined variable VOL"},
+		{"#VAR X=4;\nv{X/(X-4)}", 2, 4, "line 2, column 4: {X/(X-4)}: division by zero"},
+		{"v{1+} c", 1, 5, "line 1, column 5: {1+}: missing value"},
+		{"v{2 c", 1, 2, "line 1, column 2: {2 c}: unclosed '{'"},
+		{"#VAR = 3;", 1, 6, "line 1, column 6: {VAR = 3}: #VAR expects NAME=value"},
+	}
+	for _, tc := range cases {
+		_, err := NewParser(DefaultParserConfig()).Parse(tc.src)
+		var exprErr *ExprError
+		if !errors.As(err, &exprErr) {
+			t.Fatalf("%q: expected *ExprError, got %v", tc.src, err)
+		}
+		if exprErr.Line != tc.line || exprErr.Column != tc.column || err.Error() != tc.want {
+			t.Fatalf("%q: expected %q, got %q", tc.src, tc.want, err.Error())
+		}
+	}
+}
+
+func TestResolveExpressionsKeepsPlainMML(t *testing.T) {
+	src := "/* {not} */ #VAR N=3;\n#TABLE1{1,2};\n#A=o{N+1};\nA l{N*2} c // {kept}\n#END; {tail}"
+	got, err := ResolveExpressions(src)
+	if err != nil {
+		t.Fatalf("resolve failed: %v", err)
+	}
+	want := "/* {not} */ \n#TABLE1{1,2};\n#A=o4;\nA l6 c // {kept}\n#END; {tail}"
+	if got != want {
+		t.Fatalf("expected\n%q\ngot\n%q", want, got)
+	}
+	if _, err := NewParser(DefaultParserConfig()).Parse(got); err != nil {
+		t.Fatalf("resolved MML should parse: %v", err)
+	}
+}
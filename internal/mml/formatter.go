@@ -0,0 +1,619 @@
+package mml
+
+import "strings"
+
+type tokenKind int
+
+const (
+	tokCommand tokenKind = iota
+	tokNote
+	tokRest
+	tokLength
+	tokOctave
+	tokSlur
+	tokLoopOpen
+	tokLoopBreak
+	tokLoopClose
+	tokSeparator
+	tokMacro
+	tokStray
+)
+
+// Format rewrites MML source in a canonical layout: directives on their own
+// lines with #OPM@ tables aligned in columns, commands separated by single
+// spaces, and one bar per line in each track. Comments and blank lines
+// between blocks are kept. Tokens are recognized the same way the parser
+// reads them, so the formatted text compiles to the same score.
+func Format(src string) (string, error) {
+	cfg := DefaultParserConfig()
+	if _, err := NewParser(cfg).Parse(src); err != nil {
+		return "", err
+	}
+	f := &formatter{
+		src: src,
+		cfg: cfg,
+		pre: preprocessorState{
+			macros:      make(map[string]string),
+			definitions: make(map[string]string),
+		},
+	}
+	f.resetTrack()
+	f.run()
+	return f.out.String(), nil
+}
+
+type loopMark struct {
+	start int
+	brk   int
+	first string // the body's first token
+}
+
+type formatter struct {
+	src string
+	cfg ParserConfig
+	pre preprocessorState
+	st  parseState
+
+	out       strings.Builder
+	line      strings.Builder
+	spaceNext bool
+	lastKind  tokenKind
+
+	newlines     int  // newlines in the whitespace before the current token
+	spaced       bool // whitespace before the current token
+	lineBar      int
+	pendingBreak bool
+	loops        []loopMark
+
+	sectionPlays bool
+	preludeLen   int
+	sections     int
+}
+
+func (f *formatter) resetTrack() {
+	f.st = newState(f.cfg, parserOptions{}, f.pre.definitions)
+	if f.preludeLen > 0 {
+		f.st.defaultLen = f.preludeLen
+	}
+	f.lineBar = 0
+	f.loops = f.loops[:0]
+}
+
+func (f *formatter) run() {
+	src := f.src
+	for i := 0; i < len(src); {
+		if isSpace(src[i]) {
+			if src[i] == '\n' {
+				f.newlines++
+			}
+			f.spaced = true
+			i++
+			continue
+		}
+		if end, ok := commentEnd(src, i); ok {
+			f.comment(src[i:end])
+			i = end
+			f.clearGap()
+			continue
+		}
+		if src[i] == '#' {
+			end := directiveEnd(src, i)
+			stop := f.directive(src[i:end])
+			i = end
+			f.clearGap()
+			if stop {
+				f.endLine()
+				f.out.WriteString(strings.TrimSpace(src[i:]))
+				if i < len(src) {
+					f.out.WriteByte('\n')
+				}
+				return
+			}
+			continue
+		}
+		kind, end := f.scanToken(src, i)
+		f.token(kind, src[i:end])
+		i = end
+		f.clearGap()
+	}
+	f.endLine()
+}
+
+func (f *formatter) clearGap() {
+	f.newlines = 0
+	f.spaced = false
+}
+
+// token writes one track token and advances the tick position the way the
+// parser would, ending the line once a bar boundary has been crossed.
+func (f *formatter) token(kind tokenKind, text string) {
+	// Macro bodies are spliced in as raw text and unknown characters may
+	// belong to the previous token, so keep the source spacing around them.
+	keepGap := kind == tokMacro || kind == tokStray || f.lastKind == tokMacro
+	loopGap := !keepGap && f.loopGap(kind, text)
+	if f.pendingBreak && kind != tokSlur && kind != tokSeparator && kind != tokLoopClose && (!keepGap && !loopGap || f.spaced) {
+		f.endLine()
+	}
+	f.blankLine()
+	if kind != tokLoopOpen && f.lastKind == tokLoopOpen && len(f.loops) > 0 {
+		f.loops[len(f.loops)-1].first = text
+	}
+	switch {
+	case keepGap:
+		f.keep(text)
+	case loopGap:
+		f.keep(text)
+		f.spaceNext = !glued(kind)
+	case glued(kind):
+		f.glue(text)
+	default:
+		f.word(text)
+	}
+	switch kind {
+	case tokNote, tokRest:
+		f.sectionPlays = true
+		f.advance(f.noteTicks(kind, text))
+	case tokLength:
+		if length, _, err := parseLengthToken(text, 1, f.st); err == nil {
+			f.st.defaultLen = length
+		}
+	case tokLoopOpen:
+		f.spaceNext = false
+		f.loops = append(f.loops, loopMark{start: f.st.tick, brk: -1})
+	case tokLoopBreak:
+		if len(f.loops) == 1 {
+			f.loops[0].brk = f.st.tick
+		}
+	case tokLoopClose:
+		f.closeLoop(text)
+	case tokSeparator:
+		f.endLine()
+		if text == ";" {
+			f.sections++
+			if f.sections == 1 && !f.sectionPlays {
+				// A leading section without notes is the global prelude.
+				f.preludeLen = f.st.defaultLen
+			}
+		}
+		f.sectionPlays = false
+		f.resetTrack()
+	case tokMacro:
+		f.measureMacro(text)
+	}
+	f.lastKind = kind
+}
+
+func glued(kind tokenKind) bool {
+	switch kind {
+	case tokNote, tokRest, tokOctave, tokSlur, tokLoopBreak, tokLoopClose, tokSeparator:
+		return true
+	}
+	return false
+}
+
+func isLoopMark(kind tokenKind) bool {
+	return kind == tokLoopOpen || kind == tokLoopBreak || kind == tokLoopClose
+}
+
+// loopGap reports whether the space before a token at a loop mark has to
+// stay as the source wrote it. Loops expand as raw text, so the tokens on
+// either side of a mark, and the last and first tokens of the body, can
+// otherwise run together.
+func (f *formatter) loopGap(kind tokenKind, text string) bool {
+	switch {
+	case kind == tokLoopOpen || kind == tokLoopBreak:
+		return true
+	case kind == tokLoopClose:
+		// A dot or tie written after the loop would also extend a body that
+		// ends in a length.
+		return len(f.loops) == 0 || !standsAlone(f.loops[len(f.loops)-1].first) || takesLength(f.lastKind)
+	case isLoopMark(f.lastKind):
+		return !standsAlone(text)
+	}
+	return false
+}
+
+func takesLength(kind tokenKind) bool {
+	return kind == tokNote || kind == tokRest || kind == tokLength
+}
+
+// standsAlone reports whether a token starting with text is read the same
+// whatever token comes right before it.
+func standsAlone(text string) bool {
+	return text != "" && strings.IndexByte("acdefgilqrsvx<>$@[|]", lower(text[0])) >= 0
+}
+
+func (f *formatter) noteTicks(kind tokenKind, text string) int {
+	var dur int
+	var err error
+	switch {
+	case kind == tokRest:
+		dur, _, err = parseLengthWithTie(text, 1, f.st)
+	case lower(text[0]) == 'n':
+		_, dur, _, err = parseNoteByNumber(text, 0, f.st)
+	default:
+		_, dur, _, err = parseNote(text, 0, f.st)
+	}
+	if err != nil {
+		return 0
+	}
+	return dur
+}
+
+func (f *formatter) advance(ticks int) {
+	f.st.tick += ticks
+	if len(f.loops) > 0 || f.cfg.Resolution <= 0 {
+		return
+	}
+	if bar := f.st.tick / f.cfg.Resolution; bar > f.lineBar {
+		f.lineBar = bar
+		f.pendingBreak = true
+	}
+}
+
+// closeLoop applies the same repeat rule as parseLoopBody: the part before
+// '|' plays n-1 times and the part after it once.
+func (f *formatter) closeLoop(text string) {
+	if len(f.loops) == 0 {
+		return
+	}
+	mark := f.loops[len(f.loops)-1]
+	f.loops = f.loops[:len(f.loops)-1]
+	repeat, _, err := parseNumberDefault(text, 1, 2)
+	if err != nil || repeat < 1 {
+		repeat = 1
+	}
+	body := f.st.tick - mark.start
+	total := body * repeat
+	if mark.brk >= 0 {
+		pre := mark.brk - mark.start
+		total = pre*(repeat-1) + body - pre
+	}
+	f.st.tick = mark.start
+	f.advance(total)
+}
+
+// measureMacro advances the tick position by the expanded macro body.
+func (f *formatter) measureMacro(text string) {
+	shift, _ := parseOptionalSignedParen(text, 1)
+	body, err := expandLoops(expandMacroByName(text[:1], shift, &f.pre, 0), f.cfg.Limits)
+	if err != nil {
+		return
+	}
+	ticks := 0
+	for i := 0; i < len(body); {
+		if isSpace(body[i]) {
+			i++
+			continue
+		}
+		op, end := scanTrackToken(body, i)
+		switch kind := op.kind(); kind {
+		case tokNote, tokRest:
+			ticks += f.noteTicks(kind, body[i:end])
+			f.sectionPlays = true
+		case tokLength:
+			if length, _, err := parseLengthToken(body[i:end], 1, f.st); err == nil {
+				f.st.defaultLen = length
+			}
+		}
+		i = end
+	}
+	f.advance(ticks)
+}
+
+func (f *formatter) comment(text string) {
+	ownLine := f.line.Len() == 0 || f.newlines > 0
+	if ownLine {
+		f.endLine()
+		f.blankLine()
+		f.writeLine(text)
+		return
+	}
+	if strings.HasPrefix(text, "//") || strings.Contains(text, "\n") {
+		f.line.WriteByte(' ')
+		f.line.WriteString(text)
+		f.endLine()
+		return
+	}
+	f.word(text)
+}
+
+// directive writes a #...; statement on its own line and feeds it to the
+// preprocessor state so later macro calls can be measured. It reports
+// whether the directive was #END.
+func (f *formatter) directive(text string) bool {
+	f.endLine()
+	f.blankLine()
+	stmt := stripComments(text)
+	if !strings.HasSuffix(stmt, ";") {
+		stmt += ";"
+	}
+	body := strings.TrimSuffix(strings.TrimPrefix(text, "#"), ";")
+	switch {
+	case strings.HasPrefix(strings.ToUpper(strings.TrimSpace(body)), "OPM@"):
+		if table, ok := formatOPMTable(body); ok {
+			body = table
+		}
+	case isMacroDefinition(stripComments(body)):
+		// Macro bodies are MML, so lay them out like a track, with bars
+		// counted from the start of the macro.
+		op := strings.IndexByte(body, '=')
+		if op > 0 && body[op-1] == '+' {
+			op--
+		}
+		value := strings.TrimLeft(body[op:], "+=")
+		sub := &formatter{src: value, cfg: f.cfg, pre: f.pre}
+		sub.resetTrack()
+		sub.run()
+		body = strings.TrimSpace(body[:op]) + body[op:len(body)-len(value)] + strings.TrimSpace(sub.out.String())
+	default:
+		body = tidyLines(body)
+	}
+	_, stop := parseDirective(stmt, 0, &f.pre)
+	if strings.HasSuffix(text, ";") {
+		body += ";"
+	}
+	// Leave the line open so a comment written after the ';' stays there.
+	f.line.WriteString("#" + body)
+	f.pendingBreak = true
+	return stop
+}
+
+func (f *formatter) word(s string) {
+	if f.line.Len() > 0 && f.lineLastByte() != '[' {
+		f.line.WriteByte(' ')
+	}
+	f.line.WriteString(s)
+	f.spaceNext = true
+}
+
+// glue writes notes, rests, ties and octave shifts next to each other, with
+// the same guard against a following 'b' being read as a flat that the
+// serializer uses, and keeps two slurs from reading as one &&.
+func (f *formatter) glue(s string) {
+	if f.line.Len() > 0 {
+		if last := f.lineLastByte(); f.spaceNext && last != '[' {
+			f.line.WriteByte(' ')
+		} else if lower(s[0]) == 'b' && (isNote(lower(last)) || last == '+' || last == '-' || last == '#') {
+			f.line.WriteByte(' ')
+		} else if s[0] == '&' && last == '&' {
+			f.line.WriteByte(' ')
+		}
+	}
+	f.line.WriteString(s)
+	f.spaceNext = false
+}
+
+// keep writes s with a single space before it only if the source had one.
+func (f *formatter) keep(s string) {
+	if f.line.Len() > 0 && f.spaced {
+		f.line.WriteByte(' ')
+	}
+	f.line.WriteString(s)
+	f.spaceNext = true
+}
+
+func (f *formatter) lineLastByte() byte {
+	s := f.line.String()
+	return s[len(s)-1]
+}
+
+func (f *formatter) endLine() {
+	f.pendingBreak = false
+	if f.line.Len() == 0 {
+		return
+	}
+	f.writeLine(f.line.String())
+	f.line.Reset()
+	f.spaceNext = false
+}
+
+func (f *formatter) writeLine(s string) {
+	f.out.WriteString(s)
+	f.out.WriteByte('\n')
+}
+
+// blankLine keeps one blank line where the source had any, as long as the
+// current output line has not started yet.
+func (f *formatter) blankLine() {
+	if f.newlines < 2 || f.line.Len() > 0 || f.out.Len() == 0 {
+		return
+	}
+	if strings.HasSuffix(f.out.String(), "\n\n") {
+		return
+	}
+	f.out.WriteByte('\n')
+	f.newlines = 0
+}
+
+func (f *formatter) scanToken(src string, at int) (tokenKind, int) {
+	if isMacroName(src[at]) {
+		if _, ok := f.pre.macros[string(src[at])]; ok {
+			_, next := parseOptionalSignedParen(src, at+1)
+			return tokMacro, next
+		}
+	}
+	op, end := scanTrackToken(src, at)
+	kind := op.kind()
+	if kind == tokSeparator && (len(f.loops) > 0 || (src[at] == ',' && isArgumentComma(src, at))) {
+		return tokStray, end
+	}
+	return kind, end
+}
+
+// commentEnd reports whether a comment starts at src[at] and where it ends.
+func commentEnd(src string, at int) (int, bool) {
+	switch {
+	case startsWithWord(src, at, "//"):
+		end := strings.IndexByte(src[at:], '\n')
+		if end < 0 {
+			return len(src), true
+		}
+		return at + end, true
+	case startsWithWord(src, at, "/*"):
+		end := strings.Index(src[at+2:], "*/")
+		if end < 0 {
+			return len(src), true
+		}
+		return at + 2 + end + 2, true
+	}
+	return at, false
+}
+
+// directiveEnd returns the end of the #...; statement at src[at], including
+// the ';'. Comments inside the statement do not terminate it.
+func directiveEnd(src string, at int) int {
+	for i := at + 1; i < len(src); {
+		if end, ok := commentEnd(src, i); ok {
+			i = end
+			continue
+		}
+		if src[i] == ';' {
+			return i + 1
+		}
+		i++
+	}
+	return len(src)
+}
+
+// isMacroDefinition mirrors the fallback in parseDirective: a statement that
+// is not a known directive but assigns to macro names.
+func isMacroDefinition(body string) bool {
+	if _, _, ok := parseKnownDirective(body); ok || isVarDirective(body) {
+		return false
+	}
+	op := strings.IndexByte(body, '=')
+	return op > 0 && len(parseMacroTargets(strings.TrimSuffix(body[:op], "+"))) > 0
+}
+
+// tidyLines trims each line of a directive body and drops empty lines.
+func tidyLines(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	out := lines[:0]
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			out = append(out, line)
+		}
+	}
+	return strings.Join(out, "\n")
+}
+
+type opmRow struct {
+	lead  []string
+	vals  []string
+	trail string
+}
+
+// formatOPMTable lays out an OPM@ body as the algorithm/feedback pair
+// followed by one row of 11 parameters per operator, with right-aligned
+// columns. Comments stay with the row they were written next to.
+func formatOPMTable(body string) (string, bool) {
+	open, close := -1, -1
+	for i := 0; i < len(body); {
+		if end, ok := commentEnd(body, i); ok {
+			i = end
+			continue
+		}
+		if body[i] == '{' && open < 0 {
+			open = i
+		} else if body[i] == '}' && open >= 0 {
+			close = i
+			break
+		}
+		i++
+	}
+	header := strings.Join(strings.Fields(body[:max(open, 0)]), "")
+	if open < 0 || close < 0 || strings.Contains(header, "/") {
+		return "", false
+	}
+
+	rows := make([]opmRow, 0, 5)
+	var lead []string
+	inner := body[open+1 : close]
+	newline := false
+	for i := 0; i < len(inner); {
+		ch := inner[i]
+		if isSpace(ch) || ch == ',' {
+			if ch == '\n' {
+				newline = true
+			}
+			i++
+			continue
+		}
+		if end, ok := commentEnd(inner, i); ok {
+			text := inner[i:end]
+			if len(rows) == 0 || newline {
+				lead = append(lead, text)
+			} else {
+				row := &rows[len(rows)-1]
+				row.trail = strings.TrimSpace(row.trail + " " + text)
+			}
+			i = end
+			newline = false
+			continue
+		}
+		end := i
+		for end < len(inner) && !isSpace(inner[end]) && inner[end] != ',' {
+			if _, ok := commentEnd(inner, end); ok {
+				break
+			}
+			end++
+		}
+		if len(rows) == 0 || len(rows[len(rows)-1].vals) >= opmRowSize(len(rows)-1) {
+			rows = append(rows, opmRow{lead: lead})
+			lead = nil
+		}
+		rows[len(rows)-1].vals = append(rows[len(rows)-1].vals, inner[i:end])
+		i = end
+		newline = false
+	}
+
+	widths := []int{}
+	for _, row := range rows {
+		for c, v := range row.vals {
+			if c >= len(widths) {
+				widths = append(widths, 0)
+			}
+			if len(v) > widths[c] {
+				widths[c] = len(v)
+			}
+		}
+	}
+	var out strings.Builder
+	out.WriteString(header)
+	out.WriteString("{\n")
+	for r, row := range rows {
+		for _, c := range row.lead {
+			out.WriteString("    " + c + "\n")
+		}
+		out.WriteString("   ")
+		for c, v := range row.vals {
+			out.WriteString(" " + strings.Repeat(" ", widths[c]-len(v)) + v)
+			if r < len(rows)-1 || c < len(row.vals)-1 {
+				out.WriteByte(',')
+			}
+		}
+		if row.trail != "" {
+			out.WriteString(" " + row.trail)
+		}
+		out.WriteByte('\n')
+	}
+	for _, c := range lead {
+		out.WriteString("    " + c + "\n")
+	}
+	out.WriteByte('}')
+	suffix := strings.TrimLeft(body[close+1:], " \t\r")
+	if strings.HasPrefix(suffix, "\n") {
+		out.WriteByte('\n')
+	}
+	out.WriteString(tidyLines(suffix))
+	return out.String(), true
+}
+
+func opmRowSize(row int) int {
+	if row == 0 {
+		return 2
+	}
+	return 11
+}
@@ -0,0 +1,145 @@
+package mml
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func assertFormatPreservesScore(t *testing.T, name string, src string) string {
+	t.Helper()
+	p := NewParser(DefaultParserConfig())
+	want, err := p.Parse(src)
+	if err != nil {
+		t.Fatalf("%s: parse failed: %v", name, err)
+	}
+	text, err := Format(src)
+	if err != nil {
+		t.Fatalf("%s: format failed: %v", name, err)
+	}
+	got, err := p.Parse(text)
+	if err != nil {
+		t.Fatalf("%s: formatted text does not parse: %v\n%s", name, err, text)
+	}
+	if len(want.Tracks) != len(got.Tracks) {
+		t.Fatalf("%s: expected %d tracks, got %d\n%s", name, len(want.Tracks), len(got.Tracks), text)
+	}
+	for i := range want.Tracks {
+		a, b := want.Tracks[i], got.Tracks[i]
+		// Spans move with the layout; everything else must survive.
+		a.Span, b.Span = SourceSpan{}, SourceSpan{}
+		if !reflect.DeepEqual(a, b) {
+			t.Fatalf("%s: formatting changed track %d\n%s", name, i, text)
+		}
+	}
+	if len(want.Definitions) != len(got.Definitions) {
+		t.Fatalf("%s: expected %d definitions, got %d", name, len(want.Definitions), len(got.Definitions))
+	}
+	for k, v := range want.Definitions {
+		if strings.Join(strings.Fields(v), "") != strings.Join(strings.Fields(got.Definitions[k]), "") {
+			t.Fatalf("%s: definition %s changed: %q -> %q", name, k, v, got.Definitions[k])
+		}
+	}
+	again, err := Format(text)
+	if err != nil || again != text {
+		t.Fatalf("%s: expected formatting to be stable, got:\n%s", name, again)
+	}
+	return text
+}
+
+func TestFormatExamplesPreserveScore(t *testing.T) {
+	files, _ := filepath.Glob("../../examples/*.mml")
+	if len(files) == 0 {
+		t.Skip("no example fixtures available")
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatalf("read %s: %v", f, err)
+		}
+		assertFormatPreservesScore(t, filepath.Base(f), string(data))
+	}
+}
+
+func TestFormatOneBarPerLine(t *testing.T) {
+	got := assertFormatPreservesScore(t, "bars", "t120   l8 cdefga b>c<  bagfedc4 r4;")
+	want := "t120 l8 cdefga b>c\n<bagfedc4\nr4;\n"
+	if got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestFormatCountsLoopsAndMacros(t *testing.T) {
+	got := assertFormatPreservesScore(t, "loops", "#A=l4 cc; l2 [c|d]3 A e1")
+	want := "#A=l4 cc;\nl2 [c|d]3\nA\ne1\n"
+	if got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestFormatKeepsComments(t *testing.T) {
+	src := "// intro\nt120 l8 cdef /* inline */ ga b>c // end\n\n\n/* block */\nc1;"
+	got := assertFormatPreservesScore(t, "comments", src)
+	want := "// intro\nt120 l8 cdef /* inline */ ga b>c // end\n\n/* block */\nc1;\n"
+	if got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestFormatAlignsOPMTable(t *testing.T) {
+	src := "#OPM@1{0,7, 31,0,0,15,0,0,0,1,0,0,0, 31,0,0,15,0,0,0,1,0,0,0, 31,0,0,15,0,0,0,1,0,0,0, 31,0,0,15,0,0,0,1,0,0,0}; @1 c"
+	got := assertFormatPreservesScore(t, "opm", src)
+	want := "#OPM@1{\n" +
+		"     0, 7,\n" +
+		"    31, 0, 0, 15, 0, 0, 0, 1, 0, 0, 0,\n" +
+		"    31, 0, 0, 15, 0, 0, 0, 1, 0, 0, 0,\n" +
+		"    31, 0, 0, 15, 0, 0, 0, 1, 0, 0, 0,\n" +
+		"    31, 0, 0, 15, 0, 0, 0, 1, 0, 0, 0\n" +
+		"};\n@1 c\n"
+	if got != want {
+		t.Fatalf("expected:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestFormatKeepsTempoRamps(t *testing.T) {
+	text := assertFormatPreservesScore(t, "ramp", "t120 o5 c t60,2.^8 d, e")
+	if !strings.Contains(text, "t60,2.^8") {
+		t.Fatalf("expected the ramp length to stay with its t command:\n%s", text)
+	}
+}
+
+// formatPieces are MML fragments, including later commands such as @mono,
+// pipes, SSG-EG and tempo ramps, that generated tracks are built from.
+var formatPieces = []string{
+	"c", "d+", "e-8", "f+4.", "g2^8", "a", "b", "r", "r16", "n60", "n48,", "l8", "l4.", "t120", "t90,2", "t60,",
+	"o4", "<", ">", "«", "»", "v12", "x100", "q6", "k-3", "kt2", "p2", "po40", "%f1,2", "%t3,1,0", "%v1,4", "%x2",
+	"%5", "%2,1", "&", "&&", "s20", "s10,-5", "s,", "(", ")2", "@v100,3", "@q4,2", "@p-20", "@mask3", "@al4,5",
+	"@fb3", "i1", "@tl20", "@rr10,5", "@ml2,64", "@dt-64", "@fx60", "@se10", "@er0", "@mono2", "@o1,2", "@i5,2",
+	"@r8,1", "@f64,2,3", "@lfo30,1", "mp10,20,5,5", "ma8", "@2", "@3,1,", "$", "*", "*30", "na1", "nt2,3", "_nf4",
+	"_@@1", "@ph1", "[", "]", "]3", "|", ",", ";", " ", " ", "\n", "^", ".", "é",
+}
+
+func TestFormatGeneratedTracksPreserveEvents(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 2000; n++ {
+		var b strings.Builder
+		for k := r.Intn(30); k >= 0; k-- {
+			b.WriteString(formatPieces[r.Intn(len(formatPieces))])
+		}
+		src := b.String()
+		if _, err := NewParser(DefaultParserConfig()).Parse(src); err != nil {
+			continue
+		}
+		assertFormatPreservesScore(t, fmt.Sprintf("generated %q", src), src)
+	}
+}
+
+func TestFormatRejectsInvalidInput(t *testing.T) {
+	if _, err := Format("c [d e"); err == nil {
+		t.Fatalf("expected error for unclosed loop")
+	}
+}
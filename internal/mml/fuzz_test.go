@@ -0,0 +1,41 @@
+package mml
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		"t120 o5 l8 cdefgab>c",
+		"#A=cde; #B=A(2)f; o5 B A(-1) g;",
+		"#MACRO{dynamic}; #A=cA; A",
+		"#VAR X=3; v{X*4} @p{X-10} [c | d]{X}",
+		"#REV{octave}; #SIGN{G}; [[c]3 d]2 $ e & f",
+		"#TABLE1{(0,64)8|64}; #OPM@0{0,7,31,0,0,0,0,0,0,0,0,0}; na1 @0 c; %1,2 n60",
+	} {
+		f.Add(seed)
+	}
+	examples, _ := filepath.Glob(filepath.Join("..", "..", "examples", "*.mml"))
+	for _, path := range examples {
+		if data, err := os.ReadFile(path); err == nil {
+			f.Add(string(data))
+		}
+	}
+	cfg := DefaultParserConfig()
+	cfg.Limits = ParserLimits{MaxExpandedLen: 1 << 16, MaxEvents: 1 << 12}
+	f.Fuzz(func(t *testing.T, src string) {
+		score, err := NewParser(cfg).Parse(src)
+		if err != nil {
+			return
+		}
+		events := 0
+		for _, tr := range score.Tracks {
+			events += len(tr.Events)
+		}
+		if events > cfg.Limits.MaxEvents {
+			t.Fatalf("parsed %d events, over the limit of %d", events, cfg.Limits.MaxEvents)
+		}
+	})
+}
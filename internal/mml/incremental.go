@@ -0,0 +1,242 @@
+package mml
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// IncrementalParser parses successive versions of the same MML text, such as
+// an editor buffer, and only redoes the work an edit affects.
+//
+// The comment-free source is cut into statements at ';' and at directives.
+// Each statement caches its macro expansion together with the macro state it
+// was expanded under, so it is reused as long as its text and the macros it
+// refers to are unchanged. Each track caches its parsed events keyed by its
+// expanded text and the definitions parseTrack reads (#SIGN, #REV, #VMODE,
+// #QUANT, #TMODE). Tracks of the returned Score may share event slices with
+// earlier results and must be treated as read-only.
+type IncrementalParser struct {
+	parser *Parser
+
+	mu       sync.Mutex
+	sections map[string]cachedSection
+	tracks   map[string]Track
+	trackCtx string
+
+	// Work done by the last Parse call.
+	expandedSections int
+	parsedTracks     int
+}
+
+type cachedSection struct {
+	revOctave    bool
+	macroDynamic bool
+	macros       map[string]string
+	deps         map[string]macroDep
+	text         string
+	positions    []int // statement offset of each byte of text
+}
+
+// macroDep records the value a macro name had (or that it was undefined)
+// when a section was expanded.
+type macroDep struct {
+	body    string
+	defined bool
+}
+
+func NewIncrementalParser(cfg ParserConfig) *IncrementalParser {
+	return &IncrementalParser{
+		parser:   NewParser(cfg),
+		sections: make(map[string]cachedSection),
+		tracks:   make(map[string]Track),
+	}
+}
+
+// Parse parses input like Parser.Parse, reusing sections and tracks from the
+// previous call that are not affected by the changes.
+func (ip *IncrementalParser) Parse(input string) (*Score, error) {
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	ip.expandedSections, ip.parsedTracks = 0, 0
+
+	st := preprocessorState{
+		macros:      make(map[string]string),
+		definitions: make(map[string]string),
+		limits:      ip.parser.cfg.Limits,
+	}
+	noComments, stripped, err := stripSource(input)
+	if err != nil {
+		return nil, err
+	}
+	sections := make(map[string]cachedSection, len(ip.sections))
+	var expanded strings.Builder
+	origins := make([]int, 0, len(input))
+	offset := 0
+	for _, stmt := range splitStatements(noComments) {
+		at := offset
+		offset += len(stmt)
+		if stmt[0] == '#' {
+			if _, stop := parseDirective(stmt, 0, &st); stop {
+				break
+			}
+			if st.err != nil {
+				return nil, st.err
+			}
+			continue
+		}
+		sec, ok := ip.sections[stmt]
+		if !ok || !sec.matches(&st) {
+			sec = expandSection(stmt, &st)
+			ip.expandedSections++
+		} else {
+			st.emitted += len(sec.text)
+			st.checkLength(st.emitted, "")
+		}
+		if st.err != nil {
+			return nil, st.err
+		}
+		sections[stmt] = sec
+		expanded.WriteString(sec.text)
+		for _, pos := range sec.positions {
+			origins = append(origins, stripped[at+pos])
+		}
+	}
+	ip.sections = sections
+
+	defs := st.definitions
+	opts := parseOptions(defs)
+	ctx := trackContext(opts, defs)
+	if ctx != ip.trackCtx {
+		ip.tracks = make(map[string]Track)
+		ip.trackCtx = ctx
+	}
+	parts := splitTrackParts(expanded.String())
+	describeTracks(parts, input, origins, st.names)
+	tracks := make([]Track, 0, len(parts))
+	cache := make(map[string]Track, len(parts))
+	events := 0
+	for _, part := range parts {
+		tr, ok := ip.tracks[part.text]
+		if !ok {
+			var err error
+			tr, _, err = ip.parser.parseTrack(part.text, opts, defs)
+			if err != nil {
+				return nil, part.wrapError(len(tracks), err)
+			}
+			ip.parsedTracks++
+		}
+		events += len(tr.Events)
+		if err := checkEventCount(events, ip.parser.cfg.Limits); err != nil {
+			return nil, part.wrapError(len(tracks), err)
+		}
+		cache[part.text] = tr
+		tracks = append(tracks, part.label(tr))
+	}
+	ip.tracks = cache
+	return &Score{
+		Resolution:  ip.parser.cfg.Resolution,
+		InitialBPM:  ip.parser.cfg.DefaultBPM,
+		Tracks:      tracks,
+		Definitions: defs,
+	}, nil
+}
+
+// splitStatements cuts comment-free source into directives (from '#' through
+// ';') and runs of track text ending at ';'. Feeding the pieces through
+// preprocessStream in order yields the same text as the whole source, since
+// neither a directive nor a macro call can span a ';'.
+func splitStatements(src string) []string {
+	out := make([]string, 0, 16)
+	start := 0
+	for i := 0; i < len(src); i++ {
+		switch src[i] {
+		case '#':
+			if start < i {
+				out = append(out, src[start:i])
+			}
+			end := strings.IndexByte(src[i:], ';')
+			if end < 0 {
+				return append(out, src[i:])
+			}
+			out = append(out, src[i:i+end+1])
+			i += end
+			start = i + 1
+		case ';':
+			out = append(out, src[start:i+1])
+			start = i + 1
+		}
+	}
+	if start < len(src) {
+		out = append(out, src[start:])
+	}
+	return out
+}
+
+func expandSection(src string, st *preprocessorState) cachedSection {
+	sec := cachedSection{
+		revOctave:    st.revOctave,
+		macroDynamic: st.macroDynamic,
+		deps:         make(map[string]macroDep),
+	}
+	st.trackPositions, st.positions = true, nil
+	sec.text = preprocessStream(src, st)
+	sec.positions = st.positions
+	st.trackPositions, st.positions = false, nil
+	if st.macroDynamic {
+		// Dynamic macros expand their references at call time, so any
+		// macro may contribute to the result.
+		sec.macros = make(map[string]string, len(st.macros))
+		for k, v := range st.macros {
+			sec.macros[k] = v
+		}
+	}
+	for i := 0; i < len(src); i++ {
+		if isMacroName(src[i]) {
+			name := string(src[i])
+			body, ok := st.macros[name]
+			sec.deps[name] = macroDep{body: body, defined: ok}
+		}
+	}
+	return sec
+}
+
+// matches reports whether expanding the section under st would give the
+// cached text.
+func (sec cachedSection) matches(st *preprocessorState) bool {
+	if sec.revOctave != st.revOctave || sec.macroDynamic != st.macroDynamic {
+		return false
+	}
+	for name, dep := range sec.deps {
+		if body, ok := st.macros[name]; ok != dep.defined || body != dep.body {
+			return false
+		}
+	}
+	if sec.macroDynamic {
+		if len(sec.macros) != len(st.macros) {
+			return false
+		}
+		for k, v := range sec.macros {
+			if st.macros[k] != v {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// trackContext fingerprints the inputs besides its text that parseTrack
+// reads, so cached tracks are dropped when any of them change.
+func trackContext(opts parserOptions, defs map[string]string) string {
+	rev, hasRev := defs["REV"]
+	return strings.Join([]string{
+		strconv.Itoa(opts.quantMax),
+		opts.tempoMode,
+		strconv.Itoa(opts.tempoUnit),
+		strconv.Itoa(opts.tempoFPS),
+		strconv.FormatBool(hasRev),
+		rev,
+		defs["SIGN"],
+		defs["VMODE"],
+	}, "\x00")
+}
@@ -0,0 +1,92 @@
+package mml
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func assertSameScore(t *testing.T, name string, want, got *Score) {
+	t.Helper()
+	if !reflect.DeepEqual(want.Tracks, got.Tracks) {
+		t.Fatalf("%s: incremental tracks differ from a full parse", name)
+	}
+	if !reflect.DeepEqual(want.Definitions, got.Definitions) {
+		t.Fatalf("%s: expected definitions %#v, got %#v", name, want.Definitions, got.Definitions)
+	}
+}
+
+func TestIncrementalParserMatchesFullParse(t *testing.T) {
+	files, _ := filepath.Glob("../../examples/*.mml")
+	if len(files) == 0 {
+		t.Skip("no example fixtures available")
+	}
+	p := NewParser(DefaultParserConfig())
+	ip := NewIncrementalParser(DefaultParserConfig())
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatalf("read %s: %v", f, err)
+		}
+		want, err := p.Parse(string(data))
+		if err != nil {
+			t.Fatalf("%s: parse failed: %v", f, err)
+		}
+		got, err := ip.Parse(string(data))
+		if err != nil {
+			t.Fatalf("%s: incremental parse failed: %v", f, err)
+		}
+		assertSameScore(t, filepath.Base(f), want, got)
+	}
+}
+
+func TestIncrementalParserReparsesOnlyEditedTrack(t *testing.T) {
+	src := "#A=cde; t120; o5 A f; o4 g a; o3 b>c;"
+	ip := NewIncrementalParser(DefaultParserConfig())
+	if _, err := ip.Parse(src); err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if ip.parsedTracks != 3 {
+		t.Fatalf("expected 3 tracks parsed initially, got %d", ip.parsedTracks)
+	}
+	edited := strings.Replace(src, "o4 g a", "o4 g a g", 1)
+	got, err := ip.Parse(edited)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if ip.parsedTracks != 1 || ip.expandedSections != 1 {
+		t.Fatalf("expected 1 track and 1 section redone, got %d tracks and %d sections", ip.parsedTracks, ip.expandedSections)
+	}
+	want, _ := NewParser(DefaultParserConfig()).Parse(edited)
+	assertSameScore(t, "edited track", want, got)
+}
+
+func TestIncrementalParserTracksMacroChanges(t *testing.T) {
+	ip := NewIncrementalParser(DefaultParserConfig())
+	if _, err := ip.Parse("#A=cde; A; g;"); err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	edited := "#A=c; A; g;"
+	got, err := ip.Parse(edited)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if ip.parsedTracks != 1 || ip.expandedSections != 1 {
+		t.Fatalf("expected only the macro user to be redone, got %d tracks and %d sections", ip.parsedTracks, ip.expandedSections)
+	}
+	want, _ := NewParser(DefaultParserConfig()).Parse(edited)
+	assertSameScore(t, "macro edit", want, got)
+
+	edited = "#SIGN{G}; #A=c; A; g;"
+	got, err = ip.Parse(edited)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if ip.parsedTracks != 2 {
+		t.Fatalf("expected #SIGN to reparse every track, got %d", ip.parsedTracks)
+	}
+	want, _ = NewParser(DefaultParserConfig()).Parse(edited)
+	assertSameScore(t, "sign edit", want, got)
+}
@@ -0,0 +1,79 @@
+package mml
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ParserLimits bounds the work Parse does, so that untrusted input such as
+// [[[c]99]99]99 or self-referencing macros fails fast instead of exhausting
+// memory. A zero field uses the value from DefaultParserLimits and a negative
+// one disables that limit.
+type ParserLimits struct {
+	MaxExpandedLen int // bytes of preprocessed text, and of each track after loop expansion
+	MaxEvents      int // events in the whole score
+	MaxLoopDepth   int // nested [ ] loops
+	MaxMacroDepth  int // macros expanded inside macros
+}
+
+func DefaultParserLimits() ParserLimits {
+	return ParserLimits{
+		MaxExpandedLen: 4 << 20,
+		MaxEvents:      1 << 18,
+		MaxLoopDepth:   32,
+		MaxMacroDepth:  32,
+	}
+}
+
+// effective returns l with defaults filled in and disabled limits raised to
+// math.MaxInt.
+func (l ParserLimits) effective() ParserLimits {
+	def := DefaultParserLimits()
+	resolve := func(v, d int) int {
+		switch {
+		case v == 0:
+			return d
+		case v < 0:
+			return math.MaxInt
+		}
+		return v
+	}
+	return ParserLimits{
+		MaxExpandedLen: resolve(l.MaxExpandedLen, def.MaxExpandedLen),
+		MaxEvents:      resolve(l.MaxEvents, def.MaxEvents),
+		MaxLoopDepth:   resolve(l.MaxLoopDepth, def.MaxLoopDepth),
+		MaxMacroDepth:  resolve(l.MaxMacroDepth, def.MaxMacroDepth),
+	}
+}
+
+// The limit a LimitError exceeded; test with errors.Is.
+var (
+	ErrExpandedLen = errors.New("expanded text too long")
+	ErrEventCount  = errors.New("too many events")
+	ErrLoopDepth   = errors.New("loops nested too deeply")
+	ErrMacroDepth  = errors.New("macros nested too deeply")
+)
+
+// LimitError reports input that exceeds one of the ParserLimits.
+type LimitError struct {
+	Err   error // ErrExpandedLen, ErrEventCount, ErrLoopDepth or ErrMacroDepth
+	Limit int
+	At    string // the macro or loop being expanded, when known
+}
+
+func (e *LimitError) Error() string {
+	if e.At != "" {
+		return fmt.Sprintf("%s: %v (limit %d)", e.At, e.Err, e.Limit)
+	}
+	return fmt.Sprintf("%v (limit %d)", e.Err, e.Limit)
+}
+
+func (e *LimitError) Unwrap() error { return e.Err }
+
+func checkEventCount(n int, limits ParserLimits) error {
+	if limit := limits.effective().MaxEvents; n > limit {
+		return &LimitError{Err: ErrEventCount, Limit: limit}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package mml
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseLimitsReturnTypedErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		src    string
+		limits ParserLimits
+		want   error
+	}{
+		{"nested loop repeats", "[[[[c]99]99]99]99", ParserLimits{}, ErrExpandedLen},
+		{"long loop", "[cdefgab]99", ParserLimits{MaxExpandedLen: 512}, ErrExpandedLen},
+		{"loop nesting", strings.Repeat("[", 40) + "c" + strings.Repeat("]", 40), ParserLimits{}, ErrLoopDepth},
+		{"self-referencing macro", "#MACRO{dynamic}; #A=cA; A", ParserLimits{}, ErrMacroDepth},
+		{"doubling macros", "#A=cc; #A=AAAA; #A=AAAA; #A=AAAA; #A=AAAA; A", ParserLimits{MaxExpandedLen: 256}, ErrExpandedLen},
+		{"doubling dynamic macros", "#MACRO{dynamic}; #A=c; #B=AAAA; #C=BBBB; #D=CCCC; D", ParserLimits{MaxExpandedLen: 32}, ErrExpandedLen},
+		{"event count", "cdef; gec", ParserLimits{MaxEvents: 6}, ErrEventCount},
+	}
+	for _, tc := range cases {
+		cfg := DefaultParserConfig()
+		cfg.Limits = tc.limits
+		for _, parse := range []func(string) (*Score, error){NewParser(cfg).Parse, NewIncrementalParser(cfg).Parse} {
+			_, err := parse(tc.src)
+			var limitErr *LimitError
+			if !errors.Is(err, tc.want) || !errors.As(err, &limitErr) {
+				t.Fatalf("%s: expected %v, got %v", tc.name, tc.want, err)
+			}
+		}
+	}
+}
+
+func TestParseLimitsCanBeRaisedOrDisabled(t *testing.T) {
+	cfg := DefaultParserConfig()
+	cfg.Limits = ParserLimits{MaxLoopDepth: -1, MaxEvents: 8}
+	src := strings.Repeat("[", 40) + "c" + strings.Repeat("]1", 40) + " defgec>c"
+	score, err := NewParser(cfg).Parse(src)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if n := len(score.Tracks[0].Events); n != 8 {
+		t.Fatalf("expected 8 events, got %d", n)
+	}
+}
+
+// macroChain defines n dynamic macros, each calling the next, and plays the
+// first.
+func macroChain(n int) string {
+	var b strings.Builder
+	b.WriteString("#MACRO{dynamic};")
+	for i := 0; i < n; i++ {
+		b.WriteString("#" + string(rune('A'+i)) + "=c")
+		if i+1 < n {
+			b.WriteByte(byte('A' + i + 1))
+		}
+		b.WriteByte(';')
+	}
+	b.WriteString("A")
+	return b.String()
+}
+
+func TestMacroDepthCountsNestedMacros(t *testing.T) {
+	score, err := NewParser(DefaultParserConfig()).Parse(macroChain(26))
+	if err != nil {
+		t.Fatalf("expected 25 nested macros to parse within the defaults: %v", err)
+	}
+	if n := len(score.Tracks[0].Events); n != 26 {
+		t.Fatalf("expected a note from each macro, got %d events", n)
+	}
+	cfg := DefaultParserConfig()
+	cfg.Limits = ParserLimits{MaxMacroDepth: 3}
+	if _, err := NewParser(cfg).Parse(macroChain(4)); err != nil {
+		t.Fatalf("expected 3 nested macros to parse: %v", err)
+	}
+	if _, err := NewParser(cfg).Parse(macroChain(5)); !errors.Is(err, ErrMacroDepth) {
+		t.Fatalf("expected 4 nested macros to exceed the limit, got %v", err)
+	}
+}
@@ -0,0 +1,435 @@
+package mml
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// mckChannels maps ppmck track letters onto the APU channels of module 0:
+// pulse 1, pulse 2, triangle, noise and DPCM (see nesapu.ChannelPulse1).
+var mckChannels = map[byte]int{'A': 1, 'B': 2, 'C': 3, 'D': 4, 'E': 5}
+
+// mckIgnored lists ppmck commands with no equivalent here (pitch envelopes,
+// hardware LFO, duty envelopes, sweep, register writes, detune). They are
+// skipped together with their arguments so the notes still compile.
+var mckIgnored = []string{"@EP", "EPOF", "@MP", "MPOF", "@@", "s", "y", "D"}
+
+const mckMaxIncludeDepth = 16
+
+// ParseMCK compiles ppmck/MCK source into a Score.
+//
+// Tracks A-E are routed to the NES APU channels with %0,1 ... %0,5. @v volume
+// envelopes become na tables, @EN note envelopes become nt tables, and
+// @DPCMn samples become #DPCM definitions keyed by the note that plays them.
+// ppmck octaves are one lower than SiON's (ppmck o4a is A4), so notes keep
+// their pitch. load reads the files named by #INCLUDE and @DPCM.
+func (p *Parser) ParseMCK(input string, load func(name string) ([]byte, error)) (*Score, error) {
+	text, err := translateMCK(input, load)
+	if err != nil {
+		return nil, err
+	}
+	return p.Parse(text)
+}
+
+type mckTranslator struct {
+	load      func(name string) ([]byte, error)
+	title     string
+	octaveRev bool
+	defs      []string
+	tables    map[string]int // "v3" or "EN2" -> #TABLE id
+	lines     []mckLine
+}
+
+type mckLine struct {
+	letters string
+	body    string
+	file    string
+	line    int
+}
+
+// mckTrack is the state of one output track while its lines are translated.
+type mckTrack struct {
+	out      strings.Builder
+	envelope bool
+}
+
+func translateMCK(input string, load func(name string) ([]byte, error)) (string, error) {
+	t := &mckTranslator{load: load, tables: make(map[string]int)}
+	if err := t.read(input, "", 0); err != nil {
+		return "", err
+	}
+	tracks := make(map[byte]*mckTrack)
+	for _, ln := range t.lines {
+		for i := 0; i < len(ln.letters); i++ {
+			letter := ln.letters[i]
+			tr := tracks[letter]
+			if tr == nil {
+				tr = &mckTrack{}
+				tracks[letter] = tr
+			}
+			if err := t.translateBody(tr, ln.body); err != nil {
+				return "", dialectError(ln.file, ln.line, "track %c: %v", letter, err)
+			}
+		}
+	}
+
+	var out strings.Builder
+	if t.title != "" {
+		out.WriteString("#TITLE{" + t.title + "};\n")
+	}
+	for _, def := range t.defs {
+		out.WriteString(def + "\n")
+	}
+	// All tracks go in one section so that a track without notes is not
+	// taken for a global prelude.
+	first := true
+	for _, letter := range []byte("ABCDE") {
+		tr := tracks[letter]
+		if tr == nil {
+			continue
+		}
+		if !first {
+			out.WriteString(",\n")
+		}
+		first = false
+		fmt.Fprintf(&out, "#NAME{%c}; %%0,%d %s", letter, mckChannels[letter], dialectLoops(strings.TrimSpace(tr.out.String())))
+	}
+	out.WriteString(";\n")
+	return out.String(), nil
+}
+
+// read processes one source file: headers and definitions take effect
+// immediately, track lines are kept until every definition is known.
+func (t *mckTranslator) read(src string, file string, depth int) error {
+	src = stripDialectComments(src, ";")
+	line := 1
+	i := 0
+	for i < len(src) {
+		ch := src[i]
+		switch {
+		case ch == '\n':
+			line++
+			i++
+		case isSpace(ch):
+			i++
+		case ch == '#':
+			end := lineEnd(src, i)
+			if err := t.header(src[i+1:end], file, line, depth); err != nil {
+				return err
+			}
+			i = end
+		case ch == '@':
+			end := strings.IndexByte(src[i:], '}')
+			if end < 0 {
+				return dialectError(file, line, "unclosed definition")
+			}
+			end += i + 1
+			if err := t.definition(src[i+1 : end]); err != nil {
+				return dialectError(file, line, "%v", err)
+			}
+			line += strings.Count(src[i:end], "\n")
+			i = end
+		case ch >= 'A' && ch <= 'Z':
+			start := i
+			for i < len(src) && src[i] >= 'A' && src[i] <= 'Z' {
+				i++
+			}
+			letters := src[start:i]
+			if i < len(src) && src[i] != ' ' && src[i] != '\t' {
+				return dialectError(file, line, "unexpected %q", src[start:lineEnd(src, i)])
+			}
+			for j := 0; j < len(letters); j++ {
+				if _, ok := mckChannels[letters[j]]; !ok {
+					return dialectError(file, line, "track %c: expansion sound channels are not supported", letters[j])
+				}
+			}
+			end := lineEnd(src, i)
+			t.lines = append(t.lines, mckLine{letters: letters, body: src[i:end], file: file, line: line})
+			i = end
+		default:
+			return dialectError(file, line, "unexpected %q", src[i:lineEnd(src, i)])
+		}
+	}
+	return nil
+}
+
+func (t *mckTranslator) header(text string, file string, line int, depth int) error {
+	name := text
+	value := ""
+	if at := strings.IndexAny(text, " \t"); at >= 0 {
+		name, value = text[:at], strings.TrimSpace(text[at:])
+	}
+	switch strings.ToUpper(name) {
+	case "INCLUDE":
+		path := strings.Trim(value, `"`)
+		if depth >= mckMaxIncludeDepth {
+			return dialectError(file, line, "#INCLUDE %q: nested too deeply", path)
+		}
+		data, err := t.loadFile(path)
+		if err != nil {
+			return dialectError(file, line, "#INCLUDE: %v", err)
+		}
+		return t.read(string(data), path, depth+1)
+	case "TITLE":
+		t.title = strings.Trim(value, `"`)
+	case "OCTAVE-REV":
+		t.octaveRev = value != "" && value != "0"
+	}
+	// #COMPOSER, #PROGRAMER, #BANK-CHANGE and the like do not affect the
+	// compiled score.
+	return nil
+}
+
+func (t *mckTranslator) definition(text string) error {
+	eq := strings.IndexByte(text, '=')
+	open := strings.IndexByte(text, '{')
+	if eq < 0 || open < eq {
+		return fmt.Errorf("malformed definition @%s", text)
+	}
+	name := strings.TrimSpace(text[:eq])
+	body := text[open+1 : len(text)-1]
+	upper := strings.ToUpper(name)
+	switch {
+	case strings.HasPrefix(upper, "DPCM"):
+		n, err := strconv.Atoi(name[4:])
+		if err != nil {
+			return fmt.Errorf("invalid @%s", name)
+		}
+		return t.dpcm(n, body)
+	case strings.HasPrefix(upper, "EN"):
+		values, loop, err := parseMCKEnvelope(body)
+		if err != nil {
+			return fmt.Errorf("@%s: %v", name, err)
+		}
+		// Note envelope steps are relative; nt tables hold the running
+		// offset in 1/16 semitones.
+		acc := 0
+		for i, v := range values {
+			acc += v
+			values[i] = acc * 16
+		}
+		return t.table("EN"+strings.TrimSpace(name[2:]), values, loop)
+	case strings.HasPrefix(name, "v"):
+		values, loop, err := parseMCKEnvelope(body)
+		if err != nil {
+			return fmt.Errorf("@%s: %v", name, err)
+		}
+		// Scale 0-15 onto the 0-128 na range.
+		for i, v := range values {
+			values[i] = clampInt(v, 0, 15) * 128 / 15
+		}
+		return t.table("v"+strings.TrimSpace(name[1:]), values, loop)
+	}
+	// Tone (@n = {...}), @EP, @MP and expansion chip definitions are not used.
+	return nil
+}
+
+func (t *mckTranslator) table(key string, values []int, loop int) error {
+	if len(values) == 0 {
+		return fmt.Errorf("empty envelope @%s", key)
+	}
+	id, ok := t.tables[key]
+	if !ok {
+		// Table 0 is left undefined so that na0/nt0 switch envelopes off.
+		id = len(t.tables) + 1
+		t.tables[key] = id
+	}
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(v)
+	}
+	body := strings.Join(parts, ",")
+	if loop >= 0 {
+		body = strings.Join(parts[:loop], ",") + "|" + strings.Join(parts[loop:], ",")
+	}
+	t.defs = append(t.defs, "#TABLE"+strconv.Itoa(id)+"{"+body+"};")
+	return nil
+}
+
+func (t *mckTranslator) dpcm(n int, body string) error {
+	fields := strings.Split(body, ",")
+	path := strings.Trim(strings.TrimSpace(fields[0]), `"`)
+	rate := 15
+	if len(fields) > 1 {
+		v, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil || v < 0 || v > 15 {
+			return fmt.Errorf("@DPCM%d: invalid rate %q", n, strings.TrimSpace(fields[1]))
+		}
+		rate = v
+	}
+	data, err := t.loadFile(path)
+	if err != nil {
+		return fmt.Errorf("@DPCM%d: %v", n, err)
+	}
+	// ppmck numbers samples by note from o0c; shift to the note that plays
+	// them after the octave offset.
+	t.defs = append(t.defs, fmt.Sprintf("#DPCM%d{%d,%s};", n+12, rate, hex.EncodeToString(data)))
+	return nil
+}
+
+func (t *mckTranslator) loadFile(path string) ([]byte, error) {
+	if t.load == nil {
+		return nil, fmt.Errorf("cannot read %q: no file loader", path)
+	}
+	return t.load(path)
+}
+
+// translateBody appends the SiON form of one line of track text to tr.
+func (t *mckTranslator) translateBody(tr *mckTrack, body string) error {
+	out := &tr.out
+	out.WriteByte(' ')
+	i := 0
+	for i < len(body) {
+		ch := body[i]
+		if isSpace(ch) {
+			i++
+			continue
+		}
+		if word, ok := ignoredWordAt(mckIgnored, body, i); ok {
+			i = skipDialectArgs(body, i+len(word))
+			continue
+		}
+		switch {
+		case startsWithWord(body, i, "@v"):
+			n, next := dialectNumber(body, i+2)
+			id, ok := t.tables["v"+n]
+			if !ok {
+				return fmt.Errorf("undefined envelope @v%s", n)
+			}
+			fmt.Fprintf(out, " na%d ", id)
+			tr.envelope = true
+			i = next
+		case startsWithWord(body, i, "@EN"):
+			n, next := dialectNumber(body, i+3)
+			id, ok := t.tables["EN"+n]
+			if !ok {
+				return fmt.Errorf("undefined envelope @EN%s", n)
+			}
+			fmt.Fprintf(out, " nt%d ", id)
+			i = next
+		case strings.HasPrefix(body[i:], "ENOF"):
+			out.WriteString(" nt0 ")
+			i += 4
+		case ch == '@':
+			n, next := dialectNumber(body, i+1)
+			if n == "" {
+				return fmt.Errorf("unsupported command %q", body[i:min(i+3, len(body))])
+			}
+			out.WriteString(" @" + n + " ")
+			i = next
+		case isNote(ch):
+			if ch == 'b' {
+				// Keep b from reading as a flat on the previous note.
+				out.WriteByte(' ')
+			}
+			out.WriteByte(ch)
+			i++
+			for i < len(body) && (body[i] == '+' || body[i] == '#' || body[i] == '-') {
+				if body[i] == '-' {
+					out.WriteByte('-')
+				} else {
+					out.WriteByte('+')
+				}
+				i++
+			}
+			i = copyDialectLength(out, body, i)
+		case ch == 'r' || ch == 'w':
+			// w waits without key-off; a rest is the closest equivalent.
+			out.WriteByte('r')
+			i = copyDialectLength(out, body, i+1)
+		case ch == '^' || ch == 'l':
+			out.WriteByte(ch)
+			i = copyDialectLength(out, body, i+1)
+		case ch == '&':
+			out.WriteByte('&')
+			i++
+		case ch == 'o':
+			n, next := dialectNumber(body, i+1)
+			v, err := strconv.Atoi(n)
+			if err != nil {
+				return fmt.Errorf("invalid octave %q", body[i:next])
+			}
+			fmt.Fprintf(out, " o%d ", v+1)
+			i = next
+		case ch == '<' || ch == '>':
+			if t.octaveRev {
+				ch = '<' + '>' - ch
+			}
+			out.WriteByte(ch)
+			i++
+		case ch == 't' || ch == 'q':
+			n, next := dialectNumber(body, i+1)
+			fmt.Fprintf(out, " %c%s ", ch, n)
+			i = next
+		case ch == 'v':
+			switch {
+			case i+1 < len(body) && body[i+1] == '+':
+				n, next := dialectNumber(body, i+2)
+				out.WriteString(" (" + n + " ")
+				i = next
+			case i+1 < len(body) && body[i+1] == '-':
+				n, next := dialectNumber(body, i+2)
+				out.WriteString(" )" + n + " ")
+				i = next
+			default:
+				// A plain volume cancels the @v envelope.
+				n, next := dialectNumber(body, i+1)
+				if tr.envelope {
+					out.WriteString(" na0")
+					tr.envelope = false
+				}
+				out.WriteString(" v" + n + " ")
+				i = next
+			}
+		case ch == 'K':
+			n, next := dialectSignedNumber(body, i+1)
+			out.WriteString(" kt" + n + " ")
+			i = next
+		case ch == 'L':
+			out.WriteString(" $ ")
+			i++
+		case ch == '[' || ch == '|':
+			out.WriteByte(ch)
+			i++
+		case ch == ']':
+			n, next := dialectNumber(body, i+1)
+			out.WriteString("]" + n + " ")
+			i = next
+		case ch == '!':
+			// ! ends the track data on this line.
+			return nil
+		default:
+			return fmt.Errorf("unsupported command %q", string(ch))
+		}
+	}
+	return nil
+}
+
+// parseMCKEnvelope reads "15 14 13 | 12 11" style envelope bodies. loop is
+// the index of the first value after '|', or -1.
+func parseMCKEnvelope(body string) ([]int, int, error) {
+	values := make([]int, 0, 16)
+	loop := -1
+	for _, field := range strings.FieldsFunc(body, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	}) {
+		for strings.HasPrefix(field, "|") {
+			loop = len(values)
+			field = field[1:]
+		}
+		if field == "" {
+			continue
+		}
+		v, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid value %q", field)
+		}
+		values = append(values, v)
+	}
+	if loop == len(values) {
+		loop = -1
+	}
+	return values, loop, nil
+}
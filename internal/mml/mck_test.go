@@ -0,0 +1,132 @@
+package mml
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func mapLoader(files map[string]string) func(string) ([]byte, error) {
+	return func(name string) ([]byte, error) {
+		data, ok := files[name]
+		if !ok {
+			return nil, fmt.Errorf("%s: not found", name)
+		}
+		return []byte(data), nil
+	}
+}
+
+func TestParseMCKRoutesTracksToAPUChannels(t *testing.T) {
+	src := `#TITLE "demo"
+; comment line
+A  t150 o4 l8 a b
+/* block
+comment */
+BC o3 c4 /* inline */ d
+D  c
+`
+	score, err := NewParser(DefaultParserConfig()).ParseMCK(src, nil)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if score.Definitions["TITLE"] != "demo" {
+		t.Fatalf("expected title, got %#v", score.Definitions)
+	}
+	if len(score.Tracks) != 4 {
+		t.Fatalf("expected 4 tracks, got %d", len(score.Tracks))
+	}
+	for i, want := range []string{"A", "B", "C", "D"} {
+		tr := score.Tracks[i]
+		if tr.Name != want {
+			t.Fatalf("track %d: expected name %q, got %q", i, want, tr.Name)
+		}
+		var module *Event
+		for j := range tr.Events {
+			if tr.Events[j].Type == EventModule {
+				module = &tr.Events[j]
+				break
+			}
+		}
+		if module == nil || module.Module != 0 || module.Channel != i+1 {
+			t.Fatalf("track %s: expected %%0,%d, got %#v", want, i+1, module)
+		}
+	}
+	notes := func(tr Track) []int {
+		var out []int
+		for _, ev := range tr.Events {
+			if ev.Type == EventNote {
+				out = append(out, ev.Note)
+			}
+		}
+		return out
+	}
+	// ppmck o4a is A4 (MIDI 69).
+	if got := notes(score.Tracks[0]); len(got) != 2 || got[0] != 69 || got[1] != 71 {
+		t.Fatalf("expected A4 B4, got %v", got)
+	}
+	if got := notes(score.Tracks[2]); len(got) != 2 || got[0] != 48 || got[1] != 50 {
+		t.Fatalf("expected shared BC line on triangle, got %v", got)
+	}
+}
+
+func TestParseMCKEnvelopesLoopsAndIncludes(t *testing.T) {
+	files := map[string]string{
+		"env.h":    "@v0 = { 15 12 | 8 }\n@EN1 = { 0, 4, 3 }\n",
+		"kick.dmc": "\xff\x00",
+	}
+	src := `#INCLUDE "env.h"
+@DPCM0 = { "kick.dmc", 15 }
+A @v0 c @EN1 d ENOF v10 e
+A L [c | d]2 s 1,2 y 3,4 e
+E o0 c
+`
+	score, err := NewParser(DefaultParserConfig()).ParseMCK(src, mapLoader(files))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if got := score.Definitions["TABLE1"]; got != "TABLE1{128,102|68}" {
+		t.Fatalf("expected scaled volume envelope, got %q", got)
+	}
+	if got := score.Definitions["TABLE2"]; got != "TABLE2{0,64,112}" {
+		t.Fatalf("expected accumulated note envelope, got %q", got)
+	}
+	if got := score.Definitions["DPCM12"]; got != "DPCM12{15,ff00}" {
+		t.Fatalf("expected sample keyed by note, got %q", got)
+	}
+	a := score.Tracks[0]
+	var cmds []string
+	for _, ev := range a.Events {
+		switch ev.Type {
+		case EventTableEnv:
+			cmds = append(cmds, fmt.Sprintf("%s%d", ev.Command, ev.Value))
+		case EventVolume:
+			cmds = append(cmds, fmt.Sprintf("v%d", ev.Value))
+		}
+	}
+	if strings.Join(cmds, " ") != "na1 nt2 nt0 na0 v10" {
+		t.Fatalf("unexpected envelope commands %v", cmds)
+	}
+	if a.LoopIndex < 0 || a.LoopTick != 3*DefaultParserConfig().Resolution/4 {
+		t.Fatalf("expected L loop point after three quarter notes, got tick %d", a.LoopTick)
+	}
+	e := score.Tracks[1]
+	if e.Name != "E" || len(e.Events) < 2 || e.Events[len(e.Events)-1].Note != 12 {
+		t.Fatalf("expected E track to play DPCM note 12, got %#v", e)
+	}
+}
+
+func TestParseMCKErrors(t *testing.T) {
+	cases := map[string]string{
+		"A @v3 c":                "line 1: track A: undefined envelope @v3",
+		"\nF c":                  "line 2: track F: expansion sound channels are not supported",
+		"#INCLUDE \"missing\"":   "line 1: #INCLUDE: missing: not found",
+		"A c\nA c { d }":         "line 2: track A: unsupported command \"{\"",
+		"@DPCM0 = { \"x.dmc\" }": "line 1: @DPCM0: x.dmc: not found",
+	}
+	for src, want := range cases {
+		_, err := NewParser(DefaultParserConfig()).ParseMCK(src, mapLoader(nil))
+		if err == nil || err.Error() != want {
+			t.Fatalf("%q: expected error %q, got %v", src, want, err)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package mml
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// mdxFMTracks are the eight OPM channels; P is the ADPCM track.
+const mdxFMTracks = "ABCDEFGH"
+
+// mdxPCMModule is SiON's PCM module, used for the ADPCM track.
+const mdxPCMModule = 7
+
+// mdxIgnored lists mxdrv commands with no equivalent here (hardware LFO,
+// sync, noise, ADPCM frequency, key-on delay). They are skipped together
+// with their arguments so the notes still compile.
+var mdxIgnored = []string{"MPON", "MPOF", "MAON", "MAOF", "MHON", "MHOF", "MP", "MA", "MD", "MH", "S", "w", "F", "k", "_", "!"}
+
+// mdxVoiceLen is the size of an @n={...} voice: four operator rows of AR, DR,
+// SR, RR, SL, OL, KS, ML, DT1, DT2, AMS-EN, then CON, FL and the slot mask.
+const mdxVoiceLen = 4*11 + 3
+
+// ParseMDX compiles mxdrv (MDX) MML into a Score.
+//
+// Tracks A-H play on the FM module (%6) and the ADPCM track P on the PCM
+// module (%7). Each @n={...} voice is returned as OPM patch data in the layout
+// fm.Engine.LoadOPMPatch takes (CON, FL, then the operator rows), and is also
+// written to the score's definitions as #OPM@n so Player loads it. mxdrv
+// octaves are one lower than SiON's, so notes keep their pitch.
+func (p *Parser) ParseMDX(input string) (*Score, map[int][]int, error) {
+	text, patches, err := translateMDX(input)
+	if err != nil {
+		return nil, nil, err
+	}
+	score, err := p.Parse(text)
+	if err != nil {
+		return nil, nil, err
+	}
+	return score, patches, nil
+}
+
+type mdxLine struct {
+	letters string
+	body    string
+	line    int
+}
+
+func translateMDX(input string) (string, map[int][]int, error) {
+	src := stripDialectComments(input, "")
+	title := ""
+	patches := make(map[int][]int)
+	var lines []mdxLine
+	line := 1
+	for i := 0; i < len(src); {
+		ch := src[i]
+		switch {
+		case ch == '\n':
+			line++
+			i++
+		case isSpace(ch):
+			i++
+		case ch == '#':
+			end := lineEnd(src, i)
+			name, value, _ := strings.Cut(strings.TrimSpace(src[i+1:end]), " ")
+			if strings.EqualFold(name, "title") {
+				title = strings.Trim(strings.TrimSpace(value), `"`)
+			}
+			// #pcmfile and other headers name resources that are not loaded.
+			i = end
+		case ch == '@':
+			end := strings.IndexByte(src[i:], '}')
+			if end < 0 {
+				return "", nil, dialectError("", line, "unclosed voice definition")
+			}
+			end += i + 1
+			n, data, err := parseMDXVoice(src[i+1 : end])
+			if err != nil {
+				return "", nil, dialectError("", line, "%v", err)
+			}
+			patches[n] = data
+			line += strings.Count(src[i:end], "\n")
+			i = end
+		case ch >= 'A' && ch <= 'Z':
+			start := i
+			for i < len(src) && src[i] >= 'A' && src[i] <= 'Z' {
+				i++
+			}
+			letters := src[start:i]
+			for j := 0; j < len(letters); j++ {
+				if letters[j] != 'P' && strings.IndexByte(mdxFMTracks, letters[j]) < 0 {
+					return "", nil, dialectError("", line, "track %c: PCM8 tracks are not supported", letters[j])
+				}
+			}
+			end := lineEnd(src, i)
+			lines = append(lines, mdxLine{letters: letters, body: src[i:end], line: line})
+			i = end
+		default:
+			return "", nil, dialectError("", line, "unexpected %q", src[i:lineEnd(src, i)])
+		}
+	}
+
+	tracks := make(map[byte]*strings.Builder)
+	for _, ln := range lines {
+		for j := 0; j < len(ln.letters); j++ {
+			letter := ln.letters[j]
+			out := tracks[letter]
+			if out == nil {
+				out = &strings.Builder{}
+				tracks[letter] = out
+			}
+			if err := translateMDXBody(out, ln.body, strings.IndexByte(mdxFMTracks, letter)); err != nil {
+				return "", nil, dialectError("", ln.line, "track %c: %v", letter, err)
+			}
+		}
+	}
+
+	var out strings.Builder
+	if title != "" {
+		out.WriteString("#TITLE{" + title + "};\n")
+	}
+	numbers := make([]int, 0, len(patches))
+	for n := range patches {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	for _, n := range numbers {
+		out.WriteString("#OPM@" + strconv.Itoa(n) + "{" + joinInts(patches[n], 0) + "};\n")
+	}
+	// All tracks go in one section so that a track without notes is not
+	// taken for a global prelude.
+	first := true
+	for _, letter := range []byte(mdxFMTracks + "P") {
+		body := tracks[letter]
+		if body == nil {
+			continue
+		}
+		if !first {
+			out.WriteString(",\n")
+		}
+		first = false
+		module := fmt.Sprintf("%%6,%d", strings.IndexByte(mdxFMTracks, letter))
+		if letter == 'P' {
+			module = "%" + strconv.Itoa(mdxPCMModule)
+		}
+		fmt.Fprintf(&out, "#NAME{%c}; %s %s", letter, module, dialectLoops(strings.TrimSpace(body.String())))
+	}
+	out.WriteString(";\n")
+	return out.String(), patches, nil
+}
+
+// parseMDXVoice reads "n={...}" into a voice number and OPM patch data.
+func parseMDXVoice(text string) (int, []int, error) {
+	name, body, ok := strings.Cut(text, "=")
+	open := strings.IndexByte(body, '{')
+	if !ok || open < 0 {
+		return 0, nil, fmt.Errorf("malformed voice definition @%s", text)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(name))
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid voice number @%s", strings.TrimSpace(name))
+	}
+	values := make([]int, 0, mdxVoiceLen)
+	for _, field := range strings.FieldsFunc(body[open+1:len(body)-1], func(r rune) bool {
+		return r == ',' || isSpace(byte(r))
+	}) {
+		v, err := strconv.Atoi(field)
+		if err != nil {
+			return 0, nil, fmt.Errorf("@%d: invalid value %q", n, field)
+		}
+		values = append(values, v)
+	}
+	// The slot mask is optional; all four operators are always used.
+	if len(values) != mdxVoiceLen && len(values) != mdxVoiceLen-1 {
+		return 0, nil, fmt.Errorf("@%d: expected %d values, got %d", n, mdxVoiceLen, len(values))
+	}
+	data := make([]int, 0, 2+4*11)
+	data = append(data, values[44], values[45])
+	return n, append(data, values[:44]...), nil
+}
+
+// translateMDXBody appends the SiON form of one line of track text to out.
+// channel is the OPM channel for y register writes, or -1 on the PCM track.
+func translateMDXBody(out *strings.Builder, body string, channel int) error {
+	out.WriteByte(' ')
+	i := 0
+	for i < len(body) {
+		ch := body[i]
+		if isSpace(ch) {
+			i++
+			continue
+		}
+		if word, ok := ignoredWordAt(mdxIgnored, body, i); ok {
+			i = skipDialectArgs(body, i+len(word))
+			continue
+		}
+		switch {
+		case isNote(ch):
+			if ch == 'b' {
+				// Keep b from reading as a flat on the previous note.
+				out.WriteByte(' ')
+			}
+			out.WriteByte(ch)
+			i++
+			for i < len(body) && (body[i] == '+' || body[i] == '#' || body[i] == '-') {
+				if body[i] == '-' {
+					out.WriteByte('-')
+				} else {
+					out.WriteByte('+')
+				}
+				i++
+			}
+			i = copyDialectLength(out, body, i)
+		case ch == 'r':
+			out.WriteByte('r')
+			i = copyDialectLength(out, body, i+1)
+		case ch == '^' || ch == 'l':
+			out.WriteByte(ch)
+			i = copyDialectLength(out, body, i+1)
+		case ch == '&' || ch == '<' || ch == '>' || ch == '[':
+			out.WriteByte(ch)
+			i++
+		case ch == '/':
+			out.WriteByte('|')
+			i++
+		case ch == ']':
+			n, next := dialectNumber(body, i+1)
+			if n == "" {
+				n = "2"
+			}
+			out.WriteString("]" + n + " ")
+			i = next
+		case ch == 'L':
+			out.WriteString(" $ ")
+			i++
+		case ch == 'o':
+			n, next := dialectNumber(body, i+1)
+			v, err := strconv.Atoi(n)
+			if err != nil {
+				return fmt.Errorf("invalid octave %q", body[i:next])
+			}
+			fmt.Fprintf(out, " o%d ", v+1)
+			i = next
+		case ch == 'v' || ch == 'q' || ch == 't':
+			n, next := dialectNumber(body, i+1)
+			fmt.Fprintf(out, " %c%s ", ch, n)
+			i = next
+		case ch == '(' || ch == ')':
+			// mxdrv ( lowers the volume, the opposite of SiON.
+			n, next := dialectNumber(body, i+1)
+			fmt.Fprintf(out, " %c%s ", '('+')'-ch, n)
+			i = next
+		case ch == 'D':
+			// Both detunes are in 1/64 semitones.
+			n, next := dialectSignedNumber(body, i+1)
+			out.WriteString(" k" + n + " ")
+			i = next
+		case ch == 'p':
+			n, next := dialectNumber(body, i+1)
+			v, _ := strconv.Atoi(n)
+			out.WriteString(" p" + strconv.Itoa(mdxPan(v)) + " ")
+			i = next
+		case ch == 'y':
+			reg, data, next, err := mdxRegisterWrite(body, i+1)
+			if err != nil {
+				return err
+			}
+			out.WriteString(mdxRegister(reg, data, channel))
+			i = next
+		case startsWithWord(body, i, "@t"):
+			n, next := dialectNumber(body, i+2)
+			v, err := strconv.Atoi(n)
+			if err != nil || v < 0 || v > 255 {
+				return fmt.Errorf("invalid timer-B tempo %q", body[i:next])
+			}
+			fmt.Fprintf(out, " t%d ", mdxTimerBTempo(v))
+			i = next
+		case startsWithWord(body, i, "@v") || startsWithWord(body, i, "@q"):
+			n, next := dialectNumber(body, i+2)
+			out.WriteString(" " + body[i:i+2] + n + " ")
+			i = next
+		case ch == '@':
+			n, next := dialectNumber(body, i+1)
+			if n == "" {
+				return fmt.Errorf("unsupported command %q", body[i:min(i+3, len(body))])
+			}
+			out.WriteString(" @" + n + " ")
+			i = next
+		default:
+			return fmt.Errorf("unsupported command %q", string(ch))
+		}
+	}
+	return nil
+}
+
+// mdxPan maps mxdrv's output select (0 off, 1 left, 2 right, 3 both) onto p.
+func mdxPan(v int) int {
+	switch v {
+	case 1:
+		return 0
+	case 2:
+		return 8
+	}
+	return 4
+}
+
+// mdxTimerBTempo converts an OPM timer-B value into BPM at mxdrv's 48 clocks
+// per quarter note.
+func mdxTimerBTempo(n int) int {
+	return int(math.Round(4000000.0 * 60 / (48 * 1024 * float64(256-n))))
+}
+
+func mdxRegisterWrite(body string, at int) (int, int, int, error) {
+	reg, next, err := mdxByte(body, at)
+	if err != nil {
+		return 0, 0, at, err
+	}
+	if next >= len(body) || body[next] != ',' {
+		return 0, 0, at, fmt.Errorf("expected y register,data")
+	}
+	data, next, err := mdxByte(body, next+1)
+	if err != nil {
+		return 0, 0, at, err
+	}
+	return reg, data, next, nil
+}
+
+// mdxByte reads a decimal or $-prefixed hex byte.
+func mdxByte(body string, at int) (int, int, error) {
+	for at < len(body) && isSpace(body[at]) {
+		at++
+	}
+	base := 10
+	if at < len(body) && body[at] == '$' {
+		base = 16
+		at++
+	}
+	start := at
+	for at < len(body) && strings.IndexByte("0123456789abcdefABCDEF", body[at]) >= 0 && (base == 16 || isDigit(body[at])) {
+		at++
+	}
+	v, err := strconv.ParseInt(body[start:at], base, 32)
+	if err != nil || v < 0 || v > 255 {
+		return 0, at, fmt.Errorf("invalid register value %q", body[start:at])
+	}
+	return int(v), at, nil
+}
+
+// mdxRegister maps a y register write onto SiON commands. Only the
+// channel's RL/FB/CON register ($20+ch) has an equivalent; other writes are
+// dropped.
+func mdxRegister(reg, data, channel int) string {
+	if channel < 0 || reg != 0x20+channel {
+		return ""
+	}
+	pan := 4
+	switch data >> 6 {
+	case 1:
+		pan = 0
+	case 2:
+		pan = 8
+	}
+	return fmt.Sprintf(" @al4,%d @fb%d p%d ", data&7, (data>>3)&7, pan)
+}
@@ -0,0 +1,103 @@
+package mml
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const mdxVoice = `@12={
+/*  AR  DR  SR  RR  SL  OL  KS  ML DT1 DT2 AME */
+    31, 18,  0,  6,  2, 36,  0, 10,  3,  0,  0,
+    31, 14,  4,  6,  2, 45,  0,  0,  3,  0,  0,
+    31, 10,  3,  6,  2, 18,  1,  0,  3,  0,  0,
+    31, 10,  3,  6,  2,  0,  1,  0,  3,  0,  0,
+/*  CON  FL  OP */
+     4,   7, 15 }
+`
+
+func TestParseMDXVoicesAndTracks(t *testing.T) {
+	src := "#title \"demo\"\n" + mdxVoice + `
+A t120 @12 v12 o4 l8 a b L [c / d]3
+B @t200 o3 c D-16 p1 y$21,$5c y$20,7
+P c
+`
+	score, patches, err := NewParser(DefaultParserConfig()).ParseMDX(src)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	data := patches[12]
+	if len(data) != 2+4*11 || data[0] != 4 || data[1] != 7 || data[2] != 31 || data[7] != 36 || data[45] != 0 {
+		t.Fatalf("unexpected patch data %v", data)
+	}
+	if !strings.HasPrefix(score.Definitions["OPM@12"], "OPM@12{4,7,31,18,") {
+		t.Fatalf("expected #OPM@12 definition, got %q", score.Definitions["OPM@12"])
+	}
+	if score.Definitions["TITLE"] != "demo" {
+		t.Fatalf("expected title, got %#v", score.Definitions)
+	}
+	if len(score.Tracks) != 3 || score.Tracks[0].Name != "A" || score.Tracks[1].Name != "B" || score.Tracks[2].Name != "P" {
+		t.Fatalf("expected tracks A, B, P, got %d", len(score.Tracks))
+	}
+
+	a := score.Tracks[0]
+	var notes []int
+	for _, ev := range a.Events {
+		if ev.Type == EventNote {
+			notes = append(notes, ev.Note)
+		}
+	}
+	// mxdrv o4a is A4; the loop plays c d c d c.
+	want := []int{69, 71, 60, 62, 60, 62, 60}
+	if len(notes) != len(want) {
+		t.Fatalf("expected notes %v, got %v", want, notes)
+	}
+	for i := range want {
+		if notes[i] != want[i] {
+			t.Fatalf("expected notes %v, got %v", want, notes)
+		}
+	}
+	if a.LoopTick != DefaultParserConfig().Resolution/4 {
+		t.Fatalf("expected L after two eighth notes, got tick %d", a.LoopTick)
+	}
+
+	b := score.Tracks[1]
+	var got []string
+	for _, ev := range b.Events {
+		switch ev.Type {
+		case EventModule:
+			got = append(got, "%"+strconv.Itoa(ev.Module)+","+strconv.Itoa(ev.Channel))
+		case EventTempo:
+			got = append(got, "t"+strconv.Itoa(ev.Value))
+		case EventDetune:
+			got = append(got, "k"+strconv.Itoa(ev.Value))
+		case EventPan:
+			got = append(got, "pan"+strconv.Itoa(ev.Value))
+		case EventControl:
+			got = append(got, ev.Command+strconv.Itoa(ev.Value)+ev.Text)
+		}
+	}
+	// $5c: L only, FB 3, CON 4. The write to channel 0's register is dropped.
+	if strings.Join(got, " ") != "%6,1 t87 k-16 pan-64 @al4,4 @fb3 pan-64" {
+		t.Fatalf("unexpected track B controls %v", got)
+	}
+	if p := score.Tracks[2]; p.Events[0].Type != EventModule || p.Events[0].Module != mdxPCMModule {
+		t.Fatalf("expected PCM track on module %d, got %#v", mdxPCMModule, p.Events[0])
+	}
+}
+
+func TestParseMDXErrors(t *testing.T) {
+	cases := map[string]string{
+		"@1={ 1, 2, 3 }":   "line 1: @1: expected 47 values, got 3",
+		"A c\nQ c":         "line 2: track Q: PCM8 tracks are not supported",
+		"A c { d }":        "line 1: track A: unsupported command \"{\"",
+		"\nB y$20":         "line 2: track B: expected y register,data",
+		"A c\n\nB @t300 c": "line 3: track B: invalid timer-B tempo \"@t300\"",
+	}
+	for src, want := range cases {
+		_, _, err := NewParser(DefaultParserConfig()).ParseMDX(src)
+		if err == nil || err.Error() != want {
+			t.Fatalf("%q: expected error %q, got %v", src, want, err)
+		}
+	}
+}
@@ -17,25 +17,25 @@ type Parser struct{ cfg ParserConfig }
 func NewParser(cfg ParserConfig) *Parser { return &Parser{cfg: cfg} }
 
 func (p *Parser) Parse(input string) (*Score, error) {
-	preprocessed := preprocessInput(input)
-	parts := splitSectionsAsTracks(preprocessed.text)
-	tmode, tunit, tfps := parseTMODE(preprocessed.definitions)
-	opts := parserOptions{
-		quantMax:  parseQuantMax(preprocessed.definitions),
-		tempoMode: tmode,
-		tempoUnit: tunit,
-		tempoFPS:  tfps,
+	preprocessed, err := preprocessInput(input, p.cfg.Limits)
+	if err != nil {
+		return nil, err
 	}
+	parts := splitTrackParts(preprocessed.text)
+	describeTracks(parts, input, preprocessed.origins, preprocessed.names)
+	opts := parseOptions(preprocessed.definitions)
 	tracks := make([]Track, 0, len(parts))
+	events := 0
 	for _, part := range parts {
-		if strings.TrimSpace(part) == "" {
-			continue
+		tr, _, err := p.parseTrack(part.text, opts, preprocessed.definitions)
+		if err == nil {
+			events += len(tr.Events)
+			err = checkEventCount(events, p.cfg.Limits)
 		}
-		tr, _, err := p.parseTrack(part, opts, preprocessed.definitions)
 		if err != nil {
-			return nil, err
+			return nil, part.wrapError(len(tracks), err)
 		}
-		tracks = append(tracks, tr)
+		tracks = append(tracks, part.label(tr))
 	}
 	return &Score{
 		Resolution:  p.cfg.Resolution,
@@ -52,8 +52,18 @@ type parserOptions struct {
 	tempoFPS  int
 }
 
+func parseOptions(defs map[string]string) parserOptions {
+	tmode, tunit, tfps := parseTMODE(defs)
+	return parserOptions{
+		quantMax:  parseQuantMax(defs),
+		tempoMode: tmode,
+		tempoUnit: tunit,
+		tempoFPS:  tfps,
+	}
+}
+
 func (p *Parser) parseTrack(input string, opts parserOptions, defs map[string]string) (Track, float64, error) {
-	expanded, err := expandLoops(input)
+	expanded, err := expandLoops(input, p.cfg.Limits)
 	if err != nil {
 		return Track{}, 0, err
 	}
@@ -62,106 +72,102 @@ func (p *Parser) parseTrack(input string, opts parserOptions, defs map[string]st
 	i := 0
 	loopTick, loopIndex := -1, -1
 	for i < len(expanded) {
-		ch := lower(expanded[i])
-		if isSpace(ch) {
+		if err := checkEventCount(len(events), p.cfg.Limits); err != nil {
+			return Track{}, 0, err
+		}
+		if isSpace(expanded[i]) {
 			i++
 			continue
 		}
-		switch {
-		case ch == 'n' && i+1 < len(expanded) && unicode.IsDigit(rune(expanded[i+1])):
-			evt, stepDur, next, e := parseNoteByNumber(expanded, i, st)
+		// Each command reads its arguments from its own token, so it stops
+		// where the scanner says it does.
+		at := i
+		op, end := scanTrackToken(expanded, at)
+		tok := expanded[:end]
+		i = end
+		switch op {
+		case opNoteNumber, opNote:
+			parse := parseNote
+			if op == opNoteNumber {
+				parse = parseNoteByNumber
+			}
+			evt, stepDur, _, e := parse(tok, at, st)
 			if e != nil {
 				return Track{}, 0, e
 			}
 			events = append(events, evt)
 			st.slurMode = SlurNone
 			st.tick += stepDur
-			i = next
-		case isNote(ch):
-			evt, stepDur, next, e := parseNote(expanded, i, st)
-			if e != nil {
-				return Track{}, 0, e
-			}
-			events = append(events, evt)
-			st.slurMode = SlurNone
-			st.tick += stepDur
-			i = next
-		case ch == 'r':
-			dur, next, e := parseLengthWithTie(expanded, i+1, st)
+		case opRest:
+			dur, _, e := parseLengthWithTie(tok, at+1, st)
 			if e != nil {
 				return Track{}, 0, e
 			}
 			events = append(events, Event{Type: EventRest, Tick: st.tick, Duration: dur})
 			st.tick += dur
-			i = next
-		case ch == 'l':
-			length, next, e := parseLengthToken(expanded, i+1, st)
+		case opLength:
+			length, _, e := parseLengthToken(tok, at+1, st)
 			if e != nil {
 				return Track{}, 0, e
 			}
 			st.defaultLen = length
-			i = next
-		case ch == 't':
-			val, next, e := parseNumberDefault(expanded, i+1, int(st.bpm))
+		case opTempo:
+			val, next, e := parseNumberDefault(tok, at+1, int(st.bpm))
 			if e != nil {
 				return Track{}, 0, e
 			}
 			bpm := applyTMODETempo(val, opts)
 			st.bpm = bpm
-			events = append(events, Event{Type: EventTempo, Tick: st.tick, Value: int(math.Round(bpm))})
-			i = next
-		case ch == 'o':
-			val, next, e := parseNumberDefault(expanded, i+1, st.octave)
+			// t bpm,length ramps to bpm over a note length instead of jumping.
+			ramp := 0
+			if next < len(tok) && tok[next] == ',' {
+				ramp, _, e = parseLengthWithTie(tok, next+1, st)
+				if e != nil {
+					return Track{}, 0, e
+				}
+			}
+			events = append(events, Event{Type: EventTempo, Tick: st.tick, Duration: ramp, Value: int(math.Round(bpm))})
+		case opOctave:
+			val, _, e := parseNumberDefault(tok, at+1, st.octave)
 			if e != nil {
 				return Track{}, 0, e
 			}
 			if val < p.cfg.MinOctave || val > p.cfg.MaxOctave {
-				return Track{}, 0, fmt.Errorf("octave out of range at %d", i)
+				return Track{}, 0, fmt.Errorf("octave out of range at %d", at)
 			}
 			st.octave = val
-			i = next
-		case strings.HasPrefix(expanded[i:], "«"):
+		case opOctaveUp2:
 			st.octave += 2 * p.cfg.OctavePolarize
 			st.octave = clampInt(st.octave, p.cfg.MinOctave, p.cfg.MaxOctave)
-			i += len("«")
-		case strings.HasPrefix(expanded[i:], "»"):
+		case opOctaveDown2:
 			st.octave -= 2 * p.cfg.OctavePolarize
 			st.octave = clampInt(st.octave, p.cfg.MinOctave, p.cfg.MaxOctave)
-			i += len("»")
-		case ch == '<':
-			val, next, e := parseNumberDefault(expanded, i+1, 1)
+		case opOctaveUp, opOctaveDown:
+			val, _, e := parseNumberDefault(tok, at+1, 1)
 			if e != nil {
 				return Track{}, 0, e
 			}
-			st.octave += val * p.cfg.OctavePolarize
-			st.octave = clampInt(st.octave, p.cfg.MinOctave, p.cfg.MaxOctave)
-			i = next
-		case ch == '>':
-			val, next, e := parseNumberDefault(expanded, i+1, 1)
-			if e != nil {
-				return Track{}, 0, e
+			if op == opOctaveDown {
+				val = -val
 			}
-			st.octave -= val * p.cfg.OctavePolarize
+			st.octave += val * p.cfg.OctavePolarize
 			st.octave = clampInt(st.octave, p.cfg.MinOctave, p.cfg.MaxOctave)
-			i = next
-		case ch == 'v':
-			val, next, e := parseNumberDefault(expanded, i+1, st.volume)
+		case opVolume:
+			val, _, e := parseNumberDefault(tok, at+1, st.volume)
 			if e != nil {
 				return Track{}, 0, e
 			}
 			st.volume = val
 			events = append(events, Event{Type: EventVolume, Tick: st.tick, Value: val})
-			i = next
-		case ch == 'x':
-			val, next, e := parseNumberDefault(expanded, i+1, st.expression)
+		case opExpression:
+			val, _, e := parseNumberDefault(tok, at+1, st.expression)
 			if e != nil {
 				return Track{}, 0, e
 			}
 			st.expression = clampInt(val, 0, 128)
 			events = append(events, Event{Type: EventExpression, Tick: st.tick, Value: st.expression})
-			i = next
-		case ch == 'q':
-			val, next, e := parseNumberDefault(expanded, i+1, st.quantValue)
+		case opQuantize:
+			val, _, e := parseNumberDefault(tok, at+1, st.quantValue)
 			if e != nil {
 				return Track{}, 0, e
 			}
@@ -169,157 +175,131 @@ func (p *Parser) parseTrack(input string, opts parserOptions, defs map[string]st
 			st.quantValue = val
 			st.gatePercent = (val * 100) / st.quantMax
 			events = append(events, Event{Type: EventQuantize, Tick: st.tick, Value: val})
-			i = next
-		case ch == 'k':
-			if i+1 < len(expanded) && lower(expanded[i+1]) == 't' {
-				val, next, e := parseSignedNumberDefault(expanded, i+2, st.transpose)
-				if e != nil {
-					return Track{}, 0, e
-				}
-				st.transpose = val
-				events = append(events, Event{Type: EventTranspose, Tick: st.tick, Value: val})
-				i = next
-				continue
+		case opTranspose:
+			val, _, e := parseSignedNumberDefault(tok, at+2, st.transpose)
+			if e != nil {
+				return Track{}, 0, e
 			}
-			val, next, e := parseSignedNumberDefault(expanded, i+1, st.detune)
+			st.transpose = val
+			events = append(events, Event{Type: EventTranspose, Tick: st.tick, Value: val})
+		case opDetune:
+			val, _, e := parseSignedNumberDefault(tok, at+1, st.detune)
 			if e != nil {
 				return Track{}, 0, e
 			}
 			st.detune = val
 			events = append(events, Event{Type: EventDetune, Tick: st.tick, Value: val})
-			i = next
-		case ch == 'p':
-			if i+1 < len(expanded) && lower(expanded[i+1]) == 'o' {
-				val, next, e := parseSignedNumberDefault(expanded, i+2, 0)
-				if e != nil {
-					return Track{}, 0, e
-				}
-				events = append(events, Event{Type: EventControl, Tick: st.tick, Command: "po", Value: val})
-				i = next
-				continue
+		case opPan, opAtPan:
+			start := at + 1
+			if op == opAtPan {
+				start = at + 2
 			}
-			val, next, e := parseSignedNumberDefault(expanded, i+1, st.pan)
+			val, _, e := parseSignedNumberDefault(tok, start, st.pan)
 			if e != nil {
 				return Track{}, 0, e
 			}
 			st.pan = normalizePanValue(val)
 			events = append(events, Event{Type: EventPan, Tick: st.tick, Value: st.pan})
-			i = next
-		case ch == '%':
-			if i+1 < len(expanded) && (lower(expanded[i+1]) == 'f' || lower(expanded[i+1]) == 't' || lower(expanded[i+1]) == 'e') {
-				cmd := "%" + string(lower(expanded[i+1]))
-				val, next, e := parseSignedNumberDefault(expanded, i+2, 0)
-				if e != nil {
-					return Track{}, 0, e
-				}
-				values := []int{val}
-				for next < len(expanded) && expanded[next] == ',' {
-					arg, n2, e2 := parseSignedNumberDefault(expanded, next+1, 0)
-					if e2 != nil {
-						return Track{}, 0, e2
-					}
-					values = append(values, arg)
-					next = n2
+		case opControl:
+			cmd := "%" + string(lower(tok[at+1]))
+			val, next, e := parseSignedNumberDefault(tok, at+2, 0)
+			if e != nil {
+				return Track{}, 0, e
+			}
+			values := []int{val}
+			for next < len(tok) && tok[next] == ',' {
+				arg, n2, e2 := parseSignedNumberDefault(tok, next+1, 0)
+				if e2 != nil {
+					return Track{}, 0, e2
 				}
-				events = append(events, Event{Type: EventControl, Tick: st.tick, Command: cmd, Value: val, Values: values})
-				i = next
-				continue
+				values = append(values, arg)
+				next = n2
 			}
-			if i+1 < len(expanded) && (lower(expanded[i+1]) == 'v' || lower(expanded[i+1]) == 'x') {
-				scaleName := lower(expanded[i+1])
-				val, next, e := parseNumberDefault(expanded, i+2, 0)
-				if e != nil {
-					return Track{}, 0, e
+			events = append(events, Event{Type: EventControl, Tick: st.tick, Command: cmd, Value: val, Values: values})
+		case opVolumeScale:
+			mode, next, e := parseNumberDefault(tok, at+2, 0)
+			if e != nil {
+				return Track{}, 0, e
+			}
+			max := st.vScaleMax
+			if next < len(tok) && tok[next] == ',' {
+				mv, _, e2 := parseNumberDefault(tok, next+1, 0)
+				if e2 != nil {
+					return Track{}, 0, e2
 				}
-				if scaleName == 'v' {
-					mode := val
-					max := st.vScaleMax
-					if next < len(expanded) && expanded[next] == ',' {
-						mv, n2, e2 := parseNumberDefault(expanded, next+1, 0)
-						if e2 != nil {
-							return Track{}, 0, e2
-						}
-						// Spec: n2 = max value of v computed as 256 >> n2.
-						if mv > 0 {
-							max = 256 >> mv
-						}
-						next = n2
-					}
-					if max <= 0 {
-						max = 16
-					}
-					st.vScaleMode = mode
-					st.vScaleMax = max
-					events = append(events, Event{
-						Type:    EventControl,
-						Tick:    st.tick,
-						Command: "%v",
-						Value:   mode,
-						Values:  []int{mode, max},
-					})
-				} else {
-					st.xScaleMode = val
-					events = append(events, Event{
-						Type:    EventControl,
-						Tick:    st.tick,
-						Command: "%x",
-						Value:   val,
-						Values:  []int{val},
-					})
+				// Spec: n2 = max value of v computed as 256 >> n2.
+				if mv > 0 {
+					max = 256 >> mv
 				}
-				i = next
-				continue
 			}
-			mod, next, e := parseNumberDefault(expanded, i+1, st.module)
+			if max <= 0 {
+				max = 16
+			}
+			st.vScaleMode = mode
+			st.vScaleMax = max
+			events = append(events, Event{
+				Type:    EventControl,
+				Tick:    st.tick,
+				Command: "%v",
+				Value:   mode,
+				Values:  []int{mode, max},
+			})
+		case opExpressionScale:
+			val, _, e := parseNumberDefault(tok, at+2, 0)
+			if e != nil {
+				return Track{}, 0, e
+			}
+			st.xScaleMode = val
+			events = append(events, Event{
+				Type:    EventControl,
+				Tick:    st.tick,
+				Command: "%x",
+				Value:   val,
+				Values:  []int{val},
+			})
+		case opModule:
+			mod, next, e := parseNumberDefault(tok, at+1, st.module)
 			if e != nil {
 				return Track{}, 0, e
 			}
 			st.module = mod
 			st.channel = 0
-			if next < len(expanded) && expanded[next] == ',' {
-				chv, n2, e2 := parseNumberDefault(expanded, next+1, 0)
+			if next < len(tok) && tok[next] == ',' {
+				chv, _, e2 := parseNumberDefault(tok, next+1, 0)
 				if e2 != nil {
 					return Track{}, 0, e2
 				}
 				st.channel = chv
-				next = n2
 			}
 			events = append(events, Event{Type: EventModule, Tick: st.tick, Module: st.module, Channel: st.channel})
-			i = next
-		case ch == '&':
-			if i+1 < len(expanded) && expanded[i+1] == '&' {
-				st.slurMode = SlurWeak
-				events = append(events, Event{Type: EventSlur, Tick: st.tick, Slur: SlurWeak})
-				i += 2
-				continue
-			}
+		case opSlurWeak:
+			st.slurMode = SlurWeak
+			events = append(events, Event{Type: EventSlur, Tick: st.tick, Slur: SlurWeak})
+		case opSlur:
 			st.slurMode = SlurNormal
 			events = append(events, Event{Type: EventSlur, Tick: st.tick, Slur: SlurNormal})
-			i++
-		case ch == 's':
-			// sustain/release command: s n1,n2 where n1=release rate, n2=pitch sweep.
-			val, next, e := parseSignedNumberDefault(expanded, i+1, 0)
+		case opRelease:
+			// sustain/release command: s n1,n2 where n1=release rate (default 28), n2=pitch sweep.
+			val, next, e := parseSignedNumberDefault(tok, at+1, 28)
 			if e != nil {
 				return Track{}, 0, e
 			}
 			values := []int{val}
-			if next < len(expanded) && expanded[next] == ',' {
-				v2, n2, e2 := parseSignedNumberDefault(expanded, next+1, 0)
+			if next < len(tok) && tok[next] == ',' {
+				v2, _, e2 := parseSignedNumberDefault(tok, next+1, 0)
 				if e2 != nil {
 					return Track{}, 0, e2
 				}
 				values = append(values, v2)
-				next = n2
 			}
 			events = append(events, Event{Type: EventControl, Tick: st.tick, Command: "s", Value: val, Values: values})
-			i = next
-		case ch == '(' || ch == ')':
+		case opVolumeUp, opVolumeDown:
 			// volume shift shorthand
-			shift, next, e := parseNumberDefault(expanded, i+1, 1)
+			shift, _, e := parseNumberDefault(tok, at+1, 1)
 			if e != nil {
 				return Track{}, 0, e
 			}
-			up := ch == '('
+			up := op == opVolumeUp
 			if st.revVolume {
 				up = !up
 			}
@@ -330,107 +310,75 @@ func (p *Parser) parseTrack(input string, opts parserOptions, defs map[string]st
 			}
 			st.volume = clampInt(st.volume, 0, 127)
 			events = append(events, Event{Type: EventVolume, Tick: st.tick, Value: st.volume})
-			i = next
-		case ch == '@':
-			if i+1 < len(expanded) && lower(expanded[i+1]) == 'v' {
-				val, next, e := parseNumberDefault(expanded, i+2, st.fineVol)
-				if e != nil {
-					return Track{}, 0, e
-				}
-				values := []int{val}
-				for next < len(expanded) && expanded[next] == ',' {
-					arg, n2, e2 := parseNumberDefault(expanded, next+1, 0)
-					if e2 != nil {
-						return Track{}, 0, e2
-					}
-					values = append(values, arg)
-					next = n2
-				}
-				st.fineVol = val
-				events = append(events, Event{Type: EventFineVolume, Tick: st.tick, Value: val, Values: values})
-				i = next
-				continue
+		case opFineVolume:
+			val, next, e := parseNumberDefault(tok, at+2, st.fineVol)
+			if e != nil {
+				return Track{}, 0, e
 			}
-			if i+1 < len(expanded) && lower(expanded[i+1]) == 'q' {
-				off, next, e := parseNumberDefault(expanded, i+2, st.keyOffTick)
-				if e != nil {
-					return Track{}, 0, e
-				}
-				convertedOff := convertQuarter192ToTicks(off, st.resolution)
-				if convertedOff <= 0 {
-					convertedOff = -1
-				}
-				st.keyOffTick = convertedOff
-				st.keyOnDelay = 0
-				if next < len(expanded) && expanded[next] == ',' {
-					delay, n2, e2 := parseNumberDefault(expanded, next+1, 0)
-					if e2 != nil {
-						return Track{}, 0, e2
-					}
-					st.keyOnDelay = convertQuarter192ToTicks(delay, st.resolution)
-					next = n2
+			values := []int{val}
+			for next < len(tok) && tok[next] == ',' {
+				arg, n2, e2 := parseNumberDefault(tok, next+1, 0)
+				if e2 != nil {
+					return Track{}, 0, e2
 				}
-				events = append(events, Event{Type: EventKeyOnDelay, Tick: st.tick, GateTick: st.keyOffTick, Delay: st.keyOnDelay})
-				i = next
-				continue
+				values = append(values, arg)
+				next = n2
 			}
-			if startsWithWord(expanded, i, "@p") {
-				val, next, e := parseSignedNumberDefault(expanded, i+2, st.pan)
-				if e != nil {
-					return Track{}, 0, e
-				}
-				st.pan = normalizePanValue(val)
-				events = append(events, Event{Type: EventPan, Tick: st.tick, Value: st.pan})
-				i = next
-				continue
+			st.fineVol = val
+			events = append(events, Event{Type: EventFineVolume, Tick: st.tick, Value: val, Values: values})
+		case opKeyOff:
+			off, next, e := parseNumberDefault(tok, at+2, st.keyOffTick)
+			if e != nil {
+				return Track{}, 0, e
 			}
-			if startsWithWord(expanded, i, "@mask") {
-				val, next, e := parseNumberDefault(expanded, i+5, 0)
-				if e != nil {
-					return Track{}, 0, e
-				}
-				events = append(events, Event{Type: EventControl, Tick: st.tick, Command: "@mask", Value: clampInt(val, 0, 63)})
-				i = next
-				continue
+			convertedOff := convertQuarter192ToTicks(off, st.resolution)
+			if convertedOff <= 0 {
+				convertedOff = -1
 			}
-			if i+1 < len(expanded) && isAlpha(lower(expanded[i+1])) {
-				cmdStart := i + 1
-				cmdEnd := cmdStart
-				for cmdEnd < len(expanded) && isAlpha(lower(expanded[cmdEnd])) {
-					cmdEnd++
-				}
-				cmd := strings.ToLower(expanded[cmdStart:cmdEnd])
-				first := 0
-				next := cmdEnd
-				if cmdEnd < len(expanded) {
-					if v, n2, e := parseSignedNumberDefault(expanded, cmdEnd, 0); e == nil {
-						first = v
-						next = n2
-					}
-				}
-				// Parse optional comma arguments and preserve raw tail text for compatibility.
-				tailStart := next
-				for next < len(expanded) && (expanded[next] == ',' || expanded[next] == '+' || expanded[next] == '-' || (expanded[next] >= '0' && expanded[next] <= '9') || isSpace(expanded[next])) {
-					next++
+			st.keyOffTick = convertedOff
+			st.keyOnDelay = 0
+			if next < len(tok) && tok[next] == ',' {
+				delay, _, e2 := parseNumberDefault(tok, next+1, 0)
+				if e2 != nil {
+					return Track{}, 0, e2
 				}
-				events = append(events, Event{
-					Type:    EventControl,
-					Tick:    st.tick,
-					Command: "@" + cmd,
-					Value:   first,
-					Text:    strings.TrimSpace(expanded[tailStart:next]),
-				})
-				i = next
-				continue
+				st.keyOnDelay = convertQuarter192ToTicks(delay, st.resolution)
+			}
+			events = append(events, Event{Type: EventKeyOnDelay, Tick: st.tick, GateTick: st.keyOffTick, Delay: st.keyOnDelay})
+		case opMask:
+			val, _, e := parseNumberDefault(tok, at+5, 0)
+			if e != nil {
+				return Track{}, 0, e
+			}
+			events = append(events, Event{Type: EventControl, Tick: st.tick, Command: "@mask", Value: clampInt(val, 0, 63)})
+		case opAtCommand:
+			next := at + 1
+			for next < len(tok) && isAlpha(tok[next]) {
+				next++
 			}
-			val, next, e := parseNumberDefault(expanded, i+1, st.program)
+			cmd := strings.ToLower(tok[at+1 : next])
+			first := 0
+			if v, n2, e := parseSignedNumberDefault(tok, next, 0); e == nil {
+				first = v
+				next = n2
+			}
+			// Keep the optional comma arguments as raw tail text for compatibility.
+			events = append(events, Event{
+				Type:    EventControl,
+				Tick:    st.tick,
+				Command: "@" + cmd,
+				Value:   first,
+				Text:    strings.TrimSpace(tok[next:]),
+			})
+		case opProgram:
+			val, next, e := parseNumberDefault(tok, at+1, st.program)
 			if e != nil {
 				return Track{}, 0, e
 			}
 			st.program = val
 			args := []int{}
-			for next < len(expanded) && expanded[next] == ',' {
-				arg, n2, e2 := parseNumberDefault(expanded, next+1, 0)
+			for next < len(tok) && tok[next] == ',' {
+				arg, n2, e2 := parseNumberDefault(tok, next+1, 0)
 				if e2 != nil {
 					break
 				}
@@ -442,76 +390,49 @@ func (p *Parser) parseTrack(input string, opts parserOptions, defs map[string]st
 				evt.Values = args
 			}
 			events = append(events, evt)
-			i = next
-		case ch == '$':
+		case opLoopPoint:
 			loopTick, loopIndex = st.tick, len(events)
-			i++
-		default:
-			// parser-level fallback coverage for commands we do not fully
-			// synthesize yet but still need to keep in the control stream.
-			if startsWithWord(expanded, i, "kt") {
-				val, next, e := parseSignedNumberDefault(expanded, i+2, st.transpose)
-				if e != nil {
-					return Track{}, 0, e
-				}
-				st.transpose = val
-				events = append(events, Event{Type: EventTranspose, Tick: st.tick, Value: val})
-				i = next
-				continue
+		case opOperator:
+			// i selects the FM operator later @tl/@rr/@ml/@dt/@fx modify.
+			val, _, e := parseSignedNumberDefault(tok, at+1, 0)
+			if e != nil {
+				return Track{}, 0, e
 			}
-			if startsWithWord(expanded, i, "po") || ch == '*' {
-				cmd := string(ch)
-				advance := i + 1
-				if startsWithWord(expanded, i, "po") {
-					cmd = "po"
-					advance = i + 2
-				}
-				val, next, e := parseSignedNumberDefault(expanded, advance, 0)
-				if e != nil {
-					return Track{}, 0, e
-				}
-				events = append(events, Event{Type: EventControl, Tick: st.tick, Command: cmd, Value: val})
-				i = next
-				continue
+			events = append(events, Event{Type: EventControl, Tick: st.tick, Command: "i", Value: val})
+		case opPortamento, opSlide:
+			cmd, start := "*", at+1
+			if op == opPortamento {
+				cmd, start = "po", at+2
 			}
-			if startsWithWord(expanded, i, "mp") || startsWithWord(expanded, i, "ma") || startsWithWord(expanded, i, "mf") {
-				cmd := strings.ToLower(expanded[i : i+2])
-				val, next, e := parseSignedNumberDefault(expanded, i+2, 0)
-				if e != nil {
-					return Track{}, 0, e
-				}
-				tailStart := next
-				for next < len(expanded) && (expanded[next] == ',' || expanded[next] == '+' || expanded[next] == '-' || (expanded[next] >= '0' && expanded[next] <= '9') || isSpace(expanded[next])) {
-					next++
-				}
-				events = append(events, Event{
-					Type:    EventControl,
-					Tick:    st.tick,
-					Command: cmd,
-					Value:   val,
-					Text:    strings.TrimSpace(expanded[tailStart:next]),
-				})
-				i = next
-				continue
+			val, _, e := parseSignedNumberDefault(tok, start, 0)
+			if e != nil {
+				return Track{}, 0, e
 			}
-			if startsWithWord(expanded, i, "na") || startsWithWord(expanded, i, "np") || startsWithWord(expanded, i, "nt") || startsWithWord(expanded, i, "nf") ||
-				startsWithWord(expanded, i, "_na") || startsWithWord(expanded, i, "_np") || startsWithWord(expanded, i, "_nt") || startsWithWord(expanded, i, "_nf") ||
-				startsWithWord(expanded, i, "@@") || startsWithWord(expanded, i, "_@@") {
-				cmd, next := parseWordToken(expanded, i)
-				val, n2, _ := parseSignedNumberDefault(expanded, next, 0)
-				step := 1
-				values := []int{val}
-				if n2 < len(expanded) && expanded[n2] == ',' {
-					v2, n3, _ := parseNumberDefault(expanded, n2+1, 1)
-					step = v2
-					values = append(values, v2)
-					n2 = n3
-				}
-				events = append(events, Event{Type: EventTableEnv, Tick: st.tick, Command: cmd, Value: val, Delay: step, Values: values})
-				i = n2
-				continue
+			events = append(events, Event{Type: EventControl, Tick: st.tick, Command: cmd, Value: val})
+		case opModulation:
+			cmd := strings.ToLower(tok[at : at+2])
+			val, next, e := parseSignedNumberDefault(tok, at+2, 0)
+			if e != nil {
+				return Track{}, 0, e
 			}
-			i++
+			events = append(events, Event{
+				Type:    EventControl,
+				Tick:    st.tick,
+				Command: cmd,
+				Value:   val,
+				Text:    strings.TrimSpace(tok[next:]),
+			})
+		case opTableEnv:
+			cmd, next := parseWordToken(tok, at)
+			val, n2, _ := parseSignedNumberDefault(tok, next, 0)
+			step := 1
+			values := []int{val}
+			if n2 < len(tok) && tok[n2] == ',' {
+				v2, _, _ := parseNumberDefault(tok, n2+1, 1)
+				step = v2
+				values = append(values, v2)
+			}
+			events = append(events, Event{Type: EventTableEnv, Tick: st.tick, Command: cmd, Value: val, Delay: step, Values: values})
 		}
 	}
 	return Track{
@@ -939,21 +860,44 @@ func parseKeySignature(defs map[string]string) map[byte]int {
 type preprocessedInput struct {
 	text        string
 	definitions map[string]string
+	origins     []int // source offset of each byte of text
+	names       []trackName
 }
 
-func preprocessInput(src string) preprocessedInput {
-	noComments := stripComments(src)
+func preprocessInput(src string, limits ParserLimits) (preprocessedInput, error) {
+	noComments, stripped, err := stripSource(src)
+	if err != nil {
+		return preprocessedInput{}, err
+	}
 	state := preprocessorState{
-		macros:      make(map[string]string),
-		definitions: make(map[string]string),
+		macros:         make(map[string]string),
+		definitions:    make(map[string]string),
+		trackPositions: true,
+		limits:         limits,
+	}
+	text := preprocessStream(noComments, &state)
+	if state.err != nil {
+		return preprocessedInput{}, state.err
+	}
+	origins := make([]int, len(state.positions))
+	for i, pos := range state.positions {
+		origins[i] = stripped[pos]
 	}
 	return preprocessedInput{
-		text:        preprocessStream(noComments, &state),
+		text:        text,
 		definitions: state.definitions,
-	}
+		origins:     origins,
+		names:       state.names,
+	}, nil
 }
 
 func stripComments(src string) string {
+	return stripCommentsTracked(src, nil)
+}
+
+// stripCommentsTracked removes comments like stripComments and, when origins
+// is non-nil, records the source offset of every byte it keeps.
+func stripCommentsTracked(src string, origins *[]int) string {
 	var out strings.Builder
 	out.Grow(len(src))
 	for i := 0; i < len(src); i++ {
@@ -975,10 +919,16 @@ func stripComments(src string) string {
 			}
 			if i < len(src) && src[i] == '\n' {
 				out.WriteByte('\n')
+				if origins != nil {
+					*origins = append(*origins, i)
+				}
 			}
 			continue
 		}
 		out.WriteByte(src[i])
+		if origins != nil {
+			*origins = append(*origins, i)
+		}
 	}
 	return out.String()
 }
@@ -989,13 +939,55 @@ type preprocessorState struct {
 	macroDynamic bool
 	revOctave    bool
 	revVolume    bool
+
+	// emitted counts the bytes written so far, so #NAME can mark where in
+	// the preprocessed text it appeared.
+	emitted int
+	names   []trackName
+	// With trackPositions set, positions receives the input offset of each
+	// output byte; macro expansions map to their call site.
+	trackPositions bool
+	positions      []int
+	// With traceMacros set, spans receives every macro expansion written.
+	traceMacros bool
+	spans       []MacroSpan
+
+	// limits bounds macro nesting and the length of the output; err holds
+	// the first limit exceeded, after which expansions come out empty.
+	limits ParserLimits
+	err    error
+}
+
+func (st *preprocessorState) fail(err error) {
+	if st.err == nil {
+		st.err = err
+	}
+}
+
+// checkLength fails once n bytes exceed the expanded length limit.
+func (st *preprocessorState) checkLength(n int, at string) bool {
+	if limit := st.limits.effective().MaxExpandedLen; n > limit {
+		st.fail(&LimitError{Err: ErrExpandedLen, Limit: limit, At: at})
+		return false
+	}
+	return true
 }
 
 func preprocessStream(src string, st *preprocessorState) string {
 	var out strings.Builder
 	out.Grow(len(src))
+	base := st.emitted
+	emit := func(s string, at int) {
+		out.WriteString(s)
+		if st.trackPositions {
+			for k := 0; k < len(s); k++ {
+				st.positions = append(st.positions, at)
+			}
+		}
+	}
 	for i := 0; i < len(src); {
 		if src[i] == '#' {
+			st.emitted = base + out.Len()
 			advance, stopAll := parseDirective(src, i, st)
 			if stopAll {
 				break
@@ -1007,26 +999,41 @@ func preprocessStream(src string, st *preprocessorState) string {
 			name := string(src[i])
 			if _, ok := st.macros[name]; ok {
 				shift, next := parseOptionalSignedParen(src, i+1)
-				out.WriteString(expandMacroByName(name, shift, st, 0))
+				start := base + out.Len()
+				text := expandMacroByName(name, shift, st, 0)
+				if st.err != nil || !st.checkLength(start+len(text), "macro "+name) {
+					break
+				}
+				emit(text, i)
+				if st.traceMacros {
+					st.spans = append(st.spans, MacroSpan{Start: start, End: start + len(text), Name: name, Shift: shift})
+					for _, inner := range nestedMacroSpans(name, shift, st, 0) {
+						inner.Start += start
+						inner.End += start
+						st.spans = append(st.spans, inner)
+					}
+				}
 				i = next
 				continue
 			}
 		}
 		if st.revOctave {
 			if src[i] == '<' {
-				out.WriteByte('>')
+				emit(">", i)
 				i++
 				continue
 			}
 			if src[i] == '>' {
-				out.WriteByte('<')
+				emit("<", i)
 				i++
 				continue
 			}
 		}
-		out.WriteByte(src[i])
+		emit(src[i:i+1], i)
 		i++
 	}
+	st.emitted = base + out.Len()
+	st.checkLength(st.emitted, "")
 	return out.String()
 }
 
@@ -1059,6 +1066,12 @@ func parseDirective(src string, at int, st *preprocessorState) (int, bool) {
 		st.definitions["MACRO_MODE"] = strings.ToLower(strings.TrimSpace(mode))
 		return stmtEnd, false
 	}
+	if strings.HasPrefix(upperBody, "NAME{") {
+		// #NAME{...}; names the track it appears in, or the next one.
+		name := strings.TrimSpace(parseBraceValue(body[len("NAME"):]))
+		st.names = append(st.names, trackName{name: name, at: st.emitted})
+		return stmtEnd, false
+	}
 	if strings.HasPrefix(upperBody, "REV") {
 		// #REV; reverses both octave and volume.
 		opts := strings.ToLower(strings.TrimSpace(parseBraceValue(body[len("REV"):])))
@@ -1075,6 +1088,10 @@ func parseDirective(src string, at int, st *preprocessorState) (int, bool) {
 		st.definitions[key] = val
 		return stmtEnd, false
 	}
+	if isVarDirective(body) {
+		// #VAR is applied before preprocessing; see resolveExpressions.
+		return stmtEnd, false
+	}
 	if applyMacroDefinition(body, st) {
 		return stmtEnd, false
 	}
@@ -1109,6 +1126,7 @@ func parseKnownDirective(body string) (string, string, bool) {
 		strings.HasPrefix(upper, "FM{"),
 		strings.HasPrefix(upper, "EFFECT"),
 		strings.HasPrefix(upper, "SAMPLER"),
+		strings.HasPrefix(upper, "DPCM"),
 		strings.HasPrefix(upper, "PCMWAVE"),
 		strings.HasPrefix(upper, "PCMVOICE"):
 		return extractDirectiveName(upper), body, true
@@ -1241,6 +1259,7 @@ func applyMacroDefinition(stmt string, st *preprocessorState) bool {
 		} else {
 			st.macros[target] = expandedValue
 		}
+		st.checkLength(len(st.macros[target]), "macro "+target)
 	}
 	return true
 }
@@ -1287,14 +1306,20 @@ func parseMacroTargets(spec string) []string {
 	return out
 }
 
+// expandMacroByName returns the text of a call to macro name made inside
+// depth other macros.
 func expandMacroByName(name string, shift int, st *preprocessorState, depth int) string {
-	if depth > 32 {
-		return name
+	if st.err != nil {
+		return ""
 	}
 	body, ok := st.macros[name]
 	if !ok {
 		return name
 	}
+	if limit := st.limits.effective().MaxMacroDepth; depth > limit {
+		st.fail(&LimitError{Err: ErrMacroDepth, Limit: limit, At: "macro " + name})
+		return ""
+	}
 	if st.macroDynamic {
 		body = expandMacroText(body, st, depth+1)
 	}
@@ -1307,10 +1332,42 @@ func expandMacroByName(name string, shift int, st *preprocessorState, depth int)
 	return body
 }
 
-func expandMacroText(src string, st *preprocessorState, depth int) string {
-	if depth > 32 {
-		return src
+// nestedMacroSpans lists the macro calls inside an expansion made by
+// expandMacroByName at depth, relative to the start of the expansion. Static
+// macros are expanded when defined, and transposed bodies are rewritten note
+// by note, so only untransposed dynamic expansions have calls to report.
+func nestedMacroSpans(name string, shift int, st *preprocessorState, depth int) []MacroSpan {
+	if !st.macroDynamic || shift != 0 || st.err != nil {
+		return nil
 	}
+	body := st.macros[name]
+	var spans []MacroSpan
+	pos := 0
+	for i := 0; i < len(body); i++ {
+		ch := body[i]
+		if isMacroName(ch) {
+			if _, ok := st.macros[string(ch)]; ok {
+				// Mirrors expandMacroText(body, st, depth+1).
+				inner, next := parseOptionalSignedParen(body, i+1)
+				text := expandMacroByName(string(ch), inner, st, depth+1)
+				spans = append(spans, MacroSpan{Start: pos, End: pos + len(text), Name: string(ch), Shift: inner, Depth: depth + 1})
+				for _, sp := range nestedMacroSpans(string(ch), inner, st, depth+1) {
+					sp.Start += pos
+					sp.End += pos
+					spans = append(spans, sp)
+				}
+				pos += len(text)
+				i = next - 1
+				continue
+			}
+		}
+		pos++
+	}
+	return spans
+}
+
+// expandMacroText expands the macro calls in src, the body of depth macros.
+func expandMacroText(src string, st *preprocessorState, depth int) string {
 	var out strings.Builder
 	out.Grow(len(src))
 	for i := 0; i < len(src); i++ {
@@ -1318,7 +1375,10 @@ func expandMacroText(src string, st *preprocessorState, depth int) string {
 		if isMacroName(ch) {
 			if _, ok := st.macros[string(ch)]; ok {
 				shift, next := parseOptionalSignedParen(src, i+1)
-				out.WriteString(expandMacroByName(string(ch), shift, st, depth+1))
+				out.WriteString(expandMacroByName(string(ch), shift, st, depth))
+				if st.err != nil || !st.checkLength(out.Len(), "macro "+string(ch)) {
+					return ""
+				}
 				i = next - 1
 				continue
 			}
@@ -1483,51 +1543,75 @@ func min(a, b int) int {
 }
 
 func splitSectionsAsTracks(src string) []string {
-	sections := splitTopLevel(src, ';')
-	nonEmptySections := make([]string, 0, len(sections))
-	for _, section := range sections {
-		section = strings.TrimSpace(section)
-		if section == "" {
+	parts := splitTrackParts(src)
+	out := make([]string, len(parts))
+	for i, part := range parts {
+		out[i] = part.text
+	}
+	return out
+}
+
+// splitTrackParts splits preprocessed text into tracks at top-level ';' and
+// ','. A first section without notes is a global prelude prepended to every
+// track.
+func splitTrackParts(src string) []trackPart {
+	type span struct{ start, end int }
+	sections := make([]span, 0, 8)
+	for _, r := range splitTopLevelRanges(src, ';', 0, len(src)) {
+		start, end := trimRange(src, r[0], r[1])
+		if start == end {
 			continue
 		}
-		nonEmptySections = append(nonEmptySections, section)
+		sections = append(sections, span{start, end})
 	}
-	if len(nonEmptySections) == 0 {
+	if len(sections) == 0 {
 		return nil
 	}
 
 	globalPrelude := ""
 	startSection := 0
-	if len(nonEmptySections) > 1 && !containsPlayableEvents(nonEmptySections[0]) {
-		globalPrelude = nonEmptySections[0]
+	if len(sections) > 1 && !containsPlayableEvents(src[sections[0].start:sections[0].end]) {
+		globalPrelude = src[sections[0].start:sections[0].end]
 		startSection = 1
 	}
 
-	parts := make([]string, 0, len(nonEmptySections)*2)
-	for _, section := range nonEmptySections[startSection:] {
-		for _, part := range splitTopLevel(section, ',') {
-			part = strings.TrimSpace(part)
-			if part == "" {
+	parts := make([]trackPart, 0, len(sections)*2)
+	for idx := startSection; idx < len(sections); idx++ {
+		for _, r := range splitTopLevelRanges(src, ',', sections[idx].start, sections[idx].end) {
+			start, end := trimRange(src, r[0], r[1])
+			if start == end {
 				continue
 			}
+			part := trackPart{text: src[start:end], section: idx, start: start, end: end}
 			if globalPrelude != "" {
-				parts = append(parts, globalPrelude+" "+part)
-			} else {
-				parts = append(parts, part)
+				part.text = globalPrelude + " " + part.text
+				part.preludeStart, part.preludeLen = sections[0].start, len(globalPrelude)+1
 			}
+			parts = append(parts, part)
 		}
 	}
 	if len(parts) == 0 && globalPrelude != "" {
-		parts = append(parts, globalPrelude)
+		parts = append(parts, trackPart{text: globalPrelude, start: sections[0].start, end: sections[0].end})
 	}
 	return parts
 }
 
 func splitTopLevel(src string, sep byte) []string {
+	ranges := splitTopLevelRanges(src, sep, 0, len(src))
+	parts := make([]string, len(ranges))
+	for i, r := range ranges {
+		parts[i] = src[r[0]:r[1]]
+	}
+	return parts
+}
+
+// splitTopLevelRanges splits src[from:to] at sep outside loop brackets and
+// returns the [start, end) offsets of the pieces.
+func splitTopLevelRanges(src string, sep byte, from, to int) [][2]int {
 	depth := 0
-	start := 0
-	parts := make([]string, 0, 4)
-	for i := 0; i < len(src); i++ {
+	start := from
+	parts := make([][2]int, 0, 4)
+	for i := from; i < to; i++ {
 		switch src[i] {
 		case '[':
 			depth++
@@ -1537,18 +1621,26 @@ func splitTopLevel(src string, sep byte) []string {
 			}
 		default:
 			if src[i] == sep && depth == 0 {
-				if sep == ',' && isArgumentComma(src, i) {
+				if sep == ',' && isArgumentComma(src[:to], i) {
 					continue
 				}
-				parts = append(parts, src[start:i])
+				parts = append(parts, [2]int{start, i})
 				start = i + 1
 			}
 		}
 	}
-	parts = append(parts, src[start:])
+	parts = append(parts, [2]int{start, to})
 	return parts
 }
 
+// trimRange narrows [start, end) the way strings.TrimSpace would.
+func trimRange(src string, start, end int) (int, int) {
+	s := src[start:end]
+	trimmed := strings.TrimLeftFunc(s, unicode.IsSpace)
+	start += len(s) - len(trimmed)
+	return start, start + len(strings.TrimRightFunc(trimmed, unicode.IsSpace))
+}
+
 func isArgumentComma(src string, at int) bool {
 	if at < 0 || at >= len(src) || src[at] != ',' {
 		return false
@@ -1620,10 +1712,12 @@ func lower(b byte) byte {
 }
 
 func isSpace(b byte) bool { return b == ' ' || b == '\n' || b == '\r' || b == '\t' }
+func isDigit(b byte) bool { return b >= '0' && b <= '9' }
 func isNote(b byte) bool  { _, ok := noteOffsets[b]; return ok }
 
-func expandLoops(src string) (string, error) {
-	out, i, err := parseExpanded(src, 0, 0)
+func expandLoops(src string, limits ParserLimits) (string, error) {
+	lx := loopExpander{limits: limits.effective()}
+	out, i, err := lx.parseExpanded(src, 0, 0)
 	if err != nil {
 		return "", err
 	}
@@ -1633,7 +1727,24 @@ func expandLoops(src string) (string, error) {
 	return out, nil
 }
 
-func parseExpanded(src string, at, depth int) (string, int, error) {
+// loopExpander unrolls [ ] loops within the loop depth and expanded length
+// limits.
+type loopExpander struct {
+	limits ParserLimits
+}
+
+func (lx loopExpander) open(at, depth int) error {
+	if depth > lx.limits.MaxLoopDepth {
+		return &LimitError{Err: ErrLoopDepth, Limit: lx.limits.MaxLoopDepth, At: fmt.Sprintf("loop at %d", at)}
+	}
+	return nil
+}
+
+func (lx loopExpander) tooLong(at int) error {
+	return &LimitError{Err: ErrExpandedLen, Limit: lx.limits.MaxExpandedLen, At: fmt.Sprintf("loop at %d", at)}
+}
+
+func (lx loopExpander) parseExpanded(src string, at, depth int) (string, int, error) {
 	var out strings.Builder
 	for at < len(src) {
 		ch := src[at]
@@ -1648,10 +1759,16 @@ func parseExpanded(src string, at, depth int) (string, int, error) {
 			at++
 			continue
 		}
-		body, next, err := parseLoopBody(src, at+1, depth+1)
+		if err := lx.open(at, depth+1); err != nil {
+			return "", at, err
+		}
+		body, next, err := lx.parseLoopBody(src, at+1, depth+1)
 		if err != nil {
 			return "", at, err
 		}
+		if out.Len()+len(body) > lx.limits.MaxExpandedLen {
+			return "", at, lx.tooLong(at)
+		}
 		out.WriteString(body)
 		at = next
 	}
@@ -1661,13 +1778,17 @@ func parseExpanded(src string, at, depth int) (string, int, error) {
 	return out.String(), at, nil
 }
 
-func parseLoopBody(src string, at, depth int) (string, int, error) {
+func (lx loopExpander) parseLoopBody(src string, at, depth int) (string, int, error) {
 	var pre, post strings.Builder
 	breakHit := false
+	start := at - 1
 	for at < len(src) {
 		ch := src[at]
 		if ch == '[' {
-			body, next, err := parseLoopBody(src, at+1, depth+1)
+			if err := lx.open(at, depth+1); err != nil {
+				return "", at, err
+			}
+			body, next, err := lx.parseLoopBody(src, at+1, depth+1)
 			if err != nil {
 				return "", at, err
 			}
@@ -1676,6 +1797,9 @@ func parseLoopBody(src string, at, depth int) (string, int, error) {
 			} else {
 				pre.WriteString(body)
 			}
+			if pre.Len()+post.Len() > lx.limits.MaxExpandedLen {
+				return "", at, lx.tooLong(start)
+			}
 			at = next
 			continue
 		}
@@ -1693,6 +1817,13 @@ func parseLoopBody(src string, at, depth int) (string, int, error) {
 				repeat = 1
 			}
 			preS, postS := pre.String(), post.String()
+			count := repeat
+			if breakHit {
+				count--
+			}
+			if limit := lx.limits.MaxExpandedLen; len(preS) > 0 && count > (limit-len(postS))/len(preS) {
+				return "", at, lx.tooLong(start)
+			}
 			var out strings.Builder
 			if breakHit {
 				for i := 0; i < repeat-1; i++ {
@@ -1,6 +1,9 @@
 package mml
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestParseNoteByNumber(t *testing.T) {
 	p := NewParser(DefaultParserConfig())
@@ -449,3 +452,53 @@ func TestParseSignAppliesImplicitAccidentals(t *testing.T) {
 		t.Fatalf("expected explicit F#(54), got %d", tr.Events[1].Note)
 	}
 }
+
+func TestParseTrackNamesSectionsAndSpans(t *testing.T) {
+	p := NewParser(DefaultParserConfig())
+	src := "t120 l8;\n// Lead\no5 cde, o4 g;\n#NAME{Bass}; o3 c;\n/* multi\nline */\no2 c;"
+	score, err := p.Parse(src)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if len(score.Tracks) != 4 {
+		t.Fatalf("expected 4 tracks, got %d", len(score.Tracks))
+	}
+	wantNames := []string{"Lead", "", "Bass", ""}
+	wantSections := []int{1, 1, 2, 3}
+	wantText := []string{"o5 cde", "o4 g", "o3 c", "o2 c"}
+	for i, tr := range score.Tracks {
+		if tr.Name != wantNames[i] {
+			t.Fatalf("track %d: expected name %q, got %q", i, wantNames[i], tr.Name)
+		}
+		if tr.Section != wantSections[i] {
+			t.Fatalf("track %d: expected section %d, got %d", i, wantSections[i], tr.Section)
+		}
+		if got := src[tr.Span.Start:tr.Span.End]; got != wantText[i] {
+			t.Fatalf("track %d: expected span %q, got %q", i, wantText[i], got)
+		}
+	}
+}
+
+func TestParseSpanCoversMacroCalls(t *testing.T) {
+	p := NewParser(DefaultParserConfig())
+	src := "#A=cde; o5 A f A;"
+	score, err := p.Parse(src)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	tr := score.Tracks[0]
+	if got := src[tr.Span.Start:tr.Span.End]; got != "o5 A f A" {
+		t.Fatalf("expected span over the macro calls, got %q", got)
+	}
+}
+
+func TestParseErrorNamesTrack(t *testing.T) {
+	p := NewParser(DefaultParserConfig())
+	_, err := p.Parse("o5 c; #NAME{Bass}; o3 c]")
+	if err == nil {
+		t.Fatalf("expected error for unmatched ']'")
+	}
+	if !strings.Contains(err.Error(), `track 1 "Bass"`) {
+		t.Fatalf("expected error to name the track, got %v", err)
+	}
+}
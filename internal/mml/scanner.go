@@ -0,0 +1,290 @@
+package mml
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// trackOp identifies a track command. parseTrack dispatches on it and the
+// formatter lays tokens out by it, so both read MML the same way.
+type trackOp int
+
+const (
+	opStray trackOp = iota // a character no command claims
+	opNoteNumber
+	opNote
+	opRest
+	opLength
+	opTempo
+	opOctave
+	opOctaveUp2   // «
+	opOctaveDown2 // »
+	opOctaveUp
+	opOctaveDown
+	opVolume
+	opExpression
+	opQuantize
+	opTranspose // kt
+	opDetune
+	opPortamento // po
+	opPan
+	opControl // %f, %t, %e
+	opVolumeScale
+	opExpressionScale
+	opModule
+	opSlurWeak
+	opSlur
+	opRelease // s
+	opVolumeUp
+	opVolumeDown
+	opFineVolume // @v
+	opKeyOff     // @q
+	opAtPan      // @p
+	opMask
+	opAtCommand // @ followed by a name
+	opProgram
+	opLoopPoint // $
+	opOperator  // i
+	opSlide     // *
+	opModulation
+	opTableEnv
+	opLoopOpen
+	opLoopBreak
+	opLoopClose
+	opSeparator
+)
+
+// kind returns the formatter's layout class for op.
+func (op trackOp) kind() tokenKind {
+	switch op {
+	case opStray:
+		return tokStray
+	case opNoteNumber, opNote:
+		return tokNote
+	case opRest:
+		return tokRest
+	case opLength:
+		return tokLength
+	case opOctave, opOctaveUp2, opOctaveDown2, opOctaveUp, opOctaveDown:
+		return tokOctave
+	case opSlur, opSlurWeak:
+		return tokSlur
+	case opLoopOpen:
+		return tokLoopOpen
+	case opLoopBreak:
+		return tokLoopBreak
+	case opLoopClose:
+		return tokLoopClose
+	case opSeparator:
+		return tokSeparator
+	}
+	return tokCommand
+}
+
+// scanTrackToken returns the command at src[at], which must not be a space,
+// and the end of its text. A number may be written as an {expression}.
+func scanTrackToken(src string, at int) (trackOp, int) {
+	ch := lower(src[at])
+	switch {
+	case ch == 'n' && at+1 < len(src) && (unicode.IsDigit(rune(src[at+1])) || src[at+1] == '{'):
+		return opNoteNumber, skipLengthWithTie(src, skipDigits(src, at+1))
+	case isNote(ch):
+		// '#' is not taken as a sharp: the preprocessor reads every '#' as
+		// the start of a directive.
+		i := at + 1
+		for i < len(src) && strings.IndexByte("+-b", lower(src[i])) >= 0 {
+			i++
+		}
+		return opNote, skipLengthWithTie(src, i)
+	case ch == 'r':
+		return opRest, skipLengthWithTie(src, at+1)
+	case ch == 'l':
+		return opLength, skipLength(src, at+1)
+	case ch == 't':
+		// t bpm[,ramp length]
+		at = skipDigits(src, at+1)
+		if at < len(src) && src[at] == ',' {
+			at = skipLengthWithTie(src, at+1)
+		}
+		return opTempo, at
+	case ch == 'o':
+		return opOctave, skipDigits(src, at+1)
+	case strings.HasPrefix(src[at:], "«"):
+		return opOctaveUp2, at + len("«")
+	case strings.HasPrefix(src[at:], "»"):
+		return opOctaveDown2, at + len("»")
+	case ch == '<':
+		return opOctaveUp, skipDigits(src, at+1)
+	case ch == '>':
+		return opOctaveDown, skipDigits(src, at+1)
+	case ch == 'v':
+		return opVolume, skipDigits(src, at+1)
+	case ch == 'x':
+		return opExpression, skipDigits(src, at+1)
+	case ch == 'q':
+		return opQuantize, skipDigits(src, at+1)
+	case startsWithWord(src, at, "kt"):
+		return opTranspose, skipSigned(src, at+2)
+	case ch == 'k':
+		return opDetune, skipSigned(src, at+1)
+	case startsWithWord(src, at, "po"):
+		return opPortamento, skipSigned(src, at+2)
+	case ch == 'p':
+		return opPan, skipSigned(src, at+1)
+	case ch == '%':
+		return scanPercent(src, at)
+	case startsWithWord(src, at, "&&"):
+		return opSlurWeak, at + 2
+	case ch == '&':
+		return opSlur, at + 1
+	case ch == 's':
+		// s release[,sweep]
+		return opRelease, skipArgs(src, skipSigned(src, at+1), 1, skipSigned)
+	case ch == '(':
+		return opVolumeUp, skipDigits(src, at+1)
+	case ch == ')':
+		return opVolumeDown, skipDigits(src, at+1)
+	case ch == '@':
+		return scanAtCommand(src, at)
+	case ch == '$':
+		return opLoopPoint, at + 1
+	case ch == 'i':
+		return opOperator, skipSigned(src, at+1)
+	case ch == '*':
+		return opSlide, skipSigned(src, at+1)
+	case startsWithWord(src, at, "mp") || startsWithWord(src, at, "ma") || startsWithWord(src, at, "mf"):
+		return opModulation, skipTail(src, skipSigned(src, at+2))
+	case isTableEnv(src, at):
+		// na id[,step] and friends
+		_, next := parseWordToken(src, at)
+		return opTableEnv, skipArgs(src, skipSigned(src, next), 1, skipDigits)
+	case ch == '[':
+		return opLoopOpen, at + 1
+	case ch == '|':
+		return opLoopBreak, at + 1
+	case ch == ']':
+		return opLoopClose, skipDigits(src, at+1)
+	case ch == ';' || ch == ',':
+		return opSeparator, at + 1
+	}
+	_, size := utf8.DecodeRuneInString(src[at:])
+	return opStray, at + size
+}
+
+func scanPercent(src string, at int) (trackOp, int) {
+	next := byte(0)
+	if at+1 < len(src) {
+		next = lower(src[at+1])
+	}
+	switch next {
+	case 'f', 't', 'e':
+		return opControl, skipArgs(src, skipSigned(src, at+2), -1, skipSigned)
+	case 'v':
+		// %v mode[,max shift]
+		return opVolumeScale, skipArgs(src, skipDigits(src, at+2), 1, skipDigits)
+	case 'x':
+		return opExpressionScale, skipDigits(src, at+2)
+	}
+	// %module[,channel]
+	return opModule, skipArgs(src, skipDigits(src, at+1), 1, skipDigits)
+}
+
+func scanAtCommand(src string, at int) (trackOp, int) {
+	next := byte(0)
+	if at+1 < len(src) {
+		next = lower(src[at+1])
+	}
+	switch {
+	case next == 'v':
+		return opFineVolume, skipArgs(src, skipDigits(src, at+2), -1, skipDigits)
+	case next == 'q':
+		// @q key-off[,key-on delay]
+		return opKeyOff, skipArgs(src, skipDigits(src, at+2), 1, skipDigits)
+	case next == 'p':
+		return opAtPan, skipSigned(src, at+2)
+	case startsWithWord(src, at, "@mask"):
+		return opMask, skipDigits(src, at+5)
+	case isAlpha(next):
+		i := at + 1
+		for i < len(src) && isAlpha(src[i]) {
+			i++
+		}
+		return opAtCommand, skipTail(src, skipSigned(src, i))
+	}
+	return opProgram, skipArgs(src, skipDigits(src, at+1), -1, skipDigits)
+}
+
+// isTableEnv reports whether a table envelope command such as na or _@@
+// starts at src[at].
+func isTableEnv(src string, at int) bool {
+	for _, w := range []string{"na", "np", "nt", "nf", "_na", "_np", "_nt", "_nf", "_@@"} {
+		if startsWithWord(src, at, w) {
+			return true
+		}
+	}
+	return false
+}
+
+func skipDigits(src string, at int) int {
+	if at < len(src) && src[at] == '{' {
+		// An {expression} stands in for the number.
+		if end := strings.IndexByte(src[at:], '}'); end > 0 {
+			return at + end + 1
+		}
+	}
+	for at < len(src) && src[at] >= '0' && src[at] <= '9' {
+		at++
+	}
+	return at
+}
+
+func skipSigned(src string, at int) int {
+	if at < len(src) && (src[at] == '+' || src[at] == '-') {
+		at++
+	}
+	return skipDigits(src, at)
+}
+
+// skipArgs skips up to max ",n" arguments, each read by skip; a negative max
+// skips them all. Like the parser, it takes a comma even when no number
+// follows it.
+func skipArgs(src string, at int, max int, skip func(string, int) int) int {
+	for n := 0; (max < 0 || n < max) && at < len(src) && src[at] == ','; n++ {
+		at = skip(src, at+1)
+	}
+	return at
+}
+
+// skipTail skips the raw argument tail kept in Event.Text, trimming trailing
+// whitespace so it is left to the formatter.
+func skipTail(src string, at int) int {
+	end := at
+	for i := at; i < len(src); i++ {
+		ch := src[i]
+		if isSpace(ch) {
+			continue
+		}
+		if ch != ',' && ch != '+' && ch != '-' && (ch < '0' || ch > '9') {
+			break
+		}
+		end = i + 1
+	}
+	return end
+}
+
+func skipLength(src string, at int) int {
+	at = skipDigits(src, at)
+	for at < len(src) && src[at] == '.' {
+		at++
+	}
+	return at
+}
+
+func skipLengthWithTie(src string, at int) int {
+	at = skipLength(src, at)
+	for at < len(src) && src[at] == '^' {
+		at = skipLength(src, at+1)
+	}
+	return at
+}
@@ -0,0 +1,395 @@
+package mml
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseOnlyDirectives steer how the text is read (#SIGN accidentals, #REV
+// polarity, #TMODE tempo units, macro mode, #END). Their effect is already
+// folded into a compiled Score's events, so writing them back would apply
+// them a second time.
+var parseOnlyDirectives = map[string]bool{
+	"SIGN":       true,
+	"REV":        true,
+	"TMODE":      true,
+	"MACRO_MODE": true,
+	"END":        true,
+}
+
+// Serialize renders a compiled Score as canonical SiON-style MML.
+//
+// Definitions are written first, one directive per line, followed by one
+// track per line. Every control is written with absolute values (o, v, q, ...)
+// so that parsing the result with the score's resolution yields the same event
+// stream. Macros, loops and relative shifts are not reconstructed.
+func Serialize(score *Score) string {
+	if score == nil {
+		return ""
+	}
+	resolution := score.Resolution
+	if resolution <= 0 {
+		resolution = DefaultParserConfig().Resolution
+	}
+	var out strings.Builder
+	for _, line := range serializeDefinitions(score.Definitions) {
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	tracks := make([]string, 0, len(score.Tracks))
+	for _, tr := range score.Tracks {
+		text := serializeTrack(tr, resolution)
+		if text == "" {
+			continue
+		}
+		tracks = append(tracks, text)
+	}
+	// A leading section without notes or rests is treated as a global prelude
+	// by splitSectionsAsTracks, so keep such tracks in the first section with
+	// ',' until one that plays is included.
+	lead := 0
+	for lead < len(tracks)-1 && !containsPlayableEvents(tracks[lead]) {
+		lead++
+	}
+	for i, text := range tracks {
+		out.WriteString(text)
+		if i < lead {
+			out.WriteString(",\n")
+			continue
+		}
+		out.WriteString(";\n")
+	}
+	return out.String()
+}
+
+func serializeDefinitions(defs map[string]string) []string {
+	keys := make([]string, 0, len(defs))
+	for k := range defs {
+		if parseOnlyDirectives[k] {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lines := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := defs[k]
+		switch k {
+		case "TITLE", "VMODE":
+			lines = append(lines, "#"+k+"{"+v+"};")
+		case "FPS", "QUANT":
+			lines = append(lines, "#"+k+v+";")
+		default:
+			// Table, wave, patch and effect definitions keep their full body.
+			lines = append(lines, "#"+v+";")
+		}
+	}
+	return lines
+}
+
+type trackWriter struct {
+	resolution int
+	out        strings.Builder
+	spaceNext  bool
+	octave     int
+	defaultLen int
+	transpose  int
+	detune     int
+}
+
+func serializeTrack(tr Track, resolution int) string {
+	w := &trackWriter{resolution: resolution, octave: -1}
+	if tr.Name != "" && !strings.ContainsAny(tr.Name, "};") {
+		w.word("#NAME{" + tr.Name + "};")
+	}
+	w.defaultLen = commonStepLength(tr, resolution)
+	if len(tr.Events) > 0 {
+		w.word("l" + singleLength(w.defaultLen, resolution))
+	}
+	for i, ev := range tr.Events {
+		if i == tr.LoopIndex {
+			w.word("$")
+		}
+		w.event(ev, stepTicks(tr, i))
+	}
+	if tr.LoopIndex >= 0 && tr.LoopIndex == len(tr.Events) {
+		w.word("$")
+	}
+	return w.out.String()
+}
+
+// stepTicks returns how far event i advances the track cursor. Only notes and
+// rests advance time, so the distance to the next event (or the track end)
+// is the step length.
+func stepTicks(tr Track, i int) int {
+	if i+1 < len(tr.Events) {
+		return tr.Events[i+1].Tick - tr.Events[i].Tick
+	}
+	return tr.EndTick - tr.Events[i].Tick
+}
+
+// commonStepLength picks the most frequent note/rest step that can be written
+// as a single length token, for use as the track's l value.
+func commonStepLength(tr Track, resolution int) int {
+	counts := map[int]int{}
+	best, bestCount := resolution/4, 0
+	for i, ev := range tr.Events {
+		if ev.Type != EventNote && ev.Type != EventRest {
+			continue
+		}
+		step := stepTicks(tr, i)
+		if singleLength(step, resolution) == "" {
+			continue
+		}
+		counts[step]++
+		if c := counts[step]; c > bestCount || (c == bestCount && step > best) {
+			best, bestCount = step, c
+		}
+	}
+	return best
+}
+
+func (w *trackWriter) event(ev Event, step int) {
+	switch ev.Type {
+	case EventNote:
+		w.note(ev, step)
+	case EventRest:
+		w.glue("r" + w.lengthText(step))
+	case EventTempo:
+		text := "t" + strconv.Itoa(ev.Value)
+		if ev.Duration > 0 {
+			text += "," + tiedLength(ev.Duration, w.resolution)
+		}
+		w.word(text)
+	case EventVolume:
+		w.word("v" + strconv.Itoa(ev.Value))
+	case EventFineVolume:
+		w.word("@v" + joinInts(ev.Values, ev.Value))
+	case EventExpression:
+		w.word("x" + strconv.Itoa(ev.Value))
+	case EventProgram:
+		text := "@" + strconv.Itoa(ev.Value)
+		for _, v := range ev.Values {
+			text += "," + strconv.Itoa(v)
+		}
+		w.word(text)
+	case EventPan:
+		if ev.Value%16 == 0 {
+			w.word("p" + strconv.Itoa(ev.Value/16+4))
+		} else {
+			w.word("@p" + strconv.Itoa(ev.Value))
+		}
+	case EventModule:
+		text := "%" + strconv.Itoa(ev.Module)
+		if ev.Channel != 0 {
+			text += "," + strconv.Itoa(ev.Channel)
+		}
+		w.word(text)
+	case EventDetune:
+		w.detune = ev.Value
+		w.word("k" + strconv.Itoa(ev.Value))
+	case EventTranspose:
+		w.transpose = ev.Value
+		w.word("kt" + strconv.Itoa(ev.Value))
+	case EventQuantize:
+		w.word("q" + strconv.Itoa(ev.Value))
+	case EventKeyOnDelay:
+		off := 0
+		if ev.GateTick > 0 {
+			off = ev.GateTick * 192 / w.resolution
+		}
+		text := "@q" + strconv.Itoa(off)
+		if ev.Delay != 0 {
+			text += "," + strconv.Itoa(ev.Delay*192/w.resolution)
+		}
+		w.word(text)
+	case EventSlur:
+		if ev.Slur == SlurWeak {
+			w.glue("&&")
+		} else {
+			w.glue("&")
+		}
+	case EventTableEnv:
+		text := ev.Command + strconv.Itoa(ev.Value)
+		if len(ev.Values) > 1 {
+			text += "," + strconv.Itoa(ev.Values[1])
+		}
+		w.word(text)
+	case EventControl:
+		w.control(ev)
+	}
+}
+
+func (w *trackWriter) control(ev Event) {
+	switch ev.Command {
+	case "%f", "%t", "%e", "s":
+		w.word(ev.Command + joinInts(ev.Values, ev.Value))
+	case "%v":
+		text := "%v" + strconv.Itoa(ev.Value)
+		if len(ev.Values) > 1 {
+			for shift := 1; shift < 9; shift++ {
+				if 256>>shift == ev.Values[1] {
+					text += "," + strconv.Itoa(shift)
+					break
+				}
+			}
+		}
+		w.word(text)
+	default:
+		// po, *, %x, @mask, mp/ma/mf and generic @ commands: name, first
+		// value, then the raw argument tail the parser kept in Text.
+		text := ev.Command + strconv.Itoa(ev.Value)
+		if ev.Text != "" {
+			if c := ev.Text[0]; c >= '0' && c <= '9' {
+				text += " "
+			}
+			text += ev.Text
+		}
+		w.word(text)
+	}
+}
+
+func (w *trackWriter) note(ev Event, step int) {
+	cfg := DefaultParserConfig()
+	raw := ev.Note - w.transpose - w.detune/64
+	if raw < 0 {
+		raw = 0
+	}
+	oct := raw / 12
+	if oct < cfg.MinOctave || oct > cfg.MaxOctave {
+		// Out of the letter range: use the note-number form, which takes its
+		// length from l, so move l to the first length part.
+		parts := lengthParts(step, w.resolution)
+		if w.defaultLen != parts[0] {
+			w.defaultLen = parts[0]
+			w.word("l" + singleLength(parts[0], w.resolution))
+		}
+		text := "n" + strconv.Itoa(raw)
+		for _, p := range parts[1:] {
+			text += "^" + singleLength(p, w.resolution)
+		}
+		w.glue(text)
+		return
+	}
+	switch {
+	case w.octave == oct:
+	case w.octave >= 0 && oct == w.octave+1:
+		w.glue(">")
+	case w.octave >= 0 && oct == w.octave-1:
+		w.glue("<")
+	default:
+		w.word("o" + strconv.Itoa(oct))
+	}
+	w.octave = oct
+	w.glue(noteNameForSemitone(raw%12) + w.lengthText(step))
+}
+
+// lengthText returns the length suffix for a note or rest, empty when the
+// track's l value already covers it.
+func (w *trackWriter) lengthText(ticks int) string {
+	if ticks == w.defaultLen {
+		return ""
+	}
+	return tiedLength(ticks, w.resolution)
+}
+
+// tiedLength returns a length token for ticks, tying lengths when no single
+// one fits.
+func tiedLength(ticks int, resolution int) string {
+	if s := singleLength(ticks, resolution); s != "" {
+		return s
+	}
+	parts := lengthParts(ticks, resolution)
+	texts := make([]string, len(parts))
+	for i, p := range parts {
+		texts[i] = singleLength(p, resolution)
+	}
+	return strings.Join(texts, "^")
+}
+
+// singleLength returns a length token (e.g. "8", "4.") for ticks, or "" when
+// ticks needs a tie.
+func singleLength(ticks int, resolution int) string {
+	switch {
+	case ticks == 0:
+		// Any divisor above the resolution truncates to zero ticks.
+		return strconv.Itoa(resolution * 2)
+	case ticks < 0:
+		return ""
+	case resolution%ticks == 0:
+		return strconv.Itoa(resolution / ticks)
+	}
+	if ticks%3 == 0 {
+		base := ticks * 2 / 3
+		if base%2 == 0 && resolution%base == 0 {
+			return strconv.Itoa(resolution/base) + "."
+		}
+	}
+	return ""
+}
+
+// lengthParts splits ticks greedily into lengths that divide the resolution,
+// for writing as a ^ tie chain.
+func lengthParts(ticks int, resolution int) []int {
+	if singleLength(ticks, resolution) != "" {
+		return []int{ticks}
+	}
+	parts := make([]int, 0, 4)
+	for rem := ticks; rem > 0; {
+		if rem >= resolution {
+			parts = append(parts, resolution)
+			rem -= resolution
+			continue
+		}
+		for val := 2; val <= resolution; val++ {
+			if resolution%val != 0 || resolution/val > rem {
+				continue
+			}
+			parts = append(parts, resolution/val)
+			rem -= resolution / val
+			break
+		}
+	}
+	return parts
+}
+
+// word writes a command token separated from its neighbours by spaces.
+func (w *trackWriter) word(s string) {
+	if w.out.Len() > 0 {
+		w.out.WriteByte(' ')
+	}
+	w.out.WriteString(s)
+	w.spaceNext = true
+}
+
+// glue writes notes, rests, ties and octave shifts without separators, except
+// where a following 'b' or accidental would be read as part of the previous
+// note.
+func (w *trackWriter) glue(s string) {
+	if w.out.Len() > 0 {
+		if w.spaceNext {
+			w.out.WriteByte(' ')
+		} else if last := w.lastByte(); s[0] == 'b' && (isNote(last) || last == '+' || last == '-') {
+			w.out.WriteByte(' ')
+		}
+	}
+	w.out.WriteString(s)
+	w.spaceNext = false
+}
+
+func (w *trackWriter) lastByte() byte {
+	s := w.out.String()
+	return s[len(s)-1]
+}
+
+func joinInts(values []int, first int) string {
+	if len(values) == 0 {
+		return strconv.Itoa(first)
+	}
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(v)
+	}
+	return strings.Join(parts, ",")
+}
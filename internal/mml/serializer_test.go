@@ -0,0 +1,106 @@
+package mml
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func assertRoundTrip(t *testing.T, name string, src string) {
+	t.Helper()
+	p := NewParser(DefaultParserConfig())
+	first, err := p.Parse(src)
+	if err != nil {
+		t.Fatalf("%s: parse failed: %v", name, err)
+	}
+	text := Serialize(first)
+	second, err := p.Parse(text)
+	if err != nil {
+		t.Fatalf("%s: reparse failed: %v\n%s", name, err, text)
+	}
+	if len(first.Tracks) != len(second.Tracks) {
+		t.Fatalf("%s: expected %d tracks after round trip, got %d\n%s", name, len(first.Tracks), len(second.Tracks), text)
+	}
+	for i := range first.Tracks {
+		a, b := first.Tracks[i], second.Tracks[i]
+		if a.Name != b.Name {
+			t.Fatalf("%s: track %d expected name %q, got %q", name, i, a.Name, b.Name)
+		}
+		if a.EndTick != b.EndTick || a.LoopTick != b.LoopTick || a.LoopIndex != b.LoopIndex {
+			t.Fatalf("%s: track %d timing mismatch: end %d/%d loop %d/%d index %d/%d", name, i, a.EndTick, b.EndTick, a.LoopTick, b.LoopTick, a.LoopIndex, b.LoopIndex)
+		}
+		if len(a.Events) != len(b.Events) {
+			t.Fatalf("%s: track %d expected %d events, got %d\n%s", name, i, len(a.Events), len(b.Events), text)
+		}
+		for j := range a.Events {
+			if !reflect.DeepEqual(a.Events[j], b.Events[j]) {
+				t.Fatalf("%s: track %d event %d mismatch\nwant %#v\ngot  %#v", name, i, j, a.Events[j], b.Events[j])
+			}
+		}
+	}
+}
+
+func TestSerializeRoundTrip(t *testing.T) {
+	cases := map[string]string{
+		"melody":      "t140 o5 l8 cdefgab>c<c",
+		"ties":        "l4 c^16 d. e8.. r2^8 f1^1",
+		"slurs":       "o4 c&d&&e q8 @q24,8 f",
+		"controls":    "%1,2 @q24,8 q80 x96 v12 kt2 k64 o5 l8 c&d&&e po12 *3 na1 np2 nt3 nf4 @@5,2 c",
+		"volume":      "v10(2)c )3 d @v64,32 e %v1,4 %x2 f",
+		"pan":         "p0 c p8 d @p-20 e @p33 f",
+		"program":     "@3,1,2 c @al4,2 @fb5 @lfo2,30 mp2,8,10,20 c",
+		"filters":     "%f1,2 %t3,4,5 %e6 s32,-128 @mask3 c",
+		"loop":        "l8 [cd|e]3 $ fg",
+		"tracks":      "t120, o5 c; o4 e, g;",
+		"extremes":    "o0<<c o9 b+ kt-20 o1 c kt12 o9 b",
+		"sign":        "#SIGN{G}; o4 l4 f f+ c",
+		"rev":         "#REV; o4 <c >d (2) e",
+		"tmode":       "#TMODE{unit=100}; t13755 o5 c",
+		"defs":        "#TITLE{demo}; #FPS30; #QUANT16; #TABLE1{(0,8)4}; #OPM@1{0,7, 31,0,0,15,0,0,0,1,0,0,0, 31,0,0,15,0,0,0,1,0,0,0, 31,0,0,15,0,0,0,1,0,0,0, 31,0,0,15,0,0,0,1,0,0,0}; q12 @1 na1 c",
+		"macros":      "#A=cde; #B=A(2)f; o5 B A;",
+		"note number": "l8 n60n64 n67",
+		"names":       "#NAME{Lead}; o5 c; // Bass\no3 c;",
+		"tempo ramps": "t120 o5 c t60,1 d t90,2^8 e",
+	}
+	for name, src := range cases {
+		assertRoundTrip(t, name, src)
+	}
+}
+
+func TestSerializeRoundTripExamples(t *testing.T) {
+	files, _ := filepath.Glob("../../examples/*.mml")
+	if len(files) == 0 {
+		t.Skip("no example fixtures available")
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatalf("read %s: %v", f, err)
+		}
+		assertRoundTrip(t, filepath.Base(f), string(data))
+	}
+}
+
+func TestSerializeWritesDefinitions(t *testing.T) {
+	p := NewParser(DefaultParserConfig())
+	score, err := p.Parse("#TITLE{demo}; #SIGN{G}; #TABLE1{(0,8)4}; o5 c")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	text := Serialize(score)
+	if !strings.Contains(text, "#TITLE{demo};") || !strings.Contains(text, "#TABLE1{(0,8)4};") {
+		t.Fatalf("expected definitions in output, got:\n%s", text)
+	}
+	if strings.Contains(text, "SIGN") {
+		t.Fatalf("expected #SIGN to be folded into notes, got:\n%s", text)
+	}
+	again, err := p.Parse(text)
+	if err != nil {
+		t.Fatalf("reparse failed: %v", err)
+	}
+	if again.Definitions["TITLE"] != "demo" || again.Definitions["TABLE1"] == "" {
+		t.Fatalf("expected definitions to survive round trip, got %#v", again.Definitions)
+	}
+}
@@ -0,0 +1,133 @@
+package mml
+
+import (
+	"math"
+	"sort"
+)
+
+// TempoMap converts between ticks and seconds for a score played once
+// through, following its t commands and tempo ramps. A ramp moves the BPM
+// linearly with ticks, so within one the tempo grows exponentially with time.
+type TempoMap struct {
+	resolution int
+	segments   []tempoSegment
+}
+
+// tempoSegment starts at a t command and lasts until the next one.
+type tempoSegment struct {
+	tick    int
+	sec     float64 // time at tick
+	from    float64 // BPM at tick
+	to      float64 // BPM from end on
+	end     int     // tick the ramp reaches to; end == tick holds from
+	rampSec float64 // length of the ramp in seconds
+}
+
+// NewTempoMap builds the tempo map of a score. Tempo changes apply to every
+// track; when two tracks change tempo on the same tick, the later track
+// wins, as in playback.
+func NewTempoMap(score *Score) *TempoMap {
+	res := score.Resolution
+	if res <= 0 {
+		res = 1920
+	}
+	bpm := score.InitialBPM
+	if bpm <= 0 {
+		bpm = 120
+	}
+	m := &TempoMap{resolution: res, segments: []tempoSegment{{from: bpm, to: bpm}}}
+	var tempos []Event
+	for _, tr := range score.Tracks {
+		for _, ev := range tr.Events {
+			if ev.Type == EventTempo {
+				tempos = append(tempos, ev)
+			}
+		}
+	}
+	sort.SliceStable(tempos, func(i, j int) bool { return tempos[i].Tick < tempos[j].Tick })
+	for _, ev := range tempos {
+		start := float64(ev.Tick)
+		seg := tempoSegment{tick: ev.Tick, sec: m.Seconds(start), from: m.BPM(start), to: math.Max(1, float64(ev.Value)), end: ev.Tick}
+		if ev.Duration > 0 && seg.to != seg.from {
+			seg.end = ev.Tick + ev.Duration
+			seg.rampSec = m.rampSeconds(seg, float64(seg.end))
+		} else {
+			seg.from = seg.to
+		}
+		last := len(m.segments) - 1
+		if m.segments[last].tick == seg.tick {
+			m.segments[last] = seg
+		} else {
+			m.segments = append(m.segments, seg)
+		}
+	}
+	return m
+}
+
+// segment returns the segment playing at tick.
+func (m *TempoMap) segment(tick float64) tempoSegment {
+	i := sort.Search(len(m.segments), func(i int) bool { return float64(m.segments[i].tick) > tick })
+	if i == 0 {
+		return m.segments[0]
+	}
+	return m.segments[i-1]
+}
+
+// ticksPerSec returns how many ticks a beat at bpm plays per second.
+func (m *TempoMap) ticksPerSec(bpm float64) float64 {
+	return bpm * float64(m.resolution) / 240
+}
+
+// BPM returns the tempo at tick.
+func (m *TempoMap) BPM(tick float64) float64 {
+	seg := m.segment(tick)
+	if tick >= float64(seg.end) {
+		return seg.to
+	}
+	return seg.from + (seg.to-seg.from)*(tick-float64(seg.tick))/float64(seg.end-seg.tick)
+}
+
+// rampSeconds returns the time from the start of seg's ramp to tick, which
+// must not be past its end.
+func (m *TempoMap) rampSeconds(seg tempoSegment, tick float64) float64 {
+	slope := (seg.to - seg.from) / float64(seg.end-seg.tick)
+	bpm := seg.from + slope*(tick-float64(seg.tick))
+	return math.Log(bpm/seg.from) / (m.ticksPerSec(1) * slope)
+}
+
+// Seconds returns the time at which tick plays.
+func (m *TempoMap) Seconds(tick float64) float64 {
+	seg := m.segment(tick)
+	if tick < float64(seg.end) {
+		return seg.sec + m.rampSeconds(seg, tick)
+	}
+	return seg.sec + seg.rampSec + (tick-float64(seg.end))/m.ticksPerSec(seg.to)
+}
+
+// Tick returns the tick playing at sec.
+func (m *TempoMap) Tick(sec float64) float64 {
+	i := sort.Search(len(m.segments), func(i int) bool { return m.segments[i].sec > sec })
+	seg := m.segments[0]
+	if i > 0 {
+		seg = m.segments[i-1]
+	}
+	t := sec - seg.sec
+	if t < seg.rampSec {
+		slope := (seg.to - seg.from) / float64(seg.end-seg.tick)
+		bpm := seg.from * math.Exp(m.ticksPerSec(1)*slope*t)
+		return float64(seg.tick) + (bpm-seg.from)/slope
+	}
+	return float64(seg.end) + (t-seg.rampSec)*m.ticksPerSec(seg.to)
+}
+
+// Duration returns how long the score takes to play once through, up to
+// the end of its longest track.
+func (s *Score) Duration() float64 {
+	end := 0
+	for _, tr := range s.Tracks {
+		if tr.EndTick > end {
+			end = tr.EndTick
+		}
+	}
+	return NewTempoMap(s).Seconds(float64(end))
+}
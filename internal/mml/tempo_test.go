@@ -0,0 +1,65 @@
+package mml
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTempoMapSteadyTempo(t *testing.T) {
+	score, err := NewParser(DefaultParserConfig()).Parse("t120 c1 t60 c1")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	m := NewTempoMap(score)
+	whole := float64(score.Resolution)
+	if got := m.Seconds(whole); math.Abs(got-2) > 1e-9 {
+		t.Fatalf("expected a whole note at 120 BPM to take 2s, got %f", got)
+	}
+	if got := score.Duration(); math.Abs(got-6) > 1e-9 {
+		t.Fatalf("expected 2s at 120 BPM then 4s at 60, got %f", got)
+	}
+	if got := m.Tick(4); math.Abs(got-whole*1.5) > 1e-6 {
+		t.Fatalf("expected 4s to be halfway through the second note, got tick %f", got)
+	}
+}
+
+func TestTempoMapIntegratesRamps(t *testing.T) {
+	score, err := NewParser(DefaultParserConfig()).Parse("t60 t120,1 c1 c1")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	m := NewTempoMap(score)
+	whole := float64(score.Resolution)
+	if got := m.BPM(whole / 2); math.Abs(got-90) > 1e-9 {
+		t.Fatalf("expected the ramp halfway to be at 90 BPM, got %f", got)
+	}
+	// BPM rises linearly over 4 beats, so the ramp takes 4 ln 2 beats' time
+	// at the 60 BPM it starts from.
+	ramp := 4 * math.Ln2
+	if got := m.Seconds(whole); math.Abs(got-ramp) > 1e-9 {
+		t.Fatalf("expected the ramp to take %fs, got %f", ramp, got)
+	}
+	if got := score.Duration(); math.Abs(got-(ramp+2)) > 1e-9 {
+		t.Fatalf("expected %fs, got %f", ramp+2, got)
+	}
+	for _, tick := range []float64{0, whole / 3, whole * 0.9, whole * 1.5} {
+		if got := m.Tick(m.Seconds(tick)); math.Abs(got-tick) > 1e-6 {
+			t.Fatalf("expected tick %f back from its time, got %f", tick, got)
+		}
+	}
+}
+
+func TestTempoMapLetsLaterChangesCutARampShort(t *testing.T) {
+	score, err := NewParser(DefaultParserConfig()).Parse("t60 t180,1 c2 t100 c2; r4 t200 c")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	m := NewTempoMap(score)
+	whole := float64(score.Resolution)
+	if got := m.BPM(whole / 4); got != 200 {
+		t.Fatalf("expected the second track's t200 to take over, got %f", got)
+	}
+	if got := m.BPM(whole * 3 / 4); got != 100 {
+		t.Fatalf("expected t100 to end the ramp, got %f", got)
+	}
+}
@@ -0,0 +1,145 @@
+package mml
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PreprocessTrace is the preprocessed text of each track together with the
+// macro expansions that produced it, for debugging macros.
+type PreprocessTrace struct {
+	RevOctave bool   // #REV swapped < and >
+	RevVolume bool   // #REV swapped ( and )
+	Sign      string // #SIGN key, empty when absent
+	Tracks    []TrackTrace
+}
+
+// TrackTrace is one track's text after macro expansion and #REV, before loop
+// expansion, as the track parser receives it.
+type TrackTrace struct {
+	Name   string
+	Text   string
+	Macros []MacroSpan // ordered by Start, outer expansions first
+}
+
+// MacroSpan marks Text[Start:End] as the expansion of a macro call.
+type MacroSpan struct {
+	Start, End int
+	Name       string
+	Shift      int // transpose argument of a call like A(3)
+	Depth      int // 0 for calls in track text, 1+ inside dynamic macros
+}
+
+// TracePreprocess runs the preprocessor over input the way Parse does and
+// reports the text each track is parsed from. If an expression fails to
+// evaluate, the tracks are traced with their expressions left in place.
+func TracePreprocess(input string) *PreprocessTrace {
+	noComments, stripped, err := stripSource(input)
+	if err != nil {
+		stripped = nil
+		noComments = stripCommentsTracked(input, &stripped)
+	}
+	st := preprocessorState{
+		macros:         make(map[string]string),
+		definitions:    make(map[string]string),
+		trackPositions: true,
+		traceMacros:    true,
+	}
+	text := preprocessStream(noComments, &st)
+	origins := make([]int, len(st.positions))
+	for i, pos := range st.positions {
+		origins[i] = stripped[pos]
+	}
+	parts := splitTrackParts(text)
+	describeTracks(parts, input, origins, st.names)
+
+	trace := &PreprocessTrace{
+		RevOctave: st.revOctave,
+		RevVolume: st.revVolume,
+		Sign:      st.definitions["SIGN"],
+		Tracks:    make([]TrackTrace, 0, len(parts)),
+	}
+	for _, part := range parts {
+		tt := TrackTrace{Name: part.name, Text: part.text}
+		if part.preludeLen > 0 {
+			tt.Macros = clipSpans(tt.Macros, st.spans, part.preludeStart, part.preludeStart+part.preludeLen-1, 0)
+		}
+		tt.Macros = clipSpans(tt.Macros, st.spans, part.start, part.end, part.preludeLen)
+		sort.SliceStable(tt.Macros, func(i, j int) bool {
+			return tt.Macros[i].Start < tt.Macros[j].Start
+		})
+		trace.Tracks = append(trace.Tracks, tt)
+	}
+	return trace
+}
+
+// clipSpans appends the parts of spans inside text[from:to], moved to start
+// at offset at.
+func clipSpans(dst []MacroSpan, spans []MacroSpan, from, to, at int) []MacroSpan {
+	for _, sp := range spans {
+		start, end := max(sp.Start, from), min(sp.End, to)
+		if start >= end {
+			continue
+		}
+		sp.Start, sp.End = start-from+at, end-from+at
+		dst = append(dst, sp)
+	}
+	return dst
+}
+
+// String renders the trace with each macro expansion wrapped as
+// {NAME:text}, or {NAME(shift):text} for a transposed call.
+func (t *PreprocessTrace) String() string {
+	var out strings.Builder
+	switch {
+	case t.RevOctave && t.RevVolume:
+		out.WriteString("#REV: octave, volume\n")
+	case t.RevOctave:
+		out.WriteString("#REV: octave\n")
+	case t.RevVolume:
+		out.WriteString("#REV: volume\n")
+	default:
+		out.WriteString("#REV: off\n")
+	}
+	if t.Sign != "" {
+		out.WriteString("#SIGN: " + t.Sign + "\n")
+	} else {
+		out.WriteString("#SIGN: none\n")
+	}
+	for i, tr := range t.Tracks {
+		out.WriteString(TrackLabel(i, tr.Name) + ":\n")
+		for _, line := range strings.Split(tr.annotated(), "\n") {
+			out.WriteString("  " + strings.TrimRight(line, " \t\r") + "\n")
+		}
+	}
+	return out.String()
+}
+
+// annotated returns Text with the macro spans marked. Spans are nested or
+// disjoint, so closing braces can be emitted with a stack.
+func (tr TrackTrace) annotated() string {
+	var out strings.Builder
+	open := make([]int, 0, 4)
+	next := 0
+	for i := 0; i <= len(tr.Text); i++ {
+		for len(open) > 0 && open[len(open)-1] == i {
+			out.WriteByte('}')
+			open = open[:len(open)-1]
+		}
+		for next < len(tr.Macros) && tr.Macros[next].Start == i {
+			sp := tr.Macros[next]
+			out.WriteString("{" + sp.Name)
+			if sp.Shift != 0 {
+				out.WriteString("(" + strconv.Itoa(sp.Shift) + ")")
+			}
+			out.WriteByte(':')
+			open = append(open, sp.End)
+			next++
+		}
+		if i < len(tr.Text) {
+			out.WriteByte(tr.Text[i])
+		}
+	}
+	return strings.TrimSpace(out.String())
+}
@@ -0,0 +1,52 @@
+package mml
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTracePreprocessMarksMacroSpans(t *testing.T) {
+	trace := TracePreprocess("#A=cde; #B=A(2)f; o5 B A(-1) g;")
+	if len(trace.Tracks) != 1 {
+		t.Fatalf("expected 1 track, got %d", len(trace.Tracks))
+	}
+	tr := trace.Tracks[0]
+	if got := tr.annotated(); got != "o5 {B:def+f} {A(-1):bc+d+} g" {
+		t.Fatalf("unexpected annotation %q (text %q)", got, tr.Text)
+	}
+	for _, sp := range tr.Macros {
+		if sp.Depth != 0 {
+			t.Fatalf("static macros should only report calls from track text, got %#v", sp)
+		}
+	}
+}
+
+func TestTracePreprocessDynamicNesting(t *testing.T) {
+	trace := TracePreprocess("#MACRO{dynamic}; #A=cd; #B=eAf; #A=g; o5 B;")
+	tr := trace.Tracks[0]
+	if got := tr.annotated(); got != "o5 {B:e{A:g}f}" {
+		t.Fatalf("unexpected annotation %q", got)
+	}
+	if len(tr.Macros) != 2 || tr.Macros[1].Depth != 1 || tr.Text[tr.Macros[1].Start:tr.Macros[1].End] != "g" {
+		t.Fatalf("expected nested span for A, got %#v", tr.Macros)
+	}
+}
+
+func TestTracePreprocessPreludeAndDirectives(t *testing.T) {
+	trace := TracePreprocess("#REV{octave}; #SIGN{G}; #T=t140; T; #NAME{Lead}; o5 >c; o3 f")
+	if !trace.RevOctave || trace.RevVolume || trace.Sign != "G" {
+		t.Fatalf("unexpected directive values %+v", trace)
+	}
+	if len(trace.Tracks) != 2 || trace.Tracks[0].Name != "Lead" {
+		t.Fatalf("expected 2 tracks with the first named, got %+v", trace.Tracks)
+	}
+	if got := trace.Tracks[1].annotated(); got != "{T:t140} o3 f" {
+		t.Fatalf("expected prelude macro span in every track, got %q", got)
+	}
+	dump := trace.String()
+	for _, want := range []string{"#REV: octave\n", "#SIGN: G\n", "track 0 \"Lead\":\n  {T:t140} o5 <c\n", "track 1:\n"} {
+		if !strings.Contains(dump, want) {
+			t.Fatalf("expected %q in dump:\n%s", want, dump)
+		}
+	}
+}
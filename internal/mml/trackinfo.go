@@ -0,0 +1,105 @@
+package mml
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// trackPart is one track's text as split from the preprocessed source, with
+// the metadata copied onto its Track.
+type trackPart struct {
+	text       string
+	section    int
+	start, end int // the track's own text in the preprocessed source
+	name       string
+	span       SourceSpan
+
+	// A global prelude at preludeStart is prefixed to text; preludeLen
+	// includes the joining space.
+	preludeStart, preludeLen int
+}
+
+// trackName is a #NAME{...}; directive and the preprocessed offset it was
+// found at.
+type trackName struct {
+	name string
+	at   int
+}
+
+// describeTracks fills in names and source spans. origins maps preprocessed
+// offsets back to input; names come from #NAME directives, or else from a
+// single-line comment standing on the line(s) right before the track.
+func describeTracks(parts []trackPart, input string, origins []int, names []trackName) {
+	for i := range parts {
+		p := &parts[i]
+		if p.start < len(origins) && p.end <= len(origins) && p.end > p.start {
+			p.span = SourceSpan{Start: origins[p.start], End: origins[p.end-1] + 1}
+		}
+		p.name = leadingCommentName(input, p.span.Start)
+	}
+	for _, n := range names {
+		for i := range parts {
+			if parts[i].end > n.at {
+				parts[i].name = n.name
+				break
+			}
+		}
+	}
+}
+
+// leadingCommentName returns the text of a comment that ends, apart from
+// whitespace, right where a track starts and that starts its own line.
+func leadingCommentName(input string, start int) string {
+	end := start
+	for end > 0 && isSpace(input[end-1]) {
+		end--
+	}
+	if end == 0 {
+		return ""
+	}
+	var text string
+	var begin int
+	if strings.HasSuffix(input[:end], "*/") {
+		begin = strings.LastIndex(input[:end-2], "/*")
+		if begin < 0 {
+			return ""
+		}
+		text = input[begin+2 : end-2]
+	} else {
+		lineStart := strings.LastIndexByte(input[:end], '\n') + 1
+		begin = strings.Index(input[lineStart:end], "//")
+		if begin < 0 {
+			return ""
+		}
+		begin += lineStart
+		text = input[begin+2 : end]
+	}
+	if strings.ContainsAny(text, "\r\n") {
+		return ""
+	}
+	lineStart := strings.LastIndexByte(input[:begin], '\n') + 1
+	if strings.TrimSpace(input[lineStart:begin]) != "" {
+		return ""
+	}
+	return strings.TrimSpace(text)
+}
+
+func (p trackPart) label(tr Track) Track {
+	tr.Name = p.name
+	tr.Section = p.section
+	tr.Span = p.span
+	return tr
+}
+
+func (p trackPart) wrapError(index int, err error) error {
+	return fmt.Errorf("%s: %w", TrackLabel(index, p.name), err)
+}
+
+// TrackLabel formats a track reference for messages, e.g. `track 2 "Bass"`.
+func TrackLabel(index int, name string) string {
+	if name == "" {
+		return "track " + strconv.Itoa(index)
+	}
+	return "track " + strconv.Itoa(index) + " " + strconv.Quote(name)
+}
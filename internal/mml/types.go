@@ -49,11 +49,25 @@ type Event struct {
 	Values   []int
 }
 
+// SourceSpan is a byte range [Start, End) of the MML source text.
+type SourceSpan struct {
+	Start int
+	End   int
+}
+
 type Track struct {
 	Events    []Event
 	EndTick   int
 	LoopTick  int
 	LoopIndex int
+	// Name comes from a #NAME{...}; directive in or before the track, or
+	// from a one-line comment on the line before it.
+	Name string
+	// Section is the index of the ';'-separated section the track was read
+	// from, counting the global prelude section.
+	Section int
+	// Span covers the track's own text in the source, without the prelude.
+	Span SourceSpan
 }
 
 type Score struct {
@@ -73,6 +87,7 @@ type ParserConfig struct {
 	DefaultVolume  int
 	DefaultFineVol int
 	OctavePolarize int
+	Limits         ParserLimits
 }
 
 func DefaultParserConfig() ParserConfig {
@@ -86,5 +101,6 @@ func DefaultParserConfig() ParserConfig {
 		DefaultVolume:  16,
 		DefaultFineVol: 127,
 		OctavePolarize: -1,
+		Limits:         DefaultParserLimits(),
 	}
 }
@@ -1,11 +1,16 @@
 package nesapu
 
 import (
+	"encoding/hex"
 	"math"
 	"math/rand"
+	"strconv"
+	"strings"
 	"sync/atomic"
 
+	"github.com/cbegin/mmlfm-go/internal/filter"
 	"github.com/cbegin/mmlfm-go/internal/lfo"
+	"github.com/cbegin/mmlfm-go/internal/pipe"
 )
 
 const (
@@ -22,6 +27,7 @@ type Params struct {
 	TriangleGain float64
 	PulseGain    float64
 	NoiseGain    float64
+	DPCMGain     float64
 	LPFCutoff    float64 // lowpass filter cutoff in Hz (0 = disabled)
 }
 
@@ -35,6 +41,7 @@ func DefaultParams() Params {
 		TriangleGain: 0.85,
 		PulseGain:    1.0,
 		NoiseGain:    0.45,
+		DPCMGain:     0.6,
 		LPFCutoff:    12000,
 	}
 }
@@ -46,25 +53,107 @@ const (
 	slotPulse2
 	slotTriangle
 	slotNoise
+	slotDPCM
 	slotCount
 )
 
+// Channels 1-5 of module 0 (%0,1 ... %0,5) pin notes to one APU channel, the
+// way ppmck tracks A-E address the hardware. Channel 0 keeps the automatic
+// assignment.
+const (
+	ChannelPulse1 = 1 + iota
+	ChannelPulse2
+	ChannelTriangle
+	ChannelNoise
+	ChannelDPCM
+)
+
+// pulseDuties are the four 2A03 duty cycles selected by @0-@3 on pinned
+// pulse channels.
+var pulseDuties = [4]float64{0.125, 0.25, 0.5, 0.75}
+
+// dpcmRates are the NTSC DMC sample rates in Hz for rate indexes 0-15.
+var dpcmRates = [16]float64{
+	4181.71, 4709.93, 5264.04, 5593.04, 6257.95, 7046.35, 7919.35, 8363.42,
+	9419.86, 11186.1, 12604.0, 13982.6, 16884.6, 21306.8, 24858.0, 33143.9,
+}
+
 type slotRef struct {
 	kind slotKind
 }
 
+// voiceMod is the table envelope and LFO state of a channel's current note.
+type voiceMod struct {
+	gain      float64      // level scale, 1 = unchanged
+	pitchMul  float64      // frequency ratio, 1 = unchanged
+	vcf       filter.Voice // @f envelope and resonant filter
+	pipes     pipe.Route   // @o/@r bus pipes
+	release   float64      // volume drop per frame after key-off, 0 = ReleaseStep
+	sweep     float64      // semitones per second after key-off
+	swept     float64      // semitones swept so far
+	keyedOff  bool
+	pitchMod  lfo.Mod
+	ampMod    lfo.Mod
+	filterMod lfo.Mod
+}
+
+// modulate advances the note's LFOs by one sample and returns its frequency
+// ratio and level scale.
+func (m *voiceMod) modulate(sampleRate float64) (freqMul, ampScale float64) {
+	freqMul = m.pitchMul
+	if pitchMod := m.pitchMod.Sample(sampleRate); pitchMod != 0 {
+		freqMul *= math.Pow(2, pitchMod/12.0)
+	}
+	if m.keyedOff && m.sweep != 0 {
+		m.swept += m.sweep / sampleRate
+		freqMul *= math.Pow(2, m.swept/12.0)
+	}
+	return freqMul, 1 + m.ampMod.Sample(sampleRate)
+}
+
+// keyOff starts the note's release.
+func (m *voiceMod) keyOff() {
+	m.keyedOff = true
+	m.vcf.Release()
+}
+
+// fall returns the volume the channel loses each frame after key-off.
+func (m *voiceMod) fall(release float64) float64 {
+	if m.release > 0 {
+		return m.release
+	}
+	return release
+}
+
+// filter runs one sample through the note's filter.
+func (m *voiceMod) filter(x, sampleRate float64) float64 {
+	return m.vcf.Process(x, m.filterMod.Sample(sampleRate), sampleRate)
+}
+
+// route runs one sample through the note's ring and output pipes and returns
+// what is left for the mix.
+func (m *voiceMod) route(x float64, bus *pipe.Bus) float64 {
+	x = m.pipes.Ring(bus, x)
+	if m.pipes.Send(bus, x) {
+		return 0
+	}
+	return x
+}
+
 type pulse struct {
 	active           bool
 	id               int
 	age              int
 	freq             float64
 	phase            float64
+	duty             float64 // 0 uses the slot's PulseDuty param
 	vol              float64
 	pan              float64
 	released         bool
 	portamentoTarget float64
 	portamentoFrames int
 	portamentoStep   float64
+	voiceMod
 }
 
 type triangle struct {
@@ -79,6 +168,7 @@ type triangle struct {
 	portamentoTarget float64
 	portamentoFrames int
 	portamentoStep   float64
+	voiceMod
 }
 
 type noise struct {
@@ -89,15 +179,28 @@ type noise struct {
 	pan      float64
 	released bool
 	lfsr     uint16
+	voiceMod
 }
 
-type filterType int
+// dpcm plays a 1-bit delta-encoded sample. Like the hardware it ignores
+// key-off and stops at the end of the sample.
+type dpcm struct {
+	active bool
+	id     int
+	vol    float64
+	pan    float64
+	sample dpcmSample
+	pos    float64 // position in bits
+	step   float64 // bits per output sample
+	next   int     // next bit to apply
+	level  int     // 7-bit output counter
+	voiceMod
+}
 
-const (
-	nesFilterLP filterType = iota
-	nesFilterHP
-	nesFilterBP
-)
+type dpcmSample struct {
+	data []byte
+	rate float64
+}
 
 type Engine struct {
 	sampleRate       float64
@@ -106,6 +209,8 @@ type Engine struct {
 	pulseB           pulse
 	triangle         triangle
 	noise            noise
+	dpcm             dpcm
+	samples          map[int]dpcmSample
 	activeByID       map[int]slotRef
 	nextID           int
 	assignCounter    int
@@ -114,17 +219,18 @@ type Engine struct {
 	masterGain       uint64
 	lpfL             float64
 	lpfR             float64
-	bpfL             float64
-	bpfR             float64
 	lpfAlpha         float64
-	filterKind       filterType
-	baseLPFCutoff    float64
 	nextPhase        int
 	portamentoFrom   int
 	portamentoFrames int
-	pitchLFO         lfo.LFO
-	ampLFO           lfo.LFO
-	filterLFO        lfo.LFO
+	pitchLFO         lfo.Shape // latched by the next NoteOn
+	ampLFO           lfo.Shape
+	filterLFO        lfo.Shape
+	filterEnv        filter.Envelope // latched by the next NoteOn
+	pipes            pipe.Route      // latched by the next NoteOn
+	bus              *pipe.Bus
+	releaseSec       float64 // latched by the next NoteOn, 0 = ReleaseStep
+	sweep            float64
 }
 
 func New(sampleRate int, params Params) *Engine {
@@ -136,15 +242,16 @@ func New(sampleRate int, params Params) *Engine {
 		sampleRate:  float64(sampleRate),
 		params:      params,
 		activeByID:  make(map[int]slotRef),
+		samples:     make(map[int]dpcmSample),
 		framePeriod: period,
 		masterGain:  math.Float64bits(params.MasterGain),
 		noise:       noise{lfsr: 0xACE1},
+		filterEnv:   filter.Open,
 	}
 	if params.LPFCutoff > 0 && params.LPFCutoff < float64(sampleRate)/2 {
 		rc := 1.0 / (twoPi * params.LPFCutoff)
 		dt := 1.0 / float64(sampleRate)
 		e.lpfAlpha = dt / (rc + dt)
-		e.baseLPFCutoff = params.LPFCutoff
 	}
 	return e
 }
@@ -158,15 +265,29 @@ func (e *Engine) NoteOn(note int, velocity int, pan int, encodedProgram int) int
 
 	// Determine which hardware slot to use.
 	slot := assignSlot(note, program, module, channel, e.params.NoiseCutoff, e.assignCounter)
+	duty := 0.0
+	if _, pinned := pinnedSlot(module, channel); pinned {
+		duty = pulseDuties[program&3]
+	}
 
 	switch slot {
+	case slotDPCM:
+		if e.dpcm.active {
+			delete(e.activeByID, e.dpcm.id)
+		}
+		e.dpcm = dpcm{}
+		// Notes select samples by number; a note without one is silent.
+		if sample, ok := e.samples[note]; ok {
+			e.dpcm = dpcm{active: true, id: id, vol: vel, pan: panNorm, sample: sample, step: sample.rate / e.sampleRate, level: 64, voiceMod: e.newVoiceMod()}
+			e.activeByID[id] = slotRef{kind: slotDPCM}
+		}
 	case slotNoise:
 		if e.noise.active && !e.noise.released {
 			// Steal: mark old note as gone.
 			delete(e.activeByID, e.noise.id)
 		}
 		e.noise = noise{
-			active: true, id: id, age: 0, vol: vel, pan: panNorm, released: false, lfsr: seedLFSR(e.noise.lfsr, note, id),
+			active: true, id: id, age: 0, vol: vel, pan: panNorm, released: false, lfsr: seedLFSR(e.noise.lfsr, note, id), voiceMod: e.newVoiceMod(),
 		}
 		e.activeByID[id] = slotRef{kind: slotNoise}
 	case slotTriangle:
@@ -175,7 +296,7 @@ func (e *Engine) NoteOn(note int, velocity int, pan int, encodedProgram int) int
 		}
 		freq, portTgt, portFrames, portStep := e.noteFreqParams(note)
 		ph := e.phaseForSlot(slot)
-		e.triangle = triangle{active: true, id: id, age: 0, freq: freq, phase: ph, vol: vel, pan: panNorm, portamentoTarget: portTgt, portamentoFrames: portFrames, portamentoStep: portStep}
+		e.triangle = triangle{active: true, id: id, age: 0, freq: freq, phase: ph, vol: vel, pan: panNorm, portamentoTarget: portTgt, portamentoFrames: portFrames, portamentoStep: portStep, voiceMod: e.newVoiceMod()}
 		e.activeByID[id] = slotRef{kind: slotTriangle}
 	case slotPulse2:
 		if e.pulseB.active && !e.pulseB.released {
@@ -183,7 +304,7 @@ func (e *Engine) NoteOn(note int, velocity int, pan int, encodedProgram int) int
 		}
 		freq, portTgt, portFrames, portStep := e.noteFreqParams(note)
 		ph := e.phaseForSlot(slot)
-		e.pulseB = pulse{active: true, id: id, age: 0, freq: freq, phase: ph, vol: vel, pan: panNorm, portamentoTarget: portTgt, portamentoFrames: portFrames, portamentoStep: portStep}
+		e.pulseB = pulse{active: true, id: id, age: 0, freq: freq, phase: ph, duty: duty, vol: vel, pan: panNorm, portamentoTarget: portTgt, portamentoFrames: portFrames, portamentoStep: portStep, voiceMod: e.newVoiceMod()}
 		e.activeByID[id] = slotRef{kind: slotPulse2}
 	default: // slotPulse1
 		if e.pulseA.active && !e.pulseA.released {
@@ -191,7 +312,7 @@ func (e *Engine) NoteOn(note int, velocity int, pan int, encodedProgram int) int
 		}
 		freq, portTgt, portFrames, portStep := e.noteFreqParams(note)
 		ph := e.phaseForSlot(slot)
-		e.pulseA = pulse{active: true, id: id, age: 0, freq: freq, phase: ph, vol: vel, pan: panNorm, portamentoTarget: portTgt, portamentoFrames: portFrames, portamentoStep: portStep}
+		e.pulseA = pulse{active: true, id: id, age: 0, freq: freq, phase: ph, duty: duty, vol: vel, pan: panNorm, portamentoTarget: portTgt, portamentoFrames: portFrames, portamentoStep: portStep, voiceMod: e.newVoiceMod()}
 		e.activeByID[id] = slotRef{kind: slotPulse1}
 	}
 	e.assignCounter++
@@ -201,6 +322,22 @@ func (e *Engine) NoteOn(note int, velocity int, pan int, encodedProgram int) int
 	return id
 }
 
+// newVoiceMod returns the modulation state for a new note, with the LFOs
+// set for it.
+func (e *Engine) newVoiceMod() voiceMod {
+	m := voiceMod{gain: 1, pitchMul: 1}
+	m.pitchMod.Start(e.pitchLFO)
+	m.ampMod.Start(e.ampLFO)
+	m.filterMod.Start(e.filterLFO)
+	m.vcf.Start(e.filterEnv)
+	m.pipes = e.pipes
+	m.sweep = e.sweep
+	if e.releaseSec > 0 {
+		m.release = 1 / (e.releaseSec * defaultFrameRate)
+	}
+	return m
+}
+
 func (e *Engine) noteFreqParams(note int) (freq, portTgt float64, portFrames int, portStep float64) {
 	freq = midiToFreq(note)
 	if e.portamentoFrom >= 0 && e.portamentoFrames > 0 {
@@ -226,6 +363,9 @@ func (e *Engine) phaseForSlot(slot slotKind) float64 {
 // assignSlot determines which hardware slot a note should go to based on
 // the musical context rather than pure round-robin.
 func assignSlot(note int, program int, module int, channel int, noiseCutoff int, counter int) slotKind {
+	if slot, ok := pinnedSlot(module, channel); ok {
+		return slot
+	}
 	// Noise: high notes, drum module, or drum program.
 	if note >= noiseCutoff || module == 9 || program == 9 {
 		return slotNoise
@@ -249,6 +389,26 @@ func assignSlot(note int, program int, module int, channel int, noiseCutoff int,
 	return slotPulse2
 }
 
+// pinnedSlot returns the slot addressed by an explicit APU channel.
+func pinnedSlot(module int, channel int) (slotKind, bool) {
+	if module != 0 {
+		return 0, false
+	}
+	switch channel {
+	case ChannelPulse1:
+		return slotPulse1, true
+	case ChannelPulse2:
+		return slotPulse2, true
+	case ChannelTriangle:
+		return slotTriangle, true
+	case ChannelNoise:
+		return slotNoise, true
+	case ChannelDPCM:
+		return slotDPCM, true
+	}
+	return 0, false
+}
+
 func (e *Engine) NoteOff(id int) {
 	slot, ok := e.activeByID[id]
 	if !ok {
@@ -258,32 +418,81 @@ func (e *Engine) NoteOff(id int) {
 	case slotPulse1:
 		if e.pulseA.id == id {
 			e.pulseA.released = true
+			e.pulseA.keyOff()
 		}
 	case slotPulse2:
 		if e.pulseB.id == id {
 			e.pulseB.released = true
+			e.pulseB.keyOff()
 		}
 	case slotTriangle:
 		if e.triangle.id == id {
 			e.triangle.released = true
+			e.triangle.keyOff()
 		}
 	case slotNoise:
 		if e.noise.id == id {
 			e.noise.released = true
+			e.noise.keyOff()
 		}
 	}
 }
 
-func (e *Engine) RenderFrame() (float32, float32) {
-	pitchMod := e.pitchLFO.Sample(e.sampleRate)
-	ampMod := e.ampLFO.Sample(e.sampleRate)
-	filterMod := e.filterLFO.Sample(e.sampleRate)
+// slotByID returns the table envelope state and pan of the channel playing
+// the given note, or nils once it has ended or been replaced.
+func (e *Engine) slotByID(id int) (*voiceMod, *float64) {
+	slot, ok := e.activeByID[id]
+	if !ok {
+		return nil, nil
+	}
+	switch {
+	case slot.kind == slotPulse1 && e.pulseA.active && e.pulseA.id == id:
+		return &e.pulseA.voiceMod, &e.pulseA.pan
+	case slot.kind == slotPulse2 && e.pulseB.active && e.pulseB.id == id:
+		return &e.pulseB.voiceMod, &e.pulseB.pan
+	case slot.kind == slotTriangle && e.triangle.active && e.triangle.id == id:
+		return &e.triangle.voiceMod, &e.triangle.pan
+	case slot.kind == slotNoise && e.noise.active && e.noise.id == id:
+		return &e.noise.voiceMod, &e.noise.pan
+	case slot.kind == slotDPCM && e.dpcm.active && e.dpcm.id == id:
+		return &e.dpcm.voiceMod, &e.dpcm.pan
+	}
+	return nil, nil
+}
+
+func (e *Engine) VoiceActive(id int) bool {
+	mod, _ := e.slotByID(id)
+	return mod != nil
+}
+
+// SetVoicePitch has no effect on the noise and DPCM channels, whose rates
+// are fixed.
+func (e *Engine) SetVoicePitch(id int, semitones float64) {
+	if mod, _ := e.slotByID(id); mod != nil {
+		mod.pitchMul = math.Pow(2, semitones/12.0)
+	}
+}
+
+// SetVoiceGain scales the channel volume before its 4-bit quantization.
+func (e *Engine) SetVoiceGain(id int, gain float64) {
+	if mod, _ := e.slotByID(id); mod != nil {
+		mod.gain = math.Max(gain, 0)
+	}
+}
+
+func (e *Engine) SetVoicePan(id int, pan int) {
+	if _, p := e.slotByID(id); p != nil {
+		*p = clamp(float64(pan), -64, 64)
+	}
+}
 
-	freqMul := 1.0
-	if pitchMod != 0 {
-		freqMul = math.Pow(2, pitchMod/12.0)
+func (e *Engine) SetVoiceFilter(id int, cutoff int) {
+	if mod, _ := e.slotByID(id); mod != nil {
+		mod.vcf.Hold(float64(cutoff))
 	}
+}
 
+func (e *Engine) RenderFrame() (float32, float32) {
 	e.frameCounter++
 	if e.frameCounter >= e.framePeriod {
 		e.frameCounter = 0
@@ -304,106 +513,62 @@ func (e *Engine) RenderFrame() (float32, float32) {
 		e.noise.age++
 	}
 
-	// Apply pitch LFO temporarily
-	if freqMul != 1.0 {
-		if e.pulseA.active {
-			e.pulseA.freq *= freqMul
-		}
-		if e.pulseB.active {
-			e.pulseB.freq *= freqMul
-		}
-		if e.triangle.active {
-			e.triangle.freq *= freqMul
-		}
-	}
-
 	p1, p1l, p1r := e.renderPulse(&e.pulseA, e.params.PulseDutyA)
 	p2, p2l, p2r := e.renderPulse(&e.pulseB, e.params.PulseDutyB)
 	t, tl, tr := e.renderTriangle(&e.triangle)
 	n, nl, nr := e.renderNoise(&e.noise)
+	d, dl, dr := e.renderDPCM(&e.dpcm)
 
-	// Restore original frequencies
-	if freqMul != 1.0 {
-		if e.pulseA.active {
-			e.pulseA.freq /= freqMul
-		}
-		if e.pulseB.active {
-			e.pulseB.freq /= freqMul
-		}
-		if e.triangle.active {
-			e.triangle.freq /= freqMul
-		}
-	}
-
-	// Apply amp LFO
-	ampScale := 1.0 + ampMod
-
-	l := (p1*p1l*e.params.PulseGain + p2*p2l*e.params.PulseGain + t*tl*e.params.TriangleGain + n*nl*e.params.NoiseGain) * e.masterGainValue() * ampScale
-	r := (p1*p1r*e.params.PulseGain + p2*p2r*e.params.PulseGain + t*tr*e.params.TriangleGain + n*nr*e.params.NoiseGain) * e.masterGainValue() * ampScale
-
-	// Filter LFO
-	if e.baseLPFCutoff > 0 && filterMod != 0 {
-		cutoff := e.baseLPFCutoff + filterMod*100.0
-		if cutoff < 20 {
-			cutoff = 20
-		}
-		if cutoff > e.sampleRate/2 {
-			cutoff = e.sampleRate / 2
-		}
-		rc := 1.0 / (twoPi * cutoff)
-		dt := 1.0 / e.sampleRate
-		e.lpfAlpha = dt / (rc + dt)
-	}
+	l := (p1*p1l*e.params.PulseGain + p2*p2l*e.params.PulseGain + t*tl*e.params.TriangleGain + n*nl*e.params.NoiseGain + d*dl*e.params.DPCMGain) * e.masterGainValue()
+	r := (p1*p1r*e.params.PulseGain + p2*p2r*e.params.PulseGain + t*tr*e.params.TriangleGain + n*nr*e.params.NoiseGain + d*dr*e.params.DPCMGain) * e.masterGainValue()
 
 	if e.lpfAlpha > 0 {
 		e.lpfL += e.lpfAlpha * (l - e.lpfL)
 		e.lpfR += e.lpfAlpha * (r - e.lpfR)
-		switch e.filterKind {
-		case nesFilterLP:
-			l = e.lpfL
-			r = e.lpfR
-		case nesFilterHP:
-			l = l - e.lpfL
-			r = r - e.lpfR
-		case nesFilterBP:
-			e.bpfL += e.lpfAlpha * (e.lpfL - e.bpfL)
-			e.bpfR += e.lpfAlpha * (e.lpfR - e.bpfR)
-			l = e.lpfL - e.bpfL
-			r = e.lpfR - e.bpfR
-		}
+		l = e.lpfL
+		r = e.lpfR
 	}
 
 	return float32(clamp(l, -1, 1)), float32(clamp(r, -1, 1))
 }
 
+// RenderBlock renders len(dst)/2 frames into interleaved stereo dst. The
+// channels are clocked together by the frame sequencer, so it renders frame
+// by frame.
+func (e *Engine) RenderBlock(dst []float32) {
+	for f := 0; f+1 < len(dst); f += 2 {
+		dst[f], dst[f+1] = e.RenderFrame()
+	}
+}
+
 func (e *Engine) clockFrame() {
 	release := e.params.ReleaseStep
 	if release <= 0 {
 		release = 1.0 / 48.0
 	}
 	if e.pulseA.active && e.pulseA.released {
-		e.pulseA.vol -= release
+		e.pulseA.vol -= e.pulseA.fall(release)
 		if e.pulseA.vol <= 0 {
 			delete(e.activeByID, e.pulseA.id)
 			e.pulseA = pulse{}
 		}
 	}
 	if e.pulseB.active && e.pulseB.released {
-		e.pulseB.vol -= release
+		e.pulseB.vol -= e.pulseB.fall(release)
 		if e.pulseB.vol <= 0 {
 			delete(e.activeByID, e.pulseB.id)
 			e.pulseB = pulse{}
 		}
 	}
 	if e.triangle.active && e.triangle.released {
-		e.triangle.vol -= release
+		e.triangle.vol -= e.triangle.fall(release)
 		if e.triangle.vol <= 0 {
 			delete(e.activeByID, e.triangle.id)
 			e.triangle = triangle{}
 		}
 	}
 	if e.noise.active && e.noise.released {
-		e.noise.vol -= release
+		e.noise.vol -= e.noise.fall(release)
 		if e.noise.vol <= 0 {
 			delete(e.activeByID, e.noise.id)
 			e.noise = noise{lfsr: 0xACE1}
@@ -428,6 +593,9 @@ func (e *Engine) renderPulse(p *pulse, duty float64) (float64, float64, float64)
 	if !p.active {
 		return 0, 0, 0
 	}
+	if p.duty > 0 {
+		duty = p.duty
+	}
 	if p.portamentoFrames > 0 {
 		p.portamentoFrames--
 		p.freq += p.portamentoStep
@@ -435,7 +603,8 @@ func (e *Engine) renderPulse(p *pulse, duty float64) (float64, float64, float64)
 			p.freq = p.portamentoTarget
 		}
 	}
-	dt := p.freq / e.sampleRate
+	freqMul, ampScale := p.modulate(e.sampleRate)
+	dt := p.freq * freqMul / e.sampleRate
 	p.phase += dt
 	if p.phase >= 1 {
 		p.phase -= 1
@@ -447,9 +616,9 @@ func (e *Engine) renderPulse(p *pulse, duty float64) (float64, float64, float64)
 	// Apply PolyBLEP anti-aliasing at both transitions.
 	v += polyBLEP(p.phase, dt)
 	v -= polyBLEP(math.Mod(p.phase-duty+1, 1), dt)
-	level := quantize(p.vol, 16)
+	level := quantize(p.vol*p.gain, 16)
 	angle := ((p.pan + 64.0) / 128.0) * (math.Pi / 2.0)
-	return v * level, math.Cos(angle), math.Sin(angle)
+	return p.route(p.filter(v*level*ampScale, e.sampleRate), e.bus), math.Cos(angle), math.Sin(angle)
 }
 
 func (e *Engine) renderTriangle(t *triangle) (float64, float64, float64) {
@@ -463,30 +632,102 @@ func (e *Engine) renderTriangle(t *triangle) (float64, float64, float64) {
 			t.freq = t.portamentoTarget
 		}
 	}
-	dt := t.freq / e.sampleRate
+	freqMul, ampScale := t.modulate(e.sampleRate)
+	dt := t.freq * freqMul / e.sampleRate
 	t.phase += dt
 	if t.phase >= 1 {
 		t.phase -= 1
 	}
 	raw := 2*math.Abs(2*t.phase-1) - 1
-	level := quantize(t.vol, 16)
+	level := quantize(t.vol*t.gain, 16)
 	angle := ((t.pan + 64.0) / 128.0) * (math.Pi / 2.0)
-	return raw * level, math.Cos(angle), math.Sin(angle)
+	return t.route(t.filter(raw*level*ampScale, e.sampleRate), e.bus), math.Cos(angle), math.Sin(angle)
 }
 
 func (e *Engine) renderNoise(n *noise) (float64, float64, float64) {
 	if !n.active {
 		return 0, 0, 0
 	}
+	_, ampScale := n.modulate(e.sampleRate)
 	bit := (n.lfsr ^ (n.lfsr >> 1)) & 1
 	n.lfsr = (n.lfsr >> 1) | (bit << 15)
 	v := -1.0
 	if n.lfsr&1 == 1 {
 		v = 1
 	}
-	level := quantize(n.vol, 16)
+	level := quantize(n.vol*n.gain, 16)
 	angle := ((n.pan + 64.0) / 128.0) * (math.Pi / 2.0)
-	return v * level, math.Cos(angle), math.Sin(angle)
+	return n.route(n.filter(v*level*ampScale, e.sampleRate), e.bus), math.Cos(angle), math.Sin(angle)
+}
+
+func (e *Engine) renderDPCM(d *dpcm) (float64, float64, float64) {
+	if !d.active {
+		return 0, 0, 0
+	}
+	bits := len(d.sample.data) * 8
+	d.pos += d.step
+	for d.next < int(d.pos) {
+		if d.next >= bits {
+			delete(e.activeByID, d.id)
+			*d = dpcm{}
+			return 0, 0, 0
+		}
+		// Each bit moves the counter by 2, saturating at the 7-bit range.
+		if d.sample.data[d.next/8]>>(d.next%8)&1 == 1 {
+			if d.level <= 125 {
+				d.level += 2
+			}
+		} else if d.level >= 2 {
+			d.level -= 2
+		}
+		d.next++
+	}
+	_, ampScale := d.modulate(e.sampleRate)
+	angle := ((d.pan + 64.0) / 128.0) * (math.Pi / 2.0)
+	return d.route(d.filter(float64(d.level-64)/64*d.vol*d.gain*ampScale, e.sampleRate), e.bus), math.Cos(angle), math.Sin(angle)
+}
+
+// SetDPCMSample registers a 1-bit delta-encoded (.dmc) sample played by note
+// number on the DPCM channel, at one of the 16 hardware rate indexes.
+func (e *Engine) SetDPCMSample(note int, data []byte, rateIndex int) {
+	if len(data) == 0 {
+		delete(e.samples, note)
+		return
+	}
+	rateIndex = max(0, min(rateIndex, len(dpcmRates)-1))
+	e.samples[note] = dpcmSample{data: data, rate: dpcmRates[rateIndex]}
+}
+
+// LoadDPCMFromDefs registers samples from #DPCMn{rate,hexdata} definitions.
+func (e *Engine) LoadDPCMFromDefs(defs map[string]string) {
+	for key, body := range defs {
+		upper := strings.ToUpper(key)
+		if !strings.HasPrefix(upper, "DPCM") {
+			continue
+		}
+		note, err := strconv.Atoi(strings.TrimSpace(upper[4:]))
+		if err != nil {
+			continue
+		}
+		open := strings.IndexByte(body, '{')
+		close := strings.IndexByte(body, '}')
+		if open < 0 || close <= open {
+			continue
+		}
+		rateText, hexText, ok := strings.Cut(body[open+1:close], ",")
+		if !ok {
+			continue
+		}
+		rate, err := strconv.Atoi(strings.TrimSpace(rateText))
+		if err != nil {
+			continue
+		}
+		data, err := hex.DecodeString(strings.TrimSpace(hexText))
+		if err != nil {
+			continue
+		}
+		e.SetDPCMSample(note, data, rate)
+	}
 }
 
 func midiToFreq(note int) float64 {
@@ -518,15 +759,25 @@ func clamp(v, lo, hi float64) float64 {
 	return v
 }
 
-func (e *Engine) SetFilterType(filterType int) {
-	switch filterType {
-	case 1:
-		e.filterKind = nesFilterBP
-	case 2:
-		e.filterKind = nesFilterHP
-	default:
-		e.filterKind = nesFilterLP
-	}
+// SetFilter sets the @f envelope and %f mode for subsequent NoteOns.
+func (e *Engine) SetFilter(env filter.Envelope) {
+	e.filterEnv = env
+}
+
+// SetBus sets the bus the @o/@r pipes read and write.
+func (e *Engine) SetBus(b *pipe.Bus) {
+	e.bus = b
+}
+
+// SetPipes sets the bus pipe routing for subsequent NoteOns.
+func (e *Engine) SetPipes(r pipe.Route) {
+	e.pipes = r
+}
+
+// SetRelease sets the release time in seconds for subsequent NoteOns, 0 for
+// ReleaseStep, and the pitch sweep after key-off in semitones per second.
+func (e *Engine) SetRelease(seconds, sweep float64) {
+	e.releaseSec, e.sweep = seconds, sweep
 }
 
 func (e *Engine) SetNoteOnPhase(phase int) {
@@ -538,16 +789,16 @@ func (e *Engine) SetPortamento(fromNote int, frames int) {
 	e.portamentoFrames = frames
 }
 
-func (e *Engine) SetPitchLFO(depth float64, rateHz float64, waveform int) {
-	e.pitchLFO.Set(depth, rateHz, waveform)
+func (e *Engine) SetPitchLFO(shape lfo.Shape) {
+	e.pitchLFO = shape
 }
 
-func (e *Engine) SetAmpLFO(depth float64, rateHz float64, waveform int) {
-	e.ampLFO.Set(depth, rateHz, waveform)
+func (e *Engine) SetAmpLFO(shape lfo.Shape) {
+	e.ampLFO = shape
 }
 
-func (e *Engine) SetFilterLFO(depth float64, rateHz float64, waveform int) {
-	e.filterLFO.Set(depth, rateHz, waveform)
+func (e *Engine) SetFilterLFO(shape lfo.Shape) {
+	e.filterLFO = shape
 }
 
 func (e *Engine) SetMasterGain(gain float64) {
@@ -571,6 +822,9 @@ func (e *Engine) ActiveVoiceCount() int {
 	if e.noise.active {
 		n++
 	}
+	if e.dpcm.active {
+		n++
+	}
 	return n
 }
 
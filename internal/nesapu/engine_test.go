@@ -43,3 +43,65 @@ func TestEngineSupportsStereoPan(t *testing.T) {
 		t.Fatalf("expected right-biased signal, left=%f right=%f", leftEnergy, rightEnergy)
 	}
 }
+
+func TestPinnedChannelsSelectSlots(t *testing.T) {
+	cases := map[int]slotKind{
+		ChannelPulse1:   slotPulse1,
+		ChannelPulse2:   slotPulse2,
+		ChannelTriangle: slotTriangle,
+		ChannelNoise:    slotNoise,
+		ChannelDPCM:     slotDPCM,
+	}
+	for channel, want := range cases {
+		// A high note and the drum program would pick noise automatically.
+		if got := assignSlot(96, 9, 0, channel, 84, 0); got != want {
+			t.Fatalf("channel %d: expected slot %d, got %d", channel, want, got)
+		}
+	}
+	if got := assignSlot(96, 0, 0, 0, 84, 0); got != slotNoise {
+		t.Fatalf("expected channel 0 to keep automatic assignment, got %d", got)
+	}
+}
+
+func TestDPCMPlaysSampleToEnd(t *testing.T) {
+	e := New(48000, DefaultParams())
+	e.LoadDPCMFromDefs(map[string]string{"DPCM3": "DPCM3{15,ffff0000}"})
+	id := e.NoteOn(3, 127, 0, ChannelDPCM<<16)
+	e.NoteOff(id)
+	var nonZero bool
+	for i := 0; i < 64; i++ {
+		if l, _ := e.RenderFrame(); l != 0 {
+			nonZero = true
+		}
+	}
+	if !nonZero {
+		t.Fatalf("expected DPCM output after key-off")
+	}
+	if e.ActiveVoiceCount() != 0 {
+		t.Fatalf("expected DPCM voice to end with its sample")
+	}
+	e.NoteOn(4, 127, 0, ChannelDPCM<<16)
+	if e.ActiveVoiceCount() != 0 {
+		t.Fatalf("expected note without a sample to stay silent")
+	}
+}
+
+func TestVoiceUpdatesFollowTheChannelsCurrentNote(t *testing.T) {
+	e := New(48000, DefaultParams())
+	pinned := ChannelPulse1 << 16
+	first := e.NoteOn(60, 127, 0, pinned)
+	second := e.NoteOn(64, 127, 0, pinned)
+	if e.VoiceActive(first) || !e.VoiceActive(second) {
+		t.Fatalf("expected the second note to replace the first on pulse 1")
+	}
+	e.SetVoiceGain(first, 0)
+	if e.pulseA.gain != 1 {
+		t.Fatalf("a replaced note must not change the channel, gain %f", e.pulseA.gain)
+	}
+	e.SetVoiceGain(second, 0)
+	for i := 0; i < 2048; i++ {
+		if l, r := e.RenderFrame(); l != 0 || r != 0 {
+			t.Fatalf("expected silence at gain 0, got %f,%f at frame %d", l, r, i)
+		}
+	}
+}
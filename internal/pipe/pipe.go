@@ -0,0 +1,130 @@
+// Package pipe carries track output to other tracks: the MML @o, @i and @r
+// bus pipes and #FM channel connections.
+package pipe
+
+import "math"
+
+// Count is the number of pipes on a Bus.
+const Count = 8
+
+// Output modes, numbered like MML @o.
+const (
+	Standard  = iota // play to the mix
+	Overwrite        // write to the pipe instead of the mix, replacing earlier tracks
+	Add              // add to the pipe instead of the mix
+)
+
+// Bus holds the pipes. What voices write during a frame is read back on the
+// next one, so the order voices render in does not matter. Each frame starts
+// with empty pipes and keeps its writes by track: an Overwrite drops what
+// lower numbered tracks wrote to the pipe that frame, as if the tracks had
+// played in order, while the voices of one track mix.
+type Bus struct {
+	last  [Count]float64
+	next  [Count][]float64 // this frame's writes by track
+	floor [Count]int       // lowest track still heard this frame
+	dirty [Count]bool
+}
+
+// NewBus returns a bus for tracks 0 to tracks-1. Later tracks write as the
+// last one.
+func NewBus(tracks int) *Bus {
+	n := max(tracks, 1)
+	buf := make([]float64, Count*n)
+	b := &Bus{}
+	for p := range b.next {
+		b.next[p] = buf[p*n : (p+1)*n : (p+1)*n]
+	}
+	return b
+}
+
+// Read returns what was written to pipe p during the previous frame.
+func (b *Bus) Read(p int) float64 {
+	if p < 0 || p >= Count {
+		return 0
+	}
+	return b.last[p]
+}
+
+// Write adds x to pipe p for the next frame on behalf of track t.
+func (b *Bus) Write(p, t int, x float64) {
+	if p >= 0 && p < Count {
+		b.next[p][b.track(p, t)] += x
+		b.dirty[p] = true
+	}
+}
+
+// Overwrite writes x to pipe p for the next frame on behalf of track t,
+// replacing what lower numbered tracks wrote to it this frame.
+func (b *Bus) Overwrite(p, t int, x float64) {
+	if p >= 0 && p < Count {
+		t = b.track(p, t)
+		b.next[p][t] += x
+		b.floor[p] = max(b.floor[p], t)
+		b.dirty[p] = true
+	}
+}
+
+func (b *Bus) track(p, t int) int {
+	return min(max(t, 0), len(b.next[p])-1)
+}
+
+// Advance ends a frame.
+func (b *Bus) Advance() {
+	for p := range b.next {
+		b.last[p] = 0
+		if !b.dirty[p] {
+			continue
+		}
+		for t, x := range b.next[p] {
+			if t >= b.floor[p] {
+				b.last[p] += x
+			}
+			b.next[p][t] = 0
+		}
+		b.floor[p], b.dirty[p] = 0, false
+	}
+}
+
+// Route is a voice's pipe setting. The zero value plays to the mix and reads
+// no pipes.
+type Route struct {
+	Output     int // @o mode
+	OutPipe    int
+	InputLevel int // @i 0 (off) - 7
+	InPipe     int
+	RingLevel  int // @r 0 (off) - 8
+	RingPipe   int
+	Track      int // the writing track, which decides what an Overwrite replaces
+}
+
+// Send writes x to the output pipe and reports whether it was taken out of
+// the mix.
+func (r Route) Send(b *Bus, x float64) bool {
+	if b == nil || r.Output == Standard {
+		return false
+	}
+	if r.Output == Overwrite {
+		b.Overwrite(r.OutPipe, r.Track, x)
+	} else {
+		b.Write(r.OutPipe, r.Track, x)
+	}
+	return true
+}
+
+// Modulation returns the phase offset in radians the input pipe adds to the
+// carrier. Level 5 turns a full-scale input into half a cycle.
+func (r Route) Modulation(b *Bus) float64 {
+	if b == nil || r.InputLevel <= 0 {
+		return 0
+	}
+	return b.Read(r.InPipe) * math.Pi * math.Pow(2, float64(r.InputLevel-5))
+}
+
+// Ring multiplies x by the ring pipe; level 4 multiplies by the pipe as is.
+func (r Route) Ring(b *Bus, x float64) float64 {
+	if b == nil || r.RingLevel <= 0 {
+		return x
+	}
+	return x * b.Read(r.RingPipe) * float64(r.RingLevel) / 4
+}
@@ -0,0 +1,84 @@
+package pipe
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBusReadsBackThePreviousFrame(t *testing.T) {
+	b := NewBus(2)
+	b.Write(1, 0, 0.25)
+	b.Write(1, 1, 0.5)
+	if got := b.Read(1); got != 0 {
+		t.Fatalf("writes should not be readable until the frame ends, got %f", got)
+	}
+	b.Advance()
+	if got := b.Read(1); got != 0.75 {
+		t.Fatalf("expected the pipe to mix both writes, got %f", got)
+	}
+	b.Advance()
+	if got := b.Read(1); got != 0 {
+		t.Fatalf("expected the pipe to empty after a frame with no writes, got %f", got)
+	}
+	b.Write(Count, 0, 1)
+	if got := b.Read(-1); got != 0 {
+		t.Fatalf("out of range pipes should read silent, got %f", got)
+	}
+}
+
+func TestZeroRouteLeavesTheVoiceAlone(t *testing.T) {
+	b := NewBus(1)
+	b.Write(0, 0, 0.5)
+	b.Advance()
+	var r Route
+	if r.Send(b, 0.3) || r.Modulation(b) != 0 || r.Ring(b, 0.3) != 0.3 {
+		t.Fatalf("zero route should not touch the pipes")
+	}
+}
+
+func TestRouteSendsModulatesAndRings(t *testing.T) {
+	b := NewBus(1)
+	out := Route{Output: Overwrite, OutPipe: 2}
+	if !out.Send(b, 0.5) {
+		t.Fatalf("expected output to leave the mix")
+	}
+	b.Advance()
+	in := Route{InputLevel: 5, InPipe: 2, RingLevel: 8, RingPipe: 2}
+	if got := in.Modulation(b); math.Abs(got-0.5*math.Pi) > 1e-12 {
+		t.Fatalf("expected level 5 to scale the input by pi, got %f", got)
+	}
+	if got := in.Ring(b, 0.4); math.Abs(got-0.4) > 1e-12 {
+		t.Fatalf("expected level 8 to double the ring product, got %f", got)
+	}
+	if out.Send(nil, 1) || in.Modulation(nil) != 0 || in.Ring(nil, 1) != 1 {
+		t.Fatalf("routes without a bus should play to the mix")
+	}
+}
+
+func TestOverwriteReplacesEarlierTracks(t *testing.T) {
+	b := NewBus(3)
+	// Voices render in any order; the frame reads as if tracks ran in order.
+	Route{Output: Add, OutPipe: 0, Track: 2}.Send(b, 0.125)
+	Route{Output: Overwrite, OutPipe: 0, Track: 1}.Send(b, 0.25)
+	Route{Output: Overwrite, OutPipe: 0, Track: 1}.Send(b, 0.25)
+	Route{Output: Add, OutPipe: 0, Track: 0}.Send(b, 1)
+	Route{Output: Add, OutPipe: 1, Track: 0}.Send(b, 1)
+	b.Advance()
+	if got := b.Read(0); got != 0.625 {
+		t.Fatalf("expected track 1 to replace track 0 and track 2 to add, got %f", got)
+	}
+	if got := b.Read(1); got != 1 {
+		t.Fatalf("expected other pipes to keep their writes, got %f", got)
+	}
+	Route{Output: Add, OutPipe: 0, Track: 0}.Send(b, 0.5)
+	b.Advance()
+	if got := b.Read(0); got != 0.5 {
+		t.Fatalf("expected an overwrite to last one frame, got %f", got)
+	}
+	Route{Output: Overwrite, OutPipe: 0, Track: 9}.Send(b, 0.5)
+	Route{Output: Add, OutPipe: 0, Track: 2}.Send(b, 0.5)
+	b.Advance()
+	if got := b.Read(0); got != 1 {
+		t.Fatalf("expected tracks past the bus to write as the last one, got %f", got)
+	}
+}
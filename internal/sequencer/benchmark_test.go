@@ -1,6 +1,8 @@
 package sequencer
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/cbegin/mmlfm-go/internal/fm"
@@ -22,3 +24,48 @@ func BenchmarkSequencerProcess(b *testing.B) {
 		seq.Process(buf)
 	}
 }
+
+func BenchmarkMultiEngineRenderFrame(b *testing.B) {
+	m := NewMultiEngine(0, 48000)
+	for mod := 0; mod < 4; mod++ {
+		m.AddEngine(mod, fm.New(48000, fm.DefaultParams()), 1)
+	}
+	for mod := 0; mod < 4; mod++ {
+		m.SetCurrentModule(mod)
+		m.NoteOn(60+mod, 100, 0, mod<<8)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.RenderFrame()
+	}
+}
+
+// BenchmarkExamples renders the first ten seconds of each example, once
+// with block rendering and once frame by frame.
+func BenchmarkExamples(b *testing.B) {
+	files, _ := filepath.Glob("../../examples/*.mml")
+	for _, path := range files {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		score, err := mml.NewParser(mml.DefaultParserConfig()).Parse(string(src))
+		if err != nil {
+			b.Fatalf("%s: %v", path, err)
+		}
+		buf := make([]float32, 48000*10*2)
+		for _, mode := range []string{"block", "frame"} {
+			b.Run(filepath.Base(path)+"/"+mode, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					var engine VoiceEngine = fm.New(48000, fm.DefaultParams())
+					if mode == "frame" {
+						engine = frameEngine{engine}
+					}
+					New(score, engine, 48000).Process(buf)
+				}
+			})
+		}
+	}
+}
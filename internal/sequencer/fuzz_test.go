@@ -0,0 +1,55 @@
+package sequencer
+
+import (
+	"testing"
+
+	"github.com/cbegin/mmlfm-go/internal/mml"
+)
+
+func FuzzSequencer(f *testing.F) {
+	for _, seed := range []string{
+		"t120 o5 l8 cdefgab>c",
+		"#TABLE1{(0,64)8|64,32}2*2+1; na1 nt1 c4 $ d8 &e",
+		"t1 q0 @q99 c1^1^1",
+		"t999 %f2 mp4,8,2 ma6,1 po3 c & c && c",
+		"#REV; [c | d]3 ; %1,2 @3 p9 k-64 kt2 c",
+	} {
+		f.Add(seed, false)
+		f.Add(seed, true)
+	}
+	cfg := mml.DefaultParserConfig()
+	cfg.Limits = mml.ParserLimits{MaxExpandedLen: 1 << 14, MaxEvents: 1 << 10}
+	f.Fuzz(func(t *testing.T, src string, loop bool) {
+		score, err := mml.NewParser(cfg).Parse(src)
+		if err != nil {
+			return
+		}
+		seq := NewWithOptions(score, &countingEngine{}, 8000, Options{LoopWholeScore: loop})
+		buf := make([]float32, 512*2)
+		for i := 0; i < 16; i++ {
+			seq.Process(buf)
+		}
+	})
+}
+
+func FuzzParseTableFormula(f *testing.F) {
+	for _, seed := range []string{
+		"0,1,2,3",
+		"[0,8]4 (0,64)16 *2 +3",
+		"(10)5, [1,(2,4)3]2 -1",
+		"[[1]99]99 (0,1)999999999",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, body string) {
+		if n := len(parseTableFormula(body)); n > maxTableLength {
+			t.Fatalf("table has %d values, over the %d cap", n, maxTableLength)
+		}
+		defs := map[string]string{"TABLE1": "#TABLE1{" + body + "}99*2"}
+		for _, table := range parseTableDefinitions(defs) {
+			if len(table.values) > maxTableLength || table.loopStart > len(table.values) {
+				t.Fatalf("bad table: %d values, loop at %d", len(table.values), table.loopStart)
+			}
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package sequencer
+
+import "math"
+
+// Groove moves events off the grid without changing the score. Swing or an
+// offset table shifts each step of the grid, with events between steps
+// shifted in proportion, so note lengths stretch and shrink with the grid.
+// Humanize adds a random shift per tick that is the same on every render
+// with the same seed.
+type Groove struct {
+	Step     int       // grid as a note length: 8 = eighths, 16 = sixteenths (0 = 16)
+	Swing    float64   // percent of each step pair the first step takes; 50 = straight, 0 = none
+	Offsets  []float64 // percent of a step each step moves by, cycled; overrides Swing
+	Humanize float64   // largest random shift, in percent of a step
+	Seed     uint64
+}
+
+// groove is a Groove in ticks for one track.
+type groove struct {
+	step     float64
+	offsets  []float64
+	humanize float64
+	seed     uint64
+}
+
+// newGroove converts g to ticks, returning nil when it leaves timing alone.
+func newGroove(g Groove, resolution, track int) *groove {
+	step := g.Step
+	if step <= 0 {
+		step = 16
+	}
+	out := &groove{step: float64(resolution) / float64(step), seed: g.Seed ^ uint64(track)<<32}
+	offsets := g.Offsets
+	if len(offsets) == 0 && g.Swing > 0 {
+		offsets = []float64{0, 2*g.Swing - 100}
+	}
+	for _, o := range offsets {
+		out.offsets = append(out.offsets, o/100*out.step)
+	}
+	out.humanize = g.Humanize / 100 * out.step
+	for _, o := range out.offsets {
+		if o != 0 {
+			return out
+		}
+	}
+	if out.humanize != 0 {
+		return out
+	}
+	return nil
+}
+
+// at returns when an event at tick plays, with the humanize shift of the
+// note starting at from; a note's key-off passes its key-on tick, so both
+// ends move together.
+func (g *groove) at(tick, from int) int {
+	return tick + int(math.Round(g.warp(tick)+g.jitter(from)))
+}
+
+// warp returns the grid shift at tick.
+func (g *groove) warp(tick int) float64 {
+	n := len(g.offsets)
+	if n == 0 {
+		return 0
+	}
+	pos := float64(tick) / g.step
+	i := int(math.Floor(pos))
+	a, b := g.offsets[mod(i, n)], g.offsets[mod(i+1, n)]
+	return a + (b-a)*(pos-float64(i))
+}
+
+// jitter returns the humanize shift for tick, from a hash of the seed and
+// tick so it does not depend on what played before.
+func (g *groove) jitter(tick int) float64 {
+	if g.humanize == 0 {
+		return 0
+	}
+	// splitmix64
+	x := g.seed + uint64(tick)*0x9E3779B97F4A7C15
+	x = (x ^ x>>30) * 0xBF58476D1CE4E5B9
+	x = (x ^ x>>27) * 0x94D049BB133111EB
+	x ^= x >> 31
+	return (float64(x>>11)/(1<<53)*2 - 1) * g.humanize
+}
+
+func mod(a, n int) int {
+	return ((a % n) + n) % n
+}
@@ -0,0 +1,284 @@
+package sequencer
+
+import (
+	"math"
+	"slices"
+	"sync/atomic"
+
+	"github.com/cbegin/mmlfm-go/internal/alloc"
+	"github.com/cbegin/mmlfm-go/internal/filter"
+	"github.com/cbegin/mmlfm-go/internal/fm"
+	"github.com/cbegin/mmlfm-go/internal/lfo"
+	"github.com/cbegin/mmlfm-go/internal/pipe"
+)
+
+// LiveChannels is the number of live input channels.
+const LiveChannels = 16
+
+// LiveKind identifies a live input event.
+type LiveKind int
+
+const (
+	LiveNoteOn    LiveKind = iota // Note at Velocity; velocity 0 releases it
+	LiveNoteOff                   // release Note
+	LiveProgram                   // select program Value for later notes
+	LivePan                       // pan Value (-64 to 64) the channel's notes
+	LivePitchBend                 // bend the channel's notes by Bend semitones
+)
+
+// LiveEvent is a note or control for a live channel, played on the score's
+// engine alongside its tracks.
+type LiveEvent struct {
+	Frame    int64 // output frame to apply it at; earlier frames apply at once
+	Kind     LiveKind
+	Channel  int // 0 to LiveChannels-1
+	Note     int
+	Velocity int
+	Value    int
+	Bend     float64
+}
+
+// LiveChannel is the program, pan and pitch bend a live channel's notes
+// play with.
+type LiveChannel struct {
+	Program int
+	Pan     int
+	Bend    float64 // semitones
+}
+
+// liveChannel is a LiveChannel and the voices of its held notes.
+type liveChannel struct {
+	LiveChannel
+	held [128]int // voice id + 1 of each held note, 0 = none
+}
+
+// LiveQueue passes live events from any goroutine to the audio thread
+// without locks. It is a bounded queue of slots that carry a sequence
+// number, so producers and consumers only ever race on the slot indices.
+type LiveQueue struct {
+	slots []liveSlot
+	mask  uint64
+	head  atomic.Uint64 // next slot to push
+	tail  atomic.Uint64 // next slot to pop
+}
+
+type liveSlot struct {
+	seq atomic.Uint64
+	ev  LiveEvent
+}
+
+// NewLiveQueue creates a queue holding up to size events, rounded up to a
+// power of two.
+func NewLiveQueue(size int) *LiveQueue {
+	n := 1
+	for n < size {
+		n <<= 1
+	}
+	q := &LiveQueue{slots: make([]liveSlot, n), mask: uint64(n - 1)}
+	for i := range q.slots {
+		q.slots[i].seq.Store(uint64(i))
+	}
+	return q
+}
+
+// Push adds ev, reporting false when the queue is full.
+func (q *LiveQueue) Push(ev LiveEvent) bool {
+	for {
+		pos := q.head.Load()
+		slot := &q.slots[pos&q.mask]
+		switch seq := slot.seq.Load(); {
+		case seq == pos:
+			if q.head.CompareAndSwap(pos, pos+1) {
+				slot.ev = ev
+				slot.seq.Store(pos + 1)
+				return true
+			}
+		case seq < pos:
+			return false
+		}
+	}
+}
+
+// Pop removes the oldest event, reporting false when there is none.
+func (q *LiveQueue) Pop() (LiveEvent, bool) {
+	for {
+		pos := q.tail.Load()
+		slot := &q.slots[pos&q.mask]
+		switch seq := slot.seq.Load(); {
+		case seq == pos+1:
+			if q.tail.CompareAndSwap(pos, pos+1) {
+				ev := slot.ev
+				slot.seq.Store(pos + uint64(len(q.slots)))
+				return ev, true
+			}
+		case seq < pos+1:
+			return LiveEvent{}, false
+		}
+	}
+}
+
+// capacity returns how many events the queue holds.
+func (q *LiveQueue) capacity() int {
+	return len(q.slots)
+}
+
+// Clear drops every queued event.
+func (q *LiveQueue) Clear() {
+	for {
+		if _, ok := q.Pop(); !ok {
+			return
+		}
+	}
+}
+
+// Frame returns the number of frames rendered so far, the time base of
+// LiveEvent.Frame. It is safe to call while the sequencer plays.
+func (s *Sequencer) Frame() int64 {
+	return s.rendered.Load()
+}
+
+// drainLive moves queued live events into liveEvents, ordered by frame. It
+// inserts within the capacity NewWithOptions gave liveEvents, leaving what
+// does not fit in the queue until applied events make room.
+func (s *Sequencer) drainLive() {
+	for len(s.liveEvents) < cap(s.liveEvents) {
+		ev, ok := s.live.Pop()
+		if !ok {
+			return
+		}
+		i, _ := slices.BinarySearchFunc(s.liveEvents, ev.Frame, func(e LiveEvent, f int64) int {
+			if e.Frame <= f {
+				return -1
+			}
+			return 1
+		})
+		s.liveEvents = s.liveEvents[:len(s.liveEvents)+1]
+		copy(s.liveEvents[i+1:], s.liveEvents[i:])
+		s.liveEvents[i] = ev
+	}
+}
+
+// nextLiveFrame returns the frame of the next live event, or MaxInt64.
+func (s *Sequencer) nextLiveFrame() int64 {
+	if len(s.liveEvents) == 0 {
+		return math.MaxInt64
+	}
+	return s.liveEvents[0].Frame
+}
+
+// applyLive plays the live events due by frame.
+func (s *Sequencer) applyLive(frame int64) {
+	n := 0
+	for n < len(s.liveEvents) && s.liveEvents[n].Frame <= frame {
+		s.applyLiveEvent(s.liveEvents[n])
+		n++
+	}
+	s.liveEvents = s.liveEvents[:copy(s.liveEvents, s.liveEvents[n:])]
+}
+
+func (s *Sequencer) applyLiveEvent(ev LiveEvent) {
+	if ev.Channel < 0 || ev.Channel >= LiveChannels {
+		return
+	}
+	ch := &s.liveChannels[ev.Channel]
+	switch ev.Kind {
+	case LiveNoteOn:
+		if ev.Note < 0 || ev.Note > 127 {
+			return
+		}
+		s.liveNoteOff(ch, ev.Note)
+		if ev.Velocity <= 0 {
+			return
+		}
+		s.latchLive(ev.Channel)
+		id := s.engine.NoteOn(ev.Note, clampInt(ev.Velocity, 1, 127), ch.Pan, ch.Program)
+		if id < 0 {
+			return
+		}
+		if ch.Bend != 0 {
+			s.engine.SetVoicePitch(id, ch.Bend)
+		}
+		ch.held[ev.Note] = id + 1
+		// liveVoices does not grow on the audio thread; a voice past its
+		// capacity plays but counts as the score's.
+		if s.liveSounding() < cap(s.liveVoices) {
+			s.liveVoices = append(s.liveVoices, id)
+		}
+	case LiveNoteOff:
+		if ev.Note >= 0 && ev.Note <= 127 {
+			s.liveNoteOff(ch, ev.Note)
+		}
+	case LiveProgram:
+		ch.Program = clampInt(ev.Value, 0, 255)
+	case LivePan:
+		ch.Pan = clampInt(ev.Value, -64, 64)
+		for _, v := range ch.held {
+			if v > 0 {
+				s.engine.SetVoicePan(v-1, ch.Pan)
+			}
+		}
+	case LivePitchBend:
+		ch.Bend = ev.Bend
+		for _, v := range ch.held {
+			if v > 0 {
+				s.engine.SetVoicePitch(v-1, ch.Bend)
+			}
+		}
+	}
+}
+
+func (s *Sequencer) liveNoteOff(ch *liveChannel, note int) {
+	if v := ch.held[note]; v > 0 {
+		s.engine.NoteOff(v - 1)
+		ch.held[note] = 0
+	}
+}
+
+// latchLive sets the engine's note-on state for a live note: the default
+// engine and a plain voice, so it inherits nothing from the tracks.
+func (s *Sequencer) latchLive(channel int) {
+	if ma, ok := s.engine.(interface{ SetCurrentModule(int) }); ok {
+		ma.SetCurrentModule(0)
+	}
+	s.engine.SetNoteOnPhase(0)
+	s.engine.SetPortamento(-1, 0)
+	s.engine.SetPitchLFO(lfo.Shape{})
+	s.engine.SetAmpLFO(lfo.Shape{})
+	s.engine.SetFilterLFO(lfo.Shape{})
+	s.engine.SetFilter(filter.Open)
+	s.engine.SetRelease(0, 0)
+	if e, ok := s.engine.(fmEngine); ok {
+		e.SetInline(fm.NoInline)
+		e.ContinueEnvelope(-1)
+	}
+	if e, ok := s.engine.(pipeEngine); ok {
+		e.SetPipes(pipe.Route{})
+	}
+	if e, ok := s.engine.(allocEngine); ok {
+		e.SetVoiceOwner(alloc.Owner{Track: -1 - channel})
+	}
+}
+
+// liveSounding drops live voices that have finished from liveVoices and
+// returns how many are left.
+func (s *Sequencer) liveSounding() int {
+	j := 0
+	for _, id := range s.liveVoices {
+		if s.engine.VoiceActive(id) {
+			s.liveVoices[j] = id
+			j++
+		}
+	}
+	s.liveVoices = s.liveVoices[:j]
+	return j
+}
+
+// scoreVoices returns how many voices are still sounding for the score,
+// leaving out live notes so they do not hold up its loop or end.
+func (s *Sequencer) scoreVoices() int {
+	n := s.engine.ActiveVoiceCount()
+	if len(s.liveVoices) > 0 {
+		n -= s.liveSounding()
+	}
+	return n
+}
@@ -0,0 +1,157 @@
+package sequencer
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/cbegin/mmlfm-go/internal/fm"
+	"github.com/cbegin/mmlfm-go/internal/mml"
+)
+
+func TestLiveQueuePassesEveryEventFromManyGoroutines(t *testing.T) {
+	const producers, each = 4, 1000
+	q := NewLiveQueue(64)
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				for !q.Push(LiveEvent{Channel: p, Note: i}) {
+					runtime.Gosched()
+				}
+			}
+		}(p)
+	}
+	next := make([]int, producers)
+	for got := 0; got < producers*each; {
+		ev, ok := q.Pop()
+		if !ok {
+			runtime.Gosched()
+			continue
+		}
+		if ev.Note != next[ev.Channel] {
+			t.Fatalf("producer %d: expected event %d, got %d", ev.Channel, next[ev.Channel], ev.Note)
+		}
+		next[ev.Channel]++
+		got++
+	}
+	wg.Wait()
+	if _, ok := q.Pop(); ok {
+		t.Fatalf("expected the queue to be empty")
+	}
+}
+
+// liveEngine records the output frame each NoteOn lands on and the pitch
+// set on each voice.
+type liveEngine struct {
+	*fm.Engine
+	frame int
+	on    []LiveEvent
+	pitch map[int]float64
+}
+
+func (e *liveEngine) NoteOn(note int, velocity int, pan int, program int) int {
+	id := e.Engine.NoteOn(note, velocity, pan, program)
+	e.on = append(e.on, LiveEvent{Frame: int64(e.frame), Note: note, Velocity: velocity, Value: program})
+	return id
+}
+
+func (e *liveEngine) SetVoicePitch(id int, semitones float64) {
+	e.pitch[id] = semitones
+	e.Engine.SetVoicePitch(id, semitones)
+}
+
+func (e *liveEngine) RenderFrame() (float32, float32) {
+	e.frame++
+	return e.Engine.RenderFrame()
+}
+
+func (e *liveEngine) RenderBlock(dst []float32) {
+	e.frame += len(dst) / 2
+	e.Engine.RenderBlock(dst)
+}
+
+func TestSequencerPlaysLiveEventsAtTheirFrame(t *testing.T) {
+	score, err := mml.NewParser(mml.DefaultParserConfig()).Parse("r1 r1")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	q := NewLiveQueue(16)
+	engine := &liveEngine{Engine: fm.New(8000, fm.DefaultParams()), pitch: map[int]float64{}}
+	seq := NewWithOptions(score, engine, 8000, Options{Live: q, LiveChannels: []LiveChannel{1: {Program: 3}}})
+	for _, ev := range []LiveEvent{
+		{Frame: 1234, Kind: LiveNoteOn, Channel: 1, Note: 60, Velocity: 100},
+		{Frame: 1000, Kind: LivePitchBend, Channel: 1, Bend: 2},
+		{Frame: 2000, Kind: LivePitchBend, Channel: 1, Bend: -1},
+		{Frame: 3000, Kind: LiveNoteOff, Channel: 1, Note: 60},
+		{Frame: 3001, Kind: LiveProgram, Channel: 0, Value: 5},
+		{Frame: 3001, Kind: LiveNoteOn, Channel: 0, Note: 64, Velocity: 80},
+	} {
+		q.Push(ev)
+	}
+	seq.Process(make([]float32, 4096*2))
+	if seq.Frame() != 4096 {
+		t.Fatalf("expected 4096 frames rendered, got %d", seq.Frame())
+	}
+	want := []LiveEvent{{Frame: 1234, Note: 60, Velocity: 100, Value: 3}, {Frame: 3001, Note: 64, Velocity: 80, Value: 5}}
+	if len(engine.on) != len(want) || engine.on[0] != want[0] || engine.on[1] != want[1] {
+		t.Fatalf("expected note-ons %v, got %v", want, engine.on)
+	}
+	if len(engine.pitch) != 1 {
+		t.Fatalf("expected only the bent channel's note to be pitched, got %v", engine.pitch)
+	}
+	for _, semitones := range engine.pitch {
+		if semitones != -1 {
+			t.Fatalf("expected the held note to follow the last bend, got %v", semitones)
+		}
+	}
+}
+
+func TestLiveNotesDoNotHoldUpTheScoreLoop(t *testing.T) {
+	score, err := mml.NewParser(mml.DefaultParserConfig()).Parse("l16 c")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	q := NewLiveQueue(16)
+	loops := 0
+	seq := NewWithOptions(score, fm.New(8000, fm.DefaultParams()), 8000, Options{
+		LoopWholeScore: true,
+		Live:           q,
+		OnEvent: func(kind EventKind) {
+			if kind == EventLoopCompleted {
+				loops++
+			}
+		},
+	})
+	q.Push(LiveEvent{Kind: LiveNoteOn, Note: 48, Velocity: 100})
+	seq.Process(make([]float32, 8000*2))
+	if loops == 0 {
+		t.Fatalf("expected the score to loop under a held live note")
+	}
+}
+
+func TestLiveEventsPlayWithoutAllocating(t *testing.T) {
+	score, err := mml.NewParser(mml.DefaultParserConfig()).Parse("r1")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	q := NewLiveQueue(4)
+	seq := NewWithOptions(score, fm.New(8000, fm.DefaultParams()), 8000, Options{Live: q})
+	buf := make([]float32, 64*2)
+	note := 0
+	if n := testing.AllocsPerRun(100, func() {
+		// Events due later fill liveEvents, so the queue has to wait for room.
+		for i := 0; i < 8; i++ {
+			q.Push(LiveEvent{Frame: seq.Frame() + int64(64*(8-i)), Kind: LiveNoteOn, Note: 40 + note%40, Velocity: 100})
+			note++
+		}
+		seq.Process(buf)
+	}); n != 0 {
+		t.Fatalf("expected no allocations on the audio path, got %v", n)
+	}
+	if len(seq.liveEvents) > q.capacity() || len(seq.liveVoices) > q.capacity() {
+		t.Fatalf("expected live state to stay within the queue's capacity")
+	}
+}
@@ -1,74 +1,199 @@
 package sequencer
 
 import (
+	"slices"
+	"sort"
 	"sync"
+
+	"github.com/cbegin/mmlfm-go/internal/alloc"
+	"github.com/cbegin/mmlfm-go/internal/filter"
+	"github.com/cbegin/mmlfm-go/internal/fm"
+	"github.com/cbegin/mmlfm-go/internal/lfo"
+	"github.com/cbegin/mmlfm-go/internal/pipe"
 )
 
 // MultiEngine routes note and control events to multiple VoiceEngines by module number.
-// It implements VoiceEngine and mixes the output of all engines.
+// It implements VoiceEngine and mixes the output of all engines in module
+// order; an engine registered for several modules renders once. Engines are
+// registered with AddEngine before rendering starts; after that the engine
+// list is fixed, so the audio path takes no locks and allocates nothing.
 type MultiEngine struct {
-	mu          sync.Mutex
-	engines     map[int]VoiceEngine
-	baseGains   map[int]float64
-	defaultMod  int
-	currentMod  int
-	sampleRate  int
+	modules    []moduleEngine   // registrations, ordered by module
+	engines    []moduleEngine   // distinct engines, ordered by their first module
+	byModule   [256]VoiceEngine // engine each module plays on, falling back to the default
+	defaultMod int
+	currentMod int
+	sampleRate int
+	bus        *pipe.Bus
+	mix        [][]float32 // RenderBlock output of each engine after the first, reused
+	workers    []chan []float32
+	rendering  sync.WaitGroup
+}
+
+// moduleEngine is a registered engine and the gain SetMasterGain scales.
+type moduleEngine struct {
+	module   int
+	engine   VoiceEngine
+	baseGain float64
 }
 
 // NewMultiEngine creates a MultiEngine. defaultMod is used when no module is specified.
 func NewMultiEngine(defaultMod int, sampleRate int) *MultiEngine {
 	return &MultiEngine{
-		engines:    make(map[int]VoiceEngine),
-		baseGains:  make(map[int]float64),
 		defaultMod: defaultMod,
 		currentMod: defaultMod,
 		sampleRate: sampleRate,
 	}
 }
 
-// AddEngine registers an engine for the given module number.
+// AddEngine registers an engine for the given module number (0-255),
+// replacing any engine already registered for it. It must not be called
+// while the engine is rendering.
 // baseGain is the engine's default gain; SetMasterGain applies a scalar on top.
 func (m *MultiEngine) AddEngine(module int, engine VoiceEngine, baseGain float64) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.engines[module] = engine
-	m.baseGains[module] = baseGain
+	if module < 0 || module >= len(m.byModule) {
+		return
+	}
+	i := sort.Search(len(m.modules), func(i int) bool { return m.modules[i].module >= module })
+	me := moduleEngine{module: module, engine: engine, baseGain: baseGain}
+	if i < len(m.modules) && m.modules[i].module == module {
+		m.modules[i] = me
+	} else {
+		m.modules = append(m.modules, moduleEngine{})
+		copy(m.modules[i+1:], m.modules[i:])
+		m.modules[i] = me
+	}
+	if e, ok := engine.(pipeEngine); ok && m.bus != nil {
+		e.SetBus(m.bus)
+	}
+	fallback := m.modules[0].engine
+	m.engines = m.engines[:0]
+	for _, e := range m.modules {
+		if e.module == m.defaultMod {
+			fallback = e.engine
+		}
+		if !slices.ContainsFunc(m.engines, func(r moduleEngine) bool { return r.engine == e.engine }) {
+			m.engines = append(m.engines, e)
+		}
+	}
+	for mod := range m.byModule {
+		m.byModule[mod] = fallback
+	}
+	for _, e := range m.modules {
+		m.byModule[e.module] = e.engine
+	}
 }
 
-// SetCurrentModule sets the module for subsequent control calls (SetFilterType, LFO, etc.).
+// SetParallel renders the engines of each block concurrently, one goroutine
+// per engine after the first, for offline rendering on several cores. The
+// engines are still mixed in module order, so the output is the same. Call
+// it after the engines are added, and Close when done to stop the
+// goroutines.
+func (m *MultiEngine) SetParallel(on bool) {
+	m.Close()
+	if !on {
+		return
+	}
+	for _, e := range m.engines[min(1, len(m.engines)):] {
+		jobs := make(chan []float32)
+		go func(e VoiceEngine) {
+			for dst := range jobs {
+				e.RenderBlock(dst)
+				m.rendering.Done()
+			}
+		}(e.engine)
+		m.workers = append(m.workers, jobs)
+	}
+}
+
+// Close stops the goroutines started by SetParallel.
+func (m *MultiEngine) Close() {
+	for _, jobs := range m.workers {
+		close(jobs)
+	}
+	m.workers = nil
+}
+
+func (m *MultiEngine) SetRelease(seconds, sweep float64) {
+	if e := m.currentEngine(); e != nil {
+		e.SetRelease(seconds, sweep)
+	}
+}
+
+// SetBus shares one pipe bus between all engines, so pipes connect tracks on
+// different modules.
+func (m *MultiEngine) SetBus(b *pipe.Bus) {
+	m.bus = b
+	for _, e := range m.engines {
+		if pe, ok := e.engine.(pipeEngine); ok {
+			pe.SetBus(b)
+		}
+	}
+}
+
+// SetPipes forwards the bus pipe routing to the current engine.
+func (m *MultiEngine) SetPipes(r pipe.Route) {
+	if e, ok := m.currentEngine().(pipeEngine); ok {
+		e.SetPipes(r)
+	}
+}
+
+// SetVoicePolicy sets the steal policy of every engine that has one.
+func (m *MultiEngine) SetVoicePolicy(p alloc.Policy) {
+	for _, e := range m.engines {
+		if ve, ok := e.engine.(interface{ SetVoicePolicy(alloc.Policy) }); ok {
+			ve.SetVoicePolicy(p)
+		}
+	}
+}
+
+// SetVoiceOwner forwards the next note's track to the current engine.
+func (m *MultiEngine) SetVoiceOwner(o alloc.Owner) {
+	if e, ok := m.currentEngine().(allocEngine); ok {
+		e.SetVoiceOwner(o)
+	}
+}
+
+// VoiceStats adds up the steal counts of every engine; PeakVoices is the sum
+// of each engine's peak.
+func (m *MultiEngine) VoiceStats() alloc.Stats {
+	var st alloc.Stats
+	for _, e := range m.engines {
+		if ve, ok := e.engine.(interface{ VoiceStats() alloc.Stats }); ok {
+			es := ve.VoiceStats()
+			st.Steals += es.Steals
+			st.ReleaseSteals += es.ReleaseSteals
+			st.PeakVoices += es.PeakVoices
+		}
+	}
+	return st
+}
+
+// SetCurrentModule sets the module for subsequent control calls (SetFilter, LFO, etc.).
 // Called by the sequencer before processing events for a track.
 func (m *MultiEngine) SetCurrentModule(module int) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
 	m.currentMod = module
 }
 
 func (m *MultiEngine) engine(module int) VoiceEngine {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if e, ok := m.engines[module]; ok {
-		return e
-	}
-	if e, ok := m.engines[m.defaultMod]; ok {
-		return e
-	}
-	for _, e := range m.engines {
-		return e
+	if module < 0 || module >= len(m.byModule) {
+		module = m.defaultMod
+		if module < 0 || module >= len(m.byModule) {
+			return nil
+		}
 	}
-	return nil
+	return m.byModule[module]
 }
 
 func (m *MultiEngine) currentEngine() VoiceEngine {
 	return m.engine(m.currentMod)
 }
 
-// AllEngines returns all registered engines (for OPM loading etc.).
+// AllEngines returns all registered engines in module order (for OPM loading etc.).
 func (m *MultiEngine) AllEngines() []VoiceEngine {
-	m.mu.Lock()
-	defer m.mu.Unlock()
 	out := make([]VoiceEngine, 0, len(m.engines))
 	for _, e := range m.engines {
-		out = append(out, e)
+		out = append(out, e.engine)
 	}
 	return out
 }
@@ -103,27 +228,100 @@ func (m *MultiEngine) NoteOff(id int) {
 	}
 }
 
+func (m *MultiEngine) VoiceActive(id int) bool {
+	module, localID := decodeVoiceID(id)
+	e := m.engine(module)
+	return e != nil && e.VoiceActive(localID)
+}
+
+// Legato forwards a mono track's note to the engine playing voice id.
+func (m *MultiEngine) Legato(id, note, velocity, frames int, retrigger bool) bool {
+	module, localID := decodeVoiceID(id)
+	e, ok := m.engine(module).(monoEngine)
+	return ok && e.Legato(localID, note, velocity, frames, retrigger)
+}
+
+func (m *MultiEngine) SetVoicePitch(id int, semitones float64) {
+	module, localID := decodeVoiceID(id)
+	if e := m.engine(module); e != nil {
+		e.SetVoicePitch(localID, semitones)
+	}
+}
+
+func (m *MultiEngine) SetVoiceGain(id int, gain float64) {
+	module, localID := decodeVoiceID(id)
+	if e := m.engine(module); e != nil {
+		e.SetVoiceGain(localID, gain)
+	}
+}
+
+func (m *MultiEngine) SetVoicePan(id int, pan int) {
+	module, localID := decodeVoiceID(id)
+	if e := m.engine(module); e != nil {
+		e.SetVoicePan(localID, pan)
+	}
+}
+
+func (m *MultiEngine) SetVoiceFilter(id int, cutoff int) {
+	module, localID := decodeVoiceID(id)
+	if e := m.engine(module); e != nil {
+		e.SetVoiceFilter(localID, cutoff)
+	}
+}
+
 func (m *MultiEngine) RenderFrame() (float32, float32) {
 	var l, r float32
-	for _, e := range m.AllEngines() {
-		el, er := e.RenderFrame()
+	for _, e := range m.engines {
+		el, er := e.engine.RenderFrame()
 		l += el
 		r += er
 	}
 	return l, r
 }
 
+// RenderBlock renders each engine's block and mixes them in module order.
+func (m *MultiEngine) RenderBlock(dst []float32) {
+	if len(m.engines) == 0 {
+		clear(dst)
+		return
+	}
+	for len(m.mix) < len(m.engines)-1 {
+		m.mix = append(m.mix, nil)
+	}
+	for i := range m.engines[1:] {
+		if cap(m.mix[i]) < len(dst) {
+			m.mix[i] = make([]float32, len(dst))
+		}
+		m.mix[i] = m.mix[i][:len(dst)]
+	}
+	if m.workers != nil {
+		m.rendering.Add(len(m.workers))
+		for i, jobs := range m.workers {
+			jobs <- m.mix[i]
+		}
+	} else {
+		for i, e := range m.engines[1:] {
+			e.engine.RenderBlock(m.mix[i])
+		}
+	}
+	m.engines[0].engine.RenderBlock(dst)
+	m.rendering.Wait()
+	for _, mix := range m.mix[:len(m.engines)-1] {
+		for i, x := range mix {
+			dst[i] += x
+		}
+	}
+}
+
 func (m *MultiEngine) SetMasterGain(scalar float64) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	for mod, e := range m.engines {
-		e.SetMasterGain(m.baseGains[mod] * scalar)
+	for _, e := range m.engines {
+		e.engine.SetMasterGain(e.baseGain * scalar)
 	}
 }
 
-func (m *MultiEngine) SetFilterType(filterType int) {
+func (m *MultiEngine) SetFilter(env filter.Envelope) {
 	if e := m.currentEngine(); e != nil {
-		e.SetFilterType(filterType)
+		e.SetFilter(env)
 	}
 }
 
@@ -139,28 +337,48 @@ func (m *MultiEngine) SetPortamento(fromNote int, frames int) {
 	}
 }
 
-func (m *MultiEngine) SetPitchLFO(depth float64, rateHz float64, waveform int) {
+func (m *MultiEngine) SetPitchLFO(shape lfo.Shape) {
 	if e := m.currentEngine(); e != nil {
-		e.SetPitchLFO(depth, rateHz, waveform)
+		e.SetPitchLFO(shape)
 	}
 }
 
-func (m *MultiEngine) SetAmpLFO(depth float64, rateHz float64, waveform int) {
+func (m *MultiEngine) SetAmpLFO(shape lfo.Shape) {
 	if e := m.currentEngine(); e != nil {
-		e.SetAmpLFO(depth, rateHz, waveform)
+		e.SetAmpLFO(shape)
 	}
 }
 
-func (m *MultiEngine) SetFilterLFO(depth float64, rateHz float64, waveform int) {
+func (m *MultiEngine) SetFilterLFO(shape lfo.Shape) {
 	if e := m.currentEngine(); e != nil {
-		e.SetFilterLFO(depth, rateHz, waveform)
+		e.SetFilterLFO(shape)
+	}
+}
+
+func (m *MultiEngine) SetInline(v fm.Inline) {
+	if e, ok := m.currentEngine().(fmEngine); ok {
+		e.SetInline(v)
 	}
 }
 
+// ContinueEnvelope forwards id to the current engine when the voice is one of
+// its own.
+func (m *MultiEngine) ContinueEnvelope(id int) {
+	e, ok := m.currentEngine().(fmEngine)
+	if !ok {
+		return
+	}
+	local := -1
+	if module, localID := decodeVoiceID(id); id >= 0 && m.engine(module) == m.currentEngine() {
+		local = localID
+	}
+	e.ContinueEnvelope(local)
+}
+
 func (m *MultiEngine) ActiveVoiceCount() int {
 	n := 0
-	for _, e := range m.AllEngines() {
-		n += e.ActiveVoiceCount()
+	for _, e := range m.engines {
+		n += e.engine.ActiveVoiceCount()
 	}
 	return n
 }
@@ -2,32 +2,85 @@ package sequencer
 
 import (
 	"math"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 
+	"github.com/cbegin/mmlfm-go/internal/alloc"
+	"github.com/cbegin/mmlfm-go/internal/filter"
+	"github.com/cbegin/mmlfm-go/internal/fm"
+	"github.com/cbegin/mmlfm-go/internal/lfo"
 	"github.com/cbegin/mmlfm-go/internal/mml"
+	"github.com/cbegin/mmlfm-go/internal/pipe"
 )
 
+// fmEngine is implemented by engines that play inline FM voices; the track's
+// voice and envelope continuation are latched by the next NoteOn.
+type fmEngine interface {
+	SetInline(v fm.Inline)
+	ContinueEnvelope(id int)
+}
+
+// pipeEngine is implemented by engines that can play through bus pipes; the
+// track's routing is latched by the next NoteOn.
+type pipeEngine interface {
+	SetBus(b *pipe.Bus)
+	SetPipes(r pipe.Route)
+}
+
+// allocEngine is implemented by engines that choose the voice a note steals
+// by track; the owner is latched by the next NoteOn.
+type allocEngine interface {
+	SetVoiceOwner(o alloc.Owner)
+}
+
+// monoEngine is implemented by engines that can move a sounding voice to a
+// new note for @mono tracks. Legato reports false when the voice has
+// finished, and the note is played with NoteOn instead.
+type monoEngine interface {
+	Legato(id, note, velocity, frames int, retrigger bool) bool
+}
+
 type VoiceEngine interface {
 	NoteOn(note int, velocity int, pan int, program int) int
 	NoteOff(id int)
 	RenderFrame() (float32, float32)
+	// RenderBlock renders len(dst)/2 frames into interleaved stereo dst, the
+	// same as calling RenderFrame for each with nothing in between. The
+	// sequencer only uses it while no track plays through pipes.
+	RenderBlock(dst []float32)
 	SetMasterGain(gain float64)
 	// ActiveVoiceCount returns the number of voices still sounding (attack/decay/sustain/release).
 	// Used to detect when playback has fully ended including release tails.
 	ActiveVoiceCount() int
-	// SetFilterType sets output filter: 0=LP, 1=BP, 2=HP. Called when %f changes.
-	SetFilterType(filterType int)
+	// SetFilter sets the resonant filter for subsequent NoteOns: the %f mode
+	// and the @f cutoff, resonance and envelope. Each voice runs its own copy.
+	SetFilter(env filter.Envelope)
+	// SetRelease sets the release time in seconds for subsequent NoteOns, 0
+	// for the engine's own, and the pitch sweep after key-off in semitones per
+	// second.
+	SetRelease(seconds, sweep float64)
 	// SetNoteOnPhase sets phase for next NoteOn: 0=reset, -1=random, 1-255=phase/128*PI.
 	SetNoteOnPhase(phase int)
 	// SetPortamento sets glide for next NoteOn: fromNote<0 = no portamento, frames = glide duration in samples.
 	SetPortamento(fromNote int, frames int)
-	// SetPitchLFO configures per-frame pitch modulation. depth is in semitones.
-	SetPitchLFO(depth float64, rateHz float64, waveform int)
-	// SetAmpLFO configures per-frame amplitude modulation. depth is a 0-1 factor.
-	SetAmpLFO(depth float64, rateHz float64, waveform int)
-	// SetFilterLFO configures per-frame filter cutoff modulation. depth is in cutoff units.
-	SetFilterLFO(depth float64, rateHz float64, waveform int)
+	// SetPitchLFO sets vibrato for subsequent NoteOns; each voice keeps its own. Depths are in semitones.
+	SetPitchLFO(shape lfo.Shape)
+	// SetAmpLFO sets tremolo for subsequent NoteOns. Depths are 0-1 level factors.
+	SetAmpLFO(shape lfo.Shape)
+	// SetFilterLFO sets cutoff modulation for subsequent NoteOns. Depths are in cutoff units (0-128).
+	SetFilterLFO(shape lfo.Shape)
+	// VoiceActive reports whether a voice returned by NoteOn is still sounding.
+	VoiceActive(id int) bool
+	// SetVoicePitch offsets a sounding voice from its NoteOn note, in semitones.
+	SetVoicePitch(id int, semitones float64)
+	// SetVoiceGain scales a sounding voice's level: 1 = unchanged, 0 = silent.
+	SetVoiceGain(id int, gain float64)
+	// SetVoicePan moves a sounding voice: -64=left, 0=center, 64=right.
+	SetVoicePan(id int, pan int)
+	// SetVoiceFilter sets a sounding voice's lowpass cutoff: 0-128, 128 = open.
+	SetVoiceFilter(id int, cutoff int)
 }
 
 // EventKind identifies sequencer lifecycle events.
@@ -44,19 +97,67 @@ type TriggerEvent struct {
 	TriggerID   int
 	NoteOnType  int
 	NoteOffType int
+	Track       int    // index into Score.Tracks
+	TrackName   string // Score.Tracks[Track].Name
 }
 
 type Options struct {
 	LoopWholeScore    bool
 	OnEvent           func(EventKind)
 	OnTrigger         func(TriggerEvent)
-	ReleaseTailFrames int // extra frames to render after last voice ends (0 = use 0.1s default)
-	MasterTranspose   int // master octave shift applied to all notes (in octaves, e.g. -2..+2)
+	ReleaseTailFrames int                 // extra frames to render after last voice ends (0 = use 0.1s default)
+	MasterTranspose   int                 // master octave shift applied to all notes (in octaves, e.g. -2..+2)
+	Groove            Groove              // timing template for every track (zero value = on the grid)
+	TrackGrooves      map[int]Groove      // per-track templates by track index, replacing Groove
+	TrackVoices       map[int]TrackVoices // per-track voice reservations and priority by track index
+	Live              *LiveQueue          // live input events to play with the score
+	LiveChannels      []LiveChannel       // starting state of the live channels by channel
+}
+
+// TrackVoices sets how a track's notes share the engine's voices. The zero
+// value reserves none at the default priority.
+type TrackVoices struct {
+	Reserve  int // voices other tracks cannot steal from this one
+	Priority int // notes of lower priority tracks are stolen first
 }
 
 type tableData struct {
 	values    []int
-	loopStart int // index where looping begins (-1 = loop from 0)
+	loopStart int // index where looping begins (-1 = hold the last value)
+}
+
+// Table envelope kinds, indexing runtimeState.tables and release.
+const (
+	tableAmp = iota
+	tablePitch
+	tablePan
+	tableFilter
+	tableKinds
+)
+
+// defaultTableFPS is the table envelope frame rate without @fps or #FPS.
+const defaultTableFPS = 60
+
+// tableEnv is the #TABLE selected by na/nt/np/nf or a _ release form, and the
+// number of frames each value is held.
+type tableEnv struct {
+	on   bool
+	id   int
+	rate int
+}
+
+// voiceTables steps the table envelopes of one voice from note-on until the
+// engine reports it silent. Release tables replace their kind from note-off.
+type voiceTables struct {
+	voice     int
+	tables    [tableKinds]tableEnv
+	release   [tableKinds]tableEnv
+	pan       int     // note-on pan that np values offset
+	frameLen  float64 // samples per table frame
+	untilNext float64 // samples left in the current frame
+	frame     int     // frames since note-on
+	relFrame  int     // frames since note-off
+	released  bool
 }
 
 type Sequencer struct {
@@ -65,11 +166,16 @@ type Sequencer struct {
 	sampleRate          int
 	ticksPerSamp        float64
 	initialTicksPerSamp float64
+	rampSlope           float64 // ticksPerSamp gained per tick of a tempo ramp, 0 = steady
+	rampEnd             float64 // tick the ramp ends on
+	rampTarget          float64 // ticksPerSamp once the ramp ends
 	tickFrac            float64
 	tickInt             int
 	trackState          []trackCursor
 	trackRuntime        []runtimeState
 	tableDefs           map[int]tableData
+	tableFPS            int
+	voiceTables         []voiceTables
 	noteOffs            []noteOff
 	loopWholeScore      bool
 	pendingReset        bool
@@ -82,6 +188,17 @@ type Sequencer struct {
 	loopTailCountdown   int  // frames of silence after last voice before loop reset
 	masterTranspose     int  // master octave shift in semitones
 	patchMods           map[int]patchMod
+	bus                 *pipe.Bus    // nil when the engine has no pipes
+	fmRoutes            []pipe.Route // #FM connections by track
+	grooves             []*groove    // by track; nil entries play on the grid
+	usesPipes           bool         // a track reads or writes pipes, so frames render one at a time
+	trackVoices         map[int]TrackVoices
+	live                *LiveQueue
+	liveEvents          []LiveEvent // drained from live, ordered by frame
+	liveChannels        [LiveChannels]liveChannel
+	liveVoices          []int        // voices started by live notes, pruned once finished
+	frame               int64        // frames rendered, read by the audio thread
+	rendered            atomic.Int64 // frame, for other goroutines
 }
 
 type trackCursor struct {
@@ -94,49 +211,84 @@ type trackCursor struct {
 }
 
 type runtimeState struct {
-	volume      int
-	fineVolume  int
-	expression  int
-	vScaleMode  int
-	vScaleMax   int
-	xScaleMode  int
-	pan         int
-	program     int
-	module      int
-	channel     int
-	delay       int
-	slur        mml.SlurMode
-	transpose   int
-	detune      int
-	filterCut   int
-	filterType  int
-	filterEnv   filterEnvelope
-	filterEnvOn bool
-	phase       int
-	portamento  int
-	lfoRate     int
-	lfoDepth    int
-	lfoWave     int
-	modPitch    int
-	modAmp      int
-	modPan      int
-	modFilter   int
-	tableStep   map[string]int
-	tableStart  map[string]int
-	tableRate   map[string]int
-	mask        int
-	lastVoice   int
-	lastNote    int
-	mpEnd       int
-	mpDelay     int
-	mpChange    int
-	maEnd       int
-	maDelay     int
-	maChange    int
-	mfEnd       int
-	mfDelay     int
-	mfChange    int
-	fpsRate     int
+	volume     int
+	fineVolume int
+	expression int
+	vScaleMode int
+	vScaleMax  int
+	xScaleMode int
+	pan        int
+	program    int
+	module     int
+	channel    int
+	delay      int
+	slur       mml.SlurMode
+	transpose  int
+	detune     int
+	filterType int
+	filterEnv  filterEnvelope
+	phase      int
+	portamento int
+	lfoRate    int
+	lfoWave    int
+	mp         modulation
+	ma         modulation
+	mf         modulation
+	fm         fm.Inline
+	fmOp       int  // operator selected by i; starts at the last, the carrier
+	envReset   bool // @er; false attacks from the previous note's level
+	pipes      pipe.Route
+	relRate    int // s release rate 0-63, -1 = engine default
+	sweep      int // s/@rr pitch sweep, 1/64 semitone per frame after key-off
+	tables     [tableKinds]tableEnv
+	release    [tableKinds]tableEnv
+	mask       int
+	mono       int // @mono mode
+	lastVoice  int
+	lastNote   int
+	lastPatch  int       // encoded program lastVoice was started with
+	lastFM     fm.Inline // FM settings lastVoice was started with
+	fpsRate    int
+}
+
+// lastOperator is i's default. It selects the carrier for any operator
+// count, since the FM engine maps indexes past a voice's last operator to it.
+const lastOperator = 3
+
+// @mono modes. A mono track plays each note on its last voice while that
+// still sounds with the same patch, gliding to it over po; legato restarts
+// the envelopes only when the previous note was already keyed off.
+const (
+	monoOff = iota
+	monoRetrigger
+	monoLegato
+)
+
+// modulation is an mp/ma/mf setting: the LFO depth at key-on and, when end
+// is deeper, the frames it holds there and then takes to reach end.
+type modulation struct {
+	depth  int
+	end    int
+	delay  int
+	change int
+}
+
+// newModulation reads mp/ma/mf arguments: depth, end, delay, change.
+func newModulation(args []int) modulation {
+	var m modulation
+	for i, v := range args {
+		switch i {
+		case 0:
+			m.depth = v
+		case 1:
+			m.end = v
+		case 2:
+			m.delay = v
+		case 3:
+			m.change = v
+		}
+	}
+	return m
 }
 
 type patchMod struct {
@@ -156,73 +308,29 @@ type noteOff struct {
 // co=initial cutoff, ar/dr/sr/rr=attack/decay/sustain/release rates,
 // co2=attack peak, co3=sustain level, sc=sustain cutoff, rc=release cutoff.
 type filterEnvelope struct {
-	co      int // initial cutoff
-	ar      int // attack rate (frames to reach co2)
-	dr      int // decay rate (frames from co2 to co3)
-	sr      int // sustain rate (frames from co3 to sc)
-	rr      int // release rate
-	co2     int // attack peak cutoff
-	co3     int // sustain cutoff
-	sc      int // sustain end cutoff
-	rc      int // release cutoff
-	state   int // 0=attack, 1=decay, 2=sustain, 3=release
-	frame   int // frames elapsed in current stage
-	current int // current cutoff value
-}
-
-func (fe *filterEnvelope) step() int {
-	switch fe.state {
-	case 0: // attack: co -> co2 over ar frames
-		if fe.ar <= 0 {
-			fe.current = fe.co2
-			fe.state = 1
-			fe.frame = 0
-		} else {
-			fe.current = fe.co + ((fe.co2-fe.co)*fe.frame)/fe.ar
-			fe.frame++
-			if fe.frame >= fe.ar {
-				fe.current = fe.co2
-				fe.state = 1
-				fe.frame = 0
-			}
-		}
-	case 1: // decay: co2 -> co3 over dr frames
-		if fe.dr <= 0 {
-			fe.current = fe.co3
-			fe.state = 2
-			fe.frame = 0
-		} else {
-			fe.current = fe.co2 + ((fe.co3-fe.co2)*fe.frame)/fe.dr
-			fe.frame++
-			if fe.frame >= fe.dr {
-				fe.current = fe.co3
-				fe.state = 2
-				fe.frame = 0
-			}
-		}
-	case 2: // sustain: co3 -> sc over sr frames
-		if fe.sr <= 0 {
-			fe.current = fe.sc
-		} else {
-			fe.current = fe.co3 + ((fe.sc-fe.co3)*fe.frame)/fe.sr
-			fe.frame++
-			if fe.frame >= fe.sr {
-				fe.current = fe.sc
-			}
-		}
-	case 3: // release: current -> rc over rr frames
-		if fe.rr <= 0 {
-			fe.current = fe.rc
-		} else {
-			start := fe.current
-			fe.current = start + ((fe.rc-start)*fe.frame)/fe.rr
-			fe.frame++
-			if fe.frame >= fe.rr {
-				fe.current = fe.rc
-			}
+	co  int // initial cutoff
+	res int // resonance 0-9
+	ar  int // attack rate, co -> co2 (0 holds co)
+	dr  int // decay rate, co2 -> co3
+	sr  int // sustain rate, co3 -> sc
+	rr  int // release rate, key-off cutoff -> rc (0 holds it)
+	co2 int // attack peak cutoff
+	co3 int // decay cutoff
+	sc  int // sustain cutoff, kept until key-off
+	rc  int // release cutoff
+}
+
+// newFilterEnvelope reads @f arguments; missing ones take the mmlref
+// defaults, and @f with only co and res holds co for the whole note.
+func newFilterEnvelope(args []int) filterEnvelope {
+	fe := filterEnvelope{co: 128, co2: 128, co3: 64, sc: 32, rc: 128}
+	fields := []*int{&fe.co, &fe.res, &fe.ar, &fe.dr, &fe.sr, &fe.rr, &fe.co2, &fe.co3, &fe.sc, &fe.rc}
+	for i, v := range args {
+		if i < len(fields) {
+			*fields[i] = v
 		}
 	}
-	return clampInt(fe.current, 0, 128)
+	return fe
 }
 
 func New(score *mml.Score, engine VoiceEngine, sampleRate int) *Sequencer {
@@ -243,6 +351,16 @@ func NewWithOptions(score *mml.Score, engine VoiceEngine, sampleRate int, opts O
 		onTrigger:         opts.OnTrigger,
 		releaseTailFrames: tailFrames,
 		masterTranspose:   opts.MasterTranspose * 12,
+		trackVoices:       opts.TrackVoices,
+		live:              opts.Live,
+	}
+	if opts.Live != nil {
+		// Sized up front so live input never allocates on the audio thread.
+		s.liveEvents = make([]LiveEvent, 0, opts.Live.capacity())
+		s.liveVoices = make([]int, 0, opts.Live.capacity())
+	}
+	for i, ch := range opts.LiveChannels[:min(len(opts.LiveChannels), LiveChannels)] {
+		s.liveChannels[i].LiveChannel = ch
 	}
 	bpm := score.InitialBPM
 	if bpm <= 0 {
@@ -253,7 +371,31 @@ func NewWithOptions(score *mml.Score, engine VoiceEngine, sampleRate int, opts O
 	s.trackState = make([]trackCursor, len(score.Tracks))
 	s.trackRuntime = make([]runtimeState, len(score.Tracks))
 	s.tableDefs = parseTableDefinitions(score.Definitions)
+	s.tableFPS = defaultTableFPS
+	if raw, ok := score.Definitions["FPS"]; ok {
+		if fps, err := strconv.Atoi(strings.TrimSpace(raw)); err == nil && fps > 0 {
+			s.tableFPS = fps
+		}
+	}
 	s.patchMods = parsePatchMods(score.Definitions)
+	s.fmRoutes = parseFMConnections(score.Definitions, len(score.Tracks))
+	for i := range score.Tracks {
+		g, ok := opts.TrackGrooves[i]
+		if !ok {
+			g = opts.Groove
+		}
+		if gr := newGroove(g, score.Resolution, i); gr != nil {
+			if s.grooves == nil {
+				s.grooves = make([]*groove, len(score.Tracks))
+			}
+			s.grooves[i] = gr
+		}
+	}
+	s.usesPipes = usesPipes(score, s.fmRoutes)
+	if e, ok := engine.(pipeEngine); ok {
+		s.bus = pipe.NewBus(len(score.Tracks))
+		e.SetBus(s.bus)
+	}
 	for i, tr := range score.Tracks {
 		s.trackState[i] = trackCursor{
 			events:    tr.Events,
@@ -262,28 +404,51 @@ func NewWithOptions(score *mml.Score, engine VoiceEngine, sampleRate int, opts O
 			loopTick:  tr.LoopTick,
 			endTick:   tr.EndTick,
 		}
-		s.trackRuntime[i] = runtimeState{
-			volume:     16,
-			fineVolume: 127,
-			expression: 128,
-			vScaleMax:  16,
-			filterCut:  128,
-			filterType: 0,
-			phase:      0,
-			portamento: 0,
-			tableStep:  map[string]int{},
-			tableStart: map[string]int{},
-			tableRate:  map[string]int{},
-			lastVoice:  -1,
-		}
+		s.trackRuntime[i] = s.newRuntimeState(i)
 	}
 	return s
 }
 
+// newRuntimeState returns the settings track i starts, and restarts a whole
+// score loop, with.
+func (s *Sequencer) newRuntimeState(i int) runtimeState {
+	return runtimeState{
+		volume:     16,
+		fineVolume: 127,
+		expression: 128,
+		vScaleMax:  16,
+		filterEnv:  newFilterEnvelope(nil),
+		filterType: 0,
+		phase:      0,
+		portamento: 0,
+		lastVoice:  -1,
+		lfoRate:    20,
+		lfoWave:    2,
+		fm:         fm.NoInline,
+		fmOp:       lastOperator,
+		envReset:   true,
+		pipes:      s.fmRoutes[i],
+		relRate:    -1,
+	}
+}
+
+// blockFrames caps how many frames Process hands the engine at once.
+const blockFrames = 512
+
+// Process renders len(dst)/2 frames into interleaved stereo dst. Between
+// ticks with something to dispatch the engine renders whole blocks, unless
+// table envelopes, pipes or the end-of-score tail need to act every frame.
 func (s *Sequencer) Process(dst []float32) {
+	if s.live != nil {
+		s.drainLive()
+	}
 	frames := len(dst) / 2
-	for f := 0; f < frames; f++ {
-		s.tickFrac += s.ticksPerSamp
+	advanced := false
+	for f := 0; f < frames; {
+		if !advanced {
+			s.advanceTicks()
+		}
+		advanced = false
 		nextTick := int(s.tickFrac)
 		for s.tickInt <= nextTick {
 			s.dispatchTick(s.tickInt)
@@ -292,39 +457,109 @@ func (s *Sequencer) Process(dst []float32) {
 		if s.pendingReset {
 			s.resetForWholeScoreLoop()
 		}
-		l, r := s.engine.RenderFrame()
-		dst[f*2] = l
-		dst[f*2+1] = r
-		if s.loopPending && s.engine.ActiveVoiceCount() == 0 {
-			if s.loopTailCountdown <= 0 {
-				s.loopPending = false
-				s.pendingReset = true
-				if s.onEvent != nil {
-					s.onEvent(EventLoopCompleted)
-				}
-			} else {
-				s.loopTailCountdown--
+		if len(s.liveEvents) > 0 {
+			s.applyLive(s.frame + int64(f))
+		}
+		if s.usesPipes || len(s.voiceTables) > 0 || s.loopPending || s.commandExhausted || s.pendingReset {
+			s.processFrame(dst[f*2 : f*2+2])
+			f++
+			continue
+		}
+		// Extend the block until a frame reaches the next due tick or live
+		// event; that frame starts the next block once it is dispatched.
+		due := s.nextDueTick()
+		liveDue := s.nextLiveFrame() - s.frame
+		n := 1
+		for f+n < frames && n < blockFrames && int64(f+n) < liveDue {
+			s.advanceTicks()
+			if int(s.tickFrac) >= due {
+				advanced = true
+				break
 			}
+			n++
 		}
-		if s.commandExhausted && !s.playbackEndedFired && s.engine.ActiveVoiceCount() == 0 {
-			if s.releaseTailFrames <= 0 {
-				s.playbackEndedFired = true
-				if s.onEvent != nil {
-					s.onEvent(EventPlaybackEnded)
-				}
-			} else {
-				s.releaseTailFrames--
+		s.engine.RenderBlock(dst[f*2 : (f+n)*2])
+		f += n
+	}
+	s.frame += int64(frames)
+	s.rendered.Store(s.frame)
+}
+
+// processFrame renders one frame into dst after its ticks are dispatched.
+func (s *Sequencer) processFrame(dst []float32) {
+	if len(s.voiceTables) > 0 {
+		s.stepVoiceTables()
+	}
+	dst[0], dst[1] = s.engine.RenderFrame()
+	if s.bus != nil {
+		s.bus.Advance()
+	}
+	if s.loopPending && s.scoreVoices() == 0 {
+		if s.loopTailCountdown <= 0 {
+			s.loopPending = false
+			s.pendingReset = true
+			if s.onEvent != nil {
+				s.onEvent(EventLoopCompleted)
 			}
+		} else {
+			s.loopTailCountdown--
+		}
+	}
+	if s.commandExhausted && !s.playbackEndedFired && s.scoreVoices() == 0 {
+		if s.releaseTailFrames <= 0 {
+			s.playbackEndedFired = true
+			if s.onEvent != nil {
+				s.onEvent(EventPlaybackEnded)
+			}
+		} else {
+			s.releaseTailFrames--
 		}
 	}
 }
 
+// nextDueTick returns the first tick with an event or note-off to dispatch.
+// Ticks before it dispatch nothing, so they can play inside one block.
+func (s *Sequencer) nextDueTick() int {
+	due := math.MaxInt
+	for i := range s.trackState {
+		if _, tick, ok := s.peekEvent(&s.trackState[i]); ok {
+			due = min(due, s.grooved(i, tick, tick))
+		}
+	}
+	for _, off := range s.noteOffs {
+		if !off.fired {
+			due = min(due, off.tick)
+		}
+	}
+	return due
+}
+
+// advanceTicks moves the play position on by one sample. During a tempo
+// ramp ticksPerSamp grows linearly with ticks, so over one sample it grows by
+// a factor of e^rampSlope and the position by the difference over rampSlope.
+func (s *Sequencer) advanceTicks() {
+	if s.rampSlope == 0 {
+		s.tickFrac += s.ticksPerSamp
+		return
+	}
+	next := s.ticksPerSamp * math.Exp(s.rampSlope)
+	if step := (next - s.ticksPerSamp) / s.rampSlope; s.tickFrac+step < s.rampEnd {
+		s.tickFrac += step
+		s.ticksPerSamp = next
+		return
+	}
+	// The ramp ends within this sample; play the rest at the new tempo.
+	part := math.Log(s.rampTarget/s.ticksPerSamp) / s.rampSlope
+	s.tickFrac = s.rampEnd + (1-part)*s.rampTarget
+	s.ticksPerSamp, s.rampSlope = s.rampTarget, 0
+}
+
 func (s *Sequencer) dispatchTick(tick int) {
 	for trkIdx := range s.trackState {
 		tc := &s.trackState[trkIdx]
 		for {
 			ev, effectiveTick, ok := s.peekEvent(tc)
-			if !ok || effectiveTick > tick {
+			if !ok || s.grooved(trkIdx, effectiveTick, effectiveTick) > tick {
 				break
 			}
 			s.applyEvent(trkIdx, tc, ev, effectiveTick)
@@ -338,6 +573,7 @@ func (s *Sequencer) dispatchTick(tick int) {
 	for i := range s.noteOffs {
 		if !s.noteOffs[i].fired && s.noteOffs[i].tick <= tick {
 			s.engine.NoteOff(s.noteOffs[i].voice)
+			s.releaseVoiceTables(s.noteOffs[i].voice)
 			s.noteOffs[i].fired = true
 		}
 	}
@@ -354,6 +590,15 @@ func (s *Sequencer) dispatchTick(tick int) {
 	}
 }
 
+// grooved returns the tick an event of the track at tick plays on, moved by
+// the track's groove with the humanize shift of the note starting at from.
+func (s *Sequencer) grooved(track, tick, from int) int {
+	if s.grooves == nil || s.grooves[track] == nil {
+		return tick
+	}
+	return s.grooves[track].at(tick, from)
+}
+
 func (s *Sequencer) scoreExhausted() bool {
 	for _, tc := range s.trackState {
 		if tc.index < len(tc.events) {
@@ -372,7 +617,9 @@ func (s *Sequencer) resetForWholeScoreLoop() {
 	s.tickFrac = 0
 	s.tickInt = 0
 	s.ticksPerSamp = s.initialTicksPerSamp
+	s.rampSlope = 0
 	s.noteOffs = s.noteOffs[:0]
+	s.voiceTables = s.voiceTables[:0]
 	for i, tr := range s.score.Tracks {
 		s.trackState[i].index = 0
 		s.trackState[i].loopCycle = 0
@@ -380,20 +627,7 @@ func (s *Sequencer) resetForWholeScoreLoop() {
 		s.trackState[i].loopIndex = tr.LoopIndex
 		s.trackState[i].loopTick = tr.LoopTick
 		s.trackState[i].endTick = tr.EndTick
-		s.trackRuntime[i] = runtimeState{
-			volume:     16,
-			fineVolume: 127,
-			expression: 128,
-			vScaleMax:  16,
-			filterCut:  128,
-			filterType: 0,
-			phase:      0,
-			portamento: 0,
-			tableStep:  map[string]int{},
-			tableStart: map[string]int{},
-			tableRate:  map[string]int{},
-			lastVoice:  -1,
-		}
+		s.trackRuntime[i] = s.newRuntimeState(i)
 	}
 }
 
@@ -408,7 +642,14 @@ func (s *Sequencer) applyEvent(trackIndex int, tc *trackCursor, ev mml.Event, ev
 		if tc.loopCycle > 0 && tc.loopIndex >= 0 && ev.Tick >= tc.loopTick {
 			return
 		}
-		s.ticksPerSamp = (float64(ev.Value) * float64(s.score.Resolution)) / (240.0 * float64(s.sampleRate))
+		target := (math.Max(1, float64(ev.Value)) * float64(s.score.Resolution)) / (240.0 * float64(s.sampleRate))
+		end := float64(eventTick + ev.Duration)
+		if ev.Duration <= 0 || end <= s.tickFrac || target == s.ticksPerSamp {
+			s.ticksPerSamp, s.rampSlope = target, 0
+			return
+		}
+		s.rampSlope = (target - s.ticksPerSamp) / (end - s.tickFrac)
+		s.rampEnd, s.rampTarget = end, target
 	case mml.EventVolume:
 		if rt.mask&0x01 != 0 {
 			return
@@ -433,43 +674,14 @@ func (s *Sequencer) applyEvent(trackIndex int, tc *trackCursor, ev mml.Event, ev
 		rt.program = ev.Value
 		if pm, ok := s.patchMods[ev.Value]; ok {
 			if pm.mpArgs != nil {
-				rt.modPitch = pm.mpArgs[0]
-				if len(pm.mpArgs) >= 2 {
-					rt.mpEnd = pm.mpArgs[1]
-					rt.lfoDepth = absInt(pm.mpArgs[1])
-				}
-				if len(pm.mpArgs) >= 3 {
-					rt.mpDelay = pm.mpArgs[2]
-				}
-				if len(pm.mpArgs) >= 4 {
-					rt.mpChange = pm.mpArgs[3]
-				}
+				rt.mp = newModulation(pm.mpArgs)
 			}
 			if pm.maArgs != nil {
-				rt.modAmp = pm.maArgs[0]
-				if len(pm.maArgs) >= 2 {
-					rt.maEnd = pm.maArgs[1]
-				}
-				if len(pm.maArgs) >= 3 {
-					rt.maDelay = pm.maArgs[2]
-				}
-				if len(pm.maArgs) >= 4 {
-					rt.maChange = pm.maArgs[3]
-				}
+				rt.ma = newModulation(pm.maArgs)
 			}
 			if pm.mfArgs != nil {
-				rt.modFilter = pm.mfArgs[0]
-				if len(pm.mfArgs) >= 2 {
-					rt.mfEnd = pm.mfArgs[1]
-				}
-				if len(pm.mfArgs) >= 3 {
-					rt.mfDelay = pm.mfArgs[2]
-				}
-				if len(pm.mfArgs) >= 4 {
-					rt.mfChange = pm.mfArgs[3]
-				}
+				rt.mf = newModulation(pm.mfArgs)
 			}
-			s.updateEngineLFO(rt)
 		}
 	case mml.EventModule:
 		rt.module = ev.Module
@@ -493,27 +705,18 @@ func (s *Sequencer) applyEvent(trackIndex int, tc *trackCursor, ev mml.Event, ev
 		}
 		s.applyTableEnv(rt, ev)
 	case mml.EventControl:
-		s.applyControl(rt, ev)
+		s.applyControl(trackIndex, rt, ev)
 	case mml.EventNote:
-		if ev.Slur != mml.SlurNone && rt.lastVoice >= 0 {
-			// Close previous voice at the slur boundary to avoid hanging-note
-			// accumulation when using polyphonic NoteOn-per-event engines.
-			s.engine.NoteOff(rt.lastVoice)
-			s.cancelPendingNoteOff(rt.lastVoice)
-		}
 		vel := ev.Value
 		if vel <= 0 {
 			vel = applyScaledVelocity(rt.volume, rt.expression, rt.fineVolume, rt.vScaleMode, rt.vScaleMax, rt.xScaleMode)
 		}
 		note := ev.Note + rt.transpose + rt.detune/64 + s.masterTranspose
-		note += s.sampleTable(rt, "nt", 16, eventTick)
-		note += s.sampleLFO(rt, eventTick)
 		note = clampInt(note, 0, 127)
 		pan := rt.pan
 		if rt.mask&0x02 == 0 && ev.Pan != 0 {
 			pan = ev.Pan
 		}
-		pan += s.sampleTable(rt, "np", 1, eventTick)
 		pan = clampInt(pan, -64, 64)
 		program := ev.Program
 		if program == 0 {
@@ -521,9 +724,7 @@ func (s *Sequencer) applyEvent(trackIndex int, tc *trackCursor, ev mml.Event, ev
 		}
 		// Encode module/channel into high bits for compatibility routing.
 		program = program + (rt.module << 8) + (rt.channel << 16)
-		vel = s.applyAmpControls(rt, vel, eventTick)
-		program += (clampInt(rt.filterCut, 0, 255) << 24)
-		s.engine.SetNoteOnPhase(rt.phase)
+		vel = clampInt(vel, 1, 127)
 		portamentoFrames := 0
 		if rt.portamento > 0 && rt.lastVoice >= 0 {
 			portamentoFrames = (rt.portamento * s.sampleRate) / 1000
@@ -531,11 +732,6 @@ func (s *Sequencer) applyEvent(trackIndex int, tc *trackCursor, ev mml.Event, ev
 				portamentoFrames = 1
 			}
 		}
-		s.engine.SetPortamento(rt.lastNote, portamentoFrames)
-		s.updateEngineLFO(rt)
-		voiceID := s.engine.NoteOn(note, vel, pan, program)
-		rt.lastVoice = voiceID
-		rt.lastNote = note
 		offTick := eventTick + ev.Duration
 		if ev.GateTick >= 0 {
 			offTick = eventTick + ev.GateTick
@@ -543,14 +739,83 @@ func (s *Sequencer) applyEvent(trackIndex int, tc *trackCursor, ev mml.Event, ev
 		if ev.Delay > 0 {
 			offTick += ev.Delay
 		}
+		if e, ok := s.engine.(monoEngine); ok && rt.mono != monoOff && rt.lastVoice >= 0 {
+			if program == rt.lastPatch && rt.fm == rt.lastFM {
+				held := s.pendingNoteOff(rt.lastVoice)
+				retrigger := rt.mono == monoRetrigger || !held
+				s.latchVoiceSettings(trackIndex, rt)
+				if e.Legato(rt.lastVoice, note, vel, portamentoFrames, retrigger) {
+					s.engine.SetVoicePan(rt.lastVoice, pan)
+					s.cancelPendingNoteOff(rt.lastVoice)
+					if retrigger {
+						s.dropVoiceTables(rt.lastVoice)
+						s.startVoiceTables(rt, rt.lastVoice, pan)
+					}
+					rt.lastNote = note
+					s.noteOffs = append(s.noteOffs, noteOff{
+						tick:  s.grooved(trackIndex, offTick, eventTick),
+						voice: rt.lastVoice,
+					})
+					return
+				}
+			} else {
+				// A new patch needs a new voice; the mono track's old one
+				// makes way for it.
+				s.engine.NoteOff(rt.lastVoice)
+				s.releaseVoiceTables(rt.lastVoice)
+				s.cancelPendingNoteOff(rt.lastVoice)
+			}
+		}
+		if ev.Slur != mml.SlurNone && rt.lastVoice >= 0 {
+			// Close previous voice at the slur boundary to avoid hanging-note
+			// accumulation when using polyphonic NoteOn-per-event engines.
+			s.engine.NoteOff(rt.lastVoice)
+			s.releaseVoiceTables(rt.lastVoice)
+			s.cancelPendingNoteOff(rt.lastVoice)
+		}
+		s.engine.SetNoteOnPhase(rt.phase)
+		s.engine.SetPortamento(rt.lastNote, portamentoFrames)
+		s.latchVoiceSettings(trackIndex, rt)
+		if e, ok := s.engine.(fmEngine); ok {
+			from := -1
+			if !rt.envReset {
+				from = rt.lastVoice
+			}
+			e.ContinueEnvelope(from)
+		}
+		voiceID := s.engine.NoteOn(note, vel, pan, program)
+		rt.lastVoice = voiceID
+		rt.lastNote = note
+		rt.lastPatch, rt.lastFM = program, rt.fm
+		s.startVoiceTables(rt, voiceID, pan)
 		s.noteOffs = append(s.noteOffs, noteOff{
-			tick:  offTick,
+			tick:  s.grooved(trackIndex, offTick, eventTick),
 			voice: voiceID,
 		})
 	}
 }
 
-func (s *Sequencer) applyControl(rt *runtimeState, ev mml.Event) {
+// latchVoiceSettings hands the engine the track's LFO, filter, release, FM,
+// pipe and owner settings for its next NoteOn or Legato.
+func (s *Sequencer) latchVoiceSettings(trackIndex int, rt *runtimeState) {
+	s.updateEngineLFO(rt)
+	s.engine.SetFilter(s.filterShape(rt))
+	s.engine.SetRelease(releaseRateSeconds(rt.relRate), float64(rt.sweep)/64*float64(s.frameRate(rt)))
+	if e, ok := s.engine.(fmEngine); ok {
+		e.SetInline(rt.fm)
+	}
+	if e, ok := s.engine.(pipeEngine); ok {
+		r := rt.pipes
+		r.Track = trackIndex
+		e.SetPipes(r)
+	}
+	if e, ok := s.engine.(allocEngine); ok {
+		tv := s.trackVoices[trackIndex]
+		e.SetVoiceOwner(alloc.Owner{Track: trackIndex, Priority: tv.Priority, Reserve: tv.Reserve})
+	}
+}
+
+func (s *Sequencer) applyControl(trackIndex int, rt *runtimeState, ev mml.Event) {
 	cmd := strings.ToLower(strings.TrimSpace(ev.Command))
 	switch cmd {
 	case "@mask":
@@ -565,11 +830,10 @@ func (s *Sequencer) applyControl(rt *runtimeState, ev mml.Event) {
 	case "%f":
 		if ev.Value >= 0 && ev.Value <= 2 {
 			rt.filterType = ev.Value
-			s.engine.SetFilterType(ev.Value)
 		}
 	case "%t":
 		if s.onTrigger != nil {
-			te := TriggerEvent{TriggerID: ev.Value}
+			te := TriggerEvent{TriggerID: ev.Value, Track: trackIndex, TrackName: s.score.Tracks[trackIndex].Name}
 			if len(ev.Values) >= 2 {
 				te.NoteOnType = ev.Values[1]
 			}
@@ -580,12 +844,14 @@ func (s *Sequencer) applyControl(rt *runtimeState, ev mml.Event) {
 		}
 	case "%e":
 		if s.onTrigger != nil {
-			te := TriggerEvent{TriggerID: ev.Value}
+			te := TriggerEvent{TriggerID: ev.Value, Track: trackIndex, TrackName: s.score.Tracks[trackIndex].Name}
 			if len(ev.Values) >= 2 {
 				te.NoteOnType = ev.Values[1]
 			}
 			s.onTrigger(te)
 		}
+	case "@mono":
+		rt.mono = clampInt(ev.Value, monoOff, monoLegato)
 	case "po":
 		rt.portamento = ev.Value
 	case "*":
@@ -601,127 +867,79 @@ func (s *Sequencer) applyControl(rt *runtimeState, ev mml.Event) {
 		if rt.mask&0x20 != 0 {
 			return
 		}
-		rt.filterCut = ev.Value
-		// Full @f envelope: co, res, ar, dr, sr, rr, co2, co3, sc, rc
-		if len(ev.Values) >= 3 {
-			fe := filterEnvelope{co: ev.Value, current: ev.Value}
-			// defaults: co2=co, co3=co, sc=co, rc=0
-			fe.co2 = ev.Value
-			fe.co3 = ev.Value
-			fe.sc = ev.Value
-			if len(ev.Values) >= 3 {
-				fe.ar = ev.Values[2]
-			}
-			if len(ev.Values) >= 4 {
-				fe.dr = ev.Values[3]
-			}
-			if len(ev.Values) >= 5 {
-				fe.sr = ev.Values[4]
-			}
-			if len(ev.Values) >= 6 {
-				fe.rr = ev.Values[5]
-			}
-			if len(ev.Values) >= 7 {
-				fe.co2 = ev.Values[6]
-			}
-			if len(ev.Values) >= 8 {
-				fe.co3 = ev.Values[7]
-			}
-			if len(ev.Values) >= 9 {
-				fe.sc = ev.Values[8]
-			}
-			if len(ev.Values) >= 10 {
-				fe.rc = ev.Values[9]
-			}
-			rt.filterEnv = fe
-			rt.filterEnvOn = true
-		}
+		rt.filterEnv = newFilterEnvelope(append([]int{ev.Value}, parseCSV(ev.Text)...))
 	case "@lfo":
 		if rt.mask&0x20 != 0 {
 			return
 		}
-		rt.lfoWave = ev.Value
-		parseCSVInts(ev.Text, func(idx int, v int) {
-			if idx == 0 {
-				rt.lfoRate = v
-			}
-		})
-		s.updateEngineLFO(rt)
-	case "mp":
-		if rt.mask&0x20 != 0 {
-			return
+		// @lfo cycle[,waveform]
+		rt.lfoRate = ev.Value
+		if args := parseCSV(ev.Text); len(args) >= 1 {
+			rt.lfoWave = args[0]
 		}
-		rt.modPitch = ev.Value
-		args := parseCSV(ev.Text)
-		if len(args) >= 1 {
-			rt.mpEnd = args[0]
-			rt.lfoDepth = absInt(args[0])
-		}
-		if len(args) >= 2 {
-			rt.mpDelay = args[1]
-		}
-		if len(args) >= 3 {
-			rt.mpChange = args[2]
-		}
-		s.updateEngineLFO(rt)
-	case "ma":
+	case "mp", "ma", "mf":
 		if rt.mask&0x20 != 0 {
 			return
 		}
-		rt.modAmp = ev.Value
-		args := parseCSV(ev.Text)
-		if len(args) >= 1 {
-			rt.maEnd = args[0]
-		}
-		if len(args) >= 2 {
-			rt.maDelay = args[1]
-		}
-		if len(args) >= 3 {
-			rt.maChange = args[2]
-		}
-		s.updateEngineLFO(rt)
-	case "mf":
-		if rt.mask&0x20 != 0 {
-			return
-		}
-		rt.modFilter = ev.Value
-		args := parseCSV(ev.Text)
-		if len(args) >= 1 {
-			rt.mfEnd = args[0]
-		}
-		if len(args) >= 2 {
-			rt.mfDelay = args[1]
-		}
-		if len(args) >= 3 {
-			rt.mfChange = args[2]
-		}
-		s.updateEngineLFO(rt)
-	case "s":
-		// approximate sustain/release shaping via filter/amp bias
-		if ev.Value > 0 {
-			rt.modAmp = ev.Value
+		m := newModulation(append([]int{ev.Value}, parseCSV(ev.Text)...))
+		switch cmd {
+		case "mp":
+			rt.mp = m
+		case "ma":
+			rt.ma = m
+		default:
+			rt.mf = m
 		}
 	case "@al":
-		if e, ok := s.engine.(interface {
-			SetAlgorithm(int)
-			SetOperatorCount(int)
-		}); ok {
-			e.SetOperatorCount(ev.Value)
-			alg := -1
-			if ev.Text != "" {
-				args := parseCSV(ev.Text)
-				if len(args) >= 1 {
-					alg = args[0]
-				}
-			}
-			if alg >= 0 {
-				e.SetAlgorithm(alg)
-			}
+		// @al ops[,algorithm]
+		rt.fm.Ops = clampInt(ev.Value, 1, 4)
+		if args := parseCSV(ev.Text); len(args) >= 1 {
+			rt.fm.Algorithm = clampInt(args[0], 0, 7)
 		}
 	case "@fb":
-		if e, ok := s.engine.(interface{ SetFeedback(float64) }); ok {
-			e.SetFeedback(float64(ev.Value) / 7.0)
-		}
+		rt.fm.Feedback = clampInt(ev.Value, 0, 7)
+	case "i":
+		rt.fmOp = clampInt(ev.Value, 0, 3)
+	case "@tl":
+		rt.fm.Operators[rt.fmOp].TL = clampInt(ev.Value, 0, 127)
+	case "s":
+		// s release[,sweep]
+		rt.relRate = clampInt(ev.Value, 0, 63)
+		rt.sweep = 0
+		if len(ev.Values) > 1 {
+			rt.sweep = clampInt(ev.Values[1], -256, 255)
+		}
+	case "@rr":
+		// @rr release[,sweep]
+		rt.fm.Operators[rt.fmOp].RR = clampInt(ev.Value, 0, 63)
+		if args := parseCSV(ev.Text); len(args) > 0 {
+			rt.sweep = clampInt(args[0], -256, 255)
+		}
+	case "@ml":
+		// @ml multiple[,fine]
+		op := &rt.fm.Operators[rt.fmOp]
+		op.ML = clampInt(ev.Value, 0, 15)
+		op.MLFine = 0
+		if args := parseCSV(ev.Text); len(args) >= 1 {
+			op.MLFine = clampInt(args[0], -128, 127)
+		}
+	case "@dt":
+		rt.fm.Operators[rt.fmOp].DT = clampInt(ev.Value, -8192, 8191)
+	case "@fx":
+		rt.fm.Operators[rt.fmOp].FX = clampInt(ev.Value, 0, 127)
+	case "@se":
+		rt.fm.Operators[rt.fmOp].SE = clampInt(ev.Value, 0, 17)
+	case "@er":
+		rt.envReset = ev.Value != 0
+	case "@o":
+		rt.pipes.Output = clampInt(ev.Value, pipe.Standard, pipe.Add)
+		rt.pipes.OutPipe = pipeArg(ev.Text)
+	case "@i":
+		rt.pipes.InputLevel = clampInt(ev.Value, 0, 7)
+		rt.pipes.InPipe = pipeArg(ev.Text)
+	case "@r":
+		rt.pipes.RingLevel = clampInt(ev.Value, 0, 8)
+		rt.pipes.RingPipe = pipeArg(ev.Text)
 	case "@fps":
 		if ev.Value > 0 {
 			rt.fpsRate = ev.Value
@@ -731,188 +949,194 @@ func (s *Sequencer) applyControl(rt *runtimeState, ev mml.Event) {
 
 func (s *Sequencer) applyTableEnv(rt *runtimeState, ev mml.Event) {
 	cmd := strings.ToLower(strings.TrimSpace(ev.Command))
-	isRelease := strings.HasPrefix(cmd, "_")
-	cmd = strings.TrimPrefix(cmd, "_")
-	cmd = strings.TrimPrefix(cmd, "@")
-	kind := cmd
-	if isRelease {
-		kind = "r" + kind
+	envs := &rt.tables
+	if strings.HasPrefix(cmd, "_") {
+		envs = &rt.release
+		cmd = cmd[1:]
 	}
+	kind := 0
 	switch cmd {
-	case "na", "nt", "np", "nf", "@":
-		rt.tableStep[kind] = 0
-		rt.tableStart[kind] = ev.Tick
-		step := ev.Delay
-		if step <= 0 {
-			step = 1
-		}
-		rt.tableRate[kind] = step
-		switch cmd {
-		case "na":
-			rt.modAmp = ev.Value
-		case "nt":
-			rt.modPitch = ev.Value
-		case "np":
-			rt.modPan = ev.Value
-		case "nf":
-			rt.modFilter = ev.Value
-		case "@":
-			// @@ table for timbre maps to generic modulation depth.
-			rt.modPitch = ev.Value
-		}
-	}
-}
-
-func (s *Sequencer) sampleTable(rt *runtimeState, kind string, scale int, eventTick int) int {
-	_, ok := rt.tableStep[kind]
-	if !ok {
-		return 0
-	}
-	tableID := 0
-	switch kind {
 	case "na":
-		tableID = rt.modAmp
+		kind = tableAmp
 	case "nt":
-		tableID = rt.modPitch
+		kind = tablePitch
 	case "np":
-		tableID = rt.modPan
+		kind = tablePan
 	case "nf":
-		tableID = rt.modFilter
-	}
-	td := s.tableDefs[tableID]
-	if len(td.values) == 0 {
-		return 0
-	}
-	rate := rt.tableRate[kind]
-	if rate <= 0 {
-		rate = 1
-	}
-	ticksPerFrame := s.score.Resolution / 4
-	fps := rt.fpsRate
-	if fps <= 0 {
-		if raw, ok := s.score.Definitions["FPS"]; ok {
-			if fv, err := strconv.Atoi(strings.TrimSpace(raw)); err == nil && fv > 0 {
-				fps = fv
-			}
-		}
-	}
-	if fps > 0 {
-		ticksPerFrame = int(math.Max(1, (60.0/float64(fps))*float64(s.score.Resolution)/4.0))
+		kind = tableFilter
+	default:
+		// @@ timbre tables are accepted but not stepped; the voice keeps its
+		// note-on program.
+		return
 	}
-	start := rt.tableStart[kind]
-	idx := 0
-	if eventTick > start {
-		idx = (eventTick - start) / (ticksPerFrame * rate)
+	if ev.Value == 255 {
+		envs[kind] = tableEnv{}
+		return
 	}
-	var v int
-	if idx < len(td.values) {
-		v = td.values[idx]
-	} else {
-		loopStart := td.loopStart
-		if loopStart < 0 {
-			loopStart = 0
-		}
-		loopLen := len(td.values) - loopStart
-		if loopLen <= 0 {
-			v = td.values[len(td.values)-1]
-		} else {
-			v = td.values[loopStart+(idx-loopStart)%loopLen]
-		}
+	envs[kind] = tableEnv{on: true, id: ev.Value, rate: max(ev.Delay, 1)}
+}
+
+// startVoiceTables begins stepping the track's table envelopes for a new
+// voice and applies their first frame.
+func (s *Sequencer) startVoiceTables(rt *runtimeState, voice int, pan int) {
+	if voice < 0 || (rt.tables == [tableKinds]tableEnv{} && rt.release == [tableKinds]tableEnv{}) {
+		return
 	}
-	if scale <= 0 {
-		return v
+	frameLen := float64(s.sampleRate) / float64(s.frameRate(rt))
+	vt := voiceTables{
+		voice:     voice,
+		tables:    rt.tables,
+		release:   rt.release,
+		pan:       pan,
+		frameLen:  frameLen,
+		untilNext: frameLen,
+	}
+	s.applyVoiceTables(&vt)
+	s.voiceTables = append(s.voiceTables, vt)
+}
+
+// filterShape converts the track's %f mode and @f envelope to seconds and
+// engine units.
+func (s *Sequencer) filterShape(rt *runtimeState) filter.Envelope {
+	fe := rt.filterEnv
+	cutoff := func(v int) float64 { return float64(clampInt(v, 0, 128)) }
+	return filter.Envelope{
+		Mode:          rt.filterType,
+		Resonance:     float64(clampInt(fe.res, 0, 9)) / 9,
+		Cutoff:        cutoff(fe.co),
+		Peak:          cutoff(fe.co2),
+		Level:         cutoff(fe.co3),
+		End:           cutoff(fe.sc),
+		ReleaseCutoff: cutoff(fe.rc),
+		Attack:        filterRateSeconds(fe.ar),
+		Decay:         filterRateSeconds(fe.dr),
+		Sustain:       filterRateSeconds(fe.sr),
+		Release:       filterRateSeconds(fe.rr),
 	}
-	return v / scale
 }
 
-func (s *Sequencer) sampleLFO(rt *runtimeState, tick int) int {
-	if rt.lfoDepth == 0 || rt.lfoRate <= 0 {
+// filterRateSeconds converts an @f rate (0-63) to a stage time. 0 holds the
+// stage forever and 63 is immediate; in between, every 6 steps halve the
+// time from 10 seconds.
+func filterRateSeconds(rate int) float64 {
+	switch {
+	case rate <= 0:
+		return math.Inf(1)
+	case rate >= 63:
 		return 0
 	}
-	depth := rt.lfoDepth
-	if rt.mpChange > 0 && tick > rt.mpDelay {
-		progress := clampInt(tick-rt.mpDelay, 0, rt.mpChange)
-		depth = rt.modPitch + ((rt.mpEnd-rt.modPitch)*progress)/rt.mpChange
-	}
-	// Continuous LFO waveforms. Period = lfoRate * 2 ticks.
-	period := rt.lfoRate * 2
-	phase := float64(tick%period) / float64(period) // 0..1
-	var waveVal float64
-	switch rt.lfoWave {
-	case 0: // saw
-		waveVal = 1.0 - 2.0*phase
-	case 1: // square
-		if phase < 0.5 {
-			waveVal = 1.0
-		} else {
-			waveVal = -1.0
-		}
-	case 3: // random (sample-and-hold per cycle)
-		// Approximate with a hash-based deterministic random per cycle.
-		cycle := tick / period
-		waveVal = float64((cycle*16807+1)%127)/63.0 - 1.0
-	default: // 2 = triangle (default)
-		if phase < 0.5 {
-			waveVal = 4.0*phase - 1.0
-		} else {
-			waveVal = 3.0 - 4.0*phase
-		}
-	}
-	return int(waveVal * float64(depth) / 8.0)
+	return 10 * math.Pow(2, -float64(rate)/6)
 }
 
-func (s *Sequencer) applyAmpControls(rt *runtimeState, vel int, tick int) int {
-	if vel <= 0 {
-		vel = 1
+// longestReleaseSec is the release of s0. It is long but finite, so the
+// voice still ends and the score can end or loop after it.
+const longestReleaseSec = 10
+
+// releaseRateSeconds converts an s release rate (0-63) to a release time: 0 is
+// the longest, 1 to 63 run from about 300 ms down to 10 ms the way @rr does.
+// -1 leaves the engine's own release.
+func releaseRateSeconds(rate int) float64 {
+	switch {
+	case rate < 0:
+		return 0
+	case rate == 0:
+		return longestReleaseSec
 	}
-	filterCut := rt.filterCut
-	if rt.filterEnvOn {
-		filterCut = rt.filterEnv.step()
+	return 0.01 + float64(63-rate)/63*0.3
+}
+
+// frameRate returns the track's table and modulation frames per second.
+func (s *Sequencer) frameRate(rt *runtimeState) int {
+	if rt.fpsRate > 0 {
+		return rt.fpsRate
 	}
-	vel = (vel * clampInt(filterCut, 1, 128)) / 128
-	if vel < 1 {
-		vel = 1
+	return s.tableFPS
+}
+
+// dropVoiceTables stops the table envelopes of voice, for a mono note that
+// restarts them.
+func (s *Sequencer) dropVoiceTables(voice int) {
+	s.voiceTables = slices.DeleteFunc(s.voiceTables, func(vt voiceTables) bool { return vt.voice == voice })
+}
+
+// releaseVoiceTables switches a voice to its release tables at note-off.
+func (s *Sequencer) releaseVoiceTables(voice int) {
+	for i := range s.voiceTables {
+		vt := &s.voiceTables[i]
+		if vt.voice == voice && !vt.released {
+			vt.released = true
+			vt.relFrame = 0
+			s.applyVoiceTables(vt)
+		}
 	}
-	ampTable := s.sampleTable(rt, "na", 1, tick)
-	if ampTable != 0 {
-		vel = (vel * clampInt(ampTable, 1, 128)) / 128
-		if vel < 1 {
-			vel = 1
+}
+
+// stepVoiceTables advances every tracked voice by one sample, pushing new
+// table values at frame boundaries and dropping voices the engine has
+// finished.
+func (s *Sequencer) stepVoiceTables() {
+	j := 0
+	for i := range s.voiceTables {
+		vt := &s.voiceTables[i]
+		vt.untilNext--
+		if vt.untilNext <= 0 {
+			vt.untilNext += vt.frameLen
+			if !s.engine.VoiceActive(vt.voice) {
+				continue
+			}
+			vt.frame++
+			if vt.released {
+				vt.relFrame++
+			}
+			s.applyVoiceTables(vt)
+		}
+		if j != i {
+			s.voiceTables[j] = *vt
 		}
+		j++
 	}
-	if rt.modAmp > 0 {
-		ampDepth := rt.modAmp
-		if rt.maChange > 0 && tick > rt.maDelay {
-			progress := clampInt(tick-rt.maDelay, 0, rt.maChange)
-			ampDepth = rt.modAmp + ((rt.maEnd-rt.modAmp)*progress)/rt.maChange
+	s.voiceTables = s.voiceTables[:j]
+}
+
+func (s *Sequencer) applyVoiceTables(vt *voiceTables) {
+	for kind := range tableKinds {
+		env, frame := vt.tables[kind], vt.frame
+		if vt.released && vt.release[kind].on {
+			env, frame = vt.release[kind], vt.relFrame
 		}
-		waveVal := 0.0
-		if rt.lfoRate > 0 {
-			period := rt.lfoRate * 2
-			phase := float64(tick%period) / float64(period)
-			switch rt.lfoWave {
-			case 0: // saw
-				waveVal = 1.0 - 2.0*phase
-			case 1: // square
-				if phase < 0.5 {
-					waveVal = 1.0
-				} else {
-					waveVal = -1.0
-				}
-			case 3: // random
-				cycle := tick / period
-				waveVal = float64((cycle*16807+1)%127)/63.0 - 1.0
-			default: // triangle
-				if phase < 0.5 {
-					waveVal = 4.0*phase - 1.0
-				} else {
-					waveVal = 3.0 - 4.0*phase
-				}
-			}
+		if !env.on {
+			continue
+		}
+		td := s.tableDefs[env.id]
+		if len(td.values) == 0 {
+			continue
 		}
-		vel += int(waveVal * float64(ampDepth) / 16.0)
+		v := td.at(frame / env.rate)
+		switch kind {
+		case tableAmp:
+			s.engine.SetVoiceGain(vt.voice, float64(clampInt(v, 0, 128))/128)
+		case tablePitch:
+			// nt values are 1/16 semitones.
+			s.engine.SetVoicePitch(vt.voice, float64(v)/16)
+		case tablePan:
+			s.engine.SetVoicePan(vt.voice, clampInt(vt.pan+v, -64, 64))
+		case tableFilter:
+			s.engine.SetVoiceFilter(vt.voice, clampInt(v, 0, 128))
+		}
+	}
+}
+
+// at returns the value for step idx. Past the end a table repeats from its
+// | loop point, or holds its last value when it has none.
+func (td tableData) at(idx int) int {
+	if idx < len(td.values) {
+		return td.values[idx]
+	}
+	if td.loopStart < 0 || td.loopStart >= len(td.values) {
+		return td.values[len(td.values)-1]
 	}
-	return clampInt(vel, 1, 127)
+	loopLen := len(td.values) - td.loopStart
+	return td.values[td.loopStart+(idx-td.loopStart)%loopLen]
 }
 
 func parseTableDefinitions(defs map[string]string) map[int]tableData {
@@ -943,9 +1167,12 @@ func parseTableDefinitions(defs map[string]string) map[int]tableData {
 			after := parseTableFormula(body[pipeIdx+1:])
 			loopStart = len(before)
 			values := append(before, after...)
+			unstretched := len(values)
 			values = applyTableOps(values, stretch, magnify, offset)
 			if loopStart > 0 {
-				loopStart *= maxInt(stretch, 1)
+				// applyTableOps caps the table length, so the stretch it
+				// applied may be smaller than requested.
+				loopStart = min(loopStart*max(len(values)/unstretched, 1), len(values))
 			}
 			if len(values) > 0 {
 				out[id] = tableData{values: values, loopStart: loopStart}
@@ -1015,6 +1242,12 @@ func parseTrailingOps(s string) (stretch, magnify, offset int) {
 }
 
 func applyTableOps(values []int, stretch, magnify, offset int) []int {
+	if len(values) > maxTableLength {
+		values = values[:maxTableLength]
+	}
+	if len(values) > 0 {
+		stretch = min(stretch, maxTableLength/len(values))
+	}
 	if stretch > 1 {
 		stretched := make([]int, 0, len(values)*stretch)
 		for _, v := range values {
@@ -1032,12 +1265,9 @@ func applyTableOps(values []int, stretch, magnify, offset int) []int {
 	return values
 }
 
-func maxInt(a, b int) int {
-	if a > b {
-		return a
-	}
-	return b
-}
+// maxTableLength caps a #TABLE so that repeat counts and stretch factors in
+// a definition cannot allocate without bound.
+const maxTableLength = 1 << 16
 
 func parseTableFormula(body string) []int {
 	values := make([]int, 0, 32)
@@ -1061,6 +1291,9 @@ func parseTableFormula(body string) []int {
 			repeat, ni := parseTrailingNumber(body, i, 1)
 			i = ni
 			part := parseTableFormula(block)
+			if len(part) > 0 {
+				repeat = min(repeat, (maxTableLength-len(values))/len(part))
+			}
 			for r := 0; r < repeat; r++ {
 				values = append(values, part...)
 			}
@@ -1075,6 +1308,9 @@ func parseTableFormula(body string) []int {
 			repeat, ni := parseTrailingNumber(body, i, 1)
 			i = ni
 			pts := parseCSV(inside)
+			if len(pts) > 0 {
+				repeat = min(repeat, (maxTableLength-len(values))/max(len(pts)-1, 1))
+			}
 			if len(pts) == 1 {
 				for r := 0; r < repeat; r++ {
 					values = append(values, pts[0])
@@ -1116,7 +1352,9 @@ func parseTableFormula(body string) []int {
 				i++
 				continue
 			}
-			values = append(values, v)
+			if len(values) < maxTableLength {
+				values = append(values, v)
+			}
 			i = ni
 		}
 	}
@@ -1193,11 +1431,102 @@ func parseCSV(src string) []int {
 	return out
 }
 
-func absInt(v int) int {
-	if v < 0 {
-		return -v
+// pipeArg reads the pipe number after the level in @o, @i and @r.
+func pipeArg(text string) int {
+	if args := parseCSV(text); len(args) > 0 {
+		return clampInt(args[0], 0, pipe.Count-1)
+	}
+	return 0
+}
+
+// usesPipes reports whether any track is connected by #FM or sets @o, @i or
+// @r.
+func usesPipes(score *mml.Score, routes []pipe.Route) bool {
+	for _, r := range routes {
+		if r != (pipe.Route{}) {
+			return true
+		}
+	}
+	for _, tr := range score.Tracks {
+		for _, ev := range tr.Events {
+			switch strings.ToLower(strings.TrimSpace(ev.Command)) {
+			case "@o", "@i", "@r":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseFMConnections reads the #FM{...} formula into a pipe route per track.
+// Letters name tracks in order, A being the first. "B3(A)" feeds A into B's
+// carrier at input level 3, the same as @o1 on A and @i3 on B; inputs can be
+// listed and nested, as in "C(A+B)" or "C2(B(A))", and the level defaults
+// to 5. Each connection takes the next free pipe.
+func parseFMConnections(defs map[string]string, tracks int) []pipe.Route {
+	routes := make([]pipe.Route, tracks)
+	raw := defs["FM"]
+	open, end := strings.IndexByte(raw, '{'), strings.LastIndexByte(raw, '}')
+	if open < 0 || end < open {
+		return routes
+	}
+	f := fmFormula{src: strings.ToUpper(raw[open+1 : end]), routes: routes}
+	f.terms(-1)
+	// The lowest track into a pipe overwrites it and the rest add to it, so
+	// every input of a sum is heard.
+	var taken [pipe.Count]bool
+	for i, r := range routes {
+		if r.Output == pipe.Overwrite {
+			if taken[r.OutPipe] {
+				routes[i].Output = pipe.Add
+			}
+			taken[r.OutPipe] = true
+		}
+	}
+	return routes
+}
+
+type fmFormula struct {
+	src    string
+	pos    int
+	pipes  int // pipes taken so far
+	routes []pipe.Route
+}
+
+// terms reads connections up to the closing parenthesis, sending each
+// track's output to out when it is a pipe.
+func (f *fmFormula) terms(out int) {
+	for f.pos < len(f.src) {
+		ch := f.src[f.pos]
+		f.pos++
+		switch {
+		case ch == ')':
+			return
+		case ch >= 'A' && ch <= 'Z':
+			track := int(ch - 'A')
+			level := 5
+			if start := f.pos; f.pos < len(f.src) && f.src[f.pos] >= '0' && f.src[f.pos] <= '9' {
+				for f.pos < len(f.src) && f.src[f.pos] >= '0' && f.src[f.pos] <= '9' {
+					f.pos++
+				}
+				level, _ = strconv.Atoi(f.src[start:f.pos])
+			}
+			if f.pos < len(f.src) && f.src[f.pos] == '(' {
+				f.pos++
+				in := f.pipes
+				f.pipes++
+				f.terms(in)
+				if track < len(f.routes) && in < pipe.Count {
+					f.routes[track].InputLevel = clampInt(level, 0, 7)
+					f.routes[track].InPipe = in
+				}
+			}
+			if track < len(f.routes) && out >= 0 && out < pipe.Count {
+				f.routes[track].Output = pipe.Overwrite
+				f.routes[track].OutPipe = out
+			}
+		}
 	}
-	return v
 }
 
 func parsePatchMods(defs map[string]string) map[int]patchMod {
@@ -1369,30 +1698,47 @@ func (s *Sequencer) lfoRateToHz(lfoRate int) float64 {
 	return 1.0 / period
 }
 
-// updateEngineLFO pushes the current MP/MA/MF state to the engine.
+// updateEngineLFO pushes the track's mp/ma/mf settings to the engine, which
+// latches them into the next NoteOn.
 func (s *Sequencer) updateEngineLFO(rt *runtimeState) {
-	rateHz := s.lfoRateToHz(rt.lfoRate)
-
-	// Pitch LFO (MP): depth is in 1/8 semitone units in the sequencer; convert to semitones.
-	if rt.mpEnd != 0 && rt.lfoRate > 0 {
-		s.engine.SetPitchLFO(float64(rt.mpEnd)/8.0, rateHz, rt.lfoWave)
-	} else {
-		s.engine.SetPitchLFO(0, 0, 0)
-	}
+	// Pitch depth is in 1/64 semitones, like k.
+	s.engine.SetPitchLFO(s.lfoShape(rt, rt.mp, 64))
+	// Amp depth is in 1/128 of full level.
+	s.engine.SetAmpLFO(s.lfoShape(rt, rt.ma, 128))
+	// Filter depth is in cutoff units (0-128).
+	s.engine.SetFilterLFO(s.lfoShape(rt, rt.mf, 1))
+}
 
-	// Amp LFO (MA): depth is in 1/16 units; convert to a 0-1 factor.
-	if rt.maEnd != 0 && rt.lfoRate > 0 {
-		s.engine.SetAmpLFO(float64(rt.maEnd)/16.0, rateHz, rt.lfoWave)
-	} else {
-		s.engine.SetAmpLFO(0, 0, 0)
-	}
+// lfoShape converts a modulation to seconds and engine units, dividing
+// depths by unit.
+func (s *Sequencer) lfoShape(rt *runtimeState, m modulation, unit float64) lfo.Shape {
+	rateHz := s.lfoRateToHz(rt.lfoRate)
+	if rateHz <= 0 {
+		return lfo.Shape{}
+	}
+	shape := lfo.Shape{
+		Depth:    float64(m.depth) / unit,
+		EndDepth: float64(m.depth) / unit,
+		RateHz:   rateHz,
+		Waveform: rt.lfoWave,
+	}
+	if m.end > m.depth {
+		fps := float64(s.frameRate(rt))
+		shape.EndDepth = float64(m.end) / unit
+		shape.Delay = float64(m.delay) / fps
+		shape.Change = float64(m.change) / fps
+	}
+	return shape
+}
 
-	// Filter LFO (MF): depth in cutoff units.
-	if rt.mfEnd != 0 && rt.lfoRate > 0 {
-		s.engine.SetFilterLFO(float64(rt.mfEnd)/8.0, rateHz, rt.lfoWave)
-	} else {
-		s.engine.SetFilterLFO(0, 0, 0)
+// pendingNoteOff reports whether voice is still keyed on.
+func (s *Sequencer) pendingNoteOff(voice int) bool {
+	for _, off := range s.noteOffs {
+		if off.voice == voice && !off.fired {
+			return true
+		}
 	}
+	return false
 }
 
 func (s *Sequencer) cancelPendingNoteOff(voice int) {
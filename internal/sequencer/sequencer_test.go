@@ -1,10 +1,19 @@
 package sequencer
 
 import (
+	"math"
+	"slices"
 	"testing"
 
+	"github.com/cbegin/mmlfm-go/internal/alloc"
+	"github.com/cbegin/mmlfm-go/internal/chiptune"
+	"github.com/cbegin/mmlfm-go/internal/filter"
 	"github.com/cbegin/mmlfm-go/internal/fm"
+	"github.com/cbegin/mmlfm-go/internal/lfo"
 	"github.com/cbegin/mmlfm-go/internal/mml"
+	"github.com/cbegin/mmlfm-go/internal/nesapu"
+	"github.com/cbegin/mmlfm-go/internal/pipe"
+	"github.com/cbegin/mmlfm-go/internal/wavetable"
 )
 
 type countingEngine struct {
@@ -23,14 +32,21 @@ func (e *countingEngine) NoteOn(note int, velocity int, pan int, program int) in
 }
 func (e *countingEngine) NoteOff(id int)                 { e.noteOffs = append(e.noteOffs, id) }
 func (e *countingEngine) RenderFrame() (float32, float32) { return 0, 0 }
+func (e *countingEngine) RenderBlock(dst []float32)      { clear(dst) }
 func (e *countingEngine) SetMasterGain(gain float64)      {}
 func (e *countingEngine) ActiveVoiceCount() int           { return 0 }
-func (e *countingEngine) SetFilterType(int)               {}
+func (e *countingEngine) SetFilter(filter.Envelope)       {}
+func (e *countingEngine) SetRelease(float64, float64)      {}
 func (e *countingEngine) SetNoteOnPhase(int)              {}
 func (e *countingEngine) SetPortamento(from int, frames int)          {}
-func (e *countingEngine) SetPitchLFO(float64, float64, int)           {}
-func (e *countingEngine) SetAmpLFO(float64, float64, int)             {}
-func (e *countingEngine) SetFilterLFO(float64, float64, int)          {}
+func (e *countingEngine) SetPitchLFO(lfo.Shape)                      {}
+func (e *countingEngine) SetAmpLFO(lfo.Shape)                        {}
+func (e *countingEngine) SetFilterLFO(lfo.Shape)                     {}
+func (e *countingEngine) VoiceActive(int) bool                      { return false }
+func (e *countingEngine) SetVoicePitch(int, float64)                 {}
+func (e *countingEngine) SetVoiceGain(int, float64)                  {}
+func (e *countingEngine) SetVoicePan(int, int)                       {}
+func (e *countingEngine) SetVoiceFilter(int, int)                    {}
 
 func TestSequencerProcessesFrames(t *testing.T) {
 	parser := mml.NewParser(mml.DefaultParserConfig())
@@ -109,6 +125,26 @@ func TestSequencerMaskCanIgnorePan(t *testing.T) {
 	}
 }
 
+func TestSequencerTriggerReportsTrack(t *testing.T) {
+	parser := mml.NewParser(mml.DefaultParserConfig())
+	score, err := parser.Parse("o5 c; #NAME{Drums}; %t7,1 c;")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	var got []TriggerEvent
+	seq := NewWithOptions(score, &countingEngine{}, 48000, Options{
+		OnTrigger: func(te TriggerEvent) { got = append(got, te) },
+	})
+	buf := make([]float32, 4800*2)
+	seq.Process(buf)
+	if len(got) != 1 {
+		t.Fatalf("expected 1 trigger, got %d", len(got))
+	}
+	if got[0].TriggerID != 7 || got[0].Track != 1 || got[0].TrackName != "Drums" {
+		t.Fatalf("expected trigger 7 from track 1 \"Drums\", got %#v", got[0])
+	}
+}
+
 func TestTableLoopPointSemantics(t *testing.T) {
 	defs := map[string]string{
 		"TABLE0": "#TABLE0{1,2|3,4}",
@@ -177,3 +213,774 @@ func TestParseTableDefinitionsInterpolation(t *testing.T) {
 		t.Fatalf("unexpected TABLE2 values: %#v", got2)
 	}
 }
+
+// tableEngine records the per-voice updates pushed by table envelopes.
+type tableEngine struct {
+	countingEngine
+	gains   []float64
+	pitches []float64
+}
+
+func (e *tableEngine) VoiceActive(int) bool { return true }
+func (e *tableEngine) SetVoiceGain(id int, gain float64) {
+	e.gains = append(e.gains, gain)
+}
+func (e *tableEngine) SetVoicePitch(id int, semitones float64) {
+	e.pitches = append(e.pitches, semitones)
+}
+
+func TestSequencerStepsTablesWhileNoteIsHeld(t *testing.T) {
+	score, err := mml.NewParser(mml.DefaultParserConfig()).Parse("#TABLE1{128,64,32}; #TABLE2{|0,64,112}; t60 @fps10 na1 nt2 o5 c4")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	engine := &tableEngine{}
+	seq := New(score, engine, 8000)
+	// Half a second at 10 frames per second: note-on plus five frames.
+	seq.Process(make([]float32, 4000*2))
+	wantGains := []float64{1, 0.5, 0.25, 0.25, 0.25, 0.25}
+	wantPitches := []float64{0, 4, 7, 0, 4, 7}
+	if len(engine.gains) != len(wantGains) || len(engine.pitches) != len(wantPitches) {
+		t.Fatalf("expected %d frames, got gains %v pitches %v", len(wantGains), engine.gains, engine.pitches)
+	}
+	for i := range wantGains {
+		if engine.gains[i] != wantGains[i] || engine.pitches[i] != wantPitches[i] {
+			t.Fatalf("frame %d: expected gain %v pitch %v, got gains %v pitches %v", i, wantGains[i], wantPitches[i], engine.gains, engine.pitches)
+		}
+	}
+}
+
+func TestSequencerSwitchesToReleaseTableAtNoteOff(t *testing.T) {
+	score, err := mml.NewParser(mml.DefaultParserConfig()).Parse("#TABLE1{96}; #TABLE3{64,32}; t60 @fps10 na1 _na3 q4 o5 c4")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	engine := &tableEngine{}
+	seq := New(score, engine, 8000)
+	seq.Process(make([]float32, 8000*2))
+	if len(engine.noteOffs) != 1 {
+		t.Fatalf("expected one note-off, got %v", engine.noteOffs)
+	}
+	var steps []float64
+	for _, g := range engine.gains {
+		if len(steps) == 0 || steps[len(steps)-1] != g {
+			steps = append(steps, g)
+		}
+	}
+	want := []float64{0.75, 0.5, 0.25}
+	if len(steps) != len(want) || steps[0] != want[0] || steps[1] != want[1] || steps[2] != want[2] {
+		t.Fatalf("expected held gain then release table %v, got %v", want, steps)
+	}
+}
+
+// lfoEngine records the pitch LFO shape each NoteOn latches.
+type lfoEngine struct {
+	countingEngine
+	pitch   lfo.Shape
+	latched []lfo.Shape
+}
+
+func (e *lfoEngine) SetPitchLFO(shape lfo.Shape) { e.pitch = shape }
+func (e *lfoEngine) NoteOn(note int, velocity int, pan int, program int) int {
+	e.latched = append(e.latched, e.pitch)
+	return e.countingEngine.NoteOn(note, velocity, pan, program)
+}
+
+func TestSequencerLatchesEachTracksLFOAtNoteOn(t *testing.T) {
+	score, err := mml.NewParser(mml.DefaultParserConfig()).Parse("t60 @fps10 mp64,128,5,10 o5 c4; o5 e4")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	engine := &lfoEngine{}
+	seq := New(score, engine, 8000)
+	seq.Process(make([]float32, 800*2))
+	if len(engine.latched) != 2 {
+		t.Fatalf("expected two note-ons, got %d", len(engine.latched))
+	}
+	got := engine.latched[0]
+	if got.Depth != 1 || got.EndDepth != 2 || got.Delay != 0.5 || got.Change != 1 || got.RateHz <= 0 || got.Waveform != 2 {
+		t.Fatalf("unexpected vibrato on first track: %+v", got)
+	}
+	if engine.latched[1].Active() {
+		t.Fatalf("vibrato leaked into second track: %+v", engine.latched[1])
+	}
+}
+
+// voiceEngines returns constructors for every engine, and for FM behind a
+// MultiEngine.
+func voiceEngines(sampleRate int) map[string]func() VoiceEngine {
+	return map[string]func() VoiceEngine{
+		"fm":        func() VoiceEngine { return fm.New(sampleRate, fm.DefaultParams()) },
+		"chiptune":  func() VoiceEngine { return chiptune.New(sampleRate, chiptune.DefaultParams()) },
+		"nesapu":    func() VoiceEngine { return nesapu.New(sampleRate, nesapu.DefaultParams()) },
+		"wavetable": func() VoiceEngine { return wavetable.New(sampleRate, wavetable.DefaultParams()) },
+		"multi": func() VoiceEngine {
+			m := NewMultiEngine(0, sampleRate)
+			m.AddEngine(0, fm.New(sampleRate, fm.DefaultParams()), 1)
+			return m
+		},
+	}
+}
+
+func TestEnginesKeepTheLFOAndFilterEachNoteStartedWith(t *testing.T) {
+	const sampleRate = 8000
+	engines := voiceEngines(sampleRate)
+	vibrato := lfo.Shape{Depth: 1, EndDepth: 1, RateHz: 6, Waveform: 2}
+	closed := filter.Static(filter.LowPass, 40, 0.5)
+	render := func(e VoiceEngine) []float32 {
+		out := make([]float32, 0, sampleRate/4)
+		for i := 0; i < sampleRate/4; i++ {
+			l, _ := e.RenderFrame()
+			out = append(out, l)
+		}
+		return out
+	}
+	for name, newEngine := range engines {
+		plain := newEngine()
+		plain.NoteOn(69, 100, 0, 0)
+		want := render(plain)
+
+		late := newEngine()
+		late.NoteOn(69, 100, 0, 0)
+		late.SetPitchLFO(vibrato)
+		late.SetAmpLFO(vibrato)
+		late.SetFilterLFO(vibrato)
+		late.SetFilter(closed)
+		if got := render(late); !equalSamples(got, want) {
+			t.Fatalf("%s: LFO or filter set after NoteOn changed a sounding note", name)
+		}
+
+		early := newEngine()
+		early.SetPitchLFO(vibrato)
+		early.NoteOn(69, 100, 0, 0)
+		if got := render(early); equalSamples(got, want) {
+			t.Fatalf("%s: LFO set before NoteOn had no effect", name)
+		}
+
+		filtered := newEngine()
+		filtered.SetFilter(closed)
+		filtered.NoteOn(69, 100, 0, 0)
+		if got := render(filtered); equalSamples(got, want) {
+			t.Fatalf("%s: filter set before NoteOn had no effect", name)
+		}
+	}
+}
+
+func TestEnginesReleaseAndSweepAfterKeyOff(t *testing.T) {
+	const sampleRate = 8000
+	// play holds a note for 50 ms, releases it and plays 100 ms more.
+	play := func(e VoiceEngine, seconds, sweep float64) (before, after []float32, active bool) {
+		e.SetRelease(seconds, sweep)
+		id := e.NoteOn(69, 100, 0, 0)
+		for i := 0; i < sampleRate/20; i++ {
+			l, _ := e.RenderFrame()
+			before = append(before, l)
+		}
+		e.NoteOff(id)
+		for i := 0; i < sampleRate/10; i++ {
+			l, _ := e.RenderFrame()
+			after = append(after, l)
+		}
+		return before, after, e.VoiceActive(id)
+	}
+	for name, newEngine := range voiceEngines(sampleRate) {
+		wantBefore, wantAfter, active := play(newEngine(), 0, 0)
+		if !active {
+			t.Fatalf("%s: expected the default release to outlast 100 ms", name)
+		}
+		if _, _, active := play(newEngine(), 0.01, 0); active {
+			t.Fatalf("%s: expected a 10 ms release to end the voice", name)
+		}
+		before, after, _ := play(newEngine(), 0, -120)
+		if !equalSamples(before, wantBefore) {
+			t.Fatalf("%s: pitch sweep changed the note before key-off", name)
+		}
+		if equalSamples(after, wantAfter) {
+			t.Fatalf("%s: pitch sweep had no effect after key-off", name)
+		}
+	}
+}
+
+func TestSequencerSetsReleaseAndSweepPerTrack(t *testing.T) {
+	score, err := mml.NewParser(mml.DefaultParserConfig()).Parse("o5 c8 s63,-32 c8 s c8 @rr10,16 c8; o5 e8")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	engine := &releaseEngine{}
+	New(score, engine, 8000).Process(make([]float32, 8000*2))
+	want := [][2]float64{
+		{0, 0},
+		{0.01, -30},
+		{releaseRateSeconds(28), 0},
+		{releaseRateSeconds(28), 15},
+	}
+	if len(engine.latched) != 5 {
+		t.Fatalf("expected five note-ons, got %d", len(engine.latched))
+	}
+	// Track 1 plays its only note alongside track 0's first.
+	got := append(engine.latched[:1:1], engine.latched[2:]...)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected release and sweep %v, got %v", want, got)
+		}
+	}
+	if engine.latched[1] != [2]float64{} {
+		t.Fatalf("expected the other track to keep the engine release, got %v", engine.latched[1])
+	}
+}
+
+func TestSequencerEndsAfterTheLongestRelease(t *testing.T) {
+	score, err := mml.NewParser(mml.DefaultParserConfig()).Parse("t240 s0 l8 c")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	for name, engine := range voiceEngines(8000) {
+		ended := false
+		seq := NewWithOptions(score, engine(), 8000, Options{
+			OnEvent: func(kind EventKind) { ended = ended || kind == EventPlaybackEnded },
+		})
+		// Engines that fall at the sustain level's rate take longer from a
+		// louder envelope.
+		seq.Process(make([]float32, 8000*longestReleaseSec*2*2))
+		if !ended {
+			t.Fatalf("%s: expected a score released with s0 to end", name)
+		}
+	}
+}
+
+// releaseEngine records the release time and sweep each NoteOn latches.
+type releaseEngine struct {
+	countingEngine
+	release [2]float64
+	latched [][2]float64
+}
+
+func (e *releaseEngine) SetRelease(seconds, sweep float64) { e.release = [2]float64{seconds, sweep} }
+func (e *releaseEngine) NoteOn(note int, velocity int, pan int, program int) int {
+	e.latched = append(e.latched, e.release)
+	return e.countingEngine.NoteOn(note, velocity, pan, program)
+}
+
+// filterEngine records the filter each NoteOn latches.
+type filterEngine struct {
+	countingEngine
+	filter  filter.Envelope
+	latched []filter.Envelope
+}
+
+func (e *filterEngine) SetFilter(env filter.Envelope) { e.filter = env }
+func (e *filterEngine) NoteOn(note int, velocity int, pan int, program int) int {
+	e.latched = append(e.latched, e.filter)
+	return e.countingEngine.NoteOn(note, velocity, pan, program)
+}
+
+func TestSequencerLatchesEachTracksFilterAtNoteOn(t *testing.T) {
+	score, err := mml.NewParser(mml.DefaultParserConfig()).Parse("%f2 @f64,3,63,0,0,0,100 o5 c4; o5 e4")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	engine := &filterEngine{}
+	seq := New(score, engine, 8000)
+	seq.Process(make([]float32, 800*2))
+	if len(engine.latched) != 2 {
+		t.Fatalf("expected two note-ons, got %d", len(engine.latched))
+	}
+	got := engine.latched[0]
+	if got.Mode != filter.HighPass || got.Resonance != 3.0/9 || got.Cutoff != 64 || got.Peak != 100 || got.Attack != 0 || !math.IsInf(got.Decay, 1) {
+		t.Fatalf("unexpected filter on first track: %+v", got)
+	}
+	if open := engine.latched[1]; open.Mode != filter.LowPass || open.Cutoff != 128 || !math.IsInf(open.Attack, 1) {
+		t.Fatalf("filter leaked into second track: %+v", open)
+	}
+}
+
+// inlineEngine records the inline FM voice each NoteOn latches.
+type inlineEngine struct {
+	countingEngine
+	inline  fm.Inline
+	latched []fm.Inline
+	from    []int
+}
+
+func (e *inlineEngine) SetInline(v fm.Inline)   { e.inline = v }
+func (e *inlineEngine) ContinueEnvelope(id int) { e.from = append(e.from, id) }
+func (e *inlineEngine) NoteOn(note int, velocity int, pan int, program int) int {
+	e.latched = append(e.latched, e.inline)
+	return e.countingEngine.NoteOn(note, velocity, pan, program)
+}
+
+func TestSequencerLatchesEachTracksFMVoiceAtNoteOn(t *testing.T) {
+	score, err := mml.NewParser(mml.DefaultParserConfig()).Parse("@al4,5 @fb3 o5 c4 c4; o5 e4 @al3 e4")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	direct := &inlineEngine{}
+	multi := &inlineEngine{}
+	me := NewMultiEngine(0, 8000)
+	me.AddEngine(0, multi, 1)
+	for _, engine := range []VoiceEngine{direct, me} {
+		New(score, engine, 8000).Process(make([]float32, 8000*2))
+	}
+	for name, got := range map[string][]fm.Inline{"direct": direct.latched, "multi": multi.latched} {
+		first, second := fm.NoInline, fm.NoInline
+		first.Ops, first.Algorithm, first.Feedback = 4, 5, 3
+		second.Ops = 3
+		want := []fm.Inline{first, fm.NoInline, first, second}
+		if len(got) != len(want) {
+			t.Fatalf("%s: expected %d note-ons, got %v", name, len(want), got)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("%s: note %d expected %+v, got %+v", name, i, want[i], got[i])
+			}
+		}
+	}
+}
+
+func TestSequencerAppliesOperatorCommandsToTheSelectedOperator(t *testing.T) {
+	score, err := mml.NewParser(mml.DefaultParserConfig()).Parse("@tl10 i1 @tl20 @ml2,64 @dt64 @fx60 i0 @rr0 o5 c4")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	engine := &inlineEngine{}
+	New(score, engine, 8000).Process(make([]float32, 800*2))
+	if len(engine.latched) != 1 {
+		t.Fatalf("expected one note-on, got %d", len(engine.latched))
+	}
+	ops := engine.latched[0].Operators
+	want1 := fm.Operator{TL: 20, RR: -1, ML: 2, MLFine: 64, DT: 64, FX: 60}
+	want0 := fm.NoOperator
+	want0.RR = 0
+	// Before any i, operator commands go to the last operator, the carrier.
+	want3 := fm.NoOperator
+	want3.TL = 10
+	if ops[1] != want1 || ops[0] != want0 || ops[2] != fm.NoOperator || ops[3] != want3 {
+		t.Fatalf("unexpected operators %+v", ops)
+	}
+}
+
+func TestSequencerDefaultsOperatorAgainOnWholeScoreLoop(t *testing.T) {
+	score, err := mml.NewParser(mml.DefaultParserConfig()).Parse("t240 @tl10 o5 c8 i0 @tl20 d8")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	engine := &inlineEngine{}
+	NewWithOptions(score, engine, 8000, Options{LoopWholeScore: true}).Process(make([]float32, 8000*2))
+	if len(engine.latched) < 4 {
+		t.Fatalf("expected the score to loop, got %d note-ons", len(engine.latched))
+	}
+	for i, in := range engine.latched[:4] {
+		if i%2 == 0 && (in.Operators[3].TL != 10 || in.Operators[0].TL != -1) {
+			t.Fatalf("pass %d: expected @tl without i to reach the carrier, got %+v", i/2, in.Operators)
+		}
+	}
+}
+
+func TestSequencerLatchesSSGModeAndEnvelopeReset(t *testing.T) {
+	score, err := mml.NewParser(mml.DefaultParserConfig()).Parse("i2 @se10 o5 c8 @er0 d8 e8 @er1 f8")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	engine := &inlineEngine{}
+	New(score, engine, 8000).Process(make([]float32, 8000*2))
+	if len(engine.latched) != 4 {
+		t.Fatalf("expected four note-ons, got %d", len(engine.latched))
+	}
+	if se := engine.latched[0].Operators[2].SE; se != 10 {
+		t.Fatalf("expected operator 2 to carry @se10, got %d", se)
+	}
+	want := []int{-1, 0, 1, -1}
+	for i, id := range engine.from {
+		if id != want[i] {
+			t.Fatalf("expected envelopes to continue from %v, got %v", want, engine.from)
+		}
+	}
+}
+
+// routeEngine records the pipe routing each NoteOn latches.
+type routeEngine struct {
+	countingEngine
+	bus     *pipe.Bus
+	route   pipe.Route
+	latched []pipe.Route
+}
+
+func (e *routeEngine) SetBus(b *pipe.Bus)    { e.bus = b }
+func (e *routeEngine) SetPipes(r pipe.Route) { e.route = r }
+func (e *routeEngine) NoteOn(note int, velocity int, pan int, program int) int {
+	e.latched = append(e.latched, e.route)
+	return e.countingEngine.NoteOn(note, velocity, pan, program)
+}
+
+func TestSequencerRoutesTracksThroughPipes(t *testing.T) {
+	score, err := mml.NewParser(mml.DefaultParserConfig()).Parse("#FM{C2(A+B(D))}; o5 c1; o5 e1; o5 g1; @o2,3 @r6,1 o5 b1")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	engine := &routeEngine{}
+	New(score, engine, 8000).Process(make([]float32, 800*2))
+	if engine.bus == nil {
+		t.Fatalf("expected the sequencer to give the engine a bus")
+	}
+	want := []pipe.Route{
+		{Output: pipe.Overwrite, OutPipe: 0},
+		{Output: pipe.Add, OutPipe: 0, InputLevel: 5, InPipe: 1, Track: 1},
+		{InputLevel: 2, InPipe: 0, Track: 2},
+		{Output: pipe.Add, OutPipe: 3, RingLevel: 6, RingPipe: 1, Track: 3},
+	}
+	if len(engine.latched) != len(want) {
+		t.Fatalf("expected %d note-ons, got %d", len(want), len(engine.latched))
+	}
+	for i, r := range engine.latched {
+		if r != want[i] {
+			t.Fatalf("track %d: expected %+v, got %+v", i, want[i], r)
+		}
+	}
+}
+
+func TestPipesDoNotFollowTheMasterGain(t *testing.T) {
+	score, err := mml.NewParser(mml.DefaultParserConfig()).Parse("@o1,0 o4 c1; @i7,0 @r8,0 o5 c1")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	for name, engine := range voiceEngines(8000) {
+		render := func(gain float64) []float32 {
+			e := engine()
+			e.SetMasterGain(gain)
+			buf := make([]float32, 4000*2)
+			New(score, e, 8000).Process(buf)
+			return buf
+		}
+		full, half := render(0.4), render(0.2)
+		peak := 0.0
+		for i := range full {
+			peak = math.Max(peak, math.Abs(float64(full[i])))
+			if d := math.Abs(float64(full[i] - 2*half[i])); d > 1e-5 {
+				t.Fatalf("%s: expected halving the gain to halve the output, off by %g at %d", name, d, i)
+			}
+		}
+		if peak == 0 {
+			t.Fatalf("%s: expected the reading track to sound", name)
+		}
+	}
+}
+
+func TestMultiEngineSharesThePipeBus(t *testing.T) {
+	before, after := &routeEngine{}, &routeEngine{}
+	me := NewMultiEngine(0, 8000)
+	me.AddEngine(0, before, 1)
+	bus := pipe.NewBus(2)
+	me.SetBus(bus)
+	me.AddEngine(1, after, 1)
+	if before.bus != bus || after.bus != bus {
+		t.Fatalf("expected every engine to get the bus")
+	}
+	me.SetCurrentModule(1)
+	me.SetPipes(pipe.Route{RingLevel: 4})
+	if after.route.RingLevel != 4 || before.route.RingLevel != 0 {
+		t.Fatalf("expected pipes to go to the current engine only")
+	}
+}
+
+func TestSequencerFollowsTempoRamps(t *testing.T) {
+	score, err := mml.NewParser(mml.DefaultParserConfig()).Parse("t60 t180,1 c1 t90,2 c1 c1")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	const sampleRate = 8000
+	tempo := mml.NewTempoMap(score)
+	seq := New(score, &countingEngine{}, sampleRate)
+	buf := make([]float32, sampleRate/10*2)
+	for n := 1; n <= 80; n++ {
+		seq.Process(buf)
+		want := tempo.Tick(float64(n) / 10)
+		if math.Abs(seq.tickFrac-want) > 1 {
+			t.Fatalf("after %.1fs expected tick %f, got %f", float64(n)/10, want, seq.tickFrac)
+		}
+	}
+	whole := float64(score.Resolution)
+	if got := seq.lfoRateToHz(int(whole / 2)); math.Abs(got-90.0/240) > 1e-6 {
+		t.Fatalf("expected LFO rates to follow the tempo the ramps reached, got %f Hz", got)
+	}
+}
+
+func equalSamples(a, b []float32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// tickEngine records the tick each NoteOn and NoteOff lands on.
+type tickEngine struct {
+	countingEngine
+	seq *Sequencer
+	on  []int
+	off []int
+}
+
+func (e *tickEngine) NoteOn(note int, velocity int, pan int, program int) int {
+	e.on = append(e.on, e.seq.tickInt)
+	return e.countingEngine.NoteOn(note, velocity, pan, program)
+}
+func (e *tickEngine) NoteOff(id int) { e.off = append(e.off, e.seq.tickInt) }
+
+func grooveTicks(t *testing.T, src string, opts Options) *tickEngine {
+	t.Helper()
+	score, err := mml.NewParser(mml.DefaultParserConfig()).Parse(src)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	engine := &tickEngine{}
+	engine.seq = NewWithOptions(score, engine, 8000, opts)
+	engine.seq.Process(make([]float32, 8000*2))
+	return engine
+}
+
+func TestSequencerSwingsOffbeatSixteenths(t *testing.T) {
+	e := grooveTicks(t, "l16 cccc", Options{Groove: Groove{Swing: 58}})
+	// 8% of a pair of 120-tick sixteenths moves every second one by 19.2 ticks.
+	want := []int{0, 139, 240, 379}
+	for i, tick := range want {
+		if i >= len(e.on) || e.on[i] != tick {
+			t.Fatalf("expected note-ons at %v, got %v", want, e.on)
+		}
+	}
+	// The key-off at 90 ticks is three quarters of the way to the swung step.
+	if e.off[0] != 104 {
+		t.Fatalf("expected the first note's key-off to stretch with the grid, got %d", e.off[0])
+	}
+	straight := grooveTicks(t, "l16 cccc", Options{Groove: Groove{Offsets: []float64{0, 0}}})
+	if straight.on[1] != 120 {
+		t.Fatalf("expected an all-zero table to stay on the grid, got %v", straight.on)
+	}
+}
+
+func TestSequencerHumanizesTheSameForTheSameSeed(t *testing.T) {
+	src := "l16 cccccccc"
+	g := Groove{Humanize: 20, Seed: 7}
+	a := grooveTicks(t, src, Options{Groove: g})
+	b := grooveTicks(t, src, Options{Groove: g})
+	g.Seed = 8
+	c := grooveTicks(t, src, Options{Groove: g})
+	same := true
+	for i := range a.on {
+		if a.on[i] != b.on[i] {
+			t.Fatalf("expected the same seed to play the same ticks, got %v and %v", a.on, b.on)
+		}
+		if d := a.on[i] - 120*i; d < -24 || d > 24 {
+			t.Fatalf("expected shifts within 20%% of a step, got %v", a.on)
+		}
+		same = same && a.on[i] == c.on[i]
+	}
+	if same {
+		t.Fatalf("expected another seed to play different ticks, got %v", a.on)
+	}
+}
+
+func TestSequencerTrackGrooveReplacesTheScoreGroove(t *testing.T) {
+	e := grooveTicks(t, "l16 cc; l16 r32 e", Options{
+		Groove:       Groove{Swing: 75},
+		TrackGrooves: map[int]Groove{1: {}},
+	})
+	want := []int{0, 60, 180}
+	for i, tick := range want {
+		if i >= len(e.on) || e.on[i] != tick {
+			t.Fatalf("expected note-ons at %v, got %v", want, e.on)
+		}
+	}
+}
+
+func TestMultiEngineKeepsModuleOrderAndRendersWithoutAllocating(t *testing.T) {
+	engines := []*countingEngine{{}, {}, {}}
+	m := NewMultiEngine(1, 8000)
+	m.AddEngine(5, engines[2], 1)
+	m.AddEngine(1, engines[0], 1)
+	m.AddEngine(3, engines[1], 1)
+	for i, e := range m.AllEngines() {
+		if e != engines[i] {
+			t.Fatalf("expected engines in module order, got %v at %d", e, i)
+		}
+	}
+	if m.engine(2) != engines[0] || m.engine(300) != engines[0] {
+		t.Fatalf("expected unregistered modules to play on the default engine")
+	}
+	if n := testing.AllocsPerRun(100, func() {
+		m.RenderFrame()
+		m.ActiveVoiceCount()
+		m.NoteOff(m.NoteOn(60, 100, 0, 3<<8))
+	}); n != 0 {
+		t.Fatalf("expected no allocations on the audio path, got %v", n)
+	}
+}
+
+// frameEngine renders blocks one RenderFrame at a time, as the sequencer
+// did before engines rendered blocks.
+type frameEngine struct {
+	VoiceEngine
+}
+
+func (e frameEngine) RenderBlock(dst []float32) {
+	for f := 0; f+1 < len(dst); f += 2 {
+		dst[f], dst[f+1] = e.RenderFrame()
+	}
+}
+
+func TestEnginesRenderBlocksLikeFrames(t *testing.T) {
+	score, err := mml.NewParser(mml.DefaultParserConfig()).Parse(
+		"t150 o5 l16 p2 cdefgab>c8 @w2 s20 c4; o3 l8 p6 @5 v12 cg<c>g c2 na1 e4; #TABLE1{0,4,8,12}; o4 l4 po20 c>c<c r")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	for name, newEngine := range voiceEngines(8000) {
+		block := make([]float32, 8000*2)
+		frame := make([]float32, 8000*2)
+		New(score, newEngine(), 8000).Process(block)
+		New(score, frameEngine{newEngine()}, 8000).Process(frame)
+		for i := range block {
+			if block[i] != frame[i] {
+				t.Fatalf("%s: block render differs from frame render at sample %d: %f != %f", name, i, block[i], frame[i])
+			}
+		}
+	}
+}
+
+func TestMultiEngineRendersTheSameInParallel(t *testing.T) {
+	score, err := mml.NewParser(mml.DefaultParserConfig()).Parse(
+		"t150 o5 l16 @7 cdefgab>c8; %1 o4 l8 cg<c>g c2; %4 o3 l4 c>c<c r; %6 o6 l8 @7 p1 ccrc")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	render := func(parallel bool) []float32 {
+		m := NewMultiEngine(0, 8000)
+		m.AddEngine(0, fm.New(8000, fm.DefaultParams()), 1)
+		m.AddEngine(1, chiptune.New(8000, chiptune.DefaultParams()), 1)
+		m.AddEngine(4, wavetable.New(8000, wavetable.DefaultParams()), 1)
+		m.AddEngine(6, fm.New(8000, fm.DefaultParams()), 1)
+		m.AddEngine(7, m.engine(0), 1)
+		m.SetParallel(parallel)
+		defer m.Close()
+		out := make([]float32, 8000*2)
+		New(score, m, 8000).Process(out)
+		return out
+	}
+	serial, parallel := render(false), render(true)
+	for i := range serial {
+		if serial[i] != parallel[i] {
+			t.Fatalf("parallel render differs at sample %d: %f != %f", i, parallel[i], serial[i])
+		}
+	}
+}
+
+// idEngine records the voice IDs an FM engine hands out.
+type idEngine struct {
+	*fm.Engine
+	ids []int
+}
+
+func (e *idEngine) NoteOn(note int, velocity int, pan int, program int) int {
+	id := e.Engine.NoteOn(note, velocity, pan, program)
+	e.ids = append(e.ids, id)
+	return id
+}
+
+func TestSequencerReservesVoicesPerTrack(t *testing.T) {
+	score, err := mml.NewParser(mml.DefaultParserConfig()).Parse("o4 c1; o5 l4 egb")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	held := func(voices map[int]TrackVoices) (bool, alloc.Stats) {
+		params := fm.DefaultParams()
+		params.Polyphony = 2
+		engine := &idEngine{Engine: fm.New(8000, params)}
+		engine.SetVoicePolicy(alloc.Oldest)
+		NewWithOptions(score, engine, 8000, Options{TrackVoices: voices}).Process(make([]float32, 8000*2))
+		return engine.VoiceActive(engine.ids[0]), engine.VoiceStats()
+	}
+	if ok, st := held(nil); ok || st.Steals+st.ReleaseSteals == 0 {
+		t.Fatalf("expected the oldest voice to be stolen without a reservation, got %v %+v", ok, st)
+	}
+	if ok, st := held(map[int]TrackVoices{0: {Reserve: 1}}); !ok || st.Steals+st.ReleaseSteals == 0 || st.PeakVoices != 2 {
+		t.Fatalf("expected the reserved voice to keep playing while the other track steals its own, got %v %+v", ok, st)
+	}
+	if ok, _ := held(map[int]TrackVoices{0: {Priority: 1}}); !ok {
+		t.Fatalf("expected the higher priority track's voice to keep playing")
+	}
+}
+
+type legatoEngine struct {
+	*fm.Engine
+	noteOns   int
+	retrigger []bool
+	frames    []int
+	pans      []int
+	peak      int
+}
+
+func (e *legatoEngine) NoteOn(note int, velocity int, pan int, program int) int {
+	e.noteOns++
+	return e.Engine.NoteOn(note, velocity, pan, program)
+}
+
+func (e *legatoEngine) Legato(id, note, velocity, frames int, retrigger bool) bool {
+	if !e.Engine.Legato(id, note, velocity, frames, retrigger) {
+		return false
+	}
+	e.retrigger = append(e.retrigger, retrigger)
+	e.frames = append(e.frames, frames)
+	return true
+}
+
+func (e *legatoEngine) SetVoicePan(id int, pan int) {
+	e.pans = append(e.pans, pan)
+	e.Engine.SetVoicePan(id, pan)
+}
+
+func (e *legatoEngine) RenderBlock(dst []float32) {
+	e.Engine.RenderBlock(dst)
+	e.peak = max(e.peak, e.ActiveVoiceCount())
+}
+
+func TestSequencerPlaysMonoTracksOnOneVoice(t *testing.T) {
+	for _, tc := range []struct {
+		src       string
+		noteOns   int
+		retrigger []bool
+		pans      []int
+		peak      int
+	}{
+		{"l8 q8 cd q4 ef", 4, nil, nil, 2},
+		{"@mono1 l8 q8 cd q4 ef", 1, []bool{true, true, true}, []int{0, 0, 0}, 1},
+		{"@mono2 l8 q8 cd q4 ef", 1, []bool{false, false, true}, []int{0, 0, 0}, 1},
+		{"@mono2 l8 q8 cd r2 q4 ef", 2, []bool{false, true}, []int{0, 0}, 1},
+		{"@mono1 l8 q8 c p0 d p8 e", 1, []bool{true, true}, []int{-64, 64}, 1},
+		// A patch change starts a new voice while the old one releases.
+		{"@mono1 l8 q8 @1 c @2 d e", 2, []bool{true}, []int{0}, 2},
+	} {
+		score, err := mml.NewParser(mml.DefaultParserConfig()).Parse("po50 " + tc.src)
+		if err != nil {
+			t.Fatalf("parse failed: %v", err)
+		}
+		engine := &legatoEngine{Engine: fm.New(8000, fm.DefaultParams())}
+		NewWithOptions(score, engine, 8000, Options{}).Process(make([]float32, 8000*2*2))
+		if engine.noteOns != tc.noteOns || !slices.Equal(engine.retrigger, tc.retrigger) {
+			t.Fatalf("%q: expected %d note-ons and retriggers %v, got %d and %v", tc.src, tc.noteOns, tc.retrigger, engine.noteOns, engine.retrigger)
+		}
+		if !slices.Equal(engine.pans, tc.pans) {
+			t.Fatalf("%q: expected mono notes to move the voice to pans %v, got %v", tc.src, tc.pans, engine.pans)
+		}
+		for _, frames := range engine.frames {
+			if frames != 400 {
+				t.Fatalf("%q: expected mono notes to glide over po, got %v frames", tc.src, engine.frames)
+			}
+		}
+		if tc.retrigger != nil && engine.peak > tc.peak {
+			t.Fatalf("%q: expected at most %d voices at a time, got %d", tc.src, tc.peak, engine.peak)
+		}
+	}
+}
@@ -8,7 +8,10 @@ import (
 	"strings"
 	"sync/atomic"
 
+	"github.com/cbegin/mmlfm-go/internal/alloc"
+	"github.com/cbegin/mmlfm-go/internal/filter"
 	"github.com/cbegin/mmlfm-go/internal/lfo"
+	"github.com/cbegin/mmlfm-go/internal/pipe"
 )
 
 const twoPi = math.Pi * 2
@@ -44,14 +47,6 @@ func DefaultParams() Params {
 	}
 }
 
-type filterType int
-
-const (
-	filterLP filterType = iota
-	filterHP
-	filterBP
-)
-
 type envState int
 
 const (
@@ -71,10 +66,22 @@ type voice struct {
 	env              float64
 	envState         envState
 	pan              float64
-	slot             int // wavetable slot index
+	panL, panR       float64 // equal-power gains for pan
+	slot             int     // wavetable slot index
 	portamentoTarget float64
 	portamentoFrames int
 	portamentoStep   float64
+	gain             float64      // table envelope level, 1 = unchanged
+	pitchMul         float64      // table envelope frequency ratio, 1 = unchanged
+	vcf              filter.Voice // @f envelope and resonant filter
+	pipes            pipe.Route   // @o/@r bus pipes
+	owner            alloc.Owner
+	releaseSec       float64 // 0 = ReleaseSec
+	sweep            float64 // semitones per second after key-off
+	swept            float64 // semitones swept so far
+	pitchMod         lfo.Mod
+	ampMod           lfo.Mod
+	filterMod        lfo.Mod
 }
 
 // Engine is a wavetable synthesis engine that implements sequencer.VoiceEngine.
@@ -90,14 +97,17 @@ type Engine struct {
 	portamentoFrames int
 	lpfL             float64
 	lpfR             float64
-	bpfL             float64
-	bpfR             float64
 	lpfAlpha         float64
-	baseLPFCutoff    float64
-	filterKind       filterType
-	pitchLFO         lfo.LFO
-	ampLFO           lfo.LFO
-	filterLFO        lfo.LFO
+	mix              []float64 // RenderBlock voice sums, reused
+	allocator        alloc.Allocator
+	pitchLFO         lfo.Shape // latched by the next NoteOn
+	ampLFO           lfo.Shape
+	filterLFO        lfo.Shape
+	filterEnv        filter.Envelope // latched by the next NoteOn
+	pipes            pipe.Route      // latched by the next NoteOn
+	bus              *pipe.Bus
+	releaseSec       float64 // latched by the next NoteOn, 0 = ReleaseSec
+	sweep            float64
 }
 
 // New creates a wavetable engine at the given sample rate.
@@ -113,12 +123,12 @@ func New(sampleRate int, params Params) *Engine {
 		params:     params,
 		voices:     make([]voice, params.Polyphony),
 		masterGain: math.Float64bits(params.MasterGain),
+		filterEnv:  filter.Open,
 	}
 	if params.LPFCutoff > 0 && params.LPFCutoff < float64(sampleRate)/2 {
 		rc := 1.0 / (twoPi * params.LPFCutoff)
 		dt := 1.0 / float64(sampleRate)
 		e.lpfAlpha = dt / (rc + dt)
-		e.baseLPFCutoff = params.LPFCutoff
 	}
 	// Install a default sine wavetable in slot 0.
 	sine := make([]float64, 64)
@@ -142,7 +152,7 @@ func (e *Engine) SetWavetable(slot int, samples []float64) {
 
 // NoteOn starts a voice. The low byte of program selects the wavetable slot.
 func (e *Engine) NoteOn(note int, velocity int, pan int, encodedProgram int) int {
-	slot := e.stealVoice()
+	slot := e.allocator.Pick(len(e.voices), e.allocVoice, e.stealVoice)
 	id := e.nextID
 	e.nextID++
 
@@ -189,12 +199,21 @@ func (e *Engine) NoteOn(note int, velocity int, pan int, encodedProgram int) int
 		phase:            phase,
 		env:              0,
 		envState:         envAttack,
-		pan:              p,
 		slot:             tableSlot,
 		portamentoTarget: portTgt,
 		portamentoFrames: portFrames,
 		portamentoStep:   portStep,
+		gain:             1,
+		pitchMul:         1,
 	}
+	v.setPan(p)
+	v.pitchMod.Start(e.pitchLFO)
+	v.ampMod.Start(e.ampLFO)
+	v.filterMod.Start(e.filterLFO)
+	v.vcf.Start(e.filterEnv)
+	v.pipes = e.pipes
+	v.owner = e.allocator.Owner()
+	v.releaseSec, v.sweep, v.swept = e.releaseSec, e.sweep, 0
 	return id
 }
 
@@ -204,115 +223,211 @@ func (e *Engine) NoteOff(id int) {
 		v := &e.voices[i]
 		if v.active && v.id == id && v.envState != envRelease {
 			v.envState = envRelease
+			v.vcf.Release()
 		}
 	}
 }
 
-// RenderFrame produces one stereo sample pair.
-func (e *Engine) RenderFrame() (float32, float32) {
-	pitchMod := e.pitchLFO.Sample(e.sampleRate)
-	ampMod := e.ampLFO.Sample(e.sampleRate)
-	filterMod := e.filterLFO.Sample(e.sampleRate)
+// voiceByID returns the sounding voice with the given id, or nil.
+func (e *Engine) voiceByID(id int) *voice {
+	for i := range e.voices {
+		if v := &e.voices[i]; v.active && v.id == id {
+			return v
+		}
+	}
+	return nil
+}
+
+// VoiceActive reports whether the voice with the given id is still sounding.
+func (e *Engine) VoiceActive(id int) bool {
+	return e.voiceByID(id) != nil
+}
+
+// Legato moves the sounding voice id to note and velocity for a mono track,
+// gliding over frames, and gives it the latched release, sweep, pipes and
+// owner. With retrigger, or once the voice is released, its envelopes attack
+// again from their current level and its LFOs and filter restart from the
+// latched shapes. It reports false when the voice has finished.
+func (e *Engine) Legato(id, note, velocity, frames int, retrigger bool) bool {
+	v := e.voiceByID(id)
+	if v == nil {
+		return false
+	}
+	v.velocity = clamp(float64(velocity)/127.0, 0, 1)
+	v.glide(midiToFreq(note), frames)
+	v.pipes, v.owner = e.pipes, e.allocator.Owner()
+	v.releaseSec, v.sweep = e.releaseSec, e.sweep
+	if retrigger || v.envState == envRelease {
+		v.envState, v.swept = envAttack, 0
+		v.pitchMod.Start(e.pitchLFO)
+		v.ampMod.Start(e.ampLFO)
+		v.filterMod.Start(e.filterLFO)
+		v.vcf.Retrigger(e.filterEnv)
+	}
+	return true
+}
 
-	freqMul := 1.0
-	if pitchMod != 0 {
-		freqMul = math.Pow(2, pitchMod/12.0)
+// SetVoicePitch offsets a sounding voice from its NoteOn note, in semitones.
+func (e *Engine) SetVoicePitch(id int, semitones float64) {
+	if v := e.voiceByID(id); v != nil {
+		v.pitchMul = math.Pow(2, semitones/12.0)
 	}
+}
 
+// SetVoiceGain scales a sounding voice's level; 1 leaves it unchanged.
+func (e *Engine) SetVoiceGain(id int, gain float64) {
+	if v := e.voiceByID(id); v != nil {
+		v.gain = math.Max(gain, 0)
+	}
+}
+
+// SetVoicePan moves a sounding voice: -64=left, 64=right.
+func (e *Engine) SetVoicePan(id int, pan int) {
+	if v := e.voiceByID(id); v != nil {
+		v.setPan(clamp(float64(pan), -64, 64))
+	}
+}
+
+// SetVoiceFilter sets a sounding voice's lowpass cutoff, 0-128 (128 = open).
+func (e *Engine) SetVoiceFilter(id int, cutoff int) {
+	if v := e.voiceByID(id); v != nil {
+		v.vcf.Hold(float64(cutoff))
+	}
+}
+
+// RenderFrame produces one stereo sample pair.
+func (e *Engine) RenderFrame() (float32, float32) {
 	var l, r float64
+	gain := e.masterGainValue()
 	for i := range e.voices {
-		v := &e.voices[i]
-		if !v.active {
-			continue
-		}
-
-		env := e.advanceEnv(v)
-		if !v.active {
-			continue
+		if vl, vr, ok := e.stepVoice(&e.voices[i], gain); ok {
+			l += vl
+			r += vr
 		}
+	}
+	return e.output(l, r)
+}
 
-		table := e.tables[v.slot]
-		if len(table) == 0 {
-			continue
-		}
-		tableLen := float64(len(table))
-
-		// Linear interpolation between adjacent samples.
-		idx := math.Floor(v.phase)
-		frac := v.phase - idx
-		i0 := int(idx) % len(table)
-		if i0 < 0 {
-			i0 += len(table)
-		}
-		i1 := (i0 + 1) % len(table)
-		sig := table[i0]*(1-frac) + table[i1]*frac
-
-		sig *= env * e.masterGainValue() * (0.2 + v.velocity*e.params.VelocityAmp)
-		// Apply amp LFO
-		sig *= (1.0 + ampMod)
-
-		// Equal-power stereo panning.
-		angle := ((v.pan + 64.0) / 128.0) * (math.Pi / 2.0)
-		leftGain := math.Cos(angle)
-		rightGain := math.Sin(angle)
-		l += sig * leftGain
-		r += sig * rightGain
-
-		// Portamento.
-		if v.portamentoFrames > 0 {
-			v.portamentoFrames--
-			v.freq += v.portamentoStep
-			if v.portamentoFrames <= 0 {
-				v.freq = v.portamentoTarget
+// RenderBlock renders len(dst)/2 frames into interleaved stereo dst, the
+// same as calling RenderFrame for each, one voice at a time over the block.
+func (e *Engine) RenderBlock(dst []float32) {
+	n := len(dst) / 2
+	if cap(e.mix) < n*2 {
+		e.mix = make([]float64, n*2)
+	}
+	mix := e.mix[:n*2]
+	clear(mix)
+	gain := e.masterGainValue()
+	for i := range e.voices {
+		v := &e.voices[i]
+		for f := 0; f < n && v.active; f++ {
+			if l, r, ok := e.stepVoice(v, gain); ok {
+				mix[f*2] += l
+				mix[f*2+1] += r
 			}
 		}
+	}
+	for f := 0; f < n; f++ {
+		dst[f*2], dst[f*2+1] = e.output(mix[f*2], mix[f*2+1])
+	}
+}
 
-		// Advance phase with pitch LFO modulation
-		v.phase += v.freq * freqMul * tableLen / e.sampleRate
-		for v.phase >= tableLen {
-			v.phase -= tableLen
-		}
-		for v.phase < 0 {
-			v.phase += tableLen
-		}
+// stepVoice renders one frame of v and advances it. Master gain applies to
+// what reaches the mix, not to pipe output. ok is false when the voice is
+// silent or its output went to a pipe.
+func (e *Engine) stepVoice(v *voice, gain float64) (l, r float64, ok bool) {
+	if !v.active {
+		return 0, 0, false
 	}
 
-	// Filter LFO
-	if e.baseLPFCutoff > 0 && filterMod != 0 {
-		cutoff := e.baseLPFCutoff + filterMod*100.0
-		if cutoff < 20 {
-			cutoff = 20
-		}
-		if cutoff > e.sampleRate/2 {
-			cutoff = e.sampleRate / 2
+	env := e.advanceEnv(v)
+	if !v.active {
+		return 0, 0, false
+	}
+
+	table := e.tables[v.slot]
+	if len(table) == 0 {
+		return 0, 0, false
+	}
+	tableLen := float64(len(table))
+
+	// Linear interpolation between adjacent samples.
+	idx := math.Floor(v.phase)
+	frac := v.phase - idx
+	i0 := int(idx) % len(table)
+	if i0 < 0 {
+		i0 += len(table)
+	}
+	i1 := (i0 + 1) % len(table)
+	sig := table[i0]*(1-frac) + table[i1]*frac
+
+	sig *= env * (0.2 + v.velocity*e.params.VelocityAmp)
+	// Apply amp LFO
+	sig *= (1.0 + v.ampMod.Sample(e.sampleRate))
+	sig = v.vcf.Process(sig*v.gain, v.filterMod.Sample(e.sampleRate), e.sampleRate)
+	sig = v.pipes.Ring(e.bus, sig)
+
+	// Equal-power stereo panning, unless the output goes to a pipe.
+	if !v.pipes.Send(e.bus, sig) {
+		l, r, ok = sig*gain*v.panL, sig*gain*v.panR, true
+	}
+
+	// Portamento.
+	if v.portamentoFrames > 0 {
+		v.portamentoFrames--
+		v.freq += v.portamentoStep
+		if v.portamentoFrames <= 0 {
+			v.freq = v.portamentoTarget
 		}
-		rc := 1.0 / (twoPi * cutoff)
-		dt := 1.0 / e.sampleRate
-		e.lpfAlpha = dt / (rc + dt)
 	}
 
-	// Filter.
+	// Advance phase with pitch LFO modulation
+	freqMul := v.pitchMul
+	if pitchMod := v.pitchMod.Sample(e.sampleRate); pitchMod != 0 {
+		freqMul *= math.Pow(2, pitchMod/12.0)
+	}
+	if v.envState == envRelease && v.sweep != 0 {
+		v.swept += v.sweep / e.sampleRate
+		freqMul *= math.Pow(2, v.swept/12.0)
+	}
+	v.phase += v.freq * freqMul * tableLen / e.sampleRate
+	for v.phase >= tableLen {
+		v.phase -= tableLen
+	}
+	for v.phase < 0 {
+		v.phase += tableLen
+	}
+	return l, r, ok
+}
+
+// output filters a mixed frame and clamps it.
+func (e *Engine) output(l, r float64) (float32, float32) {
 	if e.lpfAlpha > 0 {
 		e.lpfL += e.lpfAlpha * (l - e.lpfL)
 		e.lpfR += e.lpfAlpha * (r - e.lpfR)
-		switch e.filterKind {
-		case filterLP:
-			l = e.lpfL
-			r = e.lpfR
-		case filterHP:
-			l = l - e.lpfL
-			r = r - e.lpfR
-		case filterBP:
-			e.bpfL += e.lpfAlpha * (e.lpfL - e.bpfL)
-			e.bpfR += e.lpfAlpha * (e.lpfR - e.bpfR)
-			l = e.lpfL - e.bpfL
-			r = e.lpfR - e.bpfR
-		}
+		l = e.lpfL
+		r = e.lpfR
 	}
-
 	return float32(clamp(l, -1, 1)), float32(clamp(r, -1, 1))
 }
 
+// setPan sets the voice's pan and its equal-power channel gains.
+func (v *voice) setPan(pan float64) {
+	v.pan = pan
+	angle := ((pan + 64.0) / 128.0) * (math.Pi / 2.0)
+	v.panL, v.panR = math.Cos(angle), math.Sin(angle)
+}
+
+// glide moves the voice to freq over frames, at once when frames is 0.
+func (v *voice) glide(freq float64, frames int) {
+	if frames <= 0 {
+		v.freq, v.portamentoFrames = freq, 0
+		return
+	}
+	v.portamentoTarget, v.portamentoFrames = freq, frames
+	v.portamentoStep = (freq - v.freq) / float64(frames)
+}
+
 // SetMasterGain sets the master gain atomically.
 func (e *Engine) SetMasterGain(gain float64) {
 	if gain < 0 {
@@ -332,19 +447,28 @@ func (e *Engine) ActiveVoiceCount() int {
 	return n
 }
 
-// SetFilterType sets the output filter mode: 0=LP, 1=BP, 2=HP.
-func (e *Engine) SetFilterType(ft int) {
-	switch ft {
-	case 1:
-		e.filterKind = filterBP
-	case 2:
-		e.filterKind = filterHP
-	default:
-		e.filterKind = filterLP
-	}
+// SetFilter sets the @f envelope and %f mode for subsequent NoteOns.
+func (e *Engine) SetFilter(env filter.Envelope) {
+	e.filterEnv = env
 }
 
 // SetNoteOnPhase sets the phase for the next NoteOn: 0=reset, -1=random, 1-255=fixed.
+// SetBus sets the bus the @o/@r pipes read and write.
+func (e *Engine) SetBus(b *pipe.Bus) {
+	e.bus = b
+}
+
+// SetPipes sets the bus pipe routing for subsequent NoteOns.
+func (e *Engine) SetPipes(r pipe.Route) {
+	e.pipes = r
+}
+
+// SetRelease sets the release time in seconds for subsequent NoteOns, 0 for
+// ReleaseSec, and the pitch sweep after key-off in semitones per second.
+func (e *Engine) SetRelease(seconds, sweep float64) {
+	e.releaseSec, e.sweep = seconds, sweep
+}
+
 func (e *Engine) SetNoteOnPhase(phase int) {
 	e.nextPhase = phase
 }
@@ -355,16 +479,16 @@ func (e *Engine) SetPortamento(fromNote int, frames int) {
 	e.portamentoFrames = frames
 }
 
-func (e *Engine) SetPitchLFO(depth float64, rateHz float64, waveform int) {
-	e.pitchLFO.Set(depth, rateHz, waveform)
+func (e *Engine) SetPitchLFO(shape lfo.Shape) {
+	e.pitchLFO = shape
 }
 
-func (e *Engine) SetAmpLFO(depth float64, rateHz float64, waveform int) {
-	e.ampLFO.Set(depth, rateHz, waveform)
+func (e *Engine) SetAmpLFO(shape lfo.Shape) {
+	e.ampLFO = shape
 }
 
-func (e *Engine) SetFilterLFO(depth float64, rateHz float64, waveform int) {
-	e.filterLFO.Set(depth, rateHz, waveform)
+func (e *Engine) SetFilterLFO(shape lfo.Shape) {
+	e.filterLFO = shape
 }
 
 // LoadWAVBFromDefs loads #WAVB definitions from parsed score definitions into
@@ -417,6 +541,27 @@ func (e *Engine) masterGainValue() float64 {
 	return math.Float64frombits(atomic.LoadUint64(&e.masterGain))
 }
 
+// allocVoice describes voice i to the allocator.
+func (e *Engine) allocVoice(i int) alloc.Voice {
+	v := &e.voices[i]
+	return alloc.Voice{Active: v.active, Released: v.envState == envRelease, Start: v.id, Level: v.env, Owner: v.owner}
+}
+
+// SetVoicePolicy sets which voice a note steals when all are sounding.
+func (e *Engine) SetVoicePolicy(p alloc.Policy) {
+	e.allocator.SetPolicy(p)
+}
+
+// SetVoiceOwner sets the track the next NoteOn plays for.
+func (e *Engine) SetVoiceOwner(o alloc.Owner) {
+	e.allocator.SetOwner(o)
+}
+
+// VoiceStats returns how many voices notes have stolen.
+func (e *Engine) VoiceStats() alloc.Stats {
+	return e.allocator.Stats()
+}
+
 func (e *Engine) stealVoice() int {
 	for i := range e.voices {
 		if !e.voices[i].active {
@@ -459,7 +604,11 @@ func (e *Engine) advanceEnv(v *voice) float64 {
 	case envSustain:
 		// hold
 	case envRelease:
-		step := e.params.SustainLvl / (e.params.ReleaseSec * e.sampleRate)
+		release := v.releaseSec
+		if release <= 0 {
+			release = e.params.ReleaseSec
+		}
+		step := e.params.SustainLvl / (release * e.sampleRate)
 		if step <= 0 {
 			step = 1
 		}
@@ -0,0 +1,89 @@
+package mmlfm
+
+import intseq "github.com/cbegin/mmlfm-go/internal/sequencer"
+
+// LiveChannels is the number of live channels.
+const LiveChannels = intseq.LiveChannels
+
+// LiveKind identifies a live event.
+type LiveKind = intseq.LiveKind
+
+const (
+	LiveNoteOn    = intseq.LiveNoteOn    // play Note at Velocity; velocity 0 releases it
+	LiveNoteOff   = intseq.LiveNoteOff   // release Note
+	LiveProgram   = intseq.LiveProgram   // select program Value for later notes
+	LivePan       = intseq.LivePan       // pan the channel's notes to Value, -64 to 64
+	LivePitchBend = intseq.LivePitchBend // bend the channel's notes by Bend semitones
+)
+
+// LiveEvent is a note or control for a live channel. Frame is the output
+// frame, counted like RenderedFrame, that the audio thread plays it at;
+// frames already rendered play at the start of the next buffer.
+type LiveEvent = intseq.LiveEvent
+
+// liveQueueSize is how many live events can wait for the audio thread.
+const liveQueueSize = 1024
+
+// SendLive queues a live event for the playing score's engine, mixed with
+// its tracks. It is safe to call from any goroutine and does not block the
+// audio thread; it reports false when the event was dropped because the
+// queue is full. Live notes only sound while a score plays, and Play drops
+// the events still queued. Channel programs, pans and bends carry over to
+// the next Play.
+func (p *Player) SendLive(ev LiveEvent) bool {
+	if ev.Channel < 0 || ev.Channel >= LiveChannels {
+		return false
+	}
+	p.mu.Lock()
+	ch := &p.liveChannels[ev.Channel]
+	switch ev.Kind {
+	case LiveProgram:
+		ch.Program = ev.Value
+	case LivePan:
+		ch.Pan = ev.Value
+	case LivePitchBend:
+		ch.Bend = ev.Bend
+	}
+	p.mu.Unlock()
+	return p.live.Push(ev)
+}
+
+// NoteOn plays note (0-127) at velocity (1-127) on a live channel with its
+// program, pan and pitch bend, replacing the note if it is already held.
+func (p *Player) NoteOn(channel, note, velocity int) {
+	p.SendLive(LiveEvent{Kind: LiveNoteOn, Channel: channel, Note: note, Velocity: velocity})
+}
+
+// NoteOff releases a note held on a live channel.
+func (p *Player) NoteOff(channel, note int) {
+	p.SendLive(LiveEvent{Kind: LiveNoteOff, Channel: channel, Note: note})
+}
+
+// ProgramChange selects the program, as with @, that a live channel's later
+// notes play.
+func (p *Player) ProgramChange(channel, program int) {
+	p.SendLive(LiveEvent{Kind: LiveProgram, Channel: channel, Value: program})
+}
+
+// SetChannelPan pans a live channel's notes: -64=left, 0=center, 64=right.
+func (p *Player) SetChannelPan(channel, pan int) {
+	p.SendLive(LiveEvent{Kind: LivePan, Channel: channel, Value: pan})
+}
+
+// PitchBend bends a live channel's notes, held and later ones, by semitones.
+func (p *Player) PitchBend(channel int, semitones float64) {
+	p.SendLive(LiveEvent{Kind: LivePitchBend, Channel: channel, Bend: semitones})
+}
+
+// RenderedFrame returns how many frames the playing score has rendered, the
+// time base of LiveEvent.Frame. It runs ahead of PlaybackPosition by the
+// output latency. Returns 0 if not playing.
+func (p *Player) RenderedFrame() int64 {
+	p.mu.Lock()
+	seq := p.seq
+	p.mu.Unlock()
+	if seq == nil {
+		return 0
+	}
+	return seq.Frame()
+}
@@ -32,6 +32,7 @@ func RenderSamplesChiptune(score *intmml.Score, sampleRate int, seconds float64)
 
 func RenderSamplesNESAPU(score *intmml.Score, sampleRate int, seconds float64) []float32 {
 	engine := intnes.New(sampleRate, intnes.DefaultParams())
+	engine.LoadDPCMFromDefs(score.Definitions)
 	seq := intseq.New(score, engine, sampleRate)
 	frames := int(float64(sampleRate) * seconds)
 	out := make([]float32, frames*2)
@@ -48,6 +49,27 @@ func RenderSamplesWavetable(score *intmml.Score, sampleRate int, seconds float64
 	return out
 }
 
+// RenderScore renders score offline on the engines a Player in mode would
+// use, one per module the score selects with %. With parallel set those
+// engines render concurrently; tracks share the sequencer's tempo and
+// voices, so it stays on one goroutine. The output is the same either way.
+// Like RenderSamples, #EFFECT chains are not applied.
+func RenderScore(score *intmml.Score, mode SynthMode, sampleRate int, seconds float64, parallel bool) ([]float32, error) {
+	engine, multi, _, err := newScoreEngine(score, mode, sampleRate, voiceConfig{}, 1)
+	if err != nil {
+		return nil, err
+	}
+	if multi != nil && parallel {
+		multi.SetParallel(true)
+		defer multi.Close()
+	}
+	seq := intseq.New(score, engine, sampleRate)
+	frames := int(float64(sampleRate) * seconds)
+	out := make([]float32, frames*2)
+	seq.Process(out)
+	return out, nil
+}
+
 func EncodeWAVFloat32LE(samples []float32, sampleRate int, channels int) []byte {
 	dataSize := len(samples) * 4
 	byteRate := sampleRate * channels * 4
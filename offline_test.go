@@ -61,3 +61,23 @@ func TestGoldenWAVSnapshot(t *testing.T) {
 		})
 	}
 }
+
+func TestRenderScoreInParallelMatchesSerial(t *testing.T) {
+	score, err := Compile("t140 o5 l8 cdefgab>c<c; %1 o4 l4 cgec; %4 o3 l2 c>c; %6 o6 l16 @7 cc")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	serial, err := RenderScore(score, SynthModeFM, 48000, 1.2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parallel, err := RenderScore(score, SynthModeFM, 48000, 1.2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range serial {
+		if serial[i] != parallel[i] {
+			t.Fatalf("parallel render differs at sample %d: %f != %f", i, parallel[i], serial[i])
+		}
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	intalloc "github.com/cbegin/mmlfm-go/internal/alloc"
 	intaudio "github.com/cbegin/mmlfm-go/internal/audio"
 	intchip "github.com/cbegin/mmlfm-go/internal/chiptune"
 	intfx "github.com/cbegin/mmlfm-go/internal/effects"
@@ -23,6 +25,8 @@ type PlaybackEvent struct {
 	TriggerID   int
 	NoteOnType  int
 	NoteOffType int
+	Track       int    // EventTrigger: index of the track that fired it
+	TrackName   string // EventTrigger: that track's name, if any
 }
 
 const (
@@ -46,6 +50,10 @@ type playerConfig struct {
 	mode         SynthMode
 	loopPlayback bool
 	sampleTap    func([]float32)
+	groove       Groove
+	trackGrooves map[int]Groove
+	voices       voiceConfig
+	trackVoices  map[int]TrackVoices
 }
 
 func defaultPlayerConfig() playerConfig {
@@ -72,19 +80,99 @@ func WithSampleTap(tap func([]float32)) PlayerOption {
 	}
 }
 
+// Groove is a swing or timing template: Swing 58 pushes every second
+// sixteenth late, Offsets moves each step of the grid by its own amount, and
+// Humanize adds a random shift that repeats with the same Seed.
+type Groove = intseq.Groove
+
+// WithGroove plays every track of the score with the groove g.
+func WithGroove(g Groove) PlayerOption {
+	return func(cfg *playerConfig) {
+		cfg.groove = g
+	}
+}
+
+// WithTrackGroove plays the track at index track with g in place of the
+// WithGroove template.
+func WithTrackGroove(track int, g Groove) PlayerOption {
+	return func(cfg *playerConfig) {
+		if cfg.trackGrooves == nil {
+			cfg.trackGrooves = map[int]Groove{}
+		}
+		cfg.trackGrooves[track] = g
+	}
+}
+
+// VoicePolicy picks which voice a note steals once every voice is sounding.
+type VoicePolicy = intalloc.Policy
+
+const (
+	VoiceStealDefault      = intalloc.Default      // the engine's own choice
+	VoiceStealOldest       = intalloc.Oldest       // the voice that started first
+	VoiceStealQuietest     = intalloc.Quietest     // the voice with the lowest level
+	VoiceStealSameTrack    = intalloc.SameTrack    // the track's own oldest voice first
+	VoiceStealReleaseFirst = intalloc.ReleaseFirst // the oldest voice in its release first
+)
+
+// TrackVoices reserves voices for a track and sets its steal priority.
+type TrackVoices = intseq.TrackVoices
+
+// VoiceStats counts the voices notes have stolen; steals of sounding voices
+// mean the score needs more polyphony.
+type VoiceStats = intalloc.Stats
+
+// voiceConfig is the voice setup every engine of a Play is built with.
+type voiceConfig struct {
+	polyphony int // 0 = the engine's default
+	policy    VoicePolicy
+}
+
+// WithPolyphony sets how many voices the FM, chiptune and wavetable engines
+// have. The NES APU engine keeps its fixed channels.
+func WithPolyphony(voices int) PlayerOption {
+	return func(cfg *playerConfig) {
+		cfg.voices.polyphony = voices
+	}
+}
+
+// WithVoicePolicy sets which voice a note steals when all are sounding.
+func WithVoicePolicy(policy VoicePolicy) PlayerOption {
+	return func(cfg *playerConfig) {
+		cfg.voices.policy = policy
+	}
+}
+
+// WithTrackVoices reserves voices and sets the steal priority for the track
+// at index track.
+func WithTrackVoices(track int, v TrackVoices) PlayerOption {
+	return func(cfg *playerConfig) {
+		if cfg.trackVoices == nil {
+			cfg.trackVoices = map[int]TrackVoices{}
+		}
+		cfg.trackVoices[track] = v
+	}
+}
+
 type Player struct {
 	mu           sync.Mutex
-	parser       *intmml.Parser
+	parser       *intmml.IncrementalParser
 	sampleRate   int
 	mode         SynthMode
 	engine       intseq.VoiceEngine
+	seq          *intseq.Sequencer
 	audio        *intaudio.Player
 	baseGain     float64
 	volume       float64
 	transpose    int
 	loopPlayback bool
 	sampleTap    func([]float32)
+	groove       Groove
+	trackGrooves map[int]Groove
+	voices       voiceConfig
+	trackVoices  map[int]TrackVoices
 	masterEQ     *intfx.EQ5Band
+	live         *intseq.LiveQueue
+	liveChannels [LiveChannels]intseq.LiveChannel
 	done         chan struct{}
 	eventCh      chan PlaybackEvent
 	eventChMu    sync.Mutex
@@ -131,13 +219,13 @@ func NewPlayer(sampleRate int, opts ...PlayerOption) (*Player, error) {
 	for _, opt := range opts {
 		opt(&cfg)
 	}
-	engine, baseGain, err := newEngineForMode(cfg.mode, sampleRate)
+	engine, baseGain, err := newEngineForMode(cfg.mode, sampleRate, cfg.voices.polyphony)
 	if err != nil {
 		return nil, err
 	}
 	engine.SetMasterGain(baseGain)
 	return &Player{
-		parser:       intmml.NewParser(intmml.DefaultParserConfig()),
+		parser:       intmml.NewIncrementalParser(intmml.DefaultParserConfig()),
 		sampleRate:   sampleRate,
 		mode:         cfg.mode,
 		engine:       engine,
@@ -145,7 +233,12 @@ func NewPlayer(sampleRate int, opts ...PlayerOption) (*Player, error) {
 		volume:       1,
 		loopPlayback: cfg.loopPlayback,
 		sampleTap:    cfg.sampleTap,
+		groove:       cfg.groove,
+		trackGrooves: cfg.trackGrooves,
+		voices:       cfg.voices,
+		trackVoices:  cfg.trackVoices,
 		masterEQ:     intfx.NewEQ5Band(sampleRate),
+		live:         intseq.NewLiveQueue(liveQueueSize),
 	}, nil
 }
 
@@ -153,6 +246,83 @@ func Compile(mmlText string) (*intmml.Score, error) {
 	return intmml.NewParser(intmml.DefaultParserConfig()).Parse(mmlText)
 }
 
+// ParserLimits caps expanded length, event count, loop nesting and macro
+// depth. Compile applies DefaultParserLimits; a zero field means the default
+// and a negative one disables that limit.
+type ParserLimits = intmml.ParserLimits
+
+// LimitError is returned when input exceeds a ParserLimits field. Its Err is
+// one of ErrExpandedLen, ErrEventCount, ErrLoopDepth or ErrMacroDepth.
+type LimitError = intmml.LimitError
+
+var (
+	ErrExpandedLen = intmml.ErrExpandedLen
+	ErrEventCount  = intmml.ErrEventCount
+	ErrLoopDepth   = intmml.ErrLoopDepth
+	ErrMacroDepth  = intmml.ErrMacroDepth
+)
+
+func DefaultParserLimits() ParserLimits { return intmml.DefaultParserLimits() }
+
+// CompileWithLimits is Compile with explicit resource limits, for MML from
+// untrusted sources.
+func CompileWithLimits(mmlText string, limits ParserLimits) (*intmml.Score, error) {
+	cfg := intmml.DefaultParserConfig()
+	cfg.Limits = limits
+	return intmml.NewParser(cfg).Parse(mmlText)
+}
+
+// CompileMCK compiles ppmck/MCK source. Tracks A-E are pinned to the NES APU
+// pulse, triangle, noise and DPCM channels, so play the result with
+// SynthModeNESAPU. load reads the files named by #INCLUDE and @DPCM.
+func CompileMCK(mmlText string, load func(name string) ([]byte, error)) (*intmml.Score, error) {
+	return intmml.NewParser(intmml.DefaultParserConfig()).ParseMCK(mmlText, load)
+}
+
+// CompileMDX compiles mxdrv (MDX) MML. Tracks A-H play on the FM module and
+// the returned OPM patches, keyed by voice number, are in the layout
+// fm.Engine.LoadOPMPatch takes. The score's definitions carry the same voices
+// as #OPM@ tables, so Play loads them without further setup.
+func CompileMDX(mmlText string) (*intmml.Score, map[int][]int, error) {
+	return intmml.NewParser(intmml.DefaultParserConfig()).ParseMDX(mmlText)
+}
+
+// Preprocess expands macros and #REV the way Compile does and returns each
+// track's resulting text, annotated with the macro calls that produced it and
+// the #REV and #SIGN settings applied. Its String method renders a dump.
+func Preprocess(mmlText string) *intmml.PreprocessTrace {
+	return intmml.TracePreprocess(mmlText)
+}
+
+// ResolveExpressions returns mmlText with #VAR directives removed and each
+// {expression} replaced by its value, for players without variable support.
+func ResolveExpressions(mmlText string) (string, error) {
+	return intmml.ResolveExpressions(mmlText)
+}
+
+// Serialize renders a compiled Score back into MML text. Compiling the result
+// yields the same event stream, so transformed scores can be saved.
+func Serialize(score *intmml.Score) string {
+	return intmml.Serialize(score)
+}
+
+// Duration returns how long a score takes to play once through, following
+// its tempo changes and ramps. Loops play once and release tails are not
+// counted.
+func Duration(score *intmml.Score) time.Duration {
+	return time.Duration(score.Duration() * float64(time.Second))
+}
+
+// Format rewrites MML source in canonical layout (normalized spacing, one bar
+// per line, aligned #OPM@ tables) while keeping comments. The result compiles
+// to the same Score.
+func Format(mmlText string) (string, error) {
+	return intmml.Format(mmlText)
+}
+
+// PlayMML compiles and plays mmlText. The player keeps the previous parse, so
+// playing an edited version of the same text only re-parses the sections and
+// tracks that changed.
 func (p *Player) PlayMML(mmlText string) error {
 	score, err := p.parser.Parse(mmlText)
 	if err != nil {
@@ -182,60 +352,30 @@ func (p *Player) Play(score *intmml.Score) error {
 		}
 	}
 	wrapper.onTrigger = func(te intseq.TriggerEvent) {
-		p.sendEvent(PlaybackEvent{Kind: EventTrigger, TriggerID: te.TriggerID, NoteOnType: te.NoteOnType, NoteOffType: te.NoteOffType})
+		p.sendEvent(PlaybackEvent{Kind: EventTrigger, TriggerID: te.TriggerID, NoteOnType: te.NoteOnType, NoteOffType: te.NoteOffType, Track: te.Track, TrackName: te.TrackName})
 	}
 
-	// Recreate the base engine on every Play to avoid voice/envelope state
+	// Recreate the engines on every Play to avoid voice/envelope state
 	// leaking between songs.
-	baseEngine, baseGain, err := newEngineForMode(p.mode, p.sampleRate)
+	engine, _, baseGain, err := newScoreEngine(score, p.mode, p.sampleRate, p.voices, p.volume)
 	if err != nil {
 		return err
 	}
-	baseEngine.SetMasterGain(baseGain * p.volume)
-	p.engine = baseEngine
+	p.engine = engine
 	p.baseGain = baseGain
 
-	engine := baseEngine
-	usedMods := scoreUsedModules(score)
-	if len(usedMods) > 1 {
-		multi := intseq.NewMultiEngine(0, p.sampleRate)
-		defaultEng, defaultGain := baseEngine, baseGain
-		multi.AddEngine(0, defaultEng, defaultGain)
-		for mod := range usedMods {
-			if mod == 0 {
-				continue
-			}
-			e, g := engineForModule(mod, p.sampleRate, defaultEng, defaultGain)
-			multi.AddEngine(mod, e, g)
-		}
-		// Apply initial volume to all engines via the multi-engine scalar.
-		multi.SetMasterGain(p.volume)
-		p.engine = multi
-		p.baseGain = 1.0
-		for _, e := range multi.AllEngines() {
-			if fmEng, ok := e.(*intfm.Engine); ok && score.Definitions != nil {
-				fmEng.LoadOPMPatchFromDefs(score.Definitions)
-			}
-			if wtEng, ok := e.(*intwt.Engine); ok && score.Definitions != nil {
-				wtEng.LoadWAVBFromDefs(score.Definitions)
-			}
-		}
-		engine = multi
-	} else {
-		if fmEng, ok := baseEngine.(*intfm.Engine); ok && score.Definitions != nil {
-			fmEng.LoadOPMPatchFromDefs(score.Definitions)
-		}
-		if wtEng, ok := baseEngine.(*intwt.Engine); ok && score.Definitions != nil {
-			wtEng.LoadWAVBFromDefs(score.Definitions)
-		}
-	}
-
 	seq := intseq.NewWithOptions(score, engine, p.sampleRate, intseq.Options{
 		LoopWholeScore:  p.loopPlayback,
 		OnEvent:         wrapper.onEvent,
 		OnTrigger:       wrapper.onTrigger,
 		MasterTranspose: p.transpose,
+		Groove:          p.groove,
+		TrackGrooves:    p.trackGrooves,
+		TrackVoices:     p.trackVoices,
+		Live:            p.live,
+		LiveChannels:    p.liveChannels[:],
 	})
+	p.live.Clear()
 	wrapper.seq = seq
 	wrapper.effects = buildEffectChain(score.Definitions, p.sampleRate)
 	wrapper.masterEQ = p.masterEQ
@@ -249,23 +389,81 @@ func (p *Player) Play(score *intmml.Score) error {
 		_ = p.audio.Stop()
 	}
 	p.audio = backend
+	p.seq = seq
 	p.audio.Play()
 	return nil
 }
 
-func newEngineForMode(mode SynthMode, sampleRate int) (intseq.VoiceEngine, float64, error) {
+// newScoreEngine builds the engine score plays on at master volume: the
+// engine for mode, or a MultiEngine with one more engine per module the score
+// selects with %. Patches, wavetables and samples the score defines are
+// loaded into each. multi is nil for a single engine. baseGain is the gain
+// SetMasterGain multiplies by volume.
+func newScoreEngine(score *intmml.Score, mode SynthMode, sampleRate int, voices voiceConfig, volume float64) (engine intseq.VoiceEngine, multi *intseq.MultiEngine, baseGain float64, err error) {
+	baseEngine, baseGain, err := newEngineForMode(mode, sampleRate, voices.polyphony)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	baseEngine.SetMasterGain(baseGain * volume)
+	engines := []intseq.VoiceEngine{baseEngine}
+	engine = baseEngine
+	usedMods := scoreUsedModules(score)
+	if len(usedMods) > 1 {
+		multi = intseq.NewMultiEngine(0, sampleRate)
+		multi.AddEngine(0, baseEngine, baseGain)
+		for mod := range usedMods {
+			if mod == 0 {
+				continue
+			}
+			e, g := engineForModule(mod, sampleRate, voices.polyphony, baseEngine, baseGain)
+			multi.AddEngine(mod, e, g)
+		}
+		// Apply initial volume to all engines via the multi-engine scalar.
+		multi.SetMasterGain(volume)
+		engines = multi.AllEngines()
+		engine, baseGain = multi, 1.0
+	}
+	if score.Definitions != nil {
+		for _, e := range engines {
+			if fmEng, ok := e.(*intfm.Engine); ok {
+				fmEng.LoadOPMPatchFromDefs(score.Definitions)
+			}
+			if wtEng, ok := e.(*intwt.Engine); ok {
+				wtEng.LoadWAVBFromDefs(score.Definitions)
+			}
+			if nesEng, ok := e.(*intnes.Engine); ok {
+				nesEng.LoadDPCMFromDefs(score.Definitions)
+			}
+		}
+	}
+	if e, ok := engine.(interface{ SetVoicePolicy(intalloc.Policy) }); ok {
+		e.SetVoicePolicy(voices.policy)
+	}
+	return engine, multi, baseGain, nil
+}
+
+func newEngineForMode(mode SynthMode, sampleRate int, polyphony int) (intseq.VoiceEngine, float64, error) {
 	switch mode {
 	case SynthModeFM:
 		params := intfm.DefaultParams()
+		if polyphony > 0 {
+			params.Polyphony = polyphony
+		}
 		return intfm.New(sampleRate, params), params.MasterGain, nil
 	case SynthModeChiptune:
 		params := intchip.DefaultParams()
+		if polyphony > 0 {
+			params.Voices = polyphony
+		}
 		return intchip.New(sampleRate, params), params.MasterGain, nil
 	case SynthModeNESAPU:
 		params := intnes.DefaultParams()
 		return intnes.New(sampleRate, params), params.MasterGain, nil
 	case SynthModeWavetable:
 		params := intwt.DefaultParams()
+		if polyphony > 0 {
+			params.Polyphony = polyphony
+		}
 		return intwt.New(sampleRate, params), params.MasterGain, nil
 	default:
 		return nil, 0, errors.New("unknown synth mode")
@@ -319,6 +517,7 @@ func (p *Player) Stop() error {
 	}
 	err := p.audio.Stop()
 	p.audio = nil
+	p.seq = nil
 	done := p.done
 	p.done = nil
 	p.mu.Unlock()
@@ -414,6 +613,18 @@ func (p *Player) PlaybackPosition() int64 {
 	return int64(pos.Seconds() * float64(p.sampleRate))
 }
 
+// VoiceStats returns how many voices notes of the current score have
+// stolen. It is safe to call while playing.
+func (p *Player) VoiceStats() VoiceStats {
+	p.mu.Lock()
+	e := p.engine
+	p.mu.Unlock()
+	if ve, ok := e.(interface{ VoiceStats() VoiceStats }); ok {
+		return ve.VoiceStats()
+	}
+	return VoiceStats{}
+}
+
 // buildEffectChain parses #EFFECT directives from score definitions and builds
 // an effect chain. Supports: delay, reverb, chorus, distortion, eq, compressor.
 // Format: #EFFECT0{type param1,param2,...}
@@ -474,17 +685,17 @@ func scoreUsedModules(score *intmml.Score) map[int]struct{} {
 	return mods
 }
 
-func engineForModule(module int, sampleRate int, defaultEng intseq.VoiceEngine, defaultGain float64) (intseq.VoiceEngine, float64) {
+func engineForModule(module int, sampleRate int, polyphony int, defaultEng intseq.VoiceEngine, defaultGain float64) (intseq.VoiceEngine, float64) {
 	switch module {
 	case 1, 8:
-		params := intchip.DefaultParams()
-		return intchip.New(sampleRate, params), params.MasterGain
+		e, g, _ := newEngineForMode(SynthModeChiptune, sampleRate, polyphony)
+		return e, g
 	case 4:
-		params := intwt.DefaultParams()
-		return intwt.New(sampleRate, params), params.MasterGain
+		e, g, _ := newEngineForMode(SynthModeWavetable, sampleRate, polyphony)
+		return e, g
 	case 6:
-		params := intfm.DefaultParams()
-		return intfm.New(sampleRate, params), params.MasterGain
+		e, g, _ := newEngineForMode(SynthModeFM, sampleRate, polyphony)
+		return e, g
 	case 0:
 		return defaultEng, defaultGain
 	default:
@@ -1,6 +1,10 @@
 package mmlfm
 
-import "testing"
+import (
+	"testing"
+
+	intseq "github.com/cbegin/mmlfm-go/internal/sequencer"
+)
 
 func TestPlayerMasterVolumeRuntimeAPI(t *testing.T) {
 	pl, err := NewPlayer(48000)
@@ -19,3 +23,37 @@ func TestPlayerMasterVolumeRuntimeAPI(t *testing.T) {
 		t.Fatalf("master volume should clamp to 0, got %v", got)
 	}
 }
+
+func TestScoreEngineCountsStealsBeyondPolyphony(t *testing.T) {
+	score, err := Compile("o4 c1; o5 c1; o6 c1")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	for _, voices := range []int{2, 3} {
+		engine, _, _, err := newScoreEngine(score, SynthModeFM, 48000, voiceConfig{polyphony: voices, policy: VoiceStealOldest}, 1)
+		if err != nil {
+			t.Fatalf("new engine: %v", err)
+		}
+		intseq.New(score, engine, 48000).Process(make([]float32, 4800*2))
+		st := engine.(interface{ VoiceStats() VoiceStats }).VoiceStats()
+		if want := uint64(3 - voices); st.Steals != want || st.PeakVoices != voices {
+			t.Fatalf("%d voices: expected %d steals at a peak of %d, got %+v", voices, want, voices, st)
+		}
+	}
+}
+
+func TestPlayerKeepsLiveChannelControlsForTheNextPlay(t *testing.T) {
+	pl, err := NewPlayer(48000)
+	if err != nil {
+		t.Fatalf("new player: %v", err)
+	}
+	pl.ProgramChange(2, 7)
+	pl.SetChannelPan(2, -20)
+	pl.PitchBend(2, 0.5)
+	if pl.SendLive(LiveEvent{Kind: LiveNoteOn, Channel: LiveChannels, Note: 60, Velocity: 100}) {
+		t.Fatalf("expected an event for a channel out of range to be dropped")
+	}
+	if got, want := pl.liveChannels[2], (intseq.LiveChannel{Program: 7, Pan: -20, Bend: 0.5}); got != want {
+		t.Fatalf("live channel = %+v, want %+v", got, want)
+	}
+}